@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/backend/inmem/store"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"github.com/slink-go/logging"
+	bolt "go.etcd.io/bbolt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var Backend boltBackendInitializer
+
+type boltBackendInitializer struct{}
+
+func (bi *boltBackendInitializer) Init(cfg *config.AppConfig) api.Registry {
+	registry, err := newBoltRegistry(cfg, common.SystemClock, config.ReadStringOrDefault("DISCO_BOLT_FILE", "disco.db"))
+	if err != nil {
+		panic(err)
+	}
+	registry.run(context.Background())
+	return registry
+}
+
+var tenantsBucket = []byte("tenants")
+
+// region - record
+
+type record struct {
+	ClientId    string          `json:"id"`
+	ServiceId   string          `json:"service"`
+	Tenant      string          `json:"tenant"`
+	Endpoints   []string        `json:"endpoints,omitempty"`
+	Meta        map[string]any  `json:"meta,omitempty"`
+	State       api.ClientState `json:"state"`
+	Maintenance bool            `json:"maintenance,omitempty"`
+	LastSeen    time.Time       `json:"-"`
+	Load        int             `json:"-"`
+	Capacity    int             `json:"-"`
+	Dirty       bool            `json:"-"`
+}
+
+func newRecord(c api.Client) *record {
+	return &record{
+		ClientId:  c.ClientId(),
+		ServiceId: c.ServiceId(),
+		Tenant:    c.Tenant(),
+		Endpoints: endpointUrls(c.Endpoints()),
+		Meta:      c.Meta(),
+		State:     c.State(),
+		LastSeen:  c.LastSeen(),
+		Dirty:     true,
+	}
+}
+func (r *record) client(clock common.Clock) (api.Client, error) {
+	c, err := common.RestoreClient(clock, r.ClientId, r.ServiceId, r.Tenant, r.Endpoints, r.Meta, r.State, r.LastSeen)
+	if err != nil {
+		return nil, err
+	}
+	c.SetLoad(r.Load, r.Capacity)
+	c.SetMaintenance(r.Maintenance)
+	return c, nil
+}
+
+// endregion
+// region - registry
+
+// boltRegistry is a single-node registry persisted to embedded bbolt database:
+// clients are stored per tenant (tenants/<tenant>/<client id> JSON records)
+// and served from memory. Registrations and state changes are written through,
+// while ping times are kept in memory only: after restart clients get a grace
+// period (their last seen time is set to start time) to ping again.
+type boltRegistry struct {
+	sync.RWMutex
+	db               *bolt.DB
+	clients          map[string]*record
+	pingInterval     api.Duration
+	maxClients       int
+	quota            func(tenant string) config.Quota
+	failingThreshold time.Duration
+	downThreshold    time.Duration
+	removeThreshold  time.Duration
+	rejoinKey        []byte
+	events           *common.EventBus
+	clock            common.Clock
+	cancel           context.CancelFunc
+	checks           sync.WaitGroup
+	logger           logging.Logger
+}
+
+func newBoltRegistry(cfg *config.AppConfig, clock common.Clock, file string) (*boltRegistry, error) {
+	db, err := bolt.Open(file, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	registry := boltRegistry{
+		db:               db,
+		clients:          make(map[string]*record),
+		pingInterval:     api.Duration{Duration: cfg.PingDuration},
+		maxClients:       cfg.MaxClients,
+		quota:            cfg.Quota,
+		failingThreshold: time.Duration(cfg.FailingThreshold) * cfg.PingDuration,
+		downThreshold:    time.Duration(cfg.DownThreshold) * cfg.PingDuration,
+		removeThreshold:  time.Duration(cfg.RemoveThreshold) * cfg.PingDuration,
+		rejoinKey:        common.NewRejoinKey(cfg.RejoinKey),
+		events:           common.NewEventBus(common.DefaultEventLogCapacity),
+		clock:            clock,
+		logger:           logging.GetLogger("reg-bolt"),
+	}
+	if cfg.RejoinKey == "" {
+		registry.logger.Warning("rejoin key not set; rejoin tokens will not survive restart")
+	}
+	if err = registry.load(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &registry, nil
+}
+
+func (rs *boltRegistry) Join(ctx context.Context, request api.JoinRequest) (*api.JoinResponse, error) {
+	rs.logger.Debug("[registry][join] client join")
+	tnt := ctx.Value(api.TenantKey).(string)
+	c, err := common.NewClient(rs.clock, rs.createClientId(), request.ServiceId, tnt, request.Endpoints, request.Meta)
+	if err != nil {
+		return nil, err
+	}
+	rs.Lock()
+	defer rs.Unlock()
+	r, err := rs.register(c)
+	if err != nil {
+		return nil, err
+	}
+	rs.logger.Debug("[registry][join] client %s joined", c.ClientId())
+	return rs.joinResponse(r), nil
+}
+func (rs *boltRegistry) Rejoin(ctx context.Context, request api.RejoinRequest) (*api.JoinResponse, error) {
+	rs.logger.Debug("[registry][rejoin] client %s rejoin", request.ClientId)
+	tnt := ctx.Value(api.TenantKey).(string)
+	if !common.ValidRejoinToken(rs.rejoinKey, tnt, request.ClientId, request.Token) {
+		return nil, api.NewInvalidRejoinTokenError(request.ClientId)
+	}
+	rs.Lock()
+	defer rs.Unlock()
+
+	// client is still registered (e.g. ping was lost); nothing to restore
+	if r := rs.clients[request.ClientId]; r != nil {
+		if r.Tenant != tnt {
+			return nil, api.NewInvalidRejoinTokenError(request.ClientId)
+		}
+		if err := rs.up(r, rs.clock.Now(), api.Ping{}); err != nil {
+			return nil, err
+		}
+		return rs.joinResponse(r), nil
+	}
+
+	c, err := common.NewClient(rs.clock, request.ClientId, request.ServiceId, tnt, request.Endpoints, request.Meta)
+	if err != nil {
+		return nil, err
+	}
+	r, err := rs.register(c)
+	if err != nil {
+		return nil, err
+	}
+	rs.logger.Debug("[registry][rejoin] client %s rejoined", c.ClientId())
+	return rs.joinResponse(r), nil
+}
+func (rs *boltRegistry) Leave(ctx context.Context, clientId string) error {
+	rs.Lock()
+	defer rs.Unlock()
+	r := rs.clients[clientId]
+	if r == nil {
+		return api.NewClientNotFoundError(clientId)
+	}
+	if !common.Authorized(ctx, r.Tenant) {
+		return api.NewTenantsClientNotFoundError(clientId)
+	}
+	rs.logger.Debug("[registry][leave] remove client %s", clientId)
+	return rs.remove(r)
+}
+func (rs *boltRegistry) List(ctx context.Context) []api.Client {
+	if ctx.Value(api.TenantKey) == nil || ctx.Value(api.TenantKey) == "" {
+		rs.logger.Warning("no tenant context set; return empty list")
+		return make([]api.Client, 0)
+	}
+	tenant := ctx.Value(api.TenantKey).(string)
+	clients := rs.list(func(r *record) bool {
+		return tenant == api.TenantDefault || r.Tenant == tenant
+	})
+	rs.logger.Debug("[registry][list] list for %v (%d)", tenant, len(clients))
+	sort.Slice(clients, func(a, b int) bool {
+		if clients[a].ServiceId() != clients[b].ServiceId() {
+			return clients[a].ServiceId() < clients[b].ServiceId()
+		} else {
+			return clients[a].ClientId() < clients[b].ClientId()
+		}
+	})
+	return clients
+}
+func (rs *boltRegistry) ListAll() []api.Tenant {
+	tenants := make(map[string]api.Tenant)
+	for _, c := range rs.list(func(r *record) bool { return true }) {
+		if tenants[c.Tenant()] == nil {
+			tenants[c.Tenant()] = store.CreateTenant(c.Tenant())
+		}
+		tenants[c.Tenant()].Set(c.ClientId(), c)
+	}
+	var result []api.Tenant
+	for _, t := range tenants {
+		result = append(result, t)
+	}
+	return result
+}
+func (rs *boltRegistry) Ping(ctx context.Context, clientId string, ping api.Ping) (api.Pong, error) {
+	rs.Lock()
+	defer rs.Unlock()
+	r := rs.clients[clientId]
+	if r == nil {
+		return api.Pong{}, api.NewClientNotFoundError(clientId)
+	}
+	if !common.Authorized(ctx, r.Tenant) {
+		return api.Pong{}, api.NewTenantsClientNotFoundError(clientId)
+	}
+	if err := rs.updateMeta(r, ping.Meta); err != nil {
+		return api.Pong{}, err
+	}
+	if err := rs.up(r, rs.clock.Now(), ping); err != nil {
+		return api.Pong{}, err
+	}
+	response := api.PongTypeOk
+	if r.Dirty {
+		r.Dirty = false
+		response = api.PongTypeChanged
+	}
+	rs.logger.Debug("[registry][ping] client '%s' ping: '%s'", clientId, response)
+	return api.Pong{
+		Response: response,
+	}, nil
+}
+func (rs *boltRegistry) MarkAlive(ctx context.Context, clientId string) error {
+	rs.Lock()
+	defer rs.Unlock()
+	r := rs.clients[clientId]
+	if r == nil {
+		return api.NewClientNotFoundError(clientId)
+	}
+	if !common.Authorized(ctx, r.Tenant) {
+		return api.NewTenantsClientNotFoundError(clientId)
+	}
+	r.LastSeen = rs.clock.Now()
+	if state := common.AliveState(r.State, r.Maintenance); r.State != state {
+		if err := rs.transition(r, state); err != nil {
+			return err
+		}
+	}
+	rs.logger.Debug("[registry][alive] client '%s' is alive", clientId)
+	return nil
+}
+func (rs *boltRegistry) SetMaintenance(clientId string, enabled bool) error {
+	rs.Lock()
+	defer rs.Unlock()
+	r := rs.clients[clientId]
+	if r == nil {
+		return api.NewClientNotFoundError(clientId)
+	}
+	prev := r.Maintenance
+	r.Maintenance = enabled
+	var err error
+	if state := common.MaintenanceState(r.State, enabled); state != r.State {
+		err = rs.transition(r, state)
+	} else {
+		err = rs.save(r)
+	}
+	if err != nil {
+		r.Maintenance = prev
+		return err
+	}
+	rs.logger.Info("client %s (%s) maintenance: %v", clientId, r.ServiceId, enabled)
+	return nil
+}
+func (rs *boltRegistry) UpdateMeta(ctx context.Context, clientId string, delta map[string]any) error {
+	rs.Lock()
+	defer rs.Unlock()
+	r := rs.clients[clientId]
+	if r == nil {
+		return api.NewClientNotFoundError(clientId)
+	}
+	if !common.Authorized(ctx, r.Tenant) {
+		return api.NewTenantsClientNotFoundError(clientId)
+	}
+	return rs.updateMeta(r, delta)
+}
+func (rs *boltRegistry) Watch(ctx context.Context, revision uint64) (*api.WatchResponse, error) {
+	tenant, _ := ctx.Value(api.TenantKey).(string)
+	if tenant == "" {
+		rs.logger.Warning("no tenant context set; return empty watch response")
+		return &api.WatchResponse{Revision: rs.events.Revision(), Events: []api.Event{}}, nil
+	}
+	return rs.events.Wait(ctx, tenant, revision)
+}
+func (rs *boltRegistry) Subscribe(handler api.EventHandler) func() {
+	return rs.events.Subscribe(handler)
+}
+
+// endregion
+// region - state
+
+func (rs *boltRegistry) register(c api.Client) (*record, error) {
+	if len(rs.clients) >= rs.maxClients {
+		return nil, api.NewMaxClientsReachedError(rs.maxClients)
+	}
+	r := newRecord(c)
+	if rs.clients[r.ClientId] != nil || rs.has(r) {
+		return nil, api.NewAlreadyRegisteredError()
+	}
+	if err := rs.checkQuota(r); err != nil {
+		return nil, err
+	}
+	if err := rs.save(r); err != nil {
+		return nil, err
+	}
+	rs.clients[r.ClientId] = r
+	rs.update(r.Tenant)
+	rs.publish(r, common.NewClientJoinedEvent)
+	return r, nil
+}
+func (rs *boltRegistry) remove(r *record) error {
+	rs.logger.Info("removing client %s (%s)", r.ClientId, r.ServiceId)
+	err := rs.db.Update(func(tx *bolt.Tx) error {
+		tenants := tx.Bucket(tenantsBucket)
+		if tenants == nil {
+			return nil
+		}
+		tenant := tenants.Bucket([]byte(r.Tenant))
+		if tenant == nil {
+			return nil
+		}
+		if err := tenant.Delete([]byte(r.ClientId)); err != nil {
+			return err
+		}
+		if k, _ := tenant.Cursor().First(); k == nil {
+			return tenants.DeleteBucket([]byte(r.Tenant))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	prev := r.State
+	r.State = api.ClientStateRemoved
+	delete(rs.clients, r.ClientId)
+	rs.publish(r, func(c api.Client) api.Event {
+		return common.NewStateChangedEvent(c, prev)
+	})
+	rs.publish(r, func(c api.Client) api.Event {
+		return common.NewClientLeftEvent(c, prev)
+	})
+	rs.update(r.Tenant)
+	return nil
+}
+func (rs *boltRegistry) up(r *record, seen time.Time, ping api.Ping) error {
+	r.LastSeen = seen
+	r.Load, r.Capacity = ping.Load, ping.Capacity
+	if state := common.PingState(ping, r.Maintenance); r.State != state {
+		return rs.transition(r, state)
+	}
+	return nil
+}
+func (rs *boltRegistry) updateMeta(r *record, delta map[string]any) error {
+	if len(delta) == 0 {
+		return nil
+	}
+	meta := common.MergeMeta(r.Meta, delta)
+	if reflect.DeepEqual(meta, r.Meta) {
+		return nil
+	}
+	if err := common.CheckMetaSize(rs.quota(r.Tenant), meta); err != nil {
+		return err
+	}
+	prev := r.Meta
+	r.Meta = meta
+	if err := rs.save(r); err != nil {
+		r.Meta = prev
+		return err
+	}
+	rs.update(r.Tenant)
+	rs.publish(r, common.NewMetaUpdatedEvent)
+	rs.logger.Debug("[registry][meta] client %s meta updated", r.ClientId)
+	return nil
+}
+func (rs *boltRegistry) transition(r *record, state api.ClientState) error {
+	prev := r.State
+	r.State = state
+	if err := rs.save(r); err != nil {
+		r.State = prev
+		return err
+	}
+	rs.update(r.Tenant)
+	rs.publish(r, func(c api.Client) api.Event {
+		return common.NewStateChangedEvent(c, prev)
+	})
+	rs.logger.Info("client %s (%s) %s", r.ClientId, r.ServiceId, strings.ToLower(state.String()))
+	return nil
+}
+
+// update marks tenant's clients dirty, so they get CHANGED on next ping
+func (rs *boltRegistry) update(tenant string) {
+	for _, r := range rs.clients {
+		if r.Tenant == tenant {
+			r.Dirty = true
+		}
+	}
+}
+func (rs *boltRegistry) has(client *record) bool {
+	for _, r := range rs.clients {
+		if r.Tenant == client.Tenant &&
+			r.ServiceId == client.ServiceId &&
+			reflect.DeepEqual(r.Endpoints, client.Endpoints) &&
+			reflect.DeepEqual(r.Meta, client.Meta) {
+			return true
+		}
+	}
+	return false
+}
+func (rs *boltRegistry) checkQuota(client *record) error {
+	var services []string
+	for _, r := range rs.clients {
+		if r.Tenant == client.Tenant {
+			services = append(services, r.ServiceId)
+		}
+	}
+	return common.CheckQuota(rs.quota(client.Tenant), client.Tenant, client.ServiceId, client.Meta, services)
+}
+func (rs *boltRegistry) publish(r *record, event func(c api.Client) api.Event) {
+	c, err := r.client(rs.clock)
+	if err != nil {
+		rs.logger.Warning("could not publish event for client %s: %s", r.ClientId, err.Error())
+		return
+	}
+	rs.events.Publish(event(c))
+}
+func (rs *boltRegistry) list(filter func(r *record) bool) []api.Client {
+	rs.RLock()
+	defer rs.RUnlock()
+	var result []api.Client
+	for _, r := range rs.clients {
+		if !filter(r) {
+			continue
+		}
+		c, err := r.client(rs.clock)
+		if err != nil {
+			continue
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+// endregion
+// region - storage
+
+func (rs *boltRegistry) save(r *record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return rs.db.Update(func(tx *bolt.Tx) error {
+		tenants, err := tx.CreateBucketIfNotExists(tenantsBucket)
+		if err != nil {
+			return err
+		}
+		tenant, err := tenants.CreateBucketIfNotExists([]byte(r.Tenant))
+		if err != nil {
+			return err
+		}
+		return tenant.Put([]byte(r.ClientId), data)
+	})
+}
+
+// load reads persisted clients on start; all of them are dirty, so they
+// re-fetch registry on first ping
+func (rs *boltRegistry) load() error {
+	now := rs.clock.Now()
+	err := rs.db.View(func(tx *bolt.Tx) error {
+		tenants := tx.Bucket(tenantsBucket)
+		if tenants == nil {
+			return nil
+		}
+		return tenants.ForEachBucket(func(name []byte) error {
+			return tenants.Bucket(name).ForEach(func(k, v []byte) error {
+				var r record
+				if err := json.Unmarshal(v, &r); err != nil {
+					rs.logger.Warning("could not load client %s: %s", string(k), err.Error())
+					return nil
+				}
+				r.LastSeen = now
+				r.Dirty = true
+				rs.clients[r.ClientId] = &r
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	rs.logger.Info("loaded %d clients", len(rs.clients))
+	return nil
+}
+
+// Close stops failure detection and closes database
+func (rs *boltRegistry) Close() error {
+	if rs.cancel != nil {
+		rs.cancel()
+	}
+	rs.checks.Wait()
+	return rs.db.Close()
+}
+
+// endregion
+// region - runner
+
+func (rs *boltRegistry) run(ctx context.Context) {
+	ctx, rs.cancel = context.WithCancel(ctx)
+	rs.checks.Add(1)
+	go func() {
+		defer rs.checks.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				rs.check(rs.clock.Now())
+			}
+		}
+	}()
+}
+func (rs *boltRegistry) check(now time.Time) {
+	rs.Lock()
+	defer rs.Unlock()
+	var err error
+	for _, r := range rs.clients {
+		interval := now.Sub(r.LastSeen)
+		if rs.removeThreshold < interval {
+			err = rs.remove(r)
+		} else if rs.downThreshold < interval {
+			if r.State != api.ClientStateDown {
+				err = rs.transition(r, api.ClientStateDown)
+			}
+		} else if rs.failingThreshold < interval {
+			if r.State != api.ClientStateFailing {
+				err = rs.transition(r, api.ClientStateFailing)
+			}
+		}
+		if err != nil {
+			rs.logger.Warning("could not update client %s: %s", r.ClientId, err.Error())
+			err = nil
+		}
+	}
+}
+
+// endregion
+// region - helpers
+
+func (rs *boltRegistry) createClientId() string {
+	u, err := uuid.NewUUID()
+	if err != nil {
+		panic(err)
+	}
+	return u.String()
+}
+func (rs *boltRegistry) joinResponse(r *record) *api.JoinResponse {
+	return &api.JoinResponse{
+		ClientId:     r.ClientId,
+		PingInterval: rs.pingInterval,
+		Token:        common.NewRejoinToken(rs.rejoinKey, r.Tenant, r.ClientId),
+	}
+}
+
+func endpointUrls(endpoints []api.Endpoint) []string {
+	var result []string
+	for _, e := range endpoints {
+		result = append(result, e.Url())
+	}
+	return result
+}
+
+// endregion
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/backend/registrytest"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openRegistry(t *testing.T, file string) *boltRegistry {
+	rs, err := newBoltRegistry(registrytest.Config(), common.SystemClock, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+func TestSurvivesRestart(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "disco.db")
+	rs := openRegistry(t, file)
+	ctx := registrytest.Tenant("tenant")
+	kept, err := rs.Join(ctx, api.JoinRequest{ServiceId: "SVC", Meta: map[string]any{"zone": "eu-1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rs.Ping(ctx, kept.ClientId, api.Ping{}); err != nil {
+		t.Fatal(err)
+	}
+	left, err := rs.Join(registrytest.Tenant("other"), api.JoinRequest{ServiceId: "SVC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rs.Leave(registrytest.Tenant("other"), left.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	if err = rs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := openRegistry(t, file)
+	defer func() {
+		_ = restarted.Close()
+	}()
+	list := restarted.List(ctx)
+	if len(list) != 1 || list[0].ClientId() != kept.ClientId || list[0].State() != api.ClientStateUp || list[0].Meta()["zone"] != "eu-1" {
+		t.Fatalf("unexpected restored clients: %v", list)
+	}
+	if len(restarted.List(registrytest.Tenant("other"))) != 0 {
+		t.Errorf("expected removed client not to be restored")
+	}
+	pong, err := restarted.Ping(ctx, kept.ClientId, api.Ping{})
+	if err != nil {
+		t.Fatalf("expected client id to survive restart: %v", err)
+	}
+	if pong.Response != api.PongTypeChanged {
+		t.Errorf("expected CHANGED on first ping after restart, got %s", pong.Response)
+	}
+}
+func TestStateSurvivesRestart(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "disco.db")
+	rs := openRegistry(t, file)
+	ctx := registrytest.Tenant("tenant")
+	resp, err := rs.Join(ctx, api.JoinRequest{ServiceId: "SVC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rs.check(now.Add(3 * time.Second))
+	if s := rs.List(ctx)[0].State(); s != api.ClientStateFailing {
+		t.Errorf("expected FAILING, got %s", s)
+	}
+	rs.check(now.Add(5 * time.Second))
+	if s := rs.List(ctx)[0].State(); s != api.ClientStateDown {
+		t.Errorf("expected DOWN, got %s", s)
+	}
+	if err = rs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// persisted state is restored
+	rs = openRegistry(t, file)
+	if s := rs.List(ctx)[0].State(); s != api.ClientStateDown {
+		t.Errorf("expected DOWN after restart, got %s", s)
+	}
+	rs.check(time.Now().Add(9 * time.Second))
+	if _, err = rs.Ping(ctx, resp.ClientId, api.Ping{}); !errors.Is(err, api.NewClientNotFoundError(resp.ClientId)) {
+		t.Errorf("expected client to be removed, got %v", err)
+	}
+	_ = rs.Close()
+}
+func TestConformance(t *testing.T) {
+	registrytest.Run(t, func(t *testing.T, cfg *config.AppConfig, clock common.Clock) registrytest.Subject {
+		rs, err := newBoltRegistry(cfg, clock, filepath.Join(t.TempDir(), "disco.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = rs.Close()
+		})
+		return registrytest.Subject{Registry: rs, Check: rs.check}
+	})
+}
+func TestCloseStopsRunner(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "disco.db")
+	rs := openRegistry(t, file)
+	rs.run(context.Background())
+	var closer io.Closer = rs
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// database lock is released, so it can be opened again
+	_ = openRegistry(t, file).Close()
+}
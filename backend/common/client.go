@@ -3,22 +3,27 @@ package common
 import (
 	"github.com/slink-go/disco/common/api"
 	"github.com/slink-go/logging"
+	"strings"
 	"time"
 )
 
 type client struct {
-	ClientId_  string          `json:"client_id"`
-	ServiceId_ string          `json:"service_id"`
-	Tenant_    string          `json:"tenant,omitempty"`
-	Endpoints_ []api.Endpoint  `json:"endpoints,omitempty"`
-	Meta_      map[string]any  `json:"meta,omitempty"`
-	LastSeen_  time.Time       `json:"-"`
-	State_     api.ClientState `json:"state"`
-	Dirty_     bool            `json:"-"`
-	logger     logging.Logger
+	ClientId_    string          `json:"client_id"`
+	ServiceId_   string          `json:"service_id"`
+	Tenant_      string          `json:"tenant,omitempty"`
+	Endpoints_   []api.Endpoint  `json:"endpoints,omitempty"`
+	Meta_        map[string]any  `json:"meta,omitempty"`
+	LastSeen_    time.Time       `json:"-"`
+	State_       api.ClientState `json:"state"`
+	Load_        int             `json:"load,omitempty"`
+	Capacity_    int             `json:"capacity,omitempty"`
+	Maintenance_ bool            `json:"maintenance,omitempty"`
+	Dirty_       bool            `json:"-"`
+	clock        Clock
+	logger       logging.Logger
 }
 
-func NewClient(clientId, serviceId, tenant string, endpoints []string, meta map[string]any) (api.Client, error) {
+func NewClient(clock Clock, clientId, serviceId, tenant string, endpoints []string, meta map[string]any) (api.Client, error) {
 	logger := logging.GetLogger("client")
 	var ep []api.Endpoint
 	for _, u := range endpoints {
@@ -34,14 +39,29 @@ func NewClient(clientId, serviceId, tenant string, endpoints []string, meta map[
 		ServiceId_: serviceId,
 		Endpoints_: ep,
 		Meta_:      meta,
-		LastSeen_:  time.Now(),
+		LastSeen_:  clock.Now(),
 		State_:     api.ClientStateStarting,
 		Tenant_:    tenant,
 		Dirty_:     true,
+		clock:      clock,
 		logger:     logger,
 	}, nil
 }
 
+// RestoreClient re-creates client from its persisted representation (e.g.
+// stored by external backend), keeping its state and last seen time.
+func RestoreClient(clock Clock, clientId, serviceId, tenant string, endpoints []string, meta map[string]any, state api.ClientState, lastSeen time.Time) (api.Client, error) {
+	c, err := NewClient(clock, clientId, serviceId, tenant, endpoints, meta)
+	if err != nil {
+		return nil, err
+	}
+	v := c.(*client)
+	v.State_ = state
+	v.LastSeen_ = lastSeen
+	v.Dirty_ = false
+	return v, nil
+}
+
 func (c *client) ClientId() string {
 	return c.ClientId_
 }
@@ -57,11 +77,31 @@ func (c *client) Endpoints() []api.Endpoint {
 func (c *client) Meta() map[string]any {
 	return c.Meta_
 }
-func (c *client) Ping() bool {
-	c.LastSeen_ = time.Now()
-	if c.State() != api.ClientStateUp {
-		c.SetState(api.ClientStateUp)
-		c.logger.Info("client %s (%s) up", c.ClientId(), c.ServiceId())
+func (c *client) SetMeta(meta map[string]any) {
+	c.Meta_ = meta
+}
+
+// Ping updates client's last seen time, load and state reported by client;
+// it returns true, if client's state has changed
+func (c *client) Ping(ping api.Ping) bool {
+	c.LastSeen_ = c.clock.Now()
+	c.SetLoad(ping.Load, ping.Capacity)
+	if state := PingState(ping, c.Maintenance()); c.State() != state {
+		c.SetState(state)
+		c.logger.Info("client %s (%s) %s", c.ClientId(), c.ServiceId(), strings.ToLower(state.String()))
+		return true
+	}
+	return false
+}
+
+// MarkAlive updates client's last seen time only (e.g. after successful health
+// check), keeping status, load and changes reported by client; it returns true,
+// if client's state has changed
+func (c *client) MarkAlive() bool {
+	c.LastSeen_ = c.clock.Now()
+	if state := AliveState(c.State(), c.Maintenance()); c.State() != state {
+		c.SetState(state)
+		c.logger.Info("client %s (%s) %s", c.ClientId(), c.ServiceId(), strings.ToLower(state.String()))
 		return true
 	}
 	return false
@@ -75,9 +115,57 @@ func (c *client) State() api.ClientState {
 func (c *client) SetState(state api.ClientState) {
 	c.State_ = state
 }
+func (c *client) Load() (load, capacity int) {
+	return c.Load_, c.Capacity_
+}
+func (c *client) SetLoad(load, capacity int) {
+	c.Load_ = load
+	c.Capacity_ = capacity
+}
+func (c *client) Maintenance() bool {
+	return c.Maintenance_
+}
+func (c *client) SetMaintenance(enabled bool) {
+	c.Maintenance_ = enabled
+}
 func (c *client) SetDirty(value bool) {
 	c.Dirty_ = value
 }
 func (c *client) IsDirty() bool {
 	return c.Dirty_
 }
+
+// PingState returns client's state after ping: maintenance override set by
+// admin takes precedence over status reported by client
+func PingState(ping api.Ping, maintenance bool) api.ClientState {
+	if maintenance {
+		return api.ClientStateMaintenance
+	}
+	return ping.State()
+}
+
+// AliveState returns client's state after it was found alive without ping:
+// STARTING and states set on missed pings (FAILING, DOWN) are replaced with UP
+// (or maintenance override), status reported by client is kept
+func AliveState(state api.ClientState, maintenance bool) api.ClientState {
+	switch state {
+	case api.ClientStateStarting, api.ClientStateFailing, api.ClientStateDown:
+		if maintenance {
+			return api.ClientStateMaintenance
+		}
+		return api.ClientStateUp
+	}
+	return state
+}
+
+// MaintenanceState returns client's state after maintenance override is set
+// or cleared; cleared override is replaced with UP until client's next ping
+func MaintenanceState(state api.ClientState, enabled bool) api.ClientState {
+	if enabled {
+		return api.ClientStateMaintenance
+	}
+	if state == api.ClientStateMaintenance {
+		return api.ClientStateUp
+	}
+	return state
+}
@@ -0,0 +1,77 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a source of time for client liveness tracking; registries use
+// it instead of time package, so tests and simulations can advance time
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// region - ManualClock
+
+// ManualClock is a Clock which only moves when advanced
+type ManualClock struct {
+	sync.Mutex
+	now     time.Time
+	waiters []clockWaiter
+}
+type clockWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+func (c *ManualClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, clockWaiter{deadline: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves clock forward, fires expired After channels and returns new
+// current time
+func (c *ManualClock) Advance(d time.Duration) time.Time {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			waiters = append(waiters, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = waiters
+	return c.now
+}
+
+// endregion
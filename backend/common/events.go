@@ -0,0 +1,257 @@
+package common
+
+import (
+	"context"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/logging"
+	"maps"
+	"sync"
+	"time"
+)
+
+const DefaultEventLogCapacity = 1024
+const subscriberQueueSize = 256
+
+// region - events
+
+func NewClientJoinedEvent(client api.Client) api.Event {
+	return newEvent(api.EventTypeJoined, client)
+}
+func NewClientLeftEvent(client api.Client, from api.ClientState) api.Event {
+	event := newEvent(api.EventTypeLeft, client)
+	event.PrevState = from
+	event.State = api.ClientStateRemoved
+	return event
+}
+func NewStateChangedEvent(client api.Client, from api.ClientState) api.Event {
+	event := newEvent(api.EventTypeStateChanged, client)
+	event.PrevState = from
+	return event
+}
+func NewMetaUpdatedEvent(client api.Client) api.Event {
+	return newEvent(api.EventTypeMetaUpdated, client)
+}
+
+func newEvent(typ api.EventType, client api.Client) api.Event {
+	return api.Event{
+		Type:      typ,
+		Tenant:    client.Tenant(),
+		ClientId:  client.ClientId(),
+		ServiceId: client.ServiceId(),
+		Endpoints: endpointUrls(client.Endpoints()),
+		Meta:      maps.Clone(client.Meta()),
+		State:     client.State(),
+	}
+}
+
+// endregion
+// region - event bus
+
+// EventBus numbers registry events with a monotonically increasing revision,
+// keeps them in EventLog for watchers and fans them out to subscribers. Each
+// subscriber gets its own queue, so a slow one does not block the registry.
+type EventBus struct {
+	sync.RWMutex
+	log         *EventLog
+	subscribers map[uint64]chan api.Event
+	nextId      uint64
+	logger      logging.Logger
+}
+
+func NewEventBus(capacity int) *EventBus {
+	return &EventBus{
+		log:         NewEventLog(capacity),
+		subscribers: make(map[uint64]chan api.Event),
+		logger:      logging.GetLogger("events"),
+	}
+}
+
+func (b *EventBus) Publish(event api.Event) api.Event {
+	event = b.log.Append(event)
+	b.deliver(event)
+	return event
+}
+
+// PublishNumbered publishes event numbered elsewhere (e.g. by store shared by
+// several disco instances); event not newer than current revision is dropped
+func (b *EventBus) PublishNumbered(event api.Event) (api.Event, bool) {
+	event, ok := b.log.Insert(event)
+	if ok {
+		b.deliver(event)
+	}
+	return event, ok
+}
+
+// Advance moves current revision forward to the one events are numbered
+// elsewhere with (e.g. on start)
+func (b *EventBus) Advance(revision uint64) {
+	b.log.Advance(revision)
+}
+func (b *EventBus) deliver(event api.Event) {
+	b.RLock()
+	defer b.RUnlock()
+	for id, queue := range b.subscribers {
+		select {
+		case queue <- event:
+		default:
+			b.logger.Warning("subscriber %d queue is full; event %d dropped", id, event.Revision)
+		}
+	}
+}
+func (b *EventBus) Subscribe(handler api.EventHandler) func() {
+	b.Lock()
+	b.nextId++
+	id := b.nextId
+	queue := make(chan api.Event, subscriberQueueSize)
+	b.subscribers[id] = queue
+	b.Unlock()
+
+	go func() {
+		for event := range queue {
+			handler(event)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.Lock()
+			delete(b.subscribers, id)
+			close(queue)
+			b.Unlock()
+		})
+	}
+}
+func (b *EventBus) Revision() uint64 {
+	return b.log.Revision()
+}
+func (b *EventBus) Wait(ctx context.Context, tenant string, revision uint64) (*api.WatchResponse, error) {
+	return b.log.Wait(ctx, tenant, revision)
+}
+
+// endregion
+// region - event log
+
+// EventLog keeps a bounded history of registry events numbered with a
+// monotonically increasing revision and lets watchers block until events
+// newer than a given revision appear.
+type EventLog struct {
+	sync.Mutex
+	revision uint64
+	events   []api.Event
+	capacity int
+	notify   chan struct{}
+}
+
+func NewEventLog(capacity int) *EventLog {
+	if capacity <= 0 {
+		capacity = DefaultEventLogCapacity
+	}
+	return &EventLog{
+		events:   make([]api.Event, 0, capacity),
+		capacity: capacity,
+		notify:   make(chan struct{}),
+	}
+}
+
+func (l *EventLog) Append(event api.Event) api.Event {
+	l.Lock()
+	defer l.Unlock()
+	l.revision++
+	event.Revision = l.revision
+	return l.append(event)
+}
+
+// Insert appends event numbered elsewhere; event not newer than current
+// revision is dropped
+func (l *EventLog) Insert(event api.Event) (api.Event, bool) {
+	l.Lock()
+	defer l.Unlock()
+	if event.Revision <= l.revision {
+		return event, false
+	}
+	l.revision = event.Revision
+	return l.append(event), true
+}
+
+// Advance moves current revision forward; watchers of older revisions get
+// compacted revision error once newer events appear
+func (l *EventLog) Advance(revision uint64) {
+	l.Lock()
+	defer l.Unlock()
+	if revision > l.revision {
+		l.revision = revision
+	}
+}
+func (l *EventLog) append(event api.Event) api.Event {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if len(l.events) >= l.capacity {
+		l.events = append(l.events[:0], l.events[1:]...)
+	}
+	l.events = append(l.events, event)
+	close(l.notify)
+	l.notify = make(chan struct{})
+	return event
+}
+func (l *EventLog) Revision() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.revision
+}
+
+// Wait returns tenant's events newer than revision, blocking until there are
+// some or ctx is done. Zero revision returns current revision immediately, so
+// that watchers can start from it (unless there were no events at all yet).
+func (l *EventLog) Wait(ctx context.Context, tenant string, revision uint64) (*api.WatchResponse, error) {
+	for start := true; ; start = false {
+		l.Lock()
+		current := l.revision
+		if revision > current || (start && revision == 0 && current > 0) {
+			l.Unlock()
+			return &api.WatchResponse{Revision: current, Events: []api.Event{}}, nil
+		}
+		if revision < current && (len(l.events) == 0 || revision+1 < l.events[0].Revision) {
+			l.Unlock()
+			return nil, api.NewRevisionCompactedError(revision)
+		}
+		events := l.since(tenant, revision)
+		notify := l.notify
+		l.Unlock()
+
+		if len(events) > 0 {
+			return &api.WatchResponse{Revision: current, Events: events}, nil
+		}
+		// nothing new for this tenant yet; continue from current revision
+		revision = current
+		select {
+		case <-ctx.Done():
+			return &api.WatchResponse{Revision: current, Events: []api.Event{}}, nil
+		case <-notify:
+		}
+	}
+}
+
+func (l *EventLog) since(tenant string, revision uint64) []api.Event {
+	result := make([]api.Event, 0)
+	for _, e := range l.events {
+		if e.Revision <= revision {
+			continue
+		}
+		if tenant == api.TenantDefault || tenant == "" || e.Tenant == tenant {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// endregion
+
+func endpointUrls(endpoints []api.Endpoint) []string {
+	var result []string
+	for _, e := range endpoints {
+		result = append(result, e.Url())
+	}
+	return result
+}
@@ -0,0 +1,43 @@
+package common
+
+import (
+	"encoding/json"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"maps"
+)
+
+// MergeMeta applies meta delta to client's meta: keys with null value are
+// removed, others are set; meta itself is not modified
+func MergeMeta(meta, delta map[string]any) map[string]any {
+	result := maps.Clone(meta)
+	if result == nil {
+		result = make(map[string]any)
+	}
+	for k, v := range delta {
+		if v == nil {
+			delete(result, k)
+		} else {
+			result[k] = v
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// CheckMetaSize verifies JSON-encoded client's meta fits into tenant's quota
+func CheckMetaSize(quota config.Quota, meta map[string]any) error {
+	if quota.MaxMetaSize <= 0 || len(meta) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if len(data) > quota.MaxMetaSize {
+		return api.NewMetaTooLargeError(len(data), quota.MaxMetaSize)
+	}
+	return nil
+}
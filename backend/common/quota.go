@@ -0,0 +1,29 @@
+package common
+
+import (
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+)
+
+// CheckQuota verifies new client registration does not exceed its tenant's
+// quota; services are service ids of clients already registered in tenant
+// (one per client)
+func CheckQuota(quota config.Quota, tenant, serviceId string, meta map[string]any, services []string) error {
+	if err := CheckMetaSize(quota, meta); err != nil {
+		return err
+	}
+	if quota.MaxClients > 0 && len(services) >= quota.MaxClients {
+		return api.NewClientsQuotaExceededError(tenant, quota.MaxClients)
+	}
+	instances := make(map[string]int)
+	for _, s := range services {
+		instances[s]++
+	}
+	if quota.MaxInstances > 0 && instances[serviceId] >= quota.MaxInstances {
+		return api.NewInstancesQuotaExceededError(tenant, serviceId, quota.MaxInstances)
+	}
+	if _, ok := instances[serviceId]; !ok && quota.MaxServices > 0 && len(instances) >= quota.MaxServices {
+		return api.NewServicesQuotaExceededError(tenant, quota.MaxServices)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package common
+
+import (
+	"context"
+	"github.com/slink-go/disco/common/api"
+)
+
+// Authorized reports whether client of given tenant may be accessed within
+// request context: default tenant (admin) may access clients of any tenant
+func Authorized(ctx context.Context, tenant string) bool {
+	t, _ := ctx.Value(api.TenantKey).(string)
+	return t == api.TenantDefault || t != "" && t == tenant
+}
@@ -0,0 +1,67 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// Rejoin tokens are stateless HMAC signatures over tenant and client id, so
+// they stay valid across disco restarts as long as the signing key is kept.
+
+// NewRejoinKey derives rejoin tokens' (and client secrets') signing key from
+// configured secret, which may be the JWT signing secret as well, so that the
+// secret itself is never used for other signatures; random key if not set
+func NewRejoinKey(secret string) []byte {
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("disco-rejoin"))
+		return mac.Sum(nil)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+func NewRejoinToken(key []byte, tenant, clientId string) string {
+	return base64.RawURLEncoding.EncodeToString(rejoinSignature(key, tenant, clientId))
+}
+func ValidRejoinToken(key []byte, tenant, clientId, token string) bool {
+	sig, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sig, rejoinSignature(key, tenant, clientId))
+}
+
+// Client secrets are stateless as well: HMAC signature over client id only,
+// so the secret can be checked before client's tenant is known.
+
+func NewClientSecret(key []byte, clientId string) string {
+	return base64.RawURLEncoding.EncodeToString(secretSignature(key, clientId))
+}
+func ValidClientSecret(key []byte, clientId, secret string) bool {
+	sig, err := base64.RawURLEncoding.DecodeString(secret)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sig, secretSignature(key, clientId))
+}
+
+func rejoinSignature(key []byte, tenant, clientId string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(tenant))
+	mac.Write([]byte{0})
+	mac.Write([]byte(clientId))
+	return mac.Sum(nil)
+}
+func secretSignature(key []byte, clientId string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{0}) // never collides with rejoin signature (tenant is not empty)
+	mac.Write([]byte("secret"))
+	mac.Write([]byte{0})
+	mac.Write([]byte(clientId))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,891 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/backend/inmem/store"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"github.com/slink-go/logging"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+var Backend etcdBackendInitializer
+
+// maxConflictRetries limits re-reads of client record modified concurrently
+// by other disco instances
+const maxConflictRetries = 5
+
+var errConflict = errors.New("client record was modified concurrently")
+
+type etcdBackendInitializer struct{}
+
+func (bi *etcdBackendInitializer) Init(cfg *config.AppConfig) api.Registry {
+	var endpoints []string
+	for _, e := range strings.Split(config.ReadStringOrDefault("DISCO_ETCD_ENDPOINTS", "localhost:2379"), ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			endpoints = append(endpoints, e)
+		}
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		Username:    config.ReadString("DISCO_ETCD_USERNAME"),
+		Password:    config.ReadString("DISCO_ETCD_PASSWORD"),
+		DialTimeout: config.ReadDurationOrDefault("DISCO_ETCD_DIAL_TIMEOUT", 5*time.Second),
+	})
+	if err != nil {
+		panic(err)
+	}
+	prefix := config.ReadStringOrDefault("DISCO_ETCD_PREFIX", "/disco")
+	registry := newEtcdRegistry(cfg, common.SystemClock, client, prefix)
+	registry.run(context.Background())
+	return registry
+}
+
+// region - keys
+
+// Data layout (all keys are prefixed with configured prefix):
+//
+//	/clients/<tenant>/<id>   client record, attached to client's lease
+//	/index/<id>              client's tenant, attached to client's lease
+//	/changes/<tenant>        touched on every tenant change (used for dirty flag)
+//	/seen/<id>               client's last seen time and revision of /changes/<tenant>
+//	                         last acknowledged by client, attached to client's lease
+//
+// Each client owns a lease with RemoveThreshold*PingDuration TTL; ping is a
+// lease keepalive, leave revokes the lease. Failure detection (FAILING, DOWN,
+// removal) is based on lease's spent TTL, i.e. time since client's last ping;
+// etcd removes clients with expired leases if no disco instance does it.
+
+func (rs *etcdRegistry) clientsPrefix() string {
+	return rs.prefix + "/clients/"
+}
+func (rs *etcdRegistry) tenantPrefix(tenant string) string {
+	return rs.clientsPrefix() + tenant + "/"
+}
+func (rs *etcdRegistry) clientKey(tenant, clientId string) string {
+	return rs.tenantPrefix(tenant) + clientId
+}
+func (rs *etcdRegistry) indexPrefix() string {
+	return rs.prefix + "/index/"
+}
+func (rs *etcdRegistry) indexKey(clientId string) string {
+	return rs.indexPrefix() + clientId
+}
+func (rs *etcdRegistry) changesKey(tenant string) string {
+	return rs.prefix + "/changes/" + tenant
+}
+func (rs *etcdRegistry) seenPrefix() string {
+	return rs.prefix + "/seen/"
+}
+func (rs *etcdRegistry) seenKey(clientId string) string {
+	return rs.seenPrefix() + clientId
+}
+
+// endregion
+// region - record
+
+type record struct {
+	ClientId    string          `json:"id"`
+	ServiceId   string          `json:"service"`
+	Tenant      string          `json:"tenant"`
+	Endpoints   []string        `json:"endpoints,omitempty"`
+	Meta        map[string]any  `json:"meta,omitempty"`
+	State       api.ClientState `json:"state"`
+	Maintenance bool            `json:"maintenance,omitempty"`
+	Load        int             `json:"load,omitempty"`
+	Capacity    int             `json:"capacity,omitempty"`
+	Lease       int64           `json:"lease"`
+}
+
+func newRecord(c api.Client, lease clientv3.LeaseID) *record {
+	return &record{
+		ClientId:  c.ClientId(),
+		ServiceId: c.ServiceId(),
+		Tenant:    c.Tenant(),
+		Endpoints: endpointUrls(c.Endpoints()),
+		Meta:      c.Meta(),
+		State:     c.State(),
+		Lease:     int64(lease),
+	}
+}
+func (r *record) client(clock common.Clock, lastSeen time.Time) (api.Client, error) {
+	c, err := common.RestoreClient(clock, r.ClientId, r.ServiceId, r.Tenant, r.Endpoints, r.Meta, r.State, lastSeen)
+	if err != nil {
+		return nil, err
+	}
+	c.SetLoad(r.Load, r.Capacity)
+	c.SetMaintenance(r.Maintenance)
+	return c, nil
+}
+
+// seen is client's liveness record
+type seen struct {
+	Time     int64 `json:"time"`     // last seen, unix nanos
+	Revision int64 `json:"revision"` // tenant's changes revision acknowledged by client
+}
+
+func (s seen) lastSeen() time.Time {
+	if s.Time == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, s.Time)
+}
+
+// endregion
+// region - registry
+
+type etcdRegistry struct {
+	cli              *clientv3.Client
+	prefix           string
+	pingInterval     api.Duration
+	maxClients       int
+	quota            func(tenant string) config.Quota
+	leaseTTL         int64
+	failingThreshold time.Duration
+	downThreshold    time.Duration
+	removeThreshold  time.Duration
+	rejoinKey        []byte
+	clock            common.Clock
+	events           *common.EventBus
+	logger           logging.Logger
+}
+
+func newEtcdRegistry(cfg *config.AppConfig, clock common.Clock, cli *clientv3.Client, prefix string) *etcdRegistry {
+	removeThreshold := time.Duration(cfg.RemoveThreshold) * cfg.PingDuration
+	registry := etcdRegistry{
+		cli:              cli,
+		prefix:           strings.TrimSuffix(prefix, "/"),
+		pingInterval:     api.Duration{Duration: cfg.PingDuration},
+		maxClients:       cfg.MaxClients,
+		quota:            cfg.Quota,
+		leaseTTL:         int64(math.Ceil(removeThreshold.Seconds())),
+		failingThreshold: time.Duration(cfg.FailingThreshold) * cfg.PingDuration,
+		downThreshold:    time.Duration(cfg.DownThreshold) * cfg.PingDuration,
+		removeThreshold:  removeThreshold,
+		rejoinKey:        common.NewRejoinKey(cfg.RejoinKey),
+		clock:            clock,
+		events:           common.NewEventBus(common.DefaultEventLogCapacity),
+		logger:           logging.GetLogger("reg-etcd"),
+	}
+	if cfg.RejoinKey == "" {
+		registry.logger.Warning("rejoin key not set; rejoin tokens will not be accepted by other disco instances")
+	}
+	return &registry
+}
+
+func (rs *etcdRegistry) Join(ctx context.Context, request api.JoinRequest) (*api.JoinResponse, error) {
+	rs.logger.Debug("[registry][join] client join")
+	tnt := ctx.Value(api.TenantKey).(string)
+	c, err := common.NewClient(rs.clock, rs.createClientId(), request.ServiceId, tnt, request.Endpoints, request.Meta)
+	if err != nil {
+		return nil, err
+	}
+	if err = rs.register(ctx, c); err != nil {
+		return nil, err
+	}
+	rs.logger.Debug("[registry][join] client %s joined", c.ClientId())
+	return rs.joinResponse(c), nil
+}
+func (rs *etcdRegistry) Rejoin(ctx context.Context, request api.RejoinRequest) (*api.JoinResponse, error) {
+	rs.logger.Debug("[registry][rejoin] client %s rejoin", request.ClientId)
+	tnt := ctx.Value(api.TenantKey).(string)
+	if !common.ValidRejoinToken(rs.rejoinKey, tnt, request.ClientId, request.Token) {
+		return nil, api.NewInvalidRejoinTokenError(request.ClientId)
+	}
+	existing, err := rs.tenantOf(ctx, request.ClientId)
+	if err != nil {
+		return nil, err
+	}
+	if existing != "" {
+		// client is still registered (e.g. ping was lost); nothing to restore
+		if existing != tnt {
+			return nil, api.NewInvalidRejoinTokenError(request.ClientId)
+		}
+		if _, err = rs.Ping(ctx, request.ClientId, api.Ping{}); err != nil {
+			return nil, err
+		}
+		r, _, err := rs.load(ctx, tnt, request.ClientId)
+		if err != nil {
+			return nil, err
+		}
+		c, err := r.client(rs.clock, rs.clock.Now())
+		if err != nil {
+			return nil, err
+		}
+		return rs.joinResponse(c), nil
+	}
+	c, err := common.NewClient(rs.clock, request.ClientId, request.ServiceId, tnt, request.Endpoints, request.Meta)
+	if err != nil {
+		return nil, err
+	}
+	if err = rs.register(ctx, c); err != nil {
+		return nil, err
+	}
+	rs.logger.Debug("[registry][rejoin] client %s rejoined", c.ClientId())
+	return rs.joinResponse(c), nil
+}
+func (rs *etcdRegistry) Leave(ctx context.Context, clientId string) error {
+	tnt, err := rs.tenantOf(ctx, clientId)
+	if err != nil {
+		return err
+	}
+	if tnt == "" {
+		return api.NewClientNotFoundError(clientId)
+	}
+	if !common.Authorized(ctx, tnt) {
+		return api.NewTenantsClientNotFoundError(clientId)
+	}
+	r, _, err := rs.load(ctx, tnt, clientId)
+	if err != nil {
+		return err
+	}
+	rs.logger.Debug("[registry][leave] remove client %s", clientId)
+	return rs.remove(ctx, r)
+}
+func (rs *etcdRegistry) List(ctx context.Context) []api.Client {
+	if ctx.Value(api.TenantKey) == nil || ctx.Value(api.TenantKey) == "" {
+		rs.logger.Warning("no tenant context set; return empty list")
+		return make([]api.Client, 0)
+	}
+	var clients []api.Client
+	tenant := ctx.Value(api.TenantKey).(string)
+	if tenant == api.TenantDefault || tenant == "" {
+		rs.logger.Debug("[list] list all")
+		clients = rs.clients(ctx, rs.clientsPrefix())
+	} else {
+		clients = rs.clients(ctx, rs.tenantPrefix(tenant))
+	}
+	rs.logger.Debug("[registry][list] list for %v (%d)", tenant, len(clients))
+	sort.Slice(clients, func(a, b int) bool {
+		if clients[a].ServiceId() != clients[b].ServiceId() {
+			return clients[a].ServiceId() < clients[b].ServiceId()
+		} else {
+			return clients[a].ClientId() < clients[b].ClientId()
+		}
+	})
+	return clients
+}
+func (rs *etcdRegistry) ListAll() []api.Tenant {
+	tenants := make(map[string]api.Tenant)
+	for _, c := range rs.clients(context.Background(), rs.clientsPrefix()) {
+		if tenants[c.Tenant()] == nil {
+			tenants[c.Tenant()] = store.CreateTenant(c.Tenant())
+		}
+		tenants[c.Tenant()].Set(c.ClientId(), c)
+	}
+	var result []api.Tenant
+	for _, t := range tenants {
+		result = append(result, t)
+	}
+	return result
+}
+func (rs *etcdRegistry) Ping(ctx context.Context, clientId string, ping api.Ping) (api.Pong, error) {
+	tnt, err := rs.tenantOf(ctx, clientId)
+	if err != nil {
+		return api.Pong{}, err
+	}
+	if tnt == "" {
+		return api.Pong{}, api.NewClientNotFoundError(clientId)
+	}
+	if !common.Authorized(ctx, tnt) {
+		return api.Pong{}, api.NewTenantsClientNotFoundError(clientId)
+	}
+	r, _, err := rs.load(ctx, tnt, clientId)
+	if err != nil {
+		return api.Pong{}, err
+	}
+	if _, err = rs.cli.KeepAliveOnce(ctx, clientv3.LeaseID(r.Lease)); err != nil {
+		if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			return api.Pong{}, api.NewClientNotFoundError(clientId)
+		}
+		return api.Pong{}, err
+	}
+	var prev api.ClientState
+	r, err = rs.modify(ctx, tnt, clientId, func(r *record) (bool, bool, error) {
+		changed, err := rs.updateMeta(r, ping.Meta)
+		if err != nil {
+			return false, false, err
+		}
+		reported := r.Load != ping.Load || r.Capacity != ping.Capacity
+		r.Load, r.Capacity = ping.Load, ping.Capacity
+		prev = r.State
+		r.State = common.PingState(ping, r.Maintenance)
+		changed = changed || r.State != prev
+		// load change is neither signalled to clients nor published
+		return changed || reported, changed, nil
+	})
+	if err != nil {
+		return api.Pong{}, err
+	}
+	if r.State != prev {
+		rs.logger.Info("client %s (%s) %s", r.ClientId, r.ServiceId, strings.ToLower(r.State.String()))
+	}
+
+	response := api.PongTypeOk
+	dirty, err := rs.touch(ctx, r, true)
+	if err != nil {
+		return api.Pong{}, err
+	}
+	if dirty {
+		response = api.PongTypeChanged
+	}
+	rs.logger.Debug("[registry][ping] client '%s' ping: '%s'", clientId, response)
+	return api.Pong{
+		Response: response,
+	}, nil
+}
+func (rs *etcdRegistry) MarkAlive(ctx context.Context, clientId string) error {
+	tnt, err := rs.tenantOf(ctx, clientId)
+	if err != nil {
+		return err
+	}
+	if tnt == "" {
+		return api.NewClientNotFoundError(clientId)
+	}
+	if !common.Authorized(ctx, tnt) {
+		return api.NewTenantsClientNotFoundError(clientId)
+	}
+	r, _, err := rs.load(ctx, tnt, clientId)
+	if err != nil {
+		return err
+	}
+	if _, err = rs.cli.KeepAliveOnce(ctx, clientv3.LeaseID(r.Lease)); err != nil {
+		if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			return api.NewClientNotFoundError(clientId)
+		}
+		return err
+	}
+	var prev api.ClientState
+	r, err = rs.modify(ctx, tnt, clientId, func(r *record) (bool, bool, error) {
+		prev = r.State
+		r.State = common.AliveState(r.State, r.Maintenance)
+		return r.State != prev, r.State != prev, nil
+	})
+	if err != nil {
+		return err
+	}
+	if r.State != prev {
+		rs.logger.Info("client %s (%s) %s", r.ClientId, r.ServiceId, strings.ToLower(r.State.String()))
+	}
+	if _, err = rs.touch(ctx, r, false); err != nil {
+		return err
+	}
+	rs.logger.Debug("[registry][alive] client '%s' is alive", clientId)
+	return nil
+}
+func (rs *etcdRegistry) SetMaintenance(clientId string, enabled bool) error {
+	ctx := context.Background()
+	tnt, err := rs.tenantOf(ctx, clientId)
+	if err != nil {
+		return err
+	}
+	if tnt == "" {
+		return api.NewClientNotFoundError(clientId)
+	}
+	r, err := rs.modify(ctx, tnt, clientId, func(r *record) (bool, bool, error) {
+		prev := r.State
+		r.Maintenance = enabled
+		r.State = common.MaintenanceState(r.State, enabled)
+		return true, r.State != prev, nil
+	})
+	if err != nil {
+		return err
+	}
+	rs.logger.Info("client %s (%s) maintenance: %v", clientId, r.ServiceId, enabled)
+	return nil
+}
+func (rs *etcdRegistry) UpdateMeta(ctx context.Context, clientId string, delta map[string]any) error {
+	tnt, err := rs.tenantOf(ctx, clientId)
+	if err != nil {
+		return err
+	}
+	if tnt == "" {
+		return api.NewClientNotFoundError(clientId)
+	}
+	if !common.Authorized(ctx, tnt) {
+		return api.NewTenantsClientNotFoundError(clientId)
+	}
+	_, err = rs.modify(ctx, tnt, clientId, func(r *record) (bool, bool, error) {
+		changed, err := rs.updateMeta(r, delta)
+		return changed, changed, err
+	})
+	return err
+}
+func (rs *etcdRegistry) Watch(ctx context.Context, revision uint64) (*api.WatchResponse, error) {
+	tenant, _ := ctx.Value(api.TenantKey).(string)
+	if tenant == "" {
+		rs.logger.Warning("no tenant context set; return empty watch response")
+		return &api.WatchResponse{Revision: rs.events.Revision(), Events: []api.Event{}}, nil
+	}
+	return rs.events.Wait(ctx, tenant, revision)
+}
+func (rs *etcdRegistry) Subscribe(handler api.EventHandler) func() {
+	return rs.events.Subscribe(handler)
+}
+
+// endregion
+// region - storage
+
+func (rs *etcdRegistry) register(ctx context.Context, c api.Client) error {
+	count, err := rs.cli.Get(ctx, rs.indexPrefix(), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return err
+	}
+	if int(count.Count) >= rs.maxClients {
+		return api.NewMaxClientsReachedError(rs.maxClients)
+	}
+	if rs.has(ctx, c) {
+		return api.NewAlreadyRegisteredError()
+	}
+	if err = rs.checkQuota(ctx, c); err != nil {
+		return err
+	}
+	lease, err := rs.cli.Grant(ctx, rs.leaseTTL)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(newRecord(c, lease.ID))
+	if err != nil {
+		return err
+	}
+	sn, err := json.Marshal(seen{Time: c.LastSeen().UnixNano()})
+	if err != nil {
+		return err
+	}
+	resp, err := rs.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(rs.indexKey(c.ClientId())), "=", 0)).
+		Then(
+			clientv3.OpPut(rs.clientKey(c.Tenant(), c.ClientId()), string(data), clientv3.WithLease(lease.ID)),
+			clientv3.OpPut(rs.indexKey(c.ClientId()), c.Tenant(), clientv3.WithLease(lease.ID)),
+			clientv3.OpPut(rs.seenKey(c.ClientId()), string(sn), clientv3.WithLease(lease.ID)),
+			clientv3.OpPut(rs.changesKey(c.Tenant()), c.ClientId()),
+		).
+		Commit()
+	if err != nil {
+		_, _ = rs.cli.Revoke(ctx, lease.ID)
+		return err
+	}
+	if !resp.Succeeded {
+		_, _ = rs.cli.Revoke(ctx, lease.ID)
+		return api.NewAlreadyRegisteredError()
+	}
+	return nil
+}
+func (rs *etcdRegistry) remove(ctx context.Context, r *record) error {
+	rs.logger.Info("removing client %s (%s)", r.ClientId, r.ServiceId)
+	if _, err := rs.cli.Revoke(ctx, clientv3.LeaseID(r.Lease)); err != nil {
+		if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			return api.NewClientNotFoundError(r.ClientId)
+		}
+		return err
+	}
+	_, err := rs.cli.Put(ctx, rs.changesKey(r.Tenant), r.ClientId)
+	return err
+}
+
+// modify loads client record, applies fn to it and stores the result if record
+// was not modified since it was read (i.e. other disco instance has not changed
+// it already); otherwise record is re-read and fn is applied again. fn reports
+// whether record should be stored and whether tenant should be marked as
+// changed
+func (rs *etcdRegistry) modify(ctx context.Context, tenant, clientId string, fn func(r *record) (store, changed bool, err error)) (*record, error) {
+	for i := 0; i < maxConflictRetries; i++ {
+		r, revision, err := rs.load(ctx, tenant, clientId)
+		if err != nil {
+			return nil, err
+		}
+		store, changed, err := fn(r)
+		if err != nil || !store {
+			return r, err
+		}
+		if err = rs.save(ctx, r, revision, changed); !errors.Is(err, errConflict) {
+			return r, err
+		}
+	}
+	return nil, errConflict
+}
+
+// save stores client record if it was not modified since given revision and
+// all extra conditions hold (errConflict otherwise); tenant is marked as
+// changed if requested
+func (rs *etcdRegistry) save(ctx context.Context, r *record, revision int64, changed bool, conditions ...clientv3.Cmp) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	key := rs.clientKey(r.Tenant, r.ClientId)
+	ops := []clientv3.Op{clientv3.OpPut(key, string(data), clientv3.WithIgnoreLease())}
+	if changed {
+		ops = append(ops, clientv3.OpPut(rs.changesKey(r.Tenant), r.ClientId))
+	}
+	conditions = append(conditions, clientv3.Compare(clientv3.ModRevision(key), "=", revision))
+	resp, err := rs.cli.Txn(ctx).
+		If(conditions...).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return errConflict
+	}
+	return nil
+}
+
+// touch updates client's last seen time; on ping (acknowledge) it also stores
+// tenant's current change revision as seen by the client and reports whether
+// there were changes since client's previous ping. Both are kept in etcd, so
+// any disco instance may serve client's next ping
+func (rs *etcdRegistry) touch(ctx context.Context, r *record, acknowledge bool) (bool, error) {
+	resp, err := rs.cli.Txn(ctx).
+		Then(
+			clientv3.OpGet(rs.changesKey(r.Tenant)),
+			clientv3.OpGet(rs.seenKey(r.ClientId)),
+		).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	var current int64
+	if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+		current = kvs[0].ModRevision
+	}
+	var sn seen
+	if kvs := resp.Responses[1].GetResponseRange().Kvs; len(kvs) > 0 {
+		if err = json.Unmarshal(kvs[0].Value, &sn); err != nil {
+			return false, err
+		}
+	}
+	dirty := acknowledge && sn.Revision != current
+	if acknowledge {
+		sn.Revision = current
+	}
+	sn.Time = rs.clock.Now().UnixNano()
+	data, err := json.Marshal(sn)
+	if err != nil {
+		return false, err
+	}
+	if _, err = rs.cli.Put(ctx, rs.seenKey(r.ClientId), string(data), clientv3.WithLease(clientv3.LeaseID(r.Lease))); err != nil {
+		return false, err
+	}
+	return dirty, nil
+}
+
+// seenAll returns liveness records (and their revisions) of all clients
+func (rs *etcdRegistry) seenAll(ctx context.Context) (map[string]seen, map[string]int64) {
+	resp, err := rs.cli.Get(ctx, rs.seenPrefix(), clientv3.WithPrefix())
+	if err != nil {
+		rs.logger.Warning("could not read clients' last seen times: %s", err.Error())
+		return nil, nil
+	}
+	result := make(map[string]seen, len(resp.Kvs))
+	revisions := make(map[string]int64, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var sn seen
+		if err = json.Unmarshal(kv.Value, &sn); err != nil {
+			continue
+		}
+		id := strings.TrimPrefix(string(kv.Key), rs.seenPrefix())
+		result[id] = sn
+		revisions[id] = kv.ModRevision
+	}
+	return result, revisions
+}
+func (rs *etcdRegistry) tenantOf(ctx context.Context, clientId string) (string, error) {
+	resp, err := rs.cli.Get(ctx, rs.indexKey(clientId))
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", nil
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+func (rs *etcdRegistry) load(ctx context.Context, tenant, clientId string) (*record, int64, error) {
+	resp, err := rs.cli.Get(ctx, rs.clientKey(tenant, clientId))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, api.NewClientNotFoundError(clientId)
+	}
+	var r record
+	if err = json.Unmarshal(resp.Kvs[0].Value, &r); err != nil {
+		return nil, 0, err
+	}
+	return &r, resp.Kvs[0].ModRevision, nil
+}
+func (rs *etcdRegistry) records(ctx context.Context, prefix string) ([]*record, []int64) {
+	resp, err := rs.cli.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		rs.logger.Warning("could not read clients: %s", err.Error())
+		return nil, nil
+	}
+	var records []*record
+	var revisions []int64
+	for _, kv := range resp.Kvs {
+		var r record
+		if err = json.Unmarshal(kv.Value, &r); err != nil {
+			rs.logger.Warning("could not unmarshal client %s: %s", string(kv.Key), err.Error())
+			continue
+		}
+		records = append(records, &r)
+		revisions = append(revisions, kv.ModRevision)
+	}
+	return records, revisions
+}
+func (rs *etcdRegistry) clients(ctx context.Context, prefix string) []api.Client {
+	records, _ := rs.records(ctx, prefix)
+	seenTimes, _ := rs.seenAll(ctx)
+	var result []api.Client
+	for _, r := range records {
+		c, err := r.client(rs.clock, seenTimes[r.ClientId].lastSeen())
+		if err != nil {
+			continue
+		}
+		result = append(result, c)
+	}
+	return result
+}
+func (rs *etcdRegistry) has(ctx context.Context, client api.Client) bool {
+	for _, c := range rs.clients(ctx, rs.tenantPrefix(client.Tenant())) {
+		if rs.equalClients(c, client) {
+			return true
+		}
+	}
+	return false
+}
+func (rs *etcdRegistry) checkQuota(ctx context.Context, client api.Client) error {
+	var services []string
+	for _, c := range rs.clients(ctx, rs.tenantPrefix(client.Tenant())) {
+		services = append(services, c.ServiceId())
+	}
+	return common.CheckQuota(rs.quota(client.Tenant()), client.Tenant(), client.ServiceId(), client.Meta(), services)
+}
+func (rs *etcdRegistry) updateMeta(r *record, delta map[string]any) (bool, error) {
+	if len(delta) == 0 {
+		return false, nil
+	}
+	meta := common.MergeMeta(r.Meta, delta)
+	if reflect.DeepEqual(meta, r.Meta) {
+		return false, nil
+	}
+	if err := common.CheckMetaSize(rs.quota(r.Tenant), meta); err != nil {
+		return false, err
+	}
+	r.Meta = meta
+	rs.logger.Debug("[registry][meta] client '%s' meta updated", r.ClientId)
+	return true, nil
+}
+func (rs *etcdRegistry) equalClients(a, b api.Client) bool {
+	return a.ServiceId() == b.ServiceId() &&
+		reflect.DeepEqual(endpointUrls(a.Endpoints()), endpointUrls(b.Endpoints())) &&
+		reflect.DeepEqual(a.Meta(), b.Meta())
+}
+func (rs *etcdRegistry) createClientId() string {
+	u, err := uuid.NewUUID()
+	if err != nil {
+		panic(err)
+	}
+	return u.String()
+}
+func (rs *etcdRegistry) joinResponse(client api.Client) *api.JoinResponse {
+	return &api.JoinResponse{
+		ClientId:     client.ClientId(),
+		PingInterval: rs.pingInterval,
+		Token:        common.NewRejoinToken(rs.rejoinKey, client.Tenant(), client.ClientId()),
+	}
+}
+
+// endregion
+// region - events
+
+// listen converts etcd watch events on client records into registry events;
+// every disco instance sharing etcd gets the same stream
+func (rs *etcdRegistry) listen(ctx context.Context) {
+	ch := rs.cli.Watch(ctx, rs.clientsPrefix(), clientv3.WithPrefix(), clientv3.WithPrevKV(), clientv3.WithCreatedNotify())
+	// make sure watch is established before any change is made
+	if resp, ok := <-ch; !ok || resp.Err() != nil {
+		rs.logger.Warning("could not watch registry changes: %v", resp.Err())
+	}
+	go func() {
+		for resp := range ch {
+			for _, e := range resp.Events {
+				for _, event := range rs.convert(e) {
+					rs.events.Publish(event)
+				}
+			}
+		}
+	}()
+}
+func (rs *etcdRegistry) convert(e *clientv3.Event) []api.Event {
+	var current, previous record
+	if e.Kv != nil && len(e.Kv.Value) > 0 {
+		if err := json.Unmarshal(e.Kv.Value, &current); err != nil {
+			return nil
+		}
+	}
+	if e.PrevKv != nil && len(e.PrevKv.Value) > 0 {
+		if err := json.Unmarshal(e.PrevKv.Value, &previous); err != nil {
+			return nil
+		}
+	}
+	switch {
+	case e.Type == clientv3.EventTypeDelete:
+		c, err := previous.client(rs.clock, rs.clock.Now())
+		if err != nil {
+			return nil
+		}
+		c.SetState(api.ClientStateRemoved)
+		return []api.Event{
+			common.NewStateChangedEvent(c, previous.State),
+			common.NewClientLeftEvent(c, previous.State),
+		}
+	case e.IsCreate():
+		c, err := current.client(rs.clock, rs.clock.Now())
+		if err != nil {
+			return nil
+		}
+		return []api.Event{common.NewClientJoinedEvent(c)}
+	}
+	c, err := current.client(rs.clock, rs.clock.Now())
+	if err != nil {
+		return nil
+	}
+	var events []api.Event
+	if current.State != previous.State {
+		events = append(events, common.NewStateChangedEvent(c, previous.State))
+	}
+	if !reflect.DeepEqual(current.Meta, previous.Meta) {
+		events = append(events, common.NewMetaUpdatedEvent(c))
+	}
+	return events
+}
+
+// endregion
+// region - runner
+
+func (rs *etcdRegistry) run(ctx context.Context) {
+	rs.listen(ctx)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				rs.check(ctx, rs.clock.Now())
+			}
+		}
+	}()
+}
+
+// check derives FAILING/DOWN states from time since clients' last ping and
+// removes clients not seen for RemoveThreshold
+func (rs *etcdRegistry) check(ctx context.Context, now time.Time) {
+	records, revisions := rs.records(ctx, rs.clientsPrefix())
+	seenTimes, seenRevisions := rs.seenAll(ctx)
+	for i, r := range records {
+		sn, ok := seenTimes[r.ClientId]
+		if !ok {
+			continue // being registered or expired
+		}
+		interval, err := rs.sincePing(ctx, r, sn, now)
+		if err != nil {
+			rs.logger.Warning("could not read lease of client %s: %s", r.ClientId, err.Error())
+			continue
+		}
+		rs.runner(ctx, r, revisions[i], seenRevisions[r.ClientId], interval)
+	}
+}
+
+// sincePing returns time since client's last ping, i.e. spent TTL of its lease
+// (which does not depend on disco instances' clocks); lease TTL is counted in
+// whole seconds, so client's last seen time is used if it is older
+func (rs *etcdRegistry) sincePing(ctx context.Context, r *record, sn seen, now time.Time) (time.Duration, error) {
+	resp, err := rs.cli.TimeToLive(ctx, clientv3.LeaseID(r.Lease))
+	if err != nil {
+		return 0, err
+	}
+	if resp.TTL < 0 {
+		return math.MaxInt64, nil // lease has expired
+	}
+	interval := time.Duration(resp.GrantedTTL-resp.TTL) * time.Second
+	if since := now.Sub(sn.lastSeen()); since > interval {
+		interval = since
+	}
+	return interval, nil
+}
+
+// runner changes client's state if it missed pings; nothing is changed if
+// client record or its last seen time was modified since they were listed
+// (e.g. client pinged other disco instance)
+func (rs *etcdRegistry) runner(ctx context.Context, r *record, revision, seenRevision int64, interval time.Duration) {
+	unchanged := clientv3.Compare(clientv3.ModRevision(rs.seenKey(r.ClientId)), "=", seenRevision)
+	if rs.removeThreshold < interval {
+		rs.expire(ctx, r, revision, unchanged)
+		return
+	}
+	state := r.State
+	if rs.downThreshold < interval {
+		state = api.ClientStateDown
+	} else if rs.failingThreshold < interval {
+		state = api.ClientStateFailing
+	}
+	if state == r.State {
+		return
+	}
+	r.State = state
+	err := rs.save(ctx, r, revision, true, unchanged)
+	switch {
+	case errors.Is(err, errConflict):
+		rs.logger.Debug("[registry][check] client %s changed concurrently; skipped", r.ClientId)
+	case err != nil:
+		rs.logger.Warning("could not update client %s: %s", r.ClientId, err.Error())
+	default:
+		rs.logger.Info("client %s (%s) %s", r.ClientId, r.ServiceId, strings.ToLower(state.String()))
+	}
+}
+
+// expire removes client which was not seen for RemoveThreshold
+func (rs *etcdRegistry) expire(ctx context.Context, r *record, revision int64, unchanged clientv3.Cmp) {
+	resp, err := rs.cli.Txn(ctx).
+		If(unchanged, clientv3.Compare(clientv3.ModRevision(rs.clientKey(r.Tenant, r.ClientId)), "=", revision)).
+		Then(
+			clientv3.OpDelete(rs.clientKey(r.Tenant, r.ClientId)),
+			clientv3.OpDelete(rs.indexKey(r.ClientId)),
+			clientv3.OpDelete(rs.seenKey(r.ClientId)),
+			clientv3.OpPut(rs.changesKey(r.Tenant), r.ClientId),
+		).
+		Commit()
+	if err != nil {
+		rs.logger.Warning("could not remove client %s: %s", r.ClientId, err.Error())
+		return
+	}
+	if !resp.Succeeded {
+		return // seen again
+	}
+	_, _ = rs.cli.Revoke(ctx, clientv3.LeaseID(r.Lease))
+	rs.logger.Info("client %s (%s) expired", r.ClientId, r.ServiceId)
+}
+
+// endregion
+
+func endpointUrls(endpoints []api.Endpoint) []string {
+	var result []string
+	for _, e := range endpoints {
+		result = append(result, e.Url())
+	}
+	return result
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/backend/registrytest"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = l.Close()
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+func startEtcd(t *testing.T) *clientv3.Client {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", freePort(t)))
+	peerUrl, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", freePort(t)))
+	cfg.ListenClientUrls = []url.URL{*clientUrl}
+	cfg.AdvertiseClientUrls = []url.URL{*clientUrl}
+	cfg.ListenPeerUrls = []url.URL{*peerUrl}
+	cfg.AdvertisePeerUrls = []url.URL{*peerUrl}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("embedded etcd did not start")
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{clientUrl.String()},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cli.Close()
+	})
+	return cli
+}
+func testRegistry(t *testing.T, cfg *config.AppConfig) *etcdRegistry {
+	return newEtcdRegistry(cfg, common.SystemClock, startEtcd(t), "/disco")
+}
+
+func TestLeaseStateTransitions(t *testing.T) {
+	cfg := registrytest.Config()
+	cfg.FailingThreshold, cfg.DownThreshold, cfg.RemoveThreshold = 1, 2, 4
+	// registry clock is stopped, so states are derived from lease's TTL only
+	clock := common.NewManualClock(time.Now())
+	rs := newEtcdRegistry(cfg, clock, startEtcd(t), "/disco")
+	ctx, cancel := context.WithCancel(registrytest.Tenant("tenant"))
+	defer cancel()
+	rs.listen(ctx)
+
+	events := make(chan api.Event, 16)
+	rs.Subscribe(func(event api.Event) {
+		events <- event
+	})
+
+	resp, err := rs.Join(ctx, api.JoinRequest{ServiceId: "SVC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rs.Ping(ctx, resp.ClientId, api.Ping{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// no pings: lease ttl is spent, so client becomes failing, then down,
+	// then etcd expires the lease and removes client
+	states := map[api.ClientState]bool{}
+	timeout := time.After(10 * time.Second)
+	for !states[api.ClientStateRemoved] {
+		select {
+		case e := <-events:
+			states[e.State] = true
+		case <-time.After(time.Second):
+			rs.check(ctx, clock.Now())
+		case <-timeout:
+			t.Fatalf("client was not removed; seen states: %v", states)
+		}
+	}
+	for _, s := range []api.ClientState{api.ClientStateStarting, api.ClientStateUp, api.ClientStateFailing, api.ClientStateDown} {
+		if !states[s] {
+			t.Errorf("expected %s state event", s)
+		}
+	}
+	if _, err = rs.Ping(ctx, resp.ClientId, api.Ping{}); !errors.Is(err, api.NewClientNotFoundError(resp.ClientId)) {
+		t.Errorf("expected client not found, got %v", err)
+	}
+}
+func TestListLastSeen(t *testing.T) {
+	clock := common.NewManualClock(time.Now())
+	rs := newEtcdRegistry(registrytest.Config(), clock, startEtcd(t), "/disco")
+	ctx := registrytest.Tenant("tenant")
+	resp, err := rs.Join(ctx, api.JoinRequest{ServiceId: "SVC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := clock.Advance(time.Second)
+	if _, err = rs.Ping(ctx, resp.ClientId, api.Ping{}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+
+	// last seen time is read from etcd, not taken from registry clock
+	if list := rs.List(ctx); len(list) != 1 || !list[0].LastSeen().Equal(seen) {
+		t.Errorf("expected client last seen at %s, got %v", seen, list)
+	}
+	tenants := rs.ListAll()
+	if len(tenants) != 1 {
+		t.Fatalf("unexpected tenants: %v", tenants)
+	}
+	if c := tenants[0].Get(resp.ClientId); c == nil || !c.LastSeen().Equal(seen) {
+		t.Errorf("expected client last seen at %s in all tenants' list", seen)
+	}
+}
+func TestConcurrentModification(t *testing.T) {
+	rs := testRegistry(t, registrytest.Config())
+	other := newEtcdRegistry(registrytest.Config(), common.SystemClock, rs.cli, "/disco")
+	ctx := registrytest.Tenant("tenant")
+	resp, err := rs.Join(ctx, api.JoinRequest{ServiceId: "SVC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, rev, err := rs.load(ctx, "tenant", resp.ClientId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.UpdateMeta(ctx, resp.ClientId, map[string]any{"zone": "eu-1"}); err != nil {
+		t.Fatal(err)
+	}
+	// record read before other instance's change is not stored
+	r.Maintenance = true
+	if err = rs.save(ctx, r, rev, true); !errors.Is(err, errConflict) {
+		t.Errorf("expected conflict, got %v", err)
+	}
+	// changes are applied to re-read record
+	if err = rs.SetMaintenance(resp.ClientId, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rs.Ping(ctx, resp.ClientId, api.Ping{Load: 3, Capacity: 10}); err != nil {
+		t.Fatal(err)
+	}
+	list := other.List(ctx)
+	if len(list) != 1 || list[0].State() != api.ClientStateMaintenance || list[0].Meta()["zone"] != "eu-1" {
+		t.Fatalf("unexpected list: %v", list)
+	}
+	if load, capacity := list[0].Load(); load != 3 || capacity != 10 {
+		t.Errorf("expected load 3/10, got %d/%d", load, capacity)
+	}
+}
+func TestChangesAcknowledgedAcrossInstances(t *testing.T) {
+	rs := testRegistry(t, registrytest.Config())
+	other := newEtcdRegistry(registrytest.Config(), common.SystemClock, rs.cli, "/disco")
+	ctx := registrytest.Tenant("tenant")
+	resp, err := rs.Join(ctx, api.JoinRequest{ServiceId: "SVC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(rs *etcdRegistry, expected api.PongType) {
+		t.Helper()
+		pong, err := rs.Ping(ctx, resp.ClientId, api.Ping{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pong.Response != expected {
+			t.Errorf("expected %s, got %s", expected, pong.Response)
+		}
+	}
+	expect(rs, api.PongTypeChanged)
+	// change acknowledged with one instance is not reported by other one
+	expect(other, api.PongTypeOk)
+	if _, err = rs.Join(ctx, api.JoinRequest{ServiceId: "SVC2"}); err != nil {
+		t.Fatal(err)
+	}
+	expect(other, api.PongTypeChanged)
+	expect(rs, api.PongTypeOk)
+}
+func TestConformance(t *testing.T) {
+	cli := startEtcd(t)
+	var n int
+	registrytest.Run(t, func(t *testing.T, cfg *config.AppConfig, clock common.Clock) registrytest.Subject {
+		n++
+		rs := newEtcdRegistry(cfg, clock, cli, fmt.Sprintf("/disco-%d", n))
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		rs.listen(ctx)
+		return registrytest.Subject{Registry: rs, Check: func(now time.Time) {
+			rs.check(context.Background(), now)
+		}}
+	})
+}
@@ -1,4 +1,4 @@
-package main
+package inmem
 
 import (
 	"context"
@@ -6,7 +6,8 @@ import (
 	"github.com/slink-go/disco/backend/common"
 	"github.com/slink-go/disco/backend/inmem/store"
 	"github.com/slink-go/disco/common/api"
-	"github.com/slink-go/disco/server/config"
+	"github.com/slink-go/disco/common/config"
+	"github.com/slink-go/disco/common/registry"
 	"github.com/slink-go/logging"
 	"reflect"
 	"sort"
@@ -16,10 +17,15 @@ import (
 
 var Backend inMemBackendInitializer
 
+// in-memory backend is linked into disco server statically
+func init() {
+	registry.Register("inmem", &Backend)
+}
+
 type inMemBackendInitializer struct{}
 
 func (bi *inMemBackendInitializer) Init(cfg *config.AppConfig) api.Registry {
-	return newInMemRegistry(cfg)
+	return newInMemRegistry(cfg, common.SystemClock, loadSnapshotOptions())
 }
 
 type inMemRegistry struct {
@@ -28,19 +34,38 @@ type inMemRegistry struct {
 	clients      *store.ClientsSync
 	pingInterval api.Duration
 	maxClients   int
+	quota        func(tenant string) config.Quota
+	rejoinKey    []byte
+	events       *common.EventBus
+	clock        common.Clock
+	scheduler    *scheduler
+	cancel       context.CancelFunc
+	snapshots    sync.WaitGroup
 	logger       logging.Logger
 }
 
-func newInMemRegistry(cfg *config.AppConfig) api.Registry {
-	registry := inMemRegistry{
+func newInMemRegistry(cfg *config.AppConfig, clock common.Clock, snapshots snapshotOptions) api.Registry {
+	registry := &inMemRegistry{
 		tenants:      store.CreateTenants(),
 		clients:      store.CreateClients(),
 		maxClients:   cfg.MaxClients,
+		quota:        cfg.Quota,
 		pingInterval: api.Duration{Duration: cfg.PingDuration},
+		rejoinKey:    common.NewRejoinKey(cfg.RejoinKey),
+		events:       common.NewEventBus(common.DefaultEventLogCapacity),
+		clock:        clock,
 		logger:       logging.GetLogger("reg-inmem"),
 	}
-	registry.run(cfg)
-	return &registry
+	if cfg.RejoinKey == "" {
+		registry.logger.Warning("rejoin key not set; rejoin tokens will not survive restart")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	registry.cancel = cancel
+	registry.scheduler = newScheduler(ctx, clock, time.Second, func(tenant string, now time.Time) {
+		registry.checkTenant(cfg, tenant, now)
+	})
+	registry.runSnapshots(ctx, snapshots)
+	return registry
 }
 
 func (rs *inMemRegistry) Join(ctx context.Context, request api.JoinRequest) (*api.JoinResponse, error) {
@@ -56,7 +81,7 @@ func (rs *inMemRegistry) Join(ctx context.Context, request api.JoinRequest) (*ap
 	tnt := ctx.Value(api.TenantKey).(string)
 
 	clientId := rs.createClientId()
-	c, err := common.NewClient(clientId, request.ServiceId, tnt, request.Endpoints, request.Meta)
+	c, err := common.NewClient(rs.clock, clientId, request.ServiceId, tnt, request.Endpoints, request.Meta)
 	if err != nil {
 		return nil, err
 	}
@@ -64,23 +89,63 @@ func (rs *inMemRegistry) Join(ctx context.Context, request api.JoinRequest) (*ap
 	if rs.has(c) {
 		return nil, api.NewAlreadyRegisteredError()
 	}
-	rs.clients.Set(clientId, c)
-	if rs.tenants.Get(tnt) == nil {
-		rs.tenants.Set(tnt, store.CreateTenant(tnt))
+	if err = rs.checkQuota(c); err != nil {
+		return nil, err
 	}
-	rs.tenants.Get(tnt).Set(clientId, c)
-	rs.update(c)
+	rs.add(c)
 	rs.logger.Debug("[registry][join] client %s joined", c.ClientId())
-	return &api.JoinResponse{
-		ClientId:     clientId,
-		PingInterval: rs.pingInterval,
-	}, nil
+	return rs.joinResponse(c), nil
+}
+func (rs *inMemRegistry) Rejoin(ctx context.Context, request api.RejoinRequest) (*api.JoinResponse, error) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.logger.Debug("[registry][rejoin] client %s rejoin", request.ClientId)
+
+	tnt := ctx.Value(api.TenantKey).(string)
+	if !common.ValidRejoinToken(rs.rejoinKey, tnt, request.ClientId, request.Token) {
+		return nil, api.NewInvalidRejoinTokenError(request.ClientId)
+	}
+
+	// client is still registered (e.g. ping was lost); nothing to restore
+	if c := rs.clients.Get(request.ClientId); c != nil {
+		if c.Tenant() != tnt {
+			return nil, api.NewInvalidRejoinTokenError(request.ClientId)
+		}
+		prev := c.State()
+		if c.Ping(api.Ping{}) {
+			rs.update(c)
+			rs.events.Publish(common.NewStateChangedEvent(c, prev))
+		}
+		return rs.joinResponse(c), nil
+	}
+
+	if rs.clients.Size() >= rs.maxClients {
+		return nil, api.NewMaxClientsReachedError(rs.maxClients)
+	}
+
+	c, err := common.NewClient(rs.clock, request.ClientId, request.ServiceId, tnt, request.Endpoints, request.Meta)
+	if err != nil {
+		return nil, err
+	}
+	if rs.has(c) {
+		return nil, api.NewAlreadyRegisteredError()
+	}
+	if err = rs.checkQuota(c); err != nil {
+		return nil, err
+	}
+	rs.add(c)
+	rs.logger.Debug("[registry][rejoin] client %s rejoined", c.ClientId())
+	return rs.joinResponse(c), nil
 }
 func (rs *inMemRegistry) Leave(ctx context.Context, clientId string) error {
 	client := rs.clients.Get(clientId)
 	if client == nil {
 		return api.NewClientNotFoundError(clientId)
 	}
+	if !common.Authorized(ctx, client.Tenant()) {
+		return api.NewTenantsClientNotFoundError(clientId)
+	}
 	rs.logger.Debug("[registry][leave] remove client %s", clientId)
 	rs.remove(client)
 	return nil
@@ -120,15 +185,23 @@ func (rs *inMemRegistry) ListAll() []api.Tenant {
 	defer rs.RUnlock()
 	return rs.tenants.List()
 }
-func (rs *inMemRegistry) Ping(clientId string) (api.Pong, error) {
+func (rs *inMemRegistry) Ping(ctx context.Context, clientId string, ping api.Ping) (api.Pong, error) {
 	rs.Lock()
 	defer rs.Unlock()
 	v := rs.clients.Get(clientId)
 	if v == nil {
 		return api.Pong{}, api.NewClientNotFoundError(clientId)
 	}
-	if v.Ping() {
+	if !common.Authorized(ctx, v.Tenant()) {
+		return api.Pong{}, api.NewTenantsClientNotFoundError(clientId)
+	}
+	if err := rs.updateMeta(v, ping.Meta); err != nil {
+		return api.Pong{}, err
+	}
+	prev := v.State()
+	if v.Ping(ping) {
 		rs.update(v)
+		rs.events.Publish(common.NewStateChangedEvent(v, prev))
 	}
 	response := api.PongTypeOk
 	if v.IsDirty() {
@@ -140,7 +213,106 @@ func (rs *inMemRegistry) Ping(clientId string) (api.Pong, error) {
 		Response: response,
 	}, nil
 }
+func (rs *inMemRegistry) MarkAlive(ctx context.Context, clientId string) error {
+	rs.Lock()
+	defer rs.Unlock()
+	v := rs.clients.Get(clientId)
+	if v == nil {
+		return api.NewClientNotFoundError(clientId)
+	}
+	if !common.Authorized(ctx, v.Tenant()) {
+		return api.NewTenantsClientNotFoundError(clientId)
+	}
+	prev := v.State()
+	if v.MarkAlive() {
+		rs.update(v)
+		rs.events.Publish(common.NewStateChangedEvent(v, prev))
+	}
+	rs.logger.Debug("[registry][alive] client '%s' is alive", clientId)
+	return nil
+}
+func (rs *inMemRegistry) SetMaintenance(clientId string, enabled bool) error {
+	rs.Lock()
+	defer rs.Unlock()
+	v := rs.clients.Get(clientId)
+	if v == nil {
+		return api.NewClientNotFoundError(clientId)
+	}
+	v.SetMaintenance(enabled)
+	prev := v.State()
+	if state := common.MaintenanceState(prev, enabled); state != prev {
+		v.SetState(state)
+		rs.update(v)
+		rs.events.Publish(common.NewStateChangedEvent(v, prev))
+	}
+	rs.logger.Info("client %s (%s) maintenance: %v", clientId, v.ServiceId(), enabled)
+	return nil
+}
+func (rs *inMemRegistry) UpdateMeta(ctx context.Context, clientId string, delta map[string]any) error {
+	rs.Lock()
+	defer rs.Unlock()
+	v := rs.clients.Get(clientId)
+	if v == nil {
+		return api.NewClientNotFoundError(clientId)
+	}
+	if !common.Authorized(ctx, v.Tenant()) {
+		return api.NewTenantsClientNotFoundError(clientId)
+	}
+	return rs.updateMeta(v, delta)
+}
 
+func (rs *inMemRegistry) add(client api.Client) {
+	rs.clients.Set(client.ClientId(), client)
+	if rs.tenants.Get(client.Tenant()) == nil {
+		rs.tenants.Set(client.Tenant(), store.CreateTenant(client.Tenant()))
+		rs.scheduler.add(client.Tenant())
+	}
+	rs.tenants.Get(client.Tenant()).Set(client.ClientId(), client)
+	rs.update(client)
+	rs.events.Publish(common.NewClientJoinedEvent(client))
+}
+func (rs *inMemRegistry) updateMeta(client api.Client, delta map[string]any) error {
+	if len(delta) == 0 {
+		return nil
+	}
+	meta := common.MergeMeta(client.Meta(), delta)
+	if reflect.DeepEqual(meta, client.Meta()) {
+		return nil
+	}
+	if err := common.CheckMetaSize(rs.quota(client.Tenant()), meta); err != nil {
+		return err
+	}
+	client.SetMeta(meta)
+	rs.update(client)
+	rs.events.Publish(common.NewMetaUpdatedEvent(client))
+	rs.logger.Debug("[registry][meta] client %s meta updated", client.ClientId())
+	return nil
+}
+func (rs *inMemRegistry) joinResponse(client api.Client) *api.JoinResponse {
+	return &api.JoinResponse{
+		ClientId:     client.ClientId(),
+		PingInterval: rs.pingInterval,
+		Token:        common.NewRejoinToken(rs.rejoinKey, client.Tenant(), client.ClientId()),
+	}
+}
+func (rs *inMemRegistry) Watch(ctx context.Context, revision uint64) (*api.WatchResponse, error) {
+	tenant, _ := ctx.Value(api.TenantKey).(string)
+	if tenant == "" {
+		rs.logger.Warning("no tenant context set; return empty watch response")
+		return &api.WatchResponse{Revision: rs.events.Revision(), Events: []api.Event{}}, nil
+	}
+	return rs.events.Wait(ctx, tenant, revision)
+}
+func (rs *inMemRegistry) Subscribe(handler api.EventHandler) func() {
+	return rs.events.Subscribe(handler)
+}
+
+// Close stops failure detection of all tenants and saves final snapshot
+func (rs *inMemRegistry) Close() error {
+	rs.cancel()
+	rs.snapshots.Wait()
+	return nil
+}
 func (rs *inMemRegistry) createClientId() string {
 	u, err := uuid.NewUUID()
 	if err != nil {
@@ -159,30 +331,46 @@ func (rs *inMemRegistry) has(client api.Client) bool {
 	}
 	return false
 }
+func (rs *inMemRegistry) checkQuota(client api.Client) error {
+	var services []string
+	if t := rs.tenants.Get(client.Tenant()); t != nil {
+		for _, c := range t.Clients() {
+			services = append(services, c.ServiceId())
+		}
+	}
+	return common.CheckQuota(rs.quota(client.Tenant()), client.Tenant(), client.ServiceId(), client.Meta(), services)
+}
 func (rs *inMemRegistry) equalClients(a, b api.Client) bool {
 	return a.ServiceId() == b.ServiceId() &&
 		reflect.DeepEqual(a.Endpoints(), b.Endpoints()) &&
 		reflect.DeepEqual(a.Meta(), b.Meta())
 }
 
-func (rs *inMemRegistry) run(cfg *config.AppConfig) {
-	// TODO: one runner per tenant
-	go func() {
-		for {
-			time.Sleep(time.Second)
-			rs.RLock()
-			for _, t := range rs.tenants.List() {
-				go rs.runner(cfg, t)
-			}
-			rs.RUnlock()
-		}
-	}()
+// check runs failure detection for all tenants at once
+func (rs *inMemRegistry) check(cfg *config.AppConfig, now time.Time) {
+	rs.RLock()
+	tenants := rs.tenants.List()
+	rs.RUnlock()
+	for _, t := range tenants {
+		rs.runner(cfg, t, now)
+	}
+}
+func (rs *inMemRegistry) checkTenant(cfg *config.AppConfig, tenant string, now time.Time) {
+	rs.RLock()
+	t := rs.tenants.Get(tenant)
+	rs.RUnlock()
+	if t != nil {
+		rs.runner(cfg, t, now)
+	}
 }
-func (rs *inMemRegistry) runner(cfg *config.AppConfig, tenant api.Tenant) {
+func (rs *inMemRegistry) runner(cfg *config.AppConfig, tenant api.Tenant, now time.Time) {
 	for _, c := range tenant.Clients() {
-		interval := time.Now().Sub(c.LastSeen())
+		rs.RLock()
+		interval := now.Sub(c.LastSeen())
+		state := c.State()
+		rs.RUnlock()
 		if time.Duration(cfg.RemoveThreshold)*cfg.PingDuration < interval {
-			if c.State() != api.ClientStateRemoved {
+			if state != api.ClientStateRemoved {
 				rs.remove(c)
 			}
 		} else if time.Duration(cfg.DownThreshold)*cfg.PingDuration < interval {
@@ -195,29 +383,48 @@ func (rs *inMemRegistry) runner(cfg *config.AppConfig, tenant api.Tenant) {
 	}
 }
 func (rs *inMemRegistry) failing(client api.Client) {
+	rs.Lock()
+	defer rs.Unlock()
 	if client.State() != api.ClientStateFailing {
+		prev := client.State()
 		client.SetState(api.ClientStateFailing)
 		rs.update(client)
+		rs.events.Publish(common.NewStateChangedEvent(client, prev))
 		rs.logger.Info("client %s (%s) failing", client.ClientId(), client.ServiceId())
 	}
 }
 func (rs *inMemRegistry) down(client api.Client) {
+	rs.Lock()
+	defer rs.Unlock()
 	if client.State() != api.ClientStateDown {
+		prev := client.State()
 		client.SetState(api.ClientStateDown)
 		rs.update(client)
+		rs.events.Publish(common.NewStateChangedEvent(client, prev))
 		rs.logger.Info("client %s (%s) down", client.ClientId(), client.ServiceId())
 	}
 }
 func (rs *inMemRegistry) remove(client api.Client) {
 	rs.Lock()
 	defer rs.Unlock()
+	if rs.clients.Get(client.ClientId()) == nil {
+		return // already removed
+	}
 	rs.logger.Info("removing client %s (%s)", client.ClientId(), client.ServiceId())
+	prev := client.State()
+	client.SetState(api.ClientStateRemoved)
 	defer rs.update(client)
+	defer rs.events.Publish(common.NewClientLeftEvent(client, prev))
+	defer rs.events.Publish(common.NewStateChangedEvent(client, prev))
 	rs.clients.Delete(client.ClientId())
 	for _, t := range rs.tenants.List() {
 		c := t.Get(client.ClientId())
 		if c != nil {
 			t.Delete(client.ClientId())
+			if len(t.Clients()) == 0 {
+				rs.tenants.Delete(t.Name())
+				rs.scheduler.remove(t.Name())
+			}
 			return
 		}
 	}
@@ -0,0 +1,61 @@
+package inmem
+
+import (
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/backend/registrytest"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"testing"
+	"time"
+)
+
+func TestConformance(t *testing.T) {
+	registrytest.Run(t, func(t *testing.T, cfg *config.AppConfig, clock common.Clock) registrytest.Subject {
+		rs := newInMemRegistry(cfg, clock, snapshotOptions{}).(*inMemRegistry)
+		t.Cleanup(func() {
+			_ = rs.Close()
+		})
+		return registrytest.Subject{
+			Registry: rs,
+			Check: func(now time.Time) {
+				rs.check(cfg, now)
+			},
+		}
+	})
+}
+func TestTenantScheduler(t *testing.T) {
+	cfg := registrytest.Config()
+	clock := common.NewManualClock(time.Now())
+	rs := newInMemRegistry(cfg, clock, snapshotOptions{}).(*inMemRegistry)
+	defer func() {
+		_ = rs.Close()
+	}()
+	failing := make(chan string, 1)
+	defer rs.Subscribe(func(event api.Event) {
+		if event.State == api.ClientStateFailing {
+			failing <- event.ClientId
+		}
+	})()
+	resp, err := rs.Join(registrytest.Tenant("tenant"), api.JoinRequest{ServiceId: "SVC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(3 * time.Second)
+	select {
+	case id := <-failing:
+		if id != resp.ClientId {
+			t.Errorf("expected client %s to be failing, got %s", resp.ClientId, id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected tenant scheduler to mark client failing")
+	}
+	if err = rs.Leave(registrytest.Tenant("tenant"), resp.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	if n := rs.scheduler.size(); n != 0 {
+		t.Errorf("expected scheduler of emptied tenant to be stopped, got %d running", n)
+	}
+	if len(rs.ListAll()) != 0 {
+		t.Errorf("expected emptied tenant to be removed")
+	}
+}
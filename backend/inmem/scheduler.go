@@ -0,0 +1,68 @@
+package inmem
+
+import (
+	"context"
+	"github.com/slink-go/disco/backend/common"
+	"sync"
+	"time"
+)
+
+// scheduler runs failure detection of every tenant in its own goroutine,
+// started once tenant appears in registry and stopped once it is emptied
+// or scheduler context is done
+type scheduler struct {
+	sync.Mutex
+	ctx      context.Context
+	clock    common.Clock
+	interval time.Duration
+	check    func(tenant string, now time.Time)
+	tenants  map[string]context.CancelFunc
+}
+
+func newScheduler(ctx context.Context, clock common.Clock, interval time.Duration, check func(tenant string, now time.Time)) *scheduler {
+	return &scheduler{
+		ctx:      ctx,
+		clock:    clock,
+		interval: interval,
+		check:    check,
+		tenants:  make(map[string]context.CancelFunc),
+	}
+}
+
+func (s *scheduler) add(tenant string) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.tenants[tenant]; ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.tenants[tenant] = cancel
+	// first timer is set before add returns, so time advanced right after
+	// tenant is created is not missed
+	go s.run(ctx, tenant, s.clock.After(s.interval))
+}
+func (s *scheduler) remove(tenant string) {
+	s.Lock()
+	defer s.Unlock()
+	if cancel, ok := s.tenants[tenant]; ok {
+		cancel()
+		delete(s.tenants, tenant)
+	}
+}
+func (s *scheduler) size() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.tenants)
+}
+func (s *scheduler) run(ctx context.Context, tenant string, timer <-chan time.Time) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer:
+		}
+		// clock may be advanced while check was pending, so use its current time
+		s.check(tenant, s.clock.Now())
+		timer = s.clock.After(s.interval)
+	}
+}
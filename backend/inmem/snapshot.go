@@ -0,0 +1,184 @@
+package inmem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/backend/inmem/store"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// region - options
+
+type snapshotOptions struct {
+	file     string
+	interval time.Duration
+}
+
+func loadSnapshotOptions() snapshotOptions {
+	return snapshotOptions{
+		file:     config.ReadString("DISCO_SNAPSHOT_FILE"),
+		interval: config.ReadDurationOrDefault("DISCO_SNAPSHOT_INTERVAL", 30*time.Second),
+	}
+}
+
+// endregion
+// region - snapshot
+
+type snapshot struct {
+	Time    time.Time        `json:"time"`
+	Clients []snapshotClient `json:"clients"`
+}
+type snapshotClient struct {
+	ClientId    string          `json:"id"`
+	ServiceId   string          `json:"service"`
+	Tenant      string          `json:"tenant"`
+	Endpoints   []string        `json:"endpoints,omitempty"`
+	Meta        map[string]any  `json:"meta,omitempty"`
+	State       api.ClientState `json:"state"`
+	Maintenance bool            `json:"maintenance,omitempty"`
+	Load        int             `json:"load,omitempty"`
+	Capacity    int             `json:"capacity,omitempty"`
+	LastSeen    time.Time       `json:"last_seen"`
+}
+
+// saveSnapshot writes registry clients to file; file is replaced atomically,
+// so a crash during write does not corrupt previous snapshot
+func (rs *inMemRegistry) saveSnapshot(file string) error {
+	rs.RLock()
+	s := snapshot{
+		Time:    rs.clock.Now(),
+		Clients: make([]snapshotClient, 0, rs.clients.Size()),
+	}
+	for _, c := range rs.clients.List() {
+		var endpoints []string
+		for _, e := range c.Endpoints() {
+			endpoints = append(endpoints, e.Url())
+		}
+		load, capacity := c.Load()
+		s.Clients = append(s.Clients, snapshotClient{
+			ClientId:    c.ClientId(),
+			ServiceId:   c.ServiceId(),
+			Tenant:      c.Tenant(),
+			Endpoints:   endpoints,
+			Meta:        c.Meta(),
+			State:       c.State(),
+			Maintenance: c.Maintenance(),
+			Load:        load,
+			Capacity:    capacity,
+			LastSeen:    c.LastSeen(),
+		})
+	}
+	rs.RUnlock()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// restoreSnapshot loads clients saved before restart. Restored clients keep
+// their ClientId and state, but get a grace period: their last seen time is
+// set to restore time, so they have full thresholds to ping restarted disco
+// before they are marked failing. All of them are dirty, so they re-fetch
+// registry on first ping.
+func (rs *inMemRegistry) restoreSnapshot(file string) (int, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	var s snapshot
+	if err = json.Unmarshal(data, &s); err != nil {
+		return 0, err
+	}
+	rs.Lock()
+	defer rs.Unlock()
+	now := rs.clock.Now()
+	restored := 0
+	for _, v := range s.Clients {
+		if v.State == api.ClientStateRemoved || rs.clients.Get(v.ClientId) != nil {
+			continue
+		}
+		if rs.clients.Size() >= rs.maxClients {
+			return restored, api.NewMaxClientsReachedError(rs.maxClients)
+		}
+		c, err := common.RestoreClient(rs.clock, v.ClientId, v.ServiceId, v.Tenant, v.Endpoints, v.Meta, v.State, now)
+		if err != nil {
+			rs.logger.Warning("could not restore client %s: %s", v.ClientId, err.Error())
+			continue
+		}
+		c.SetMaintenance(v.Maintenance)
+		c.SetLoad(v.Load, v.Capacity)
+		c.SetDirty(true)
+		rs.clients.Set(c.ClientId(), c)
+		if rs.tenants.Get(c.Tenant()) == nil {
+			rs.tenants.Set(c.Tenant(), store.CreateTenant(c.Tenant()))
+			rs.scheduler.add(c.Tenant())
+		}
+		rs.tenants.Get(c.Tenant()).Set(c.ClientId(), c)
+		restored++
+	}
+	return restored, nil
+}
+
+// runSnapshots restores snapshot and saves registry periodically until ctx
+// is done; final snapshot is saved on the way out, so clients seen since
+// last tick survive a graceful restart. Non-positive interval disables
+// periodic saves, registry is saved on shutdown only.
+func (rs *inMemRegistry) runSnapshots(ctx context.Context, opts snapshotOptions) {
+	if opts.file == "" {
+		return
+	}
+	restored, err := rs.restoreSnapshot(opts.file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		rs.logger.Warning("could not restore snapshot %s: %s", opts.file, err.Error())
+	} else if restored > 0 {
+		rs.logger.Info("restored %d clients from snapshot %s", restored, opts.file)
+	}
+	rs.snapshots.Add(1)
+	go func() {
+		defer rs.snapshots.Done()
+		var tick <-chan time.Time
+		if opts.interval > 0 {
+			ticker := time.NewTicker(opts.interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				rs.snapshot(opts.file)
+				return
+			case <-tick:
+				rs.snapshot(opts.file)
+			}
+		}
+	}()
+}
+func (rs *inMemRegistry) snapshot(file string) {
+	if err := rs.saveSnapshot(file); err != nil {
+		rs.logger.Warning("could not save snapshot %s: %s", file, err.Error())
+	}
+}
+
+// endregion
@@ -0,0 +1,97 @@
+package inmem
+
+import (
+	"context"
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testConfig() *config.AppConfig {
+	return &config.AppConfig{
+		PingDuration:     time.Second,
+		FailingThreshold: 2,
+		DownThreshold:    4,
+		RemoveThreshold:  8,
+		MaxClients:       4,
+		RejoinKey:        "test-rejoin-key",
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "disco.json")
+	ctx := context.WithValue(context.Background(), api.TenantKey, "tenant")
+
+	rs := newInMemRegistry(testConfig(), common.SystemClock, snapshotOptions{}).(*inMemRegistry)
+	t.Cleanup(func() {
+		_ = rs.Close()
+	})
+	resp, err := rs.Join(ctx, api.JoinRequest{ServiceId: "SVC", Endpoints: []string{"http://localhost:8080"}, Meta: map[string]any{"zone": "eu-1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rs.Ping(ctx, resp.ClientId, api.Ping{Load: 3, Capacity: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err = rs.saveSnapshot(file); err != nil {
+		t.Fatal(err)
+	}
+
+	// "restarted" registry
+	restarted := newInMemRegistry(testConfig(), common.SystemClock, snapshotOptions{file: file, interval: time.Hour}).(*inMemRegistry)
+	t.Cleanup(func() {
+		_ = restarted.Close()
+	})
+	list := restarted.List(ctx)
+	if len(list) != 1 {
+		t.Fatalf("expected restored client, got %v", list)
+	}
+	c := list[0]
+	if c.ClientId() != resp.ClientId || c.State() != api.ClientStateUp || c.Meta()["zone"] != "eu-1" || c.Endpoints()[0].Url() != "http://localhost:8080" {
+		t.Errorf("unexpected restored client: %v", c)
+	}
+	if load, capacity := c.Load(); load != 3 || capacity != 10 {
+		t.Errorf("expected restored load 3/10, got %d/%d", load, capacity)
+	}
+	if time.Since(c.LastSeen()) > time.Second {
+		t.Errorf("expected restored client to get grace period")
+	}
+
+	pong, err := restarted.Ping(ctx, resp.ClientId, api.Ping{})
+	if err != nil {
+		t.Fatalf("expected old client id to keep working: %v", err)
+	}
+	if pong.Response != api.PongTypeChanged {
+		t.Errorf("expected CHANGED on first ping after restore, got %s", pong.Response)
+	}
+	if len(restarted.List(context.WithValue(context.Background(), api.TenantKey, "other"))) != 0 {
+		t.Errorf("expected tenant isolation after restore")
+	}
+}
+func TestSnapshotSavedOnClose(t *testing.T) {
+	// zero interval disables periodic saves, but not the final one
+	for _, interval := range []time.Duration{time.Hour, 0} {
+		file := filepath.Join(t.TempDir(), "disco.json")
+		ctx := context.WithValue(context.Background(), api.TenantKey, "tenant")
+
+		rs := newInMemRegistry(testConfig(), common.SystemClock, snapshotOptions{file: file, interval: interval}).(*inMemRegistry)
+		resp, err := rs.Join(ctx, api.JoinRequest{ServiceId: "SVC", Endpoints: []string{"http://localhost:8080"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = rs.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		restarted := newInMemRegistry(testConfig(), common.SystemClock, snapshotOptions{file: file, interval: interval}).(*inMemRegistry)
+		t.Cleanup(func() {
+			_ = restarted.Close()
+		})
+		if list := restarted.List(ctx); len(list) != 1 || list[0].ClientId() != resp.ClientId {
+			t.Fatalf("interval %s: expected client saved on close to be restored, got %v", interval, list)
+		}
+	}
+}
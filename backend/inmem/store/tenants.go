@@ -63,6 +63,11 @@ func (t *TenantsSync) Set(key string, value api.Tenant) {
 	t.tenants[key] = value
 	t.Unlock()
 }
+func (t *TenantsSync) Delete(key string) {
+	t.Lock()
+	delete(t.tenants, key)
+	t.Unlock()
+}
 func (t *TenantsSync) List() []api.Tenant {
 	t.Lock()
 	var result []api.Tenant
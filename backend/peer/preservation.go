@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/slink-go/logging"
+	"sync"
+	"time"
+)
+
+// selfPreservation counts client renewals (local and replicated pings) per
+// window and compares the count of the last complete window with expected
+// one: if node gets less than threshold part of expected renewals, most
+// likely it is network partition, so clients should not be evicted.
+type selfPreservation struct {
+	sync.Mutex
+	enabled      bool
+	threshold    float64
+	window       time.Duration
+	pingInterval time.Duration
+	windowStart  time.Time
+	current      int
+	last         int
+	complete     bool
+	activated    bool
+	logger       logging.Logger
+}
+
+func newSelfPreservation(enabled bool, threshold float64, window, pingInterval time.Duration, start time.Time) *selfPreservation {
+	return &selfPreservation{
+		enabled:      enabled,
+		threshold:    threshold,
+		window:       window,
+		pingInterval: pingInterval,
+		windowStart:  start,
+		logger:       logging.GetLogger("self-preservation"),
+	}
+}
+
+func (sp *selfPreservation) renew(now time.Time) {
+	sp.Lock()
+	defer sp.Unlock()
+	sp.roll(now)
+	sp.current++
+}
+
+// active reports whether eviction should be suspended for given clients count
+func (sp *selfPreservation) active(clients int, now time.Time) bool {
+	sp.Lock()
+	defer sp.Unlock()
+	sp.roll(now)
+	if !sp.enabled || !sp.complete || clients == 0 || sp.pingInterval <= 0 {
+		return false
+	}
+	expected := float64(clients) * float64(sp.window) / float64(sp.pingInterval)
+	active := float64(sp.last) < expected*sp.threshold
+	if active != sp.activated {
+		sp.activated = active
+		if active {
+			sp.logger.Warning("renewals (%d) are lower than expected (%.0f); client eviction suspended", sp.last, expected)
+		} else {
+			sp.logger.Info("renewals are back to normal; client eviction resumed")
+		}
+	}
+	return active
+}
+
+func (sp *selfPreservation) roll(now time.Time) {
+	elapsed := now.Sub(sp.windowStart)
+	if elapsed < sp.window {
+		return
+	}
+	if elapsed < 2*sp.window {
+		sp.last = sp.current
+	} else {
+		sp.last = 0 // no renewals for the whole previous window
+	}
+	sp.current = 0
+	sp.complete = true
+	sp.windowStart = now
+}
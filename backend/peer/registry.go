@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/backend/inmem/store"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"github.com/slink-go/logging"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var Backend peerBackendInitializer
+
+type peerBackendInitializer struct{}
+
+func (bi *peerBackendInitializer) Init(cfg *config.AppConfig) api.Registry {
+	opts, err := loadOptions(cfg)
+	if err != nil {
+		panic(err)
+	}
+	registry := newPeerRegistry(cfg, common.SystemClock, opts)
+	go func() {
+		registry.logger.Info("peer replication started on %s", opts.bind)
+		if err := http.ListenAndServe(opts.bind, registry.handler()); err != nil {
+			panic(err)
+		}
+	}()
+	ctx := context.Background()
+	registry.run(ctx)
+	go registry.sync(ctx)
+	return registry
+}
+
+// region - options
+
+type options struct {
+	bind                 string
+	peers                []string
+	secret               string
+	selfPreservation     bool
+	renewalThreshold     float64
+	renewalWindow        time.Duration
+	replicationInterval  time.Duration
+	replicationQueueSize int
+}
+
+func loadOptions(cfg *config.AppConfig) (*options, error) {
+	opts := options{
+		bind:                 config.ReadStringOrDefault("DISCO_PEER_BIND", ":7001"),
+		secret:               config.ReadStringOrDefault("DISCO_PEER_SECRET", cfg.SecretKey),
+		selfPreservation:     config.ReadBooleanOrDefault("DISCO_PEER_SELF_PRESERVATION", true),
+		renewalWindow:        config.ReadDurationOrDefault("DISCO_PEER_RENEWAL_WINDOW", time.Minute),
+		replicationInterval:  config.ReadDurationOrDefault("DISCO_PEER_REPLICATION_INTERVAL", 500*time.Millisecond),
+		replicationQueueSize: config.ReadIntOrDefault("DISCO_PEER_REPLICATION_QUEUE", 4096),
+	}
+	threshold, err := strconv.ParseFloat(config.ReadStringOrDefault("DISCO_PEER_RENEWAL_THRESHOLD", "0.85"), 64)
+	if err != nil || threshold < 0 || threshold > 1 {
+		return nil, fmt.Errorf("invalid renewal threshold (DISCO_PEER_RENEWAL_THRESHOLD): expected value in [0, 1]")
+	}
+	opts.renewalThreshold = threshold
+	for _, p := range strings.Split(config.ReadString("DISCO_PEERS"), ",") {
+		if p = strings.TrimSuffix(strings.TrimSpace(p), "/"); p != "" {
+			opts.peers = append(opts.peers, p)
+		}
+	}
+	if len(opts.peers) == 0 {
+		return nil, errors.New("no peers configured (DISCO_PEERS)")
+	}
+	if opts.secret == "" {
+		return nil, errors.New("peer secret not set (DISCO_PEER_SECRET or DISCO_SECRET_KEY)")
+	}
+	return &opts, nil
+}
+
+// endregion
+// region - record
+
+type record struct {
+	ClientId    string          `json:"id"`
+	ServiceId   string          `json:"service"`
+	Tenant      string          `json:"tenant"`
+	Endpoints   []string        `json:"endpoints,omitempty"`
+	Meta        map[string]any  `json:"meta,omitempty"`
+	State       api.ClientState `json:"state"`
+	Maintenance bool            `json:"maintenance,omitempty"`
+	LastSeen    time.Time       `json:"last_seen"`
+	Load        int             `json:"load,omitempty"`
+	Capacity    int             `json:"capacity,omitempty"`
+	Dirty       bool            `json:"-"`
+}
+
+func newRecord(c api.Client) *record {
+	return &record{
+		ClientId:  c.ClientId(),
+		ServiceId: c.ServiceId(),
+		Tenant:    c.Tenant(),
+		Endpoints: endpointUrls(c.Endpoints()),
+		Meta:      c.Meta(),
+		State:     c.State(),
+		LastSeen:  c.LastSeen(),
+		Dirty:     true,
+	}
+}
+func (r *record) client(clock common.Clock) (api.Client, error) {
+	c, err := common.RestoreClient(clock, r.ClientId, r.ServiceId, r.Tenant, r.Endpoints, r.Meta, r.State, r.LastSeen)
+	if err != nil {
+		return nil, err
+	}
+	c.SetLoad(r.Load, r.Capacity)
+	c.SetMaintenance(r.Maintenance)
+	return c, nil
+}
+
+// endregion
+// region - registry
+
+// peerRegistry is Eureka-like peer-to-peer registry: every node accepts
+// registrations and asynchronously replicates them to configured peers;
+// conflicting replicas are resolved by client's last seen time. Failure
+// detection is local to every node, and client eviction is suspended while
+// node gets too few renewals (self-preservation), as it most likely means
+// network partition rather than mass client failure.
+type peerRegistry struct {
+	sync.RWMutex
+	clients          map[string]*record
+	pingInterval     api.Duration
+	maxClients       int
+	quota            func(tenant string) config.Quota
+	failingThreshold time.Duration
+	downThreshold    time.Duration
+	removeThreshold  time.Duration
+	rejoinKey        []byte
+	secret           string
+	opts             *options
+	peers            []*peer
+	preservation     *selfPreservation
+	events           *common.EventBus
+	clock            common.Clock
+	logger           logging.Logger
+}
+
+func newPeerRegistry(cfg *config.AppConfig, clock common.Clock, opts *options) *peerRegistry {
+	registry := peerRegistry{
+		clients:          make(map[string]*record),
+		pingInterval:     api.Duration{Duration: cfg.PingDuration},
+		maxClients:       cfg.MaxClients,
+		quota:            cfg.Quota,
+		failingThreshold: time.Duration(cfg.FailingThreshold) * cfg.PingDuration,
+		downThreshold:    time.Duration(cfg.DownThreshold) * cfg.PingDuration,
+		removeThreshold:  time.Duration(cfg.RemoveThreshold) * cfg.PingDuration,
+		rejoinKey:        common.NewRejoinKey(cfg.RejoinKey),
+		secret:           opts.secret,
+		opts:             opts,
+		preservation:     newSelfPreservation(opts.selfPreservation, opts.renewalThreshold, opts.renewalWindow, cfg.PingDuration, clock.Now()),
+		events:           common.NewEventBus(common.DefaultEventLogCapacity),
+		clock:            clock,
+		logger:           logging.GetLogger("reg-peer"),
+	}
+	if cfg.RejoinKey == "" {
+		registry.logger.Warning("rejoin key not set; rejoin tokens will not be accepted by peers")
+	}
+	for _, p := range opts.peers {
+		registry.addPeer(p)
+	}
+	return &registry
+}
+
+func (rs *peerRegistry) Join(ctx context.Context, request api.JoinRequest) (*api.JoinResponse, error) {
+	rs.logger.Debug("[registry][join] client join")
+	tnt := ctx.Value(api.TenantKey).(string)
+	c, err := common.NewClient(rs.clock, rs.createClientId(), request.ServiceId, tnt, request.Endpoints, request.Meta)
+	if err != nil {
+		return nil, err
+	}
+	r, err := rs.register(c)
+	if err != nil {
+		return nil, err
+	}
+	rs.logger.Debug("[registry][join] client %s joined", c.ClientId())
+	return rs.joinResponse(r), nil
+}
+func (rs *peerRegistry) Rejoin(ctx context.Context, request api.RejoinRequest) (*api.JoinResponse, error) {
+	rs.logger.Debug("[registry][rejoin] client %s rejoin", request.ClientId)
+	tnt := ctx.Value(api.TenantKey).(string)
+	if !common.ValidRejoinToken(rs.rejoinKey, tnt, request.ClientId, request.Token) {
+		return nil, api.NewInvalidRejoinTokenError(request.ClientId)
+	}
+
+	rs.Lock()
+	// client is still registered (e.g. ping was lost); nothing to restore
+	if r := rs.clients[request.ClientId]; r != nil {
+		if r.Tenant != tnt {
+			rs.Unlock()
+			return nil, api.NewInvalidRejoinTokenError(request.ClientId)
+		}
+		rs.up(r, rs.clock.Now(), api.Ping{})
+		rp := newReplica(opHeartbeat, r)
+		rs.Unlock()
+		rs.replicate(rp)
+		return rs.joinResponse(r), nil
+	}
+	rs.Unlock()
+
+	c, err := common.NewClient(rs.clock, request.ClientId, request.ServiceId, tnt, request.Endpoints, request.Meta)
+	if err != nil {
+		return nil, err
+	}
+	r, err := rs.register(c)
+	if err != nil {
+		return nil, err
+	}
+	rs.logger.Debug("[registry][rejoin] client %s rejoined", c.ClientId())
+	return rs.joinResponse(r), nil
+}
+func (rs *peerRegistry) Leave(ctx context.Context, clientId string) error {
+	rs.Lock()
+	r := rs.clients[clientId]
+	if r == nil {
+		rs.Unlock()
+		return api.NewClientNotFoundError(clientId)
+	}
+	if !common.Authorized(ctx, r.Tenant) {
+		rs.Unlock()
+		return api.NewTenantsClientNotFoundError(clientId)
+	}
+	rs.logger.Debug("[registry][leave] remove client %s", clientId)
+	rs.remove(r)
+	rp := newReplica(opCancel, r)
+	rs.Unlock()
+	rs.replicate(rp)
+	return nil
+}
+func (rs *peerRegistry) List(ctx context.Context) []api.Client {
+	if ctx.Value(api.TenantKey) == nil || ctx.Value(api.TenantKey) == "" {
+		rs.logger.Warning("no tenant context set; return empty list")
+		return make([]api.Client, 0)
+	}
+	tenant := ctx.Value(api.TenantKey).(string)
+	clients := rs.list(func(r *record) bool {
+		return tenant == api.TenantDefault || r.Tenant == tenant
+	})
+	rs.logger.Debug("[registry][list] list for %v (%d)", tenant, len(clients))
+	sort.Slice(clients, func(a, b int) bool {
+		if clients[a].ServiceId() != clients[b].ServiceId() {
+			return clients[a].ServiceId() < clients[b].ServiceId()
+		} else {
+			return clients[a].ClientId() < clients[b].ClientId()
+		}
+	})
+	return clients
+}
+func (rs *peerRegistry) ListAll() []api.Tenant {
+	tenants := make(map[string]api.Tenant)
+	for _, c := range rs.list(func(r *record) bool { return true }) {
+		if tenants[c.Tenant()] == nil {
+			tenants[c.Tenant()] = store.CreateTenant(c.Tenant())
+		}
+		tenants[c.Tenant()].Set(c.ClientId(), c)
+	}
+	var result []api.Tenant
+	for _, t := range tenants {
+		result = append(result, t)
+	}
+	return result
+}
+func (rs *peerRegistry) Ping(ctx context.Context, clientId string, ping api.Ping) (api.Pong, error) {
+	rs.Lock()
+	r := rs.clients[clientId]
+	if r == nil {
+		rs.Unlock()
+		return api.Pong{}, api.NewClientNotFoundError(clientId)
+	}
+	if !common.Authorized(ctx, r.Tenant) {
+		rs.Unlock()
+		return api.Pong{}, api.NewTenantsClientNotFoundError(clientId)
+	}
+	if err := rs.updateMeta(r, ping.Meta); err != nil {
+		rs.Unlock()
+		return api.Pong{}, err
+	}
+	rs.up(r, rs.clock.Now(), ping)
+	response := api.PongTypeOk
+	if r.Dirty {
+		r.Dirty = false
+		response = api.PongTypeChanged
+	}
+	rp := newReplica(opHeartbeat, r)
+	rs.Unlock()
+	rs.preservation.renew(rs.clock.Now())
+	rs.replicate(rp)
+	rs.logger.Debug("[registry][ping] client '%s' ping: '%s'", clientId, response)
+	return api.Pong{
+		Response: response,
+	}, nil
+}
+func (rs *peerRegistry) MarkAlive(ctx context.Context, clientId string) error {
+	rs.Lock()
+	r := rs.clients[clientId]
+	if r == nil {
+		rs.Unlock()
+		return api.NewClientNotFoundError(clientId)
+	}
+	if !common.Authorized(ctx, r.Tenant) {
+		rs.Unlock()
+		return api.NewTenantsClientNotFoundError(clientId)
+	}
+	r.LastSeen = rs.clock.Now()
+	if state := common.AliveState(r.State, r.Maintenance); r.State != state {
+		rs.transition(r, state)
+	}
+	rp := newReplica(opHeartbeat, r)
+	rs.Unlock()
+	rs.preservation.renew(rs.clock.Now())
+	rs.replicate(rp)
+	rs.logger.Debug("[registry][alive] client '%s' is alive", clientId)
+	return nil
+}
+func (rs *peerRegistry) SetMaintenance(clientId string, enabled bool) error {
+	rs.Lock()
+	r := rs.clients[clientId]
+	if r == nil {
+		rs.Unlock()
+		return api.NewClientNotFoundError(clientId)
+	}
+	rs.maintenance(r, enabled)
+	rp := newReplica(opMaintenance, r)
+	rs.Unlock()
+	rs.replicate(rp)
+	rs.logger.Info("client %s (%s) maintenance: %v", clientId, r.ServiceId, enabled)
+	return nil
+}
+func (rs *peerRegistry) UpdateMeta(ctx context.Context, clientId string, delta map[string]any) error {
+	rs.Lock()
+	r := rs.clients[clientId]
+	if r == nil {
+		rs.Unlock()
+		return api.NewClientNotFoundError(clientId)
+	}
+	if !common.Authorized(ctx, r.Tenant) {
+		rs.Unlock()
+		return api.NewTenantsClientNotFoundError(clientId)
+	}
+	if err := rs.updateMeta(r, delta); err != nil {
+		rs.Unlock()
+		return err
+	}
+	rp := newReplica(opMeta, r)
+	rs.Unlock()
+	rs.replicate(rp)
+	return nil
+}
+func (rs *peerRegistry) Watch(ctx context.Context, revision uint64) (*api.WatchResponse, error) {
+	tenant, _ := ctx.Value(api.TenantKey).(string)
+	if tenant == "" {
+		rs.logger.Warning("no tenant context set; return empty watch response")
+		return &api.WatchResponse{Revision: rs.events.Revision(), Events: []api.Event{}}, nil
+	}
+	return rs.events.Wait(ctx, tenant, revision)
+}
+func (rs *peerRegistry) Subscribe(handler api.EventHandler) func() {
+	return rs.events.Subscribe(handler)
+}
+
+// endregion
+// region - state
+
+func (rs *peerRegistry) register(c api.Client) (*record, error) {
+	rs.Lock()
+	if len(rs.clients) >= rs.maxClients {
+		rs.Unlock()
+		return nil, api.NewMaxClientsReachedError(rs.maxClients)
+	}
+	r := newRecord(c)
+	if rs.clients[r.ClientId] != nil || rs.has(r) {
+		rs.Unlock()
+		return nil, api.NewAlreadyRegisteredError()
+	}
+	if err := rs.checkQuota(r); err != nil {
+		rs.Unlock()
+		return nil, err
+	}
+	rs.add(r)
+	rp := newReplica(opRegister, r)
+	rs.Unlock()
+	rs.replicate(rp)
+	return r, nil
+}
+func (rs *peerRegistry) add(r *record) {
+	r.Dirty = true
+	rs.clients[r.ClientId] = r
+	rs.update(r.Tenant)
+	rs.publish(r, common.NewClientJoinedEvent)
+}
+func (rs *peerRegistry) remove(r *record) {
+	rs.logger.Info("removing client %s (%s)", r.ClientId, r.ServiceId)
+	prev := r.State
+	r.State = api.ClientStateRemoved
+	delete(rs.clients, r.ClientId)
+	rs.publish(r, func(c api.Client) api.Event {
+		return common.NewStateChangedEvent(c, prev)
+	})
+	rs.publish(r, func(c api.Client) api.Event {
+		return common.NewClientLeftEvent(c, prev)
+	})
+	rs.update(r.Tenant)
+}
+func (rs *peerRegistry) up(r *record, seen time.Time, ping api.Ping) {
+	r.LastSeen = seen
+	r.Load, r.Capacity = ping.Load, ping.Capacity
+	if state := common.PingState(ping, r.Maintenance); r.State != state {
+		rs.transition(r, state)
+	}
+}
+func (rs *peerRegistry) updateMeta(r *record, delta map[string]any) error {
+	if len(delta) == 0 {
+		return nil
+	}
+	meta := common.MergeMeta(r.Meta, delta)
+	if err := common.CheckMetaSize(rs.quota(r.Tenant), meta); err != nil {
+		return err
+	}
+	rs.setMeta(r, meta)
+	return nil
+}
+func (rs *peerRegistry) setMeta(r *record, meta map[string]any) {
+	if reflect.DeepEqual(r.Meta, meta) {
+		return
+	}
+	r.Meta = meta
+	rs.update(r.Tenant)
+	rs.publish(r, common.NewMetaUpdatedEvent)
+	rs.logger.Debug("[registry][meta] client %s meta updated", r.ClientId)
+}
+func (rs *peerRegistry) maintenance(r *record, enabled bool) {
+	r.Maintenance = enabled
+	if state := common.MaintenanceState(r.State, enabled); r.State != state {
+		rs.transition(r, state)
+	}
+}
+func (rs *peerRegistry) transition(r *record, state api.ClientState) {
+	prev := r.State
+	r.State = state
+	rs.update(r.Tenant)
+	rs.publish(r, func(c api.Client) api.Event {
+		return common.NewStateChangedEvent(c, prev)
+	})
+	rs.logger.Info("client %s (%s) %s", r.ClientId, r.ServiceId, strings.ToLower(state.String()))
+}
+
+// update marks tenant's clients dirty, so they get CHANGED on next ping
+func (rs *peerRegistry) update(tenant string) {
+	for _, r := range rs.clients {
+		if r.Tenant == tenant {
+			r.Dirty = true
+		}
+	}
+}
+func (rs *peerRegistry) checkQuota(client *record) error {
+	var services []string
+	for _, r := range rs.clients {
+		if r.Tenant == client.Tenant {
+			services = append(services, r.ServiceId)
+		}
+	}
+	return common.CheckQuota(rs.quota(client.Tenant), client.Tenant, client.ServiceId, client.Meta, services)
+}
+func (rs *peerRegistry) has(client *record) bool {
+	for _, r := range rs.clients {
+		if r.Tenant == client.Tenant &&
+			r.ServiceId == client.ServiceId &&
+			reflect.DeepEqual(r.Endpoints, client.Endpoints) &&
+			reflect.DeepEqual(r.Meta, client.Meta) {
+			return true
+		}
+	}
+	return false
+}
+func (rs *peerRegistry) publish(r *record, event func(c api.Client) api.Event) {
+	c, err := r.client(rs.clock)
+	if err != nil {
+		rs.logger.Warning("could not publish event for client %s: %s", r.ClientId, err.Error())
+		return
+	}
+	rs.events.Publish(event(c))
+}
+func (rs *peerRegistry) list(filter func(r *record) bool) []api.Client {
+	rs.RLock()
+	defer rs.RUnlock()
+	var result []api.Client
+	for _, r := range rs.clients {
+		if !filter(r) {
+			continue
+		}
+		c, err := r.client(rs.clock)
+		if err != nil {
+			continue
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+// endregion
+// region - runner
+
+func (rs *peerRegistry) run(ctx context.Context) {
+	for _, p := range rs.peers {
+		go p.run(ctx)
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				rs.check(rs.clock.Now())
+			}
+		}
+	}()
+}
+
+// check derives clients' states from last seen time (local or replicated);
+// eviction is skipped while self-preservation is active
+func (rs *peerRegistry) check(now time.Time) {
+	rs.Lock()
+	defer rs.Unlock()
+	preserve := rs.preservation.active(len(rs.clients), now)
+	for _, r := range rs.clients {
+		interval := now.Sub(r.LastSeen)
+		if rs.removeThreshold < interval {
+			if !preserve {
+				rs.remove(r)
+			} else if r.State != api.ClientStateDown {
+				rs.transition(r, api.ClientStateDown)
+			}
+		} else if rs.downThreshold < interval {
+			if r.State != api.ClientStateDown {
+				rs.transition(r, api.ClientStateDown)
+			}
+		} else if rs.failingThreshold < interval {
+			if r.State != api.ClientStateFailing {
+				rs.transition(r, api.ClientStateFailing)
+			}
+		}
+	}
+}
+
+// endregion
+// region - helpers
+
+func (rs *peerRegistry) createClientId() string {
+	u, err := uuid.NewUUID()
+	if err != nil {
+		panic(err)
+	}
+	return u.String()
+}
+func (rs *peerRegistry) joinResponse(r *record) *api.JoinResponse {
+	return &api.JoinResponse{
+		ClientId:     r.ClientId,
+		PingInterval: rs.pingInterval,
+		Token:        common.NewRejoinToken(rs.rejoinKey, r.Tenant, r.ClientId),
+	}
+}
+
+func endpointUrls(endpoints []api.Endpoint) []string {
+	var result []string
+	for _, e := range endpoints {
+		result = append(result, e.Url())
+	}
+	return result
+}
+
+// endregion
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/backend/registrytest"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "test-peer-secret"
+
+func testConfig() *config.AppConfig {
+	return &config.AppConfig{
+		PingDuration:     time.Second,
+		FailingThreshold: 2,
+		DownThreshold:    4,
+		RemoveThreshold:  8,
+		MaxClients:       4,
+		RejoinKey:        "test-rejoin-key",
+	}
+}
+func testOptions(selfPreservation bool) *options {
+	return &options{
+		secret:               testSecret,
+		selfPreservation:     selfPreservation,
+		renewalThreshold:     0.85,
+		renewalWindow:        time.Minute,
+		replicationInterval:  20 * time.Millisecond,
+		replicationQueueSize: 16,
+	}
+}
+
+// startNodes starts in-process nodes, each of them replicating to all others
+func startNodes(t *testing.T, n int) []*peerRegistry {
+	var nodes []*peerRegistry
+	var servers []*httptest.Server
+	for i := 0; i < n; i++ {
+		node := newPeerRegistry(testConfig(), common.SystemClock, testOptions(true))
+		server := httptest.NewServer(node.handler())
+		t.Cleanup(server.Close)
+		nodes = append(nodes, node)
+		servers = append(servers, server)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	for i, node := range nodes {
+		for j, server := range servers {
+			if i != j {
+				go node.addPeer(server.URL).run(ctx)
+			}
+		}
+	}
+	return nodes
+}
+func eventually(t *testing.T, message string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal(message)
+}
+func tenantContext(tenant string) context.Context {
+	return context.WithValue(context.Background(), api.TenantKey, tenant)
+}
+func lastSeen(node *peerRegistry, clientId string) time.Time {
+	node.RLock()
+	defer node.RUnlock()
+	if r := node.clients[clientId]; r != nil {
+		return r.LastSeen
+	}
+	return time.Time{}
+}
+
+func TestReplication(t *testing.T) {
+	nodes := startNodes(t, 3)
+	ctx := tenantContext("tenant")
+
+	resp, err := nodes[0].Join(ctx, api.JoinRequest{ServiceId: "SVC", Endpoints: []string{"http://localhost:8080"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		eventually(t, "join was not replicated", func() bool {
+			return len(n.List(ctx)) == 1
+		})
+		if len(n.List(tenantContext("other"))) != 0 {
+			t.Errorf("expected tenant isolation")
+		}
+	}
+
+	// client fails over to another node
+	pong, err := nodes[1].Ping(ctx, resp.ClientId, api.Ping{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pong.Response != api.PongTypeChanged {
+		t.Errorf("expected CHANGED on first ping, got %s", pong.Response)
+	}
+	seen := lastSeen(nodes[1], resp.ClientId)
+	for _, n := range nodes {
+		eventually(t, "heartbeat was not replicated", func() bool {
+			list := n.List(ctx)
+			return len(list) == 1 && list[0].State() == api.ClientStateUp && lastSeen(n, resp.ClientId).Equal(seen)
+		})
+	}
+
+	if err = nodes[2].Leave(ctx, resp.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		eventually(t, "leave was not replicated", func() bool {
+			return len(n.List(ctx)) == 0
+		})
+	}
+	if _, err = nodes[0].Ping(ctx, resp.ClientId, api.Ping{}); !errors.Is(err, api.NewClientNotFoundError(resp.ClientId)) {
+		t.Errorf("expected client not found, got %v", err)
+	}
+}
+func TestConflictResolution(t *testing.T) {
+	node := newPeerRegistry(testConfig(), common.SystemClock, testOptions(true))
+	now := time.Now()
+	r := record{ClientId: "id", ServiceId: "SVC", Tenant: "tenant", State: api.ClientStateUp, LastSeen: now}
+	node.applyReplica(replica{Op: opRegister, Client: r, Time: now})
+	if len(node.List(tenantContext("tenant"))) != 1 {
+		t.Fatal("expected replicated client to be registered")
+	}
+
+	stale := r
+	stale.LastSeen = now.Add(-time.Second)
+	stale.State = api.ClientStateDown
+	node.applyReplica(replica{Op: opHeartbeat, Client: stale, Time: now})
+	if !lastSeen(node, "id").Equal(now) || node.List(tenantContext("tenant"))[0].State() != api.ClientStateUp {
+		t.Errorf("expected stale replica to be ignored")
+	}
+
+	fresh := r
+	fresh.LastSeen = now.Add(time.Second)
+	node.applyReplica(replica{Op: opHeartbeat, Client: fresh, Time: now})
+	if !lastSeen(node, "id").Equal(fresh.LastSeen) {
+		t.Errorf("expected newer replica to win")
+	}
+
+	// client was seen after leave was issued on another node
+	node.applyReplica(replica{Op: opCancel, Client: r, Time: now})
+	if len(node.List(tenantContext("tenant"))) != 1 {
+		t.Errorf("expected stale cancel to be ignored")
+	}
+	node.applyReplica(replica{Op: opCancel, Client: r, Time: now.Add(2 * time.Second)})
+	if len(node.List(tenantContext("tenant"))) != 0 {
+		t.Errorf("expected cancel to remove client")
+	}
+}
+func TestSelfPreservation(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		node := newPeerRegistry(testConfig(), common.SystemClock, testOptions(enabled))
+		ctx := tenantContext("tenant")
+		resp, err := node.Join(ctx, api.JoinRequest{ServiceId: "SVC"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// no renewals during complete window: looks like network partition
+		start := time.Now()
+		node.check(start.Add(2 * time.Minute))
+		list := node.List(ctx)
+		if enabled {
+			if len(list) != 1 || list[0].State() != api.ClientStateDown {
+				t.Errorf("expected client to be kept (DOWN) under self-preservation: %v", list)
+			}
+			// renewals are back: eviction resumes
+			for i := 0; i < 60; i++ {
+				node.preservation.renew(start.Add(2*time.Minute + time.Duration(i)*time.Second))
+			}
+			node.check(start.Add(3*time.Minute + time.Second))
+			if _, err = node.Ping(ctx, resp.ClientId, api.Ping{}); !errors.Is(err, api.NewClientNotFoundError(resp.ClientId)) {
+				t.Errorf("expected client to be evicted, got %v", err)
+			}
+		} else if len(list) != 0 {
+			t.Errorf("expected client to be evicted without self-preservation")
+		}
+	}
+}
+func TestInitialSync(t *testing.T) {
+	source := newPeerRegistry(testConfig(), common.SystemClock, testOptions(true))
+	server := httptest.NewServer(source.handler())
+	defer server.Close()
+	ctx := tenantContext("tenant")
+	if _, err := source.Join(ctx, api.JoinRequest{ServiceId: "SVC"}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testOptions(true)
+	opts.peers = []string{server.URL}
+	node := newPeerRegistry(testConfig(), common.SystemClock, opts)
+	node.sync(context.Background())
+	if len(node.List(ctx)) != 1 {
+		t.Errorf("expected registry to be synced from peer")
+	}
+}
+func TestPeerAuthorization(t *testing.T) {
+	node := newPeerRegistry(testConfig(), common.SystemClock, testOptions(true))
+	server := httptest.NewServer(node.handler())
+	defer server.Close()
+	req, _ := http.NewRequest(http.MethodPost, server.URL+replicatePath, strings.NewReader("[]"))
+	req.Header.Set("Authorization", "Bearer wrong")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+}
+func TestConformance(t *testing.T) {
+	registrytest.Run(t, func(t *testing.T, cfg *config.AppConfig, clock common.Clock) registrytest.Subject {
+		rs := newPeerRegistry(cfg, clock, testOptions(false))
+		return registrytest.Subject{Registry: rs, Check: rs.check}
+	})
+}
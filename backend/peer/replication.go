@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/logging"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	opRegister    = "register"
+	opHeartbeat   = "heartbeat"
+	opCancel      = "cancel"
+	opMaintenance = "maintenance"
+	opMeta        = "meta"
+)
+
+const (
+	replicatePath      = "/peer/replicate"
+	registryPath       = "/peer/registry"
+	replicationBatch   = 256
+	replicationRetries = 3
+	peerRequestTimeout = 5 * time.Second
+)
+
+// region - replica
+
+// replica is a registry change replicated to peers; it carries full client
+// record, so peer can (re-)create missing client on any of them
+type replica struct {
+	Op     string    `json:"op"`
+	Client record    `json:"client"`
+	Time   time.Time `json:"time"`
+}
+
+func newReplica(op string, r *record) replica {
+	return replica{
+		Op:     op,
+		Client: *r,
+		Time:   time.Now(),
+	}
+}
+
+// applyReplica applies change received from peer; replicated changes are not
+// replicated further. Conflicts are resolved by client's last seen time:
+// replica older than local client state is ignored.
+func (rs *peerRegistry) applyReplica(rp replica) {
+	rs.Lock()
+	defer rs.Unlock()
+	r := rs.clients[rp.Client.ClientId]
+	switch rp.Op {
+	case opRegister, opHeartbeat:
+		if r == nil {
+			if rp.Client.State == api.ClientStateRemoved {
+				return
+			}
+			if len(rs.clients) >= rs.maxClients {
+				rs.logger.Warning("replicated client %s skipped: %s", rp.Client.ClientId, api.NewMaxClientsReachedError(rs.maxClients).Error())
+				return
+			}
+			c := rp.Client
+			rs.add(&c)
+			return
+		}
+		if !rp.Client.LastSeen.After(r.LastSeen) {
+			return // local state is newer
+		}
+		if r.Tenant != rp.Client.Tenant {
+			rs.logger.Warning("replicated client %s tenant mismatch; skipped", rp.Client.ClientId)
+			return
+		}
+		r.LastSeen = rp.Client.LastSeen
+		r.Load, r.Capacity = rp.Client.Load, rp.Client.Capacity
+		r.Maintenance = rp.Client.Maintenance
+		rs.setMeta(r, rp.Client.Meta)
+		if r.State != rp.Client.State {
+			rs.transition(r, rp.Client.State)
+		}
+	case opMaintenance:
+		// admin's override is applied regardless of client's last seen time
+		if r != nil && r.Tenant == rp.Client.Tenant {
+			rs.maintenance(r, rp.Client.Maintenance)
+		}
+	case opMeta:
+		if r != nil && r.Tenant == rp.Client.Tenant {
+			rs.setMeta(r, rp.Client.Meta)
+		}
+	case opCancel:
+		if r == nil {
+			return
+		}
+		if r.LastSeen.After(rp.Time) {
+			return // client was seen after it left (e.g. rejoined)
+		}
+		rs.remove(r)
+	default:
+		rs.logger.Warning("unknown replication op %q", rp.Op)
+	}
+}
+
+// replicate sends change to all peers asynchronously
+func (rs *peerRegistry) replicate(rp replica) {
+	for _, p := range rs.peers {
+		p.enqueue(rp)
+	}
+}
+
+// sync loads full registry from the first available peer on start
+func (rs *peerRegistry) sync(ctx context.Context) {
+	for _, p := range rs.peers {
+		replicas, err := p.fetch(ctx)
+		if err != nil {
+			rs.logger.Warning("could not sync registry from %s: %s", p.url, err.Error())
+			continue
+		}
+		for _, rp := range replicas {
+			rs.applyReplica(rp)
+		}
+		rs.logger.Info("synced %d clients from %s", len(replicas), p.url)
+		return
+	}
+}
+func (rs *peerRegistry) snapshot() []replica {
+	rs.RLock()
+	defer rs.RUnlock()
+	result := make([]replica, 0, len(rs.clients))
+	for _, r := range rs.clients {
+		result = append(result, newReplica(opRegister, r))
+	}
+	return result
+}
+
+// endregion
+// region - handler
+
+func (rs *peerRegistry) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(replicatePath, rs.authorized(rs.handleReplicate))
+	mux.HandleFunc(registryPath, rs.authorized(rs.handleRegistry))
+	return mux
+}
+func (rs *peerRegistry) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(rs.secret)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+func (rs *peerRegistry) handleReplicate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var replicas []replica
+	if err := json.NewDecoder(r.Body).Decode(&replicas); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, rp := range replicas {
+		if rp.Op == opHeartbeat {
+			rs.preservation.renew(rs.clock.Now())
+		}
+		rs.applyReplica(rp)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+func (rs *peerRegistry) handleRegistry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := json.Marshal(rs.snapshot())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(api.ContentTypeHeader, api.ContentTypeApplicationJson)
+	_, _ = w.Write(data)
+}
+
+// endregion
+// region - peer
+
+type peer struct {
+	url      string
+	secret   string
+	interval time.Duration
+	queue    chan replica
+	client   *http.Client
+	logger   logging.Logger
+}
+
+func (rs *peerRegistry) addPeer(url string) *peer {
+	p := &peer{
+		url:      url,
+		secret:   rs.secret,
+		interval: rs.opts.replicationInterval,
+		queue:    make(chan replica, rs.opts.replicationQueueSize),
+		client:   &http.Client{Timeout: peerRequestTimeout},
+		logger:   logging.GetLogger("peer"),
+	}
+	rs.peers = append(rs.peers, p)
+	return p
+}
+
+func (p *peer) enqueue(rp replica) {
+	select {
+	case p.queue <- rp:
+	default:
+		p.logger.Warning("replication queue for %s is full; %s of %s dropped", p.url, rp.Op, rp.Client.ClientId)
+	}
+}
+
+// run sends queued changes to peer in batches; failed batch is retried on
+// next tick, and dropped after several attempts (peer will get client state
+// with next heartbeat or initial sync)
+func (p *peer) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	var batch []replica
+	attempts := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	drain:
+		for len(batch) < replicationBatch {
+			select {
+			case rp := <-p.queue:
+				batch = append(batch, rp)
+			default:
+				break drain
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if err := p.send(ctx, batch); err != nil {
+			attempts++
+			if attempts < replicationRetries {
+				continue
+			}
+			p.logger.Warning("could not replicate %d changes to %s: %s", len(batch), p.url, err.Error())
+		}
+		batch = nil
+		attempts = 0
+	}
+}
+func (p *peer) send(ctx context.Context, batch []replica) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	resp, err := p.request(ctx, http.MethodPost, replicatePath, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return nil
+}
+func (p *peer) fetch(ctx context.Context) ([]replica, error) {
+	resp, err := p.request(ctx, http.MethodGet, registryPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	var replicas []replica
+	if err = json.NewDecoder(resp.Body).Decode(&replicas); err != nil {
+		return nil, err
+	}
+	return replicas, nil
+}
+func (p *peer) request(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, p.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.secret)
+	if body != nil {
+		req.Header.Set(api.ContentTypeHeader, api.ContentTypeApplicationJson)
+	}
+	return p.client.Do(req)
+}
+
+// endregion
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/raft"
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"github.com/slink-go/logging"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// region - commands
+
+const (
+	opJoin         = "join"
+	opRejoin       = "rejoin"
+	opLeave        = "leave"
+	opPing         = "ping"
+	opAlive        = "alive"
+	opState        = "state"
+	opMaintenance  = "maintenance"
+	opMeta         = "meta"
+	opAddMember    = "add_member"
+	opRemoveMember = "remove_member"
+)
+
+// command is a replicated registry change; Time is set by the leader, so
+// every node applies exactly the same change. Seen (if set) makes command
+// conditional: it is applied only if client was not seen since then. Tenant
+// is the caller's tenant for client operations (default tenant may access
+// clients of any tenant).
+type command struct {
+	Op       string          `json:"op"`
+	Time     time.Time       `json:"time"`
+	ClientId string          `json:"client_id,omitempty"`
+	Tenant   string          `json:"tenant,omitempty"`
+	Client   *record         `json:"client,omitempty"`
+	State    api.ClientState `json:"state,omitempty"`
+	Seen     time.Time       `json:"seen,omitempty"`
+	Member   *api.Member     `json:"member,omitempty"`
+	Ping     *api.Ping       `json:"ping,omitempty"`
+	Enabled  bool            `json:"enabled,omitempty"`
+	Meta     map[string]any  `json:"meta,omitempty"`
+}
+
+type result struct {
+	Response api.PongType `json:"response,omitempty"`
+	Client   *record      `json:"client,omitempty"`
+	Code     string       `json:"code,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	err      error
+}
+
+// endregion
+// region - record
+
+type record struct {
+	ClientId    string          `json:"id"`
+	ServiceId   string          `json:"service"`
+	Tenant      string          `json:"tenant"`
+	Endpoints   []string        `json:"endpoints,omitempty"`
+	Meta        map[string]any  `json:"meta,omitempty"`
+	State       api.ClientState `json:"state"`
+	Maintenance bool            `json:"maintenance,omitempty"`
+	LastSeen    time.Time       `json:"last_seen"`
+	Load        int             `json:"load,omitempty"`
+	Capacity    int             `json:"capacity,omitempty"`
+	Dirty       bool            `json:"dirty"`
+}
+
+func newRecord(c api.Client) *record {
+	return &record{
+		ClientId:  c.ClientId(),
+		ServiceId: c.ServiceId(),
+		Tenant:    c.Tenant(),
+		Endpoints: endpointUrls(c.Endpoints()),
+		Meta:      c.Meta(),
+		State:     c.State(),
+		Dirty:     true,
+	}
+}
+func (r *record) client(clock common.Clock) (api.Client, error) {
+	c, err := common.RestoreClient(clock, r.ClientId, r.ServiceId, r.Tenant, r.Endpoints, r.Meta, r.State, r.LastSeen)
+	if err != nil {
+		return nil, err
+	}
+	c.SetLoad(r.Load, r.Capacity)
+	c.SetMaintenance(r.Maintenance)
+	return c, nil
+}
+
+// endregion
+// region - fsm
+
+// fsm is the replicated registry state machine; it is changed by commands
+// from raft log only, and publishes registry events on every node
+type fsm struct {
+	sync.RWMutex
+	clients    map[string]*record
+	maxClients int
+	quota      func(tenant string) config.Quota
+	clock      common.Clock
+	events     *common.EventBus
+	logger     logging.Logger
+}
+
+func newFsm(clock common.Clock, maxClients int, quota func(tenant string) config.Quota, events *common.EventBus) *fsm {
+	return &fsm{
+		clients:    make(map[string]*record),
+		maxClients: maxClients,
+		quota:      quota,
+		clock:      clock,
+		events:     events,
+		logger:     logging.GetLogger("raft-fsm"),
+	}
+}
+
+func (f *fsm) Apply(l *raft.Log) any {
+	var cmd command
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		f.logger.Warning("could not unmarshal command: %s", err.Error())
+		return &result{err: err}
+	}
+	f.Lock()
+	defer f.Unlock()
+	switch cmd.Op {
+	case opJoin:
+		return f.join(cmd)
+	case opRejoin:
+		return f.rejoin(cmd)
+	case opLeave:
+		return f.leave(cmd)
+	case opPing:
+		return f.ping(cmd)
+	case opAlive:
+		return f.alive(cmd)
+	case opState:
+		return f.state(cmd)
+	case opMaintenance:
+		return f.maintenance(cmd)
+	case opMeta:
+		return f.meta(cmd)
+	}
+	return &result{err: fmt.Errorf("unknown command %q", cmd.Op)}
+}
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.RLock()
+	defer f.RUnlock()
+	data, err := json.Marshal(f.clients)
+	if err != nil {
+		return nil, err
+	}
+	return &fsmSnapshot{data: data}, nil
+}
+func (f *fsm) Restore(snapshot io.ReadCloser) error {
+	defer func() {
+		_ = snapshot.Close()
+	}()
+	clients := make(map[string]*record)
+	if err := json.NewDecoder(snapshot).Decode(&clients); err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.clients = clients
+	return nil
+}
+
+func (f *fsm) join(cmd command) *result {
+	if cmd.Client == nil {
+		return &result{err: fmt.Errorf("no client in join command")}
+	}
+	if len(f.clients) >= f.maxClients {
+		return &result{err: api.NewMaxClientsReachedError(f.maxClients)}
+	}
+	if f.clients[cmd.Client.ClientId] != nil || f.has(cmd.Client) {
+		return &result{err: api.NewAlreadyRegisteredError()}
+	}
+	if err := f.checkQuota(cmd.Client); err != nil {
+		return &result{err: err}
+	}
+	r := *cmd.Client
+	r.LastSeen = cmd.Time
+	f.clients[r.ClientId] = &r
+	f.update(r.Tenant)
+	f.publish(&r, common.NewClientJoinedEvent)
+	return &result{Client: &r}
+}
+func (f *fsm) rejoin(cmd command) *result {
+	r := f.clients[cmd.ClientId]
+	if r == nil {
+		return f.join(cmd)
+	}
+	// client is still registered (e.g. ping was lost); nothing to restore
+	if r.Tenant != cmd.Tenant {
+		return &result{err: api.NewInvalidRejoinTokenError(cmd.ClientId)}
+	}
+	f.up(r, cmd.Time, api.Ping{})
+	return &result{Client: r}
+}
+func (f *fsm) leave(cmd command) *result {
+	r := f.clients[cmd.ClientId]
+	if r == nil {
+		return &result{err: api.NewClientNotFoundError(cmd.ClientId)}
+	}
+	if !authorized(cmd.Tenant, r) {
+		return &result{err: api.NewTenantsClientNotFoundError(cmd.ClientId)}
+	}
+	if !cmd.Seen.IsZero() && !r.LastSeen.Equal(cmd.Seen) {
+		return &result{} // client pinged since removal was decided
+	}
+	prev := r.State
+	r.State = api.ClientStateRemoved
+	delete(f.clients, r.ClientId)
+	f.publish(r, func(c api.Client) api.Event {
+		return common.NewStateChangedEvent(c, prev)
+	})
+	f.publish(r, func(c api.Client) api.Event {
+		return common.NewClientLeftEvent(c, prev)
+	})
+	f.update(r.Tenant)
+	return &result{}
+}
+func (f *fsm) ping(cmd command) *result {
+	r := f.clients[cmd.ClientId]
+	if r == nil {
+		return &result{err: api.NewClientNotFoundError(cmd.ClientId)}
+	}
+	if !authorized(cmd.Tenant, r) {
+		return &result{err: api.NewTenantsClientNotFoundError(cmd.ClientId)}
+	}
+	var ping api.Ping
+	if cmd.Ping != nil {
+		ping = *cmd.Ping
+	}
+	if err := f.updateMeta(r, ping.Meta); err != nil {
+		return &result{err: err}
+	}
+	f.up(r, cmd.Time, ping)
+	response := api.PongTypeOk
+	if r.Dirty {
+		r.Dirty = false
+		response = api.PongTypeChanged
+	}
+	return &result{Response: response}
+}
+
+// alive refreshes client's last seen time only, keeping its reported status,
+// load and pending changes
+func (f *fsm) alive(cmd command) *result {
+	r := f.clients[cmd.ClientId]
+	if r == nil {
+		return &result{err: api.NewClientNotFoundError(cmd.ClientId)}
+	}
+	if !authorized(cmd.Tenant, r) {
+		return &result{err: api.NewTenantsClientNotFoundError(cmd.ClientId)}
+	}
+	r.LastSeen = cmd.Time
+	f.transition(r, common.AliveState(r.State, r.Maintenance))
+	return &result{}
+}
+func (f *fsm) state(cmd command) *result {
+	r := f.clients[cmd.ClientId]
+	if r == nil {
+		return &result{err: api.NewClientNotFoundError(cmd.ClientId)}
+	}
+	if r.State == cmd.State || !cmd.Seen.IsZero() && !r.LastSeen.Equal(cmd.Seen) {
+		return &result{}
+	}
+	prev := r.State
+	r.State = cmd.State
+	f.update(r.Tenant)
+	f.publish(r, func(c api.Client) api.Event {
+		return common.NewStateChangedEvent(c, prev)
+	})
+	return &result{}
+}
+func (f *fsm) maintenance(cmd command) *result {
+	r := f.clients[cmd.ClientId]
+	if r == nil {
+		return &result{err: api.NewClientNotFoundError(cmd.ClientId)}
+	}
+	r.Maintenance = cmd.Enabled
+	if state := common.MaintenanceState(r.State, cmd.Enabled); r.State != state {
+		prev := r.State
+		r.State = state
+		f.update(r.Tenant)
+		f.publish(r, func(c api.Client) api.Event {
+			return common.NewStateChangedEvent(c, prev)
+		})
+	}
+	return &result{}
+}
+func (f *fsm) meta(cmd command) *result {
+	r := f.clients[cmd.ClientId]
+	if r == nil {
+		return &result{err: api.NewClientNotFoundError(cmd.ClientId)}
+	}
+	if !authorized(cmd.Tenant, r) {
+		return &result{err: api.NewTenantsClientNotFoundError(cmd.ClientId)}
+	}
+	return &result{err: f.updateMeta(r, cmd.Meta)}
+}
+func (f *fsm) updateMeta(r *record, delta map[string]any) error {
+	if len(delta) == 0 {
+		return nil
+	}
+	meta := common.MergeMeta(r.Meta, delta)
+	if reflect.DeepEqual(meta, r.Meta) {
+		return nil
+	}
+	if err := common.CheckMetaSize(f.quota(r.Tenant), meta); err != nil {
+		return err
+	}
+	r.Meta = meta
+	f.update(r.Tenant)
+	f.publish(r, common.NewMetaUpdatedEvent)
+	return nil
+}
+func (f *fsm) up(r *record, seen time.Time, ping api.Ping) {
+	r.LastSeen = seen
+	r.Load, r.Capacity = ping.Load, ping.Capacity
+	f.transition(r, common.PingState(ping, r.Maintenance))
+}
+func (f *fsm) transition(r *record, state api.ClientState) {
+	if r.State == state {
+		return
+	}
+	prev := r.State
+	r.State = state
+	f.update(r.Tenant)
+	f.publish(r, func(c api.Client) api.Event {
+		return common.NewStateChangedEvent(c, prev)
+	})
+	f.logger.Info("client %s (%s) %s", r.ClientId, r.ServiceId, strings.ToLower(state.String()))
+}
+
+// update marks tenant's clients dirty, so they get CHANGED on next ping
+func (f *fsm) update(tenant string) {
+	for _, r := range f.clients {
+		if r.Tenant == tenant {
+			r.Dirty = true
+		}
+	}
+}
+func (f *fsm) checkQuota(client *record) error {
+	var services []string
+	for _, r := range f.clients {
+		if r.Tenant == client.Tenant {
+			services = append(services, r.ServiceId)
+		}
+	}
+	return common.CheckQuota(f.quota(client.Tenant), client.Tenant, client.ServiceId, client.Meta, services)
+}
+func (f *fsm) has(client *record) bool {
+	for _, r := range f.clients {
+		if r.Tenant == client.Tenant &&
+			r.ServiceId == client.ServiceId &&
+			reflect.DeepEqual(r.Endpoints, client.Endpoints) &&
+			reflect.DeepEqual(r.Meta, client.Meta) {
+			return true
+		}
+	}
+	return false
+}
+func (f *fsm) publish(r *record, event func(c api.Client) api.Event) {
+	c, err := r.client(f.clock)
+	if err != nil {
+		f.logger.Warning("could not publish event for client %s: %s", r.ClientId, err.Error())
+		return
+	}
+	f.events.Publish(event(c))
+}
+
+func (f *fsm) list(filter func(r *record) bool) []api.Client {
+	f.RLock()
+	defer f.RUnlock()
+	var result []api.Client
+	for _, r := range f.clients {
+		if !filter(r) {
+			continue
+		}
+		c, err := r.client(f.clock)
+		if err != nil {
+			continue
+		}
+		result = append(result, c)
+	}
+	return result
+}
+func (f *fsm) records() []record {
+	f.RLock()
+	defer f.RUnlock()
+	var result []record
+	for _, r := range f.clients {
+		result = append(result, *r)
+	}
+	return result
+}
+
+// authorized reports whether command issued within tenant may access record
+// (see common.Authorized)
+func authorized(tenant string, r *record) bool {
+	return tenant == api.TenantDefault || tenant != "" && tenant == r.Tenant
+}
+
+// endregion
+// region - snapshot
+
+type fsmSnapshot struct {
+	data []byte
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s.data); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+func (s *fsmSnapshot) Release() {
+}
+
+// endregion
+
+func endpointUrls(endpoints []api.Endpoint) []string {
+	var result []string
+	for _, e := range endpoints {
+		result = append(result, e.Url())
+	}
+	return result
+}
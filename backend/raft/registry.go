@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/backend/inmem/store"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"github.com/slink-go/logging"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var Backend raftBackendInitializer
+
+type raftBackendInitializer struct{}
+
+func (bi *raftBackendInitializer) Init(cfg *config.AppConfig) api.Registry {
+	opts, err := loadOptions(cfg)
+	if err != nil {
+		panic(err)
+	}
+	listener, err := net.Listen("tcp", opts.bind)
+	if err != nil {
+		panic(err)
+	}
+	registry, err := newRaftRegistry(cfg, common.SystemClock, opts, listener)
+	if err != nil {
+		panic(err)
+	}
+	return registry
+}
+
+// region - options
+
+type options struct {
+	nodeId       string
+	bind         string
+	advertise    string
+	peers        []raft.Server
+	bootstrap    bool
+	dir          string
+	applyTimeout time.Duration
+	secret       string
+	raftConfig   func(c *raft.Config)
+}
+
+func loadOptions(cfg *config.AppConfig) (*options, error) {
+	hostname, _ := os.Hostname()
+	opts := options{
+		nodeId:       config.ReadStringOrDefault("DISCO_RAFT_NODE_ID", hostname),
+		bind:         config.ReadStringOrDefault("DISCO_RAFT_BIND", "127.0.0.1:7000"),
+		advertise:    config.ReadString("DISCO_RAFT_ADVERTISE"),
+		bootstrap:    config.ReadBooleanOrDefault("DISCO_RAFT_BOOTSTRAP", true),
+		dir:          config.ReadString("DISCO_RAFT_DIR"),
+		applyTimeout: config.ReadDurationOrDefault("DISCO_RAFT_APPLY_TIMEOUT", 5*time.Second),
+		secret:       config.ReadStringOrDefault("DISCO_RAFT_SECRET", cfg.SecretKey),
+	}
+	if opts.nodeId == "" {
+		return nil, errors.New("raft node id not set (DISCO_RAFT_NODE_ID)")
+	}
+	if opts.secret == "" {
+		return nil, errors.New("raft secret not set (DISCO_RAFT_SECRET or DISCO_SECRET_KEY)")
+	}
+	peers, err := parsePeers(config.ReadString("DISCO_RAFT_PEERS"))
+	if err != nil {
+		return nil, err
+	}
+	opts.peers = peers
+	return &opts, nil
+}
+
+// parsePeers parses initial cluster configuration: "node1=host1:7000,node2=host2:7000"
+func parsePeers(peers string) ([]raft.Server, error) {
+	var result []raft.Server
+	for _, p := range strings.Split(peers, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		parts := strings.SplitN(p, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid raft peer %q (expected id=host:port)", p)
+		}
+		result = append(result, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(strings.TrimSpace(parts[0])),
+			Address:  raft.ServerAddress(strings.TrimSpace(parts[1])),
+		})
+	}
+	return result, nil
+}
+
+// endregion
+// region - registry
+
+// raftRegistry replicates registry state machine across disco nodes with raft:
+// writes (join, leave, ping, state changes) go through the leader, reads are
+// served from local state machine copy
+type raftRegistry struct {
+	raft             *raft.Raft
+	fsm              *fsm
+	layer            *streamLayer
+	transport        *raft.NetworkTransport
+	pingInterval     api.Duration
+	failingThreshold time.Duration
+	downThreshold    time.Duration
+	removeThreshold  time.Duration
+	applyTimeout     time.Duration
+	secret           []byte
+	rejoinKey        []byte
+	clock            common.Clock
+	events           *common.EventBus
+	cancel           context.CancelFunc
+	logger           logging.Logger
+}
+
+func newRaftRegistry(cfg *config.AppConfig, clock common.Clock, opts *options, listener net.Listener) (*raftRegistry, error) {
+	events := common.NewEventBus(common.DefaultEventLogCapacity)
+	registry := raftRegistry{
+		fsm:              newFsm(clock, cfg.MaxClients, cfg.Quota, events),
+		pingInterval:     api.Duration{Duration: cfg.PingDuration},
+		failingThreshold: time.Duration(cfg.FailingThreshold) * cfg.PingDuration,
+		downThreshold:    time.Duration(cfg.DownThreshold) * cfg.PingDuration,
+		removeThreshold:  time.Duration(cfg.RemoveThreshold) * cfg.PingDuration,
+		applyTimeout:     opts.applyTimeout,
+		secret:           []byte(opts.secret),
+		rejoinKey:        common.NewRejoinKey(cfg.RejoinKey),
+		clock:            clock,
+		events:           events,
+		logger:           logging.GetLogger("reg-raft"),
+	}
+	if opts.secret == "" {
+		return nil, errors.New("raft secret not set")
+	}
+	if cfg.RejoinKey == "" {
+		registry.logger.Warning("rejoin key not set; rejoin tokens will not be accepted by other disco nodes")
+	}
+
+	var advertise net.Addr
+	if opts.advertise != "" {
+		addr, err := net.ResolveTCPAddr("tcp", opts.advertise)
+		if err != nil {
+			return nil, err
+		}
+		advertise = addr
+	}
+	registry.layer = newStreamLayer(listener, advertise, registry.handleForward)
+
+	raftLogger := hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Level:  hclog.Warn,
+		Output: os.Stderr,
+	})
+	registry.transport = raft.NewNetworkTransportWithLogger(registry.layer, 3, 10*time.Second, raftLogger)
+
+	logs, stable, snapshots, err := stores(opts.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(opts.nodeId)
+	raftConfig.Logger = raftLogger
+	if opts.raftConfig != nil {
+		opts.raftConfig(raftConfig)
+	}
+
+	if opts.bootstrap {
+		exists, err := raft.HasExistingState(logs, stable, snapshots)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			servers := opts.peers
+			if !containsServer(servers, raftConfig.LocalID) {
+				servers = append(servers, raft.Server{
+					Suffrage: raft.Voter,
+					ID:       raftConfig.LocalID,
+					Address:  registry.transport.LocalAddr(),
+				})
+			}
+			if err = raft.BootstrapCluster(raftConfig, logs, stable, snapshots, registry.transport, raft.Configuration{Servers: servers}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	registry.raft, err = raft.NewRaft(raftConfig, registry.fsm, logs, stable, snapshots, registry.transport)
+	if err != nil {
+		return nil, err
+	}
+	registry.logger.Info("raft node %s started on %s", opts.nodeId, registry.transport.LocalAddr())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	registry.cancel = cancel
+	registry.run(ctx)
+	return &registry, nil
+}
+
+func (rs *raftRegistry) Join(ctx context.Context, request api.JoinRequest) (*api.JoinResponse, error) {
+	rs.logger.Debug("[registry][join] client join")
+	tnt := ctx.Value(api.TenantKey).(string)
+	c, err := common.NewClient(rs.clock, rs.createClientId(), request.ServiceId, tnt, request.Endpoints, request.Meta)
+	if err != nil {
+		return nil, err
+	}
+	res, err := rs.apply(command{Op: opJoin, Client: newRecord(c)})
+	if err != nil {
+		return nil, err
+	}
+	rs.logger.Debug("[registry][join] client %s joined", c.ClientId())
+	return rs.joinResponse(res.Client), nil
+}
+func (rs *raftRegistry) Rejoin(ctx context.Context, request api.RejoinRequest) (*api.JoinResponse, error) {
+	rs.logger.Debug("[registry][rejoin] client %s rejoin", request.ClientId)
+	tnt := ctx.Value(api.TenantKey).(string)
+	if !common.ValidRejoinToken(rs.rejoinKey, tnt, request.ClientId, request.Token) {
+		return nil, api.NewInvalidRejoinTokenError(request.ClientId)
+	}
+	c, err := common.NewClient(rs.clock, request.ClientId, request.ServiceId, tnt, request.Endpoints, request.Meta)
+	if err != nil {
+		return nil, err
+	}
+	res, err := rs.apply(command{Op: opRejoin, ClientId: request.ClientId, Tenant: tnt, Client: newRecord(c)})
+	if err != nil {
+		return nil, err
+	}
+	rs.logger.Debug("[registry][rejoin] client %s rejoined", c.ClientId())
+	return rs.joinResponse(res.Client), nil
+}
+func (rs *raftRegistry) Leave(ctx context.Context, clientId string) error {
+	tnt, _ := ctx.Value(api.TenantKey).(string)
+	rs.logger.Debug("[registry][leave] remove client %s", clientId)
+	_, err := rs.apply(command{Op: opLeave, ClientId: clientId, Tenant: tnt})
+	return err
+}
+func (rs *raftRegistry) List(ctx context.Context) []api.Client {
+	if ctx.Value(api.TenantKey) == nil || ctx.Value(api.TenantKey) == "" {
+		rs.logger.Warning("no tenant context set; return empty list")
+		return make([]api.Client, 0)
+	}
+	tenant := ctx.Value(api.TenantKey).(string)
+	clients := rs.fsm.list(func(r *record) bool {
+		return tenant == api.TenantDefault || r.Tenant == tenant
+	})
+	rs.logger.Debug("[registry][list] list for %v (%d)", tenant, len(clients))
+	sort.Slice(clients, func(a, b int) bool {
+		if clients[a].ServiceId() != clients[b].ServiceId() {
+			return clients[a].ServiceId() < clients[b].ServiceId()
+		} else {
+			return clients[a].ClientId() < clients[b].ClientId()
+		}
+	})
+	return clients
+}
+func (rs *raftRegistry) ListAll() []api.Tenant {
+	tenants := make(map[string]api.Tenant)
+	for _, c := range rs.fsm.list(func(r *record) bool { return true }) {
+		if tenants[c.Tenant()] == nil {
+			tenants[c.Tenant()] = store.CreateTenant(c.Tenant())
+		}
+		tenants[c.Tenant()].Set(c.ClientId(), c)
+	}
+	var result []api.Tenant
+	for _, t := range tenants {
+		result = append(result, t)
+	}
+	return result
+}
+func (rs *raftRegistry) Ping(ctx context.Context, clientId string, ping api.Ping) (api.Pong, error) {
+	tnt, _ := ctx.Value(api.TenantKey).(string)
+	res, err := rs.apply(command{Op: opPing, ClientId: clientId, Tenant: tnt, Ping: &ping})
+	if err != nil {
+		return api.Pong{}, err
+	}
+	rs.logger.Debug("[registry][ping] client '%s' ping: '%s'", clientId, res.Response)
+	return api.Pong{
+		Response: res.Response,
+	}, nil
+}
+func (rs *raftRegistry) MarkAlive(ctx context.Context, clientId string) error {
+	tnt, _ := ctx.Value(api.TenantKey).(string)
+	if _, err := rs.apply(command{Op: opAlive, ClientId: clientId, Tenant: tnt}); err != nil {
+		return err
+	}
+	rs.logger.Debug("[registry][alive] client '%s' is alive", clientId)
+	return nil
+}
+func (rs *raftRegistry) SetMaintenance(clientId string, enabled bool) error {
+	if _, err := rs.apply(command{Op: opMaintenance, ClientId: clientId, Enabled: enabled}); err != nil {
+		return err
+	}
+	rs.logger.Info("client %s maintenance: %v", clientId, enabled)
+	return nil
+}
+func (rs *raftRegistry) UpdateMeta(ctx context.Context, clientId string, delta map[string]any) error {
+	tnt, _ := ctx.Value(api.TenantKey).(string)
+	_, err := rs.apply(command{Op: opMeta, ClientId: clientId, Tenant: tnt, Meta: delta})
+	return err
+}
+func (rs *raftRegistry) Watch(ctx context.Context, revision uint64) (*api.WatchResponse, error) {
+	tenant, _ := ctx.Value(api.TenantKey).(string)
+	if tenant == "" {
+		rs.logger.Warning("no tenant context set; return empty watch response")
+		return &api.WatchResponse{Revision: rs.events.Revision(), Events: []api.Event{}}, nil
+	}
+	return rs.events.Wait(ctx, tenant, revision)
+}
+func (rs *raftRegistry) Subscribe(handler api.EventHandler) func() {
+	return rs.events.Subscribe(handler)
+}
+
+// endregion
+// region - cluster
+
+func (rs *raftRegistry) Members() ([]api.Member, error) {
+	future := rs.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	_, leader := rs.raft.LeaderWithID()
+	var result []api.Member
+	for _, s := range future.Configuration().Servers {
+		result = append(result, api.Member{
+			Id:      string(s.ID),
+			Address: string(s.Address),
+			Voter:   s.Suffrage == raft.Voter,
+			Leader:  s.ID == leader,
+		})
+	}
+	return result, nil
+}
+func (rs *raftRegistry) AddMember(member api.Member) error {
+	if member.Id == "" || member.Address == "" {
+		return errors.New("member id and address are required")
+	}
+	_, err := rs.apply(command{Op: opAddMember, Member: &member})
+	return err
+}
+func (rs *raftRegistry) RemoveMember(id string) error {
+	if id == "" {
+		return errors.New("member id is required")
+	}
+	_, err := rs.apply(command{Op: opRemoveMember, Member: &api.Member{Id: id}})
+	return err
+}
+
+// endregion
+// region - apply
+
+// apply runs command on the leader: locally if this node leads the cluster,
+// otherwise command is forwarded to the leader
+func (rs *raftRegistry) apply(cmd command) (*result, error) {
+	if rs.raft.State() != raft.Leader {
+		return rs.forward(cmd)
+	}
+	return rs.applyLocal(cmd)
+}
+func (rs *raftRegistry) applyLocal(cmd command) (*result, error) {
+	var future raft.Future
+	switch cmd.Op {
+	case opAddMember:
+		rs.logger.Info("add cluster member %s (%s)", cmd.Member.Id, cmd.Member.Address)
+		future = rs.raft.AddVoter(raft.ServerID(cmd.Member.Id), raft.ServerAddress(cmd.Member.Address), 0, rs.applyTimeout)
+	case opRemoveMember:
+		rs.logger.Info("remove cluster member %s", cmd.Member.Id)
+		future = rs.raft.RemoveServer(raft.ServerID(cmd.Member.Id), 0, rs.applyTimeout)
+	default:
+		if cmd.Time.IsZero() {
+			cmd.Time = rs.clock.Now()
+		}
+		data, err := json.Marshal(cmd)
+		if err != nil {
+			return nil, err
+		}
+		apply := rs.raft.Apply(data, rs.applyTimeout)
+		if err = apply.Error(); err != nil {
+			return nil, rs.raftError(err)
+		}
+		res := apply.Response().(*result)
+		return res, res.err
+	}
+	if err := future.Error(); err != nil {
+		return nil, rs.raftError(err)
+	}
+	return &result{}, nil
+}
+func (rs *raftRegistry) raftError(err error) error {
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+		return errNoLeader
+	}
+	return err
+}
+
+// endregion
+// region - runner
+
+// run starts failure detector; it is active on the leader only, which
+// replicates state changes to the other nodes
+func (rs *raftRegistry) run(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		var leaderSince time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if rs.raft.State() != raft.Leader {
+					leaderSince = time.Time{}
+					continue
+				}
+				if leaderSince.IsZero() {
+					leaderSince = rs.clock.Now()
+				}
+				rs.check(rs.clock.Now(), leaderSince)
+			}
+		}
+	}()
+}
+
+// check derives clients' states from last seen time; new leader gives
+// clients full thresholds after election, as pings may have been lost
+// while cluster had no leader
+func (rs *raftRegistry) check(now, leaderSince time.Time) {
+	for _, r := range rs.fsm.records() {
+		seen := r.LastSeen
+		if seen.Before(leaderSince) {
+			seen = leaderSince
+		}
+		interval := now.Sub(seen)
+		var cmd *command
+		if rs.removeThreshold < interval {
+			cmd = &command{Op: opLeave, ClientId: r.ClientId, Tenant: api.TenantDefault, Seen: r.LastSeen}
+			rs.logger.Info("removing client %s (%s)", r.ClientId, r.ServiceId)
+		} else if rs.downThreshold < interval {
+			if r.State != api.ClientStateDown {
+				cmd = &command{Op: opState, ClientId: r.ClientId, State: api.ClientStateDown, Seen: r.LastSeen}
+				rs.logger.Info("client %s (%s) down", r.ClientId, r.ServiceId)
+			}
+		} else if rs.failingThreshold < interval {
+			if r.State != api.ClientStateFailing {
+				cmd = &command{Op: opState, ClientId: r.ClientId, State: api.ClientStateFailing, Seen: r.LastSeen}
+				rs.logger.Info("client %s (%s) failing", r.ClientId, r.ServiceId)
+			}
+		}
+		if cmd == nil {
+			continue
+		}
+		if _, err := rs.applyLocal(*cmd); err != nil {
+			rs.logger.Warning("could not update client %s: %s", r.ClientId, err.Error())
+		}
+	}
+}
+
+// endregion
+// region - helpers
+
+func (rs *raftRegistry) shutdown() error {
+	rs.cancel()
+	return rs.raft.Shutdown().Error()
+}
+func (rs *raftRegistry) createClientId() string {
+	u, err := uuid.NewUUID()
+	if err != nil {
+		panic(err)
+	}
+	return u.String()
+}
+func (rs *raftRegistry) joinResponse(r *record) *api.JoinResponse {
+	return &api.JoinResponse{
+		ClientId:     r.ClientId,
+		PingInterval: rs.pingInterval,
+		Token:        common.NewRejoinToken(rs.rejoinKey, r.Tenant, r.ClientId),
+	}
+}
+
+func stores(dir string) (raft.LogStore, raft.StableStore, raft.SnapshotStore, error) {
+	if dir == "" {
+		return raft.NewInmemStore(), raft.NewInmemStore(), raft.NewInmemSnapshotStore(), nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, nil, nil, err
+	}
+	bolt, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(dir, 2, os.Stderr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return bolt, bolt, snapshots, nil
+}
+func containsServer(servers []raft.Server, id raft.ServerID) bool {
+	for _, s := range servers {
+		if s.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// endregion
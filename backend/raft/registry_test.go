@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/raft"
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/backend/registrytest"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"net"
+	"testing"
+	"time"
+)
+
+func testConfig() *config.AppConfig {
+	return &config.AppConfig{
+		PingDuration:     time.Second,
+		FailingThreshold: 1,
+		DownThreshold:    3,
+		RemoveThreshold:  5,
+		MaxClients:       2,
+		RejoinKey:        "test-rejoin-key",
+	}
+}
+func fastRaft(c *raft.Config) {
+	c.HeartbeatTimeout = 200 * time.Millisecond
+	c.ElectionTimeout = 200 * time.Millisecond
+	c.LeaderLeaseTimeout = 100 * time.Millisecond
+	c.CommitTimeout = 10 * time.Millisecond
+}
+func listen(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+func startNode(t *testing.T, id string, listener net.Listener, peers []raft.Server, bootstrap bool) *raftRegistry {
+	opts := &options{
+		nodeId:       id,
+		peers:        peers,
+		bootstrap:    bootstrap,
+		applyTimeout: 2 * time.Second,
+		secret:       "test-raft-secret",
+		raftConfig:   fastRaft,
+	}
+	node, err := newRaftRegistry(testConfig(), common.SystemClock, opts, listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = node.shutdown()
+	})
+	return node
+}
+
+// startCluster starts n in-process nodes on loopback sharing initial configuration
+func startCluster(t *testing.T, n int) []*raftRegistry {
+	var listeners []net.Listener
+	var peers []raft.Server
+	for i := 0; i < n; i++ {
+		listener := listen(t)
+		listeners = append(listeners, listener)
+		peers = append(peers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(fmt.Sprintf("node-%d", i)),
+			Address:  raft.ServerAddress(listener.Addr().String()),
+		})
+	}
+	var nodes []*raftRegistry
+	for i, listener := range listeners {
+		nodes = append(nodes, startNode(t, string(peers[i].ID), listener, peers, true))
+	}
+	return nodes
+}
+func waitLeader(t *testing.T, nodes []*raftRegistry) (*raftRegistry, []*raftRegistry) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for i, n := range nodes {
+			if n.raft.State() == raft.Leader {
+				var followers []*raftRegistry
+				followers = append(followers, nodes[:i]...)
+				followers = append(followers, nodes[i+1:]...)
+				return n, followers
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil, nil
+}
+func eventually(t *testing.T, message string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal(message)
+}
+func tenantContext(tenant string) context.Context {
+	return context.WithValue(context.Background(), api.TenantKey, tenant)
+}
+
+func TestReplicationAndForwarding(t *testing.T) {
+	nodes := startCluster(t, 3)
+	_, followers := waitLeader(t, nodes)
+	ctx := tenantContext("tenant")
+
+	// write on follower is forwarded to the leader
+	resp, err := followers[0].Join(ctx, api.JoinRequest{ServiceId: "SVC", Endpoints: []string{"http://localhost:8080"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		eventually(t, "client was not replicated", func() bool {
+			return len(n.List(ctx)) == 1
+		})
+		if len(n.List(tenantContext("other"))) != 0 {
+			t.Errorf("expected tenant isolation")
+		}
+	}
+
+	pong, err := followers[1].Ping(ctx, resp.ClientId, api.Ping{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pong.Response != api.PongTypeChanged {
+		t.Errorf("expected CHANGED on first ping, got %s", pong.Response)
+	}
+	pong, err = followers[0].Ping(ctx, resp.ClientId, api.Ping{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pong.Response != api.PongTypeOk {
+		t.Errorf("expected OK on second ping, got %s", pong.Response)
+	}
+	for _, n := range nodes {
+		eventually(t, "state change was not replicated", func() bool {
+			list := n.List(ctx)
+			return len(list) == 1 && list[0].State() == api.ClientStateUp
+		})
+	}
+
+	// registry errors keep their kind when forwarded
+	if _, err = followers[0].Join(ctx, api.JoinRequest{ServiceId: "SVC", Endpoints: []string{"http://localhost:8080"}}); err == nil {
+		t.Errorf("expected duplicate registration error")
+	}
+	if _, err = followers[0].Ping(ctx, "unknown", api.Ping{}); !errors.Is(err, api.NewClientNotFoundError("unknown")) {
+		t.Errorf("expected client not found, got %v", err)
+	}
+	if err = followers[0].Leave(tenantContext("other"), resp.ClientId); !errors.Is(err, api.NewTenantsClientNotFoundError(resp.ClientId)) {
+		t.Errorf("expected tenant's client not found, got %v", err)
+	}
+
+	if err = followers[1].Leave(ctx, resp.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		eventually(t, "leave was not replicated", func() bool {
+			return len(n.List(ctx)) == 0
+		})
+	}
+}
+func TestUpdateMeta(t *testing.T) {
+	nodes := startCluster(t, 3)
+	_, followers := waitLeader(t, nodes)
+	ctx := tenantContext("tenant")
+
+	resp, err := followers[0].Join(ctx, api.JoinRequest{ServiceId: "SVC", Meta: map[string]any{"zone": "eu-1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = followers[1].UpdateMeta(tenantContext("other"), resp.ClientId, map[string]any{"zone": "us-1"}); !errors.Is(err, api.NewTenantsClientNotFoundError(resp.ClientId)) {
+		t.Errorf("expected tenant's client not found, got %v", err)
+	}
+	if err = followers[1].UpdateMeta(ctx, resp.ClientId, map[string]any{"zone": nil, "version": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = followers[0].Ping(ctx, resp.ClientId, api.Ping{Meta: map[string]any{"region": "eu"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		eventually(t, "meta update was not replicated", func() bool {
+			list := n.List(ctx)
+			return len(list) == 1 && len(list[0].Meta()) == 2 && list[0].Meta()["version"] == "2" && list[0].Meta()["region"] == "eu"
+		})
+	}
+}
+func TestForwardAuthentication(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader, followers := waitLeader(t, nodes)
+	ctx := tenantContext("tenant")
+
+	resp, err := followers[0].Join(ctx, api.JoinRequest{ServiceId: "SVC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(f forwarded) result {
+		conn, err := leader.layer.dial(leader.layer.Addr().String(), rpcForward, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err = json.NewEncoder(conn).Encode(f); err != nil {
+			t.Fatal(err)
+		}
+		var res result
+		if err = json.NewDecoder(conn).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	// leave of other tenant's client claiming default tenant
+	data, _ := json.Marshal(command{Op: opLeave, ClientId: resp.ClientId, Tenant: api.TenantDefault})
+	now := time.Now().UnixNano()
+	stale := time.Now().Add(-2 * forwardMaxAge).UnixNano()
+	cases := map[string]forwarded{
+		"unsigned":   {Command: data, Time: now},
+		"wrong key":  {Command: data, Time: now, Mac: (&raftRegistry{secret: []byte("other")}).sign(data, now)},
+		"stale":      {Command: data, Time: stale, Mac: leader.sign(data, stale)},
+		"tampered":   {Command: data, Time: now, Mac: leader.sign([]byte(`{"op":"ping"}`), now)},
+		"wrong time": {Command: data, Time: now + 1, Mac: leader.sign(data, now)},
+	}
+	for name, f := range cases {
+		if res := send(f); res.Code == "" {
+			t.Errorf("%s: expected forwarded command to be rejected", name)
+		}
+	}
+	if len(leader.List(ctx)) != 1 {
+		t.Fatalf("expected client to be kept")
+	}
+	if res := send(forwarded{Command: data, Time: now, Mac: leader.sign(data, now)}); res.Code != "" {
+		t.Errorf("expected signed command to be applied, got %s", res.Error)
+	}
+}
+func TestLeaderFailover(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader, followers := waitLeader(t, nodes)
+	ctx := tenantContext("tenant")
+
+	resp, err := leader.Join(ctx, api.JoinRequest{ServiceId: "SVC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range followers {
+		eventually(t, "client was not replicated", func() bool {
+			return len(n.List(ctx)) == 1
+		})
+	}
+
+	if err = leader.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = waitLeader(t, followers)
+	if _, err = followers[0].Ping(ctx, resp.ClientId, api.Ping{}); err != nil {
+		t.Fatalf("expected client to survive leader failover: %v", err)
+	}
+}
+func TestStateTransitions(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader, followers := waitLeader(t, nodes)
+	ctx := tenantContext("tenant")
+
+	events := make(chan api.Event, 16)
+	followers[0].Subscribe(func(event api.Event) {
+		events <- event
+	})
+
+	resp, err := leader.Join(ctx, api.JoinRequest{ServiceId: "SVC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = leader.Ping(ctx, resp.ClientId, api.Ping{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// no pings: leader detects failure and replicates state changes
+	states := map[api.ClientState]bool{}
+	timeout := time.After(15 * time.Second)
+	for !states[api.ClientStateRemoved] {
+		select {
+		case e := <-events:
+			states[e.State] = true
+		case <-timeout:
+			t.Fatalf("client was not removed; seen states: %v", states)
+		}
+	}
+	for _, s := range []api.ClientState{api.ClientStateStarting, api.ClientStateUp, api.ClientStateFailing, api.ClientStateDown} {
+		if !states[s] {
+			t.Errorf("expected %s state event", s)
+		}
+	}
+}
+func TestMembership(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader, followers := waitLeader(t, nodes)
+
+	// new node joins existing cluster without bootstrapping
+	listener := listen(t)
+	node := startNode(t, "node-new", listener, nil, false)
+	if err := followers[0].AddMember(api.Member{Id: "node-new", Address: listener.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+	members, err := node.Members()
+	eventually(t, "new node did not get cluster configuration", func() bool {
+		members, err = node.Members()
+		return err == nil && len(members) == 4
+	})
+	leaders := 0
+	for _, m := range members {
+		if m.Leader {
+			leaders++
+			if m.Address != string(leader.transport.LocalAddr()) {
+				t.Errorf("unexpected leader %v", m)
+			}
+		}
+	}
+	if leaders != 1 {
+		t.Errorf("expected exactly one leader, got %d", leaders)
+	}
+
+	// replicated state reaches new member
+	ctx := tenantContext("tenant")
+	if _, err = leader.Join(ctx, api.JoinRequest{ServiceId: "SVC"}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "client was not replicated to new member", func() bool {
+		return len(node.List(ctx)) == 1
+	})
+
+	if err = node.RemoveMember("node-new"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "member was not removed", func() bool {
+		members, err = leader.Members()
+		return err == nil && len(members) == 3
+	})
+}
+func TestParsePeers(t *testing.T) {
+	peers, err := parsePeers("a=127.0.0.1:7000, b=127.0.0.1:7001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[1].ID != "b" || peers[1].Address != "127.0.0.1:7001" {
+		t.Errorf("unexpected peers: %v", peers)
+	}
+	if _, err = parsePeers("a"); err == nil {
+		t.Errorf("expected invalid peer error")
+	}
+}
+func TestConformance(t *testing.T) {
+	registrytest.Run(t, func(t *testing.T, cfg *config.AppConfig, clock common.Clock) registrytest.Subject {
+		listener := listen(t)
+		opts := &options{
+			nodeId:       "node-0",
+			peers:        []raft.Server{{Suffrage: raft.Voter, ID: "node-0", Address: raft.ServerAddress(listener.Addr().String())}},
+			bootstrap:    true,
+			applyTimeout: 2 * time.Second,
+			secret:       "test-raft-secret",
+			raftConfig:   fastRaft,
+		}
+		rs, err := newRaftRegistry(cfg, clock, opts, listener)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = rs.shutdown()
+		})
+		waitLeader(t, []*raftRegistry{rs})
+		return registrytest.Subject{Registry: rs, Check: func(now time.Time) {
+			rs.check(now, time.Time{})
+		}}
+	})
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/raft"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/logging"
+	"net"
+	"sync"
+	"time"
+)
+
+// Raft traffic and write forwarding share the same port: the first byte
+// written to each connection tells which of them the connection is for.
+const (
+	rpcRaft    byte = 'R'
+	rpcForward byte = 'F'
+)
+
+const rpcTypeReadDeadline = 10 * time.Second
+
+// forwardMaxAge limits how long signed forwarded command stays acceptable
+// (includes clock difference between nodes)
+const forwardMaxAge = time.Minute
+
+var (
+	errNoLeader        = errors.New("no raft leader available")
+	errTransportClosed = errors.New("raft transport closed")
+	errUnknownRpcType  = errors.New("unknown rpc type")
+	errForwardAuth     = errors.New("forwarded command not authenticated")
+)
+
+// region - stream layer
+
+type streamLayer struct {
+	listener  net.Listener
+	advertise net.Addr
+	conns     chan net.Conn
+	forward   func(conn net.Conn)
+	shutdown  chan struct{}
+	once      sync.Once
+	logger    logging.Logger
+}
+
+func newStreamLayer(listener net.Listener, advertise net.Addr, forward func(conn net.Conn)) *streamLayer {
+	if advertise == nil {
+		advertise = listener.Addr()
+	}
+	layer := streamLayer{
+		listener:  listener,
+		advertise: advertise,
+		conns:     make(chan net.Conn),
+		forward:   forward,
+		shutdown:  make(chan struct{}),
+		logger:    logging.GetLogger("raft-transport"),
+	}
+	go layer.serve()
+	return &layer
+}
+
+func (l *streamLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.shutdown:
+		return nil, errTransportClosed
+	}
+}
+func (l *streamLayer) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.shutdown)
+		err = l.listener.Close()
+	})
+	return err
+}
+func (l *streamLayer) Addr() net.Addr {
+	return l.advertise
+}
+func (l *streamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return l.dial(string(address), rpcRaft, timeout)
+}
+
+func (l *streamLayer) dial(address string, typ byte, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write([]byte{typ}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+func (l *streamLayer) serve() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			select {
+			case <-l.shutdown:
+				return
+			default:
+				l.logger.Warning("accept error: %s", err.Error())
+				continue
+			}
+		}
+		go l.handle(conn)
+	}
+}
+func (l *streamLayer) handle(conn net.Conn) {
+	typ := make([]byte, 1)
+	_ = conn.SetReadDeadline(time.Now().Add(rpcTypeReadDeadline))
+	if _, err := conn.Read(typ); err != nil {
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	switch typ[0] {
+	case rpcRaft:
+		select {
+		case l.conns <- conn:
+		case <-l.shutdown:
+			_ = conn.Close()
+		}
+	case rpcForward:
+		l.forward(conn)
+	default:
+		l.logger.Warning("%s from %s", errUnknownRpcType.Error(), conn.RemoteAddr())
+		_ = conn.Close()
+	}
+}
+
+// endregion
+// region - forwarding
+
+// forwarded is a command sent by follower node to the leader; commands carry
+// their tenant, so they are signed with cluster secret and accepted only from
+// other nodes of the cluster
+type forwarded struct {
+	Command json.RawMessage `json:"command"`
+	Time    int64           `json:"time"`
+	Mac     []byte          `json:"mac"`
+}
+
+func (rs *raftRegistry) sign(cmd []byte, ts int64) []byte {
+	mac := hmac.New(sha256.New, rs.secret)
+	_ = binary.Write(mac, binary.BigEndian, ts)
+	mac.Write(cmd)
+	return mac.Sum(nil)
+}
+
+// verify checks forwarded command signature and age
+func (rs *raftRegistry) verify(f forwarded) error {
+	if !hmac.Equal(f.Mac, rs.sign(f.Command, f.Time)) {
+		return errForwardAuth
+	}
+	if age := time.Since(time.Unix(0, f.Time)); age > forwardMaxAge || age < -forwardMaxAge {
+		return errForwardAuth
+	}
+	return nil
+}
+
+// forward sends command to the leader and waits for its result
+func (rs *raftRegistry) forward(cmd command) (*result, error) {
+	address, _ := rs.raft.LeaderWithID()
+	if address == "" {
+		return nil, errNoLeader
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	ts := time.Now().UnixNano()
+	conn, err := rs.layer.dial(string(address), rpcForward, rs.applyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(2 * rs.applyTimeout))
+	if err = json.NewEncoder(conn).Encode(forwarded{Command: data, Time: ts, Mac: rs.sign(data, ts)}); err != nil {
+		return nil, err
+	}
+	var res result
+	if err = json.NewDecoder(conn).Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.Code != "" {
+		return nil, decodeError(res.Code, res.Error)
+	}
+	return &res, nil
+}
+
+// handleForward applies command forwarded by follower node
+func (rs *raftRegistry) handleForward(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(2 * rs.applyTimeout))
+	var f forwarded
+	if err := json.NewDecoder(conn).Decode(&f); err != nil {
+		rs.logger.Warning("could not read forwarded command: %s", err.Error())
+		return
+	}
+	var cmd command
+	err := rs.verify(f)
+	if err == nil {
+		err = json.Unmarshal(f.Command, &cmd)
+	}
+	if err != nil {
+		rs.logger.Warning("rejected forwarded command from %s: %s", conn.RemoteAddr(), err.Error())
+		res := result{}
+		res.Code, res.Error = encodeError(err)
+		_ = json.NewEncoder(conn).Encode(res)
+		return
+	}
+	res, err := rs.applyLocal(cmd)
+	if res == nil {
+		res = &result{}
+	}
+	if err != nil {
+		res.Code, res.Error = encodeError(err)
+	}
+	if err = json.NewEncoder(conn).Encode(res); err != nil {
+		rs.logger.Warning("could not reply to forwarded command: %s", err.Error())
+	}
+}
+
+// endregion
+// region - errors
+
+// forwardedError keeps leader's error message and matches (errors.Is) the
+// same registry errors as the original one
+type forwardedError struct {
+	message string
+	kind    error
+}
+
+func (e *forwardedError) Error() string {
+	return e.message
+}
+func (e *forwardedError) Is(tgt error) bool {
+	return e.kind != nil && errors.Is(e.kind, tgt)
+}
+
+var forwardedErrorKinds = map[string]error{
+	"client_not_found":         &api.ErrClientNotFound{},
+	"tenants_client_not_found": &api.ErrTenantsClientNotFound{},
+	"already_registered":       &api.ErrAlreadyRegistered{},
+	"max_clients_reached":      &api.ErrMaxClientsReached{},
+	"clients_quota_exceeded":   &api.ErrClientsQuotaExceeded{},
+	"services_quota_exceeded":  &api.ErrServicesQuotaExceeded{},
+	"instances_quota_exceeded": &api.ErrInstancesQuotaExceeded{},
+	"meta_too_large":           &api.ErrMetaTooLarge{},
+	"invalid_rejoin_token":     &api.ErrInvalidRejoinToken{},
+}
+
+func encodeError(err error) (string, string) {
+	var code string
+	switch err.(type) {
+	case *api.ErrClientNotFound:
+		code = "client_not_found"
+	case *api.ErrTenantsClientNotFound:
+		code = "tenants_client_not_found"
+	case *api.ErrAlreadyRegistered:
+		code = "already_registered"
+	case *api.ErrMaxClientsReached:
+		code = "max_clients_reached"
+	case *api.ErrClientsQuotaExceeded:
+		code = "clients_quota_exceeded"
+	case *api.ErrServicesQuotaExceeded:
+		code = "services_quota_exceeded"
+	case *api.ErrInstancesQuotaExceeded:
+		code = "instances_quota_exceeded"
+	case *api.ErrMetaTooLarge:
+		code = "meta_too_large"
+	case *api.ErrInvalidRejoinToken:
+		code = "invalid_rejoin_token"
+	case *forwardedError:
+		code, _ = encodeError(err.(*forwardedError).kind)
+	default:
+		if errors.Is(err, errNoLeader) {
+			code = "no_leader"
+		} else {
+			code = "error"
+		}
+	}
+	return code, err.Error()
+}
+func decodeError(code, message string) error {
+	if code == "no_leader" {
+		return errNoLeader
+	}
+	kind := forwardedErrorKinds[code]
+	if kind == nil {
+		return fmt.Errorf("%s", message)
+	}
+	return &forwardedError{
+		message: message,
+		kind:    kind,
+	}
+}
+
+// endregion
@@ -0,0 +1,800 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/backend/inmem/store"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"github.com/slink-go/logging"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var Backend redisBackendInitializer
+
+type redisBackendInitializer struct{}
+
+func (bi *redisBackendInitializer) Init(cfg *config.AppConfig) api.Registry {
+	client := redis.NewClient(&redis.Options{
+		Addr:     config.ReadStringOrDefault("DISCO_REDIS_ADDR", "localhost:6379"),
+		Password: config.ReadString("DISCO_REDIS_PASSWORD"),
+		DB:       config.ReadIntOrDefault("DISCO_REDIS_DB", 0),
+	})
+	prefix := config.ReadStringOrDefault("DISCO_REDIS_PREFIX", "disco")
+	registry, err := newRedisRegistry(cfg, common.SystemClock, client, prefix)
+	if err != nil {
+		panic(err)
+	}
+	registry.run(context.Background())
+	return registry
+}
+
+// region - keys
+
+// Data layout (all keys are prefixed with configured prefix):
+//
+//	tenants                  set of tenant names
+//	index                    hash client id -> tenant
+//	<tenant>:clients         set of tenant's client ids
+//	<tenant>:revision        tenant's change counter (used for dirty flag)
+//	<tenant>:client:<id>     client hash; expires after RemoveThreshold pings
+//	events                   pub/sub channel for registry events
+//	events_revision          registry events counter shared by disco instances
+
+const (
+	fieldClientId    = "id"
+	fieldServiceId   = "service"
+	fieldTenant      = "tenant"
+	fieldEndpoints   = "endpoints"
+	fieldMeta        = "meta"
+	fieldState       = "state"
+	fieldLastSeen    = "last_seen"
+	fieldLoad        = "load"
+	fieldCapacity    = "capacity"
+	fieldMaintenance = "maintenance"
+	fieldRevision    = "revision"
+)
+
+// compare-and-set client state; returns 1 if state was changed
+var casState = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "state") == ARGV[1] then
+	redis.call("HSET", KEYS[1], "state", ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// number event with shared events revision and publish it in one step, so
+// that all disco instances receive events in revision order; event is
+// published as "<revision> <event json>"
+var publishEvent = redis.NewScript(`
+local revision = redis.call("INCR", KEYS[1])
+redis.call("PUBLISH", ARGV[1], revision .. " " .. ARGV[2])
+return revision
+`)
+
+// refresh client's last seen time, ttl and reported load; returns 0 if client
+// is not found
+var touch = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], "last_seen", ARGV[1], "load", ARGV[3], "capacity", ARGV[4])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 1
+`)
+
+// refresh client's last seen time only; returns 0 if client is not found
+var alive = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], "last_seen", ARGV[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 1
+`)
+
+// set client's maintenance override; returns 0 if client is not found
+var maintain = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], "maintenance", ARGV[1])
+return 1
+`)
+
+// replace client's meta and mark tenant as changed; returns 0 if client is
+// not found
+var storeMeta = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], "meta", ARGV[1])
+redis.call("INCR", KEYS[2])
+return 1
+`)
+
+// store tenant's current revision as seen by the client; returns 1 if it
+// differs from previously seen one (i.e. there were changes in tenant)
+var acknowledge = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+local current = redis.call("GET", KEYS[2]) or "0"
+local seen = redis.call("HGET", KEYS[1], "revision") or "0"
+redis.call("HSET", KEYS[1], "revision", current)
+if seen ~= current then
+	return 1
+end
+return 0
+`)
+
+func (rs *redisRegistry) tenantsKey() string {
+	return rs.prefix + ":tenants"
+}
+func (rs *redisRegistry) indexKey() string {
+	return rs.prefix + ":index"
+}
+func (rs *redisRegistry) eventsChannel() string {
+	return rs.prefix + ":events"
+}
+func (rs *redisRegistry) eventsRevisionKey() string {
+	return rs.prefix + ":events_revision"
+}
+func (rs *redisRegistry) tenantClientsKey(tenant string) string {
+	return fmt.Sprintf("%s:%s:clients", rs.prefix, tenant)
+}
+func (rs *redisRegistry) tenantRevisionKey(tenant string) string {
+	return fmt.Sprintf("%s:%s:revision", rs.prefix, tenant)
+}
+func (rs *redisRegistry) clientKey(tenant, clientId string) string {
+	return fmt.Sprintf("%s:%s:client:%s", rs.prefix, tenant, clientId)
+}
+
+// endregion
+// region - registry
+
+type redisRegistry struct {
+	rdb              redis.UniversalClient
+	prefix           string
+	pingInterval     api.Duration
+	maxClients       int
+	quota            func(tenant string) config.Quota
+	failingThreshold time.Duration
+	downThreshold    time.Duration
+	removeThreshold  time.Duration
+	rejoinKey        []byte
+	clock            common.Clock
+	events           *common.EventBus
+	logger           logging.Logger
+}
+
+func newRedisRegistry(cfg *config.AppConfig, clock common.Clock, rdb redis.UniversalClient, prefix string) (*redisRegistry, error) {
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		return nil, fmt.Errorf("could not connect to redis: %w", err)
+	}
+	registry := redisRegistry{
+		rdb:              rdb,
+		prefix:           prefix,
+		pingInterval:     api.Duration{Duration: cfg.PingDuration},
+		maxClients:       cfg.MaxClients,
+		quota:            cfg.Quota,
+		failingThreshold: time.Duration(cfg.FailingThreshold) * cfg.PingDuration,
+		downThreshold:    time.Duration(cfg.DownThreshold) * cfg.PingDuration,
+		removeThreshold:  time.Duration(cfg.RemoveThreshold) * cfg.PingDuration,
+		rejoinKey:        common.NewRejoinKey(cfg.RejoinKey),
+		clock:            clock,
+		events:           common.NewEventBus(common.DefaultEventLogCapacity),
+		logger:           logging.GetLogger("reg-redis"),
+	}
+	if cfg.RejoinKey == "" {
+		registry.logger.Warning("rejoin key not set; rejoin tokens will not be accepted by other disco instances")
+	}
+	return &registry, nil
+}
+
+func (rs *redisRegistry) Join(ctx context.Context, request api.JoinRequest) (*api.JoinResponse, error) {
+	rs.logger.Debug("[registry][join] client join")
+	tnt := ctx.Value(api.TenantKey).(string)
+	c, err := common.NewClient(rs.clock, rs.createClientId(), request.ServiceId, tnt, request.Endpoints, request.Meta)
+	if err != nil {
+		return nil, err
+	}
+	if err = rs.register(ctx, c); err != nil {
+		return nil, err
+	}
+	rs.logger.Debug("[registry][join] client %s joined", c.ClientId())
+	return rs.joinResponse(c), nil
+}
+func (rs *redisRegistry) Rejoin(ctx context.Context, request api.RejoinRequest) (*api.JoinResponse, error) {
+	rs.logger.Debug("[registry][rejoin] client %s rejoin", request.ClientId)
+	tnt := ctx.Value(api.TenantKey).(string)
+	if !common.ValidRejoinToken(rs.rejoinKey, tnt, request.ClientId, request.Token) {
+		return nil, api.NewInvalidRejoinTokenError(request.ClientId)
+	}
+	existing, err := rs.rdb.HGet(ctx, rs.indexKey(), request.ClientId).Result()
+	if err == nil {
+		// client is still registered (e.g. ping was lost); nothing to restore
+		if existing != tnt {
+			return nil, api.NewInvalidRejoinTokenError(request.ClientId)
+		}
+		if _, err = rs.Ping(ctx, request.ClientId, api.Ping{}); err != nil {
+			return nil, err
+		}
+		c, err := rs.load(ctx, tnt, request.ClientId)
+		if err != nil {
+			return nil, err
+		}
+		return rs.joinResponse(c), nil
+	}
+	if !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	c, err := common.NewClient(rs.clock, request.ClientId, request.ServiceId, tnt, request.Endpoints, request.Meta)
+	if err != nil {
+		return nil, err
+	}
+	if err = rs.register(ctx, c); err != nil {
+		return nil, err
+	}
+	rs.logger.Debug("[registry][rejoin] client %s rejoined", c.ClientId())
+	return rs.joinResponse(c), nil
+}
+func (rs *redisRegistry) Leave(ctx context.Context, clientId string) error {
+	tnt, err := rs.rdb.HGet(ctx, rs.indexKey(), clientId).Result()
+	if errors.Is(err, redis.Nil) {
+		return api.NewClientNotFoundError(clientId)
+	}
+	if err != nil {
+		return err
+	}
+	if !common.Authorized(ctx, tnt) {
+		return api.NewTenantsClientNotFoundError(clientId)
+	}
+	c, err := rs.load(ctx, tnt, clientId)
+	if err != nil {
+		return err
+	}
+	rs.logger.Debug("[registry][leave] remove client %s", clientId)
+	return rs.remove(ctx, c)
+}
+func (rs *redisRegistry) List(ctx context.Context) []api.Client {
+	if ctx.Value(api.TenantKey) == nil || ctx.Value(api.TenantKey) == "" {
+		rs.logger.Warning("no tenant context set; return empty list")
+		return make([]api.Client, 0)
+	}
+	var clients []api.Client
+	tenant := ctx.Value(api.TenantKey).(string)
+	if tenant == api.TenantDefault || tenant == "" {
+		rs.logger.Debug("[list] list all")
+		for _, t := range rs.tenantNames(ctx) {
+			clients = append(clients, rs.tenantClients(ctx, t)...)
+		}
+	} else {
+		clients = rs.tenantClients(ctx, tenant)
+	}
+	rs.logger.Debug("[registry][list] list for %v (%d)", tenant, len(clients))
+	sort.Slice(clients, func(a, b int) bool {
+		if clients[a].ServiceId() != clients[b].ServiceId() {
+			return clients[a].ServiceId() < clients[b].ServiceId()
+		} else {
+			return clients[a].ClientId() < clients[b].ClientId()
+		}
+	})
+	return clients
+}
+func (rs *redisRegistry) ListAll() []api.Tenant {
+	ctx := context.Background()
+	var result []api.Tenant
+	for _, name := range rs.tenantNames(ctx) {
+		t := store.CreateTenant(name)
+		for _, c := range rs.tenantClients(ctx, name) {
+			t.Set(c.ClientId(), c)
+		}
+		result = append(result, t)
+	}
+	return result
+}
+func (rs *redisRegistry) Ping(ctx context.Context, clientId string, ping api.Ping) (api.Pong, error) {
+	tnt, err := rs.rdb.HGet(ctx, rs.indexKey(), clientId).Result()
+	if errors.Is(err, redis.Nil) {
+		return api.Pong{}, api.NewClientNotFoundError(clientId)
+	}
+	if err != nil {
+		return api.Pong{}, err
+	}
+	if !common.Authorized(ctx, tnt) {
+		return api.Pong{}, api.NewTenantsClientNotFoundError(clientId)
+	}
+	c, err := rs.load(ctx, tnt, clientId)
+	if err != nil {
+		return api.Pong{}, err
+	}
+	if err = rs.updateMeta(ctx, c, ping.Meta); err != nil {
+		return api.Pong{}, err
+	}
+	keys := []string{rs.clientKey(tnt, clientId), rs.tenantRevisionKey(tnt)}
+	found, err := touch.Run(ctx, rs.rdb, keys, rs.clock.Now().UnixNano(), rs.removeThreshold.Milliseconds(), ping.Load, ping.Capacity).Int()
+	if err != nil {
+		return api.Pong{}, err
+	}
+	if found == 0 {
+		return api.Pong{}, api.NewClientNotFoundError(clientId)
+	}
+	if state := common.PingState(ping, c.Maintenance()); c.State() != state {
+		if err = rs.transition(ctx, c, state); err != nil {
+			return api.Pong{}, err
+		}
+		rs.logger.Info("client %s (%s) %s", c.ClientId(), c.ServiceId(), strings.ToLower(state.String()))
+	}
+
+	response := api.PongTypeOk
+	dirty, err := acknowledge.Run(ctx, rs.rdb, keys).Int()
+	if err != nil {
+		return api.Pong{}, err
+	}
+	if dirty == 1 {
+		response = api.PongTypeChanged
+	}
+	rs.logger.Debug("[registry][ping] client '%s' ping: '%s'", clientId, response)
+	return api.Pong{
+		Response: response,
+	}, nil
+}
+func (rs *redisRegistry) MarkAlive(ctx context.Context, clientId string) error {
+	tnt, err := rs.rdb.HGet(ctx, rs.indexKey(), clientId).Result()
+	if errors.Is(err, redis.Nil) {
+		return api.NewClientNotFoundError(clientId)
+	}
+	if err != nil {
+		return err
+	}
+	if !common.Authorized(ctx, tnt) {
+		return api.NewTenantsClientNotFoundError(clientId)
+	}
+	c, err := rs.load(ctx, tnt, clientId)
+	if err != nil {
+		return err
+	}
+	found, err := alive.Run(ctx, rs.rdb, []string{rs.clientKey(tnt, clientId)}, rs.clock.Now().UnixNano(), rs.removeThreshold.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if found == 0 {
+		return api.NewClientNotFoundError(clientId)
+	}
+	if state := common.AliveState(c.State(), c.Maintenance()); c.State() != state {
+		if err = rs.transition(ctx, c, state); err != nil {
+			return err
+		}
+		rs.logger.Info("client %s (%s) %s", c.ClientId(), c.ServiceId(), strings.ToLower(state.String()))
+	}
+	rs.logger.Debug("[registry][alive] client '%s' is alive", clientId)
+	return nil
+}
+func (rs *redisRegistry) SetMaintenance(clientId string, enabled bool) error {
+	ctx := context.Background()
+	tnt, err := rs.rdb.HGet(ctx, rs.indexKey(), clientId).Result()
+	if errors.Is(err, redis.Nil) {
+		return api.NewClientNotFoundError(clientId)
+	}
+	if err != nil {
+		return err
+	}
+	c, err := rs.load(ctx, tnt, clientId)
+	if err != nil {
+		return err
+	}
+	flag := 0
+	if enabled {
+		flag = 1
+	}
+	found, err := maintain.Run(ctx, rs.rdb, []string{rs.clientKey(tnt, clientId)}, flag).Int()
+	if err != nil {
+		return err
+	}
+	if found == 0 {
+		return api.NewClientNotFoundError(clientId)
+	}
+	if state := common.MaintenanceState(c.State(), enabled); c.State() != state {
+		if err = rs.transition(ctx, c, state); err != nil {
+			return err
+		}
+	}
+	rs.logger.Info("client %s (%s) maintenance: %v", clientId, c.ServiceId(), enabled)
+	return nil
+}
+func (rs *redisRegistry) UpdateMeta(ctx context.Context, clientId string, delta map[string]any) error {
+	tnt, err := rs.rdb.HGet(ctx, rs.indexKey(), clientId).Result()
+	if errors.Is(err, redis.Nil) {
+		return api.NewClientNotFoundError(clientId)
+	}
+	if err != nil {
+		return err
+	}
+	if !common.Authorized(ctx, tnt) {
+		return api.NewTenantsClientNotFoundError(clientId)
+	}
+	c, err := rs.load(ctx, tnt, clientId)
+	if err != nil {
+		return err
+	}
+	return rs.updateMeta(ctx, c, delta)
+}
+func (rs *redisRegistry) Watch(ctx context.Context, revision uint64) (*api.WatchResponse, error) {
+	tenant, _ := ctx.Value(api.TenantKey).(string)
+	if tenant == "" {
+		rs.logger.Warning("no tenant context set; return empty watch response")
+		return &api.WatchResponse{Revision: rs.events.Revision(), Events: []api.Event{}}, nil
+	}
+	return rs.events.Wait(ctx, tenant, revision)
+}
+func (rs *redisRegistry) Subscribe(handler api.EventHandler) func() {
+	return rs.events.Subscribe(handler)
+}
+
+// endregion
+// region - storage
+
+func (rs *redisRegistry) register(ctx context.Context, c api.Client) error {
+	size, err := rs.rdb.HLen(ctx, rs.indexKey()).Result()
+	if err != nil {
+		return err
+	}
+	if int(size) >= rs.maxClients {
+		return api.NewMaxClientsReachedError(rs.maxClients)
+	}
+	if rs.has(ctx, c) {
+		return api.NewAlreadyRegisteredError()
+	}
+	if err = rs.checkQuota(ctx, c); err != nil {
+		return err
+	}
+	endpoints, err := json.Marshal(endpointUrls(c.Endpoints()))
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(c.Meta())
+	if err != nil {
+		return err
+	}
+	key := rs.clientKey(c.Tenant(), c.ClientId())
+	pipe := rs.rdb.TxPipeline()
+	pipe.HSet(ctx, key,
+		fieldClientId, c.ClientId(),
+		fieldServiceId, c.ServiceId(),
+		fieldTenant, c.Tenant(),
+		fieldEndpoints, endpoints,
+		fieldMeta, meta,
+		fieldState, c.State().String(),
+		fieldLastSeen, c.LastSeen().UnixNano(),
+		fieldRevision, 0,
+	)
+	pipe.Expire(ctx, key, rs.removeThreshold)
+	pipe.SAdd(ctx, rs.tenantsKey(), c.Tenant())
+	pipe.SAdd(ctx, rs.tenantClientsKey(c.Tenant()), c.ClientId())
+	pipe.HSet(ctx, rs.indexKey(), c.ClientId(), c.Tenant())
+	pipe.Incr(ctx, rs.tenantRevisionKey(c.Tenant()))
+	if _, err = pipe.Exec(ctx); err != nil {
+		return err
+	}
+	rs.publish(ctx, common.NewClientJoinedEvent(c))
+	return nil
+}
+func (rs *redisRegistry) remove(ctx context.Context, c api.Client) error {
+	removed, err := rs.rdb.HDel(ctx, rs.indexKey(), c.ClientId()).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return nil // already removed (by another disco instance)
+	}
+	rs.logger.Info("removing client %s (%s)", c.ClientId(), c.ServiceId())
+	pipe := rs.rdb.TxPipeline()
+	pipe.Del(ctx, rs.clientKey(c.Tenant(), c.ClientId()))
+	pipe.SRem(ctx, rs.tenantClientsKey(c.Tenant()), c.ClientId())
+	pipe.Incr(ctx, rs.tenantRevisionKey(c.Tenant()))
+	if _, err = pipe.Exec(ctx); err != nil {
+		return err
+	}
+	prev := c.State()
+	c.SetState(api.ClientStateRemoved)
+	rs.publish(ctx, common.NewStateChangedEvent(c, prev))
+	rs.publish(ctx, common.NewClientLeftEvent(c, prev))
+	return nil
+}
+func (rs *redisRegistry) transition(ctx context.Context, c api.Client, state api.ClientState) error {
+	prev := c.State()
+	changed, err := casState.Run(ctx, rs.rdb, []string{rs.clientKey(c.Tenant(), c.ClientId())}, prev.String(), state.String()).Int()
+	if err != nil {
+		return err
+	}
+	if changed == 0 {
+		return nil // someone else has already changed client's state
+	}
+	c.SetState(state)
+	if err = rs.rdb.Incr(ctx, rs.tenantRevisionKey(c.Tenant())).Err(); err != nil {
+		return err
+	}
+	rs.publish(ctx, common.NewStateChangedEvent(c, prev))
+	return nil
+}
+func (rs *redisRegistry) updateMeta(ctx context.Context, c api.Client, delta map[string]any) error {
+	if len(delta) == 0 {
+		return nil
+	}
+	meta := common.MergeMeta(c.Meta(), delta)
+	if reflect.DeepEqual(meta, c.Meta()) {
+		return nil
+	}
+	if err := common.CheckMetaSize(rs.quota(c.Tenant()), meta); err != nil {
+		return err
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	keys := []string{rs.clientKey(c.Tenant(), c.ClientId()), rs.tenantRevisionKey(c.Tenant())}
+	found, err := storeMeta.Run(ctx, rs.rdb, keys, data).Int()
+	if err != nil {
+		return err
+	}
+	if found == 0 {
+		return api.NewClientNotFoundError(c.ClientId())
+	}
+	c.SetMeta(meta)
+	rs.publish(ctx, common.NewMetaUpdatedEvent(c))
+	rs.logger.Debug("[registry][meta] client '%s' meta updated", c.ClientId())
+	return nil
+}
+
+func (rs *redisRegistry) load(ctx context.Context, tenant, clientId string) (api.Client, error) {
+	values, err := rs.rdb.HGetAll(ctx, rs.clientKey(tenant, clientId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, api.NewClientNotFoundError(clientId)
+	}
+	var endpoints []string
+	if err = json.Unmarshal([]byte(values[fieldEndpoints]), &endpoints); err != nil {
+		return nil, err
+	}
+	var meta map[string]any
+	if err = json.Unmarshal([]byte(values[fieldMeta]), &meta); err != nil {
+		return nil, err
+	}
+	var state api.ClientState
+	if err = state.UnmarshalJSON([]byte(strconv.Quote(values[fieldState]))); err != nil {
+		return nil, err
+	}
+	lastSeen, err := strconv.ParseInt(values[fieldLastSeen], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	c, err := common.RestoreClient(rs.clock, clientId, values[fieldServiceId], tenant, endpoints, meta, state, time.Unix(0, lastSeen))
+	if err != nil {
+		return nil, err
+	}
+	// load is reported with pings only, so it is absent until the first one
+	load, _ := strconv.Atoi(values[fieldLoad])
+	capacity, _ := strconv.Atoi(values[fieldCapacity])
+	c.SetLoad(load, capacity)
+	c.SetMaintenance(values[fieldMaintenance] == "1")
+	return c, nil
+}
+func (rs *redisRegistry) tenantNames(ctx context.Context) []string {
+	names, err := rs.rdb.SMembers(ctx, rs.tenantsKey()).Result()
+	if err != nil {
+		rs.logger.Warning("could not read tenants: %s", err.Error())
+		return nil
+	}
+	sort.Strings(names)
+	return names
+}
+func (rs *redisRegistry) tenantClients(ctx context.Context, tenant string) []api.Client {
+	ids, err := rs.rdb.SMembers(ctx, rs.tenantClientsKey(tenant)).Result()
+	if err != nil {
+		rs.logger.Warning("could not read tenant %s clients: %s", tenant, err.Error())
+		return nil
+	}
+	var result []api.Client
+	for _, id := range ids {
+		c, err := rs.load(ctx, tenant, id)
+		if err != nil {
+			continue // expired; will be cleaned up by runner
+		}
+		result = append(result, c)
+	}
+	return result
+}
+func (rs *redisRegistry) has(ctx context.Context, client api.Client) bool {
+	for _, c := range rs.tenantClients(ctx, client.Tenant()) {
+		if rs.equalClients(c, client) {
+			return true
+		}
+	}
+	return false
+}
+func (rs *redisRegistry) checkQuota(ctx context.Context, client api.Client) error {
+	var services []string
+	for _, c := range rs.tenantClients(ctx, client.Tenant()) {
+		services = append(services, c.ServiceId())
+	}
+	return common.CheckQuota(rs.quota(client.Tenant()), client.Tenant(), client.ServiceId(), client.Meta(), services)
+}
+func (rs *redisRegistry) equalClients(a, b api.Client) bool {
+	return a.ServiceId() == b.ServiceId() &&
+		reflect.DeepEqual(endpointUrls(a.Endpoints()), endpointUrls(b.Endpoints())) &&
+		reflect.DeepEqual(a.Meta(), b.Meta())
+}
+func (rs *redisRegistry) createClientId() string {
+	u, err := uuid.NewUUID()
+	if err != nil {
+		panic(err)
+	}
+	return u.String()
+}
+func (rs *redisRegistry) joinResponse(client api.Client) *api.JoinResponse {
+	return &api.JoinResponse{
+		ClientId:     client.ClientId(),
+		PingInterval: rs.pingInterval,
+		Token:        common.NewRejoinToken(rs.rejoinKey, client.Tenant(), client.ClientId()),
+	}
+}
+
+// endregion
+// region - events
+
+// publish sends event to all disco instances sharing redis (including this
+// one); received events are fed into local event bus by listen. Events are
+// numbered in redis, so watcher may continue watching with any instance
+func (rs *redisRegistry) publish(ctx context.Context, event api.Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		rs.logger.Warning("could not marshal event: %s", err.Error())
+		return
+	}
+	if err = publishEvent.Run(ctx, rs.rdb, []string{rs.eventsRevisionKey()}, rs.eventsChannel(), data).Err(); err != nil {
+		rs.logger.Warning("could not publish event: %s", err.Error())
+	}
+}
+func (rs *redisRegistry) listen(ctx context.Context) {
+	sub := rs.rdb.Subscribe(ctx, rs.eventsChannel())
+	// make sure subscription is active before any event is published
+	if _, err := sub.Receive(ctx); err != nil {
+		rs.logger.Warning("could not subscribe to registry events: %s", err.Error())
+	}
+	// events published before are not known to this instance
+	revision, err := rs.rdb.Get(ctx, rs.eventsRevisionKey()).Uint64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		rs.logger.Warning("could not read events revision: %s", err.Error())
+	}
+	rs.events.Advance(revision)
+	go func() {
+		defer func() {
+			_ = sub.Close()
+		}()
+		for msg := range sub.Channel() {
+			event, err := parseEvent(msg.Payload)
+			if err != nil {
+				rs.logger.Warning("could not parse event: %s", err.Error())
+				continue
+			}
+			rs.events.PublishNumbered(event)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = sub.Close()
+	}()
+}
+
+// parseEvent parses event message sent by publish
+func parseEvent(payload string) (api.Event, error) {
+	var event api.Event
+	revision, data, ok := strings.Cut(payload, " ")
+	if !ok {
+		return event, fmt.Errorf("unexpected event message %q", payload)
+	}
+	err := json.Unmarshal([]byte(data), &event)
+	if err == nil {
+		event.Revision, err = strconv.ParseUint(revision, 10, 64)
+	}
+	return event, err
+}
+
+// endregion
+// region - runner
+
+func (rs *redisRegistry) run(ctx context.Context) {
+	rs.listen(ctx)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				rs.check(ctx, rs.clock.Now())
+			}
+		}
+	}()
+}
+func (rs *redisRegistry) check(ctx context.Context, now time.Time) {
+	for _, tenant := range rs.tenantNames(ctx) {
+		ids, err := rs.rdb.SMembers(ctx, rs.tenantClientsKey(tenant)).Result()
+		if err != nil {
+			continue
+		}
+		for _, id := range ids {
+			c, err := rs.load(ctx, tenant, id)
+			if errors.Is(err, api.NewClientNotFoundError(id)) {
+				rs.expired(ctx, tenant, id)
+				continue
+			}
+			if err != nil {
+				continue
+			}
+			rs.runner(ctx, c, now)
+		}
+	}
+}
+func (rs *redisRegistry) runner(ctx context.Context, c api.Client, now time.Time) {
+	interval := now.Sub(c.LastSeen())
+	var err error
+	if rs.removeThreshold < interval {
+		err = rs.remove(ctx, c)
+	} else if rs.downThreshold < interval {
+		if c.State() != api.ClientStateDown {
+			err = rs.transition(ctx, c, api.ClientStateDown)
+			rs.logger.Info("client %s (%s) down", c.ClientId(), c.ServiceId())
+		}
+	} else if rs.failingThreshold < interval {
+		if c.State() != api.ClientStateFailing {
+			err = rs.transition(ctx, c, api.ClientStateFailing)
+			rs.logger.Info("client %s (%s) failing", c.ClientId(), c.ServiceId())
+		}
+	}
+	if err != nil {
+		rs.logger.Warning("could not update client %s: %s", c.ClientId(), err.Error())
+	}
+}
+
+// expired cleans up indexes for client whose hash was expired by redis
+func (rs *redisRegistry) expired(ctx context.Context, tenant, clientId string) {
+	removed, err := rs.rdb.HDel(ctx, rs.indexKey(), clientId).Result()
+	if err != nil || removed == 0 {
+		return
+	}
+	rs.rdb.SRem(ctx, rs.tenantClientsKey(tenant), clientId)
+	rs.rdb.Incr(ctx, rs.tenantRevisionKey(tenant))
+	rs.logger.Info("client %s expired", clientId)
+	rs.publish(ctx, api.Event{
+		Type:      api.EventTypeLeft,
+		Tenant:    tenant,
+		ClientId:  clientId,
+		PrevState: api.ClientStateDown,
+		State:     api.ClientStateRemoved,
+	})
+}
+
+// endregion
+
+func endpointUrls(endpoints []api.Endpoint) []string {
+	var result []string
+	for _, e := range endpoints {
+		result = append(result, e.Url())
+	}
+	return result
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/backend/registrytest"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"testing"
+	"time"
+)
+
+func testRegistry(t *testing.T, m *miniredis.Miniredis) *redisRegistry {
+	rs, err := newRedisRegistry(registrytest.Config(), common.SystemClock, redis.NewClient(&redis.Options{Addr: m.Addr()}), "disco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+func TestExpiry(t *testing.T) {
+	m := miniredis.RunT(t)
+	rs := testRegistry(t, m)
+	ctx := registrytest.Tenant("tenant")
+	resp, err := rs.Join(ctx, api.JoinRequest{ServiceId: "SVC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Exists(rs.clientKey("tenant", resp.ClientId)) {
+		t.Fatal("expected client to be stored")
+	}
+
+	// client key expires even if no disco instance runs failure detection
+	m.FastForward(9 * time.Second)
+	if m.Exists(rs.clientKey("tenant", resp.ClientId)) {
+		t.Errorf("expected client key to expire")
+	}
+	rs.check(ctx, time.Now())
+	if len(rs.List(ctx)) != 0 {
+		t.Errorf("expected expired client to be removed")
+	}
+	if _, err = rs.Ping(ctx, resp.ClientId, api.Ping{}); !errors.Is(err, api.NewClientNotFoundError(resp.ClientId)) {
+		t.Errorf("expected expired client not found, got %v", err)
+	}
+}
+func TestEventsPubSub(t *testing.T) {
+	m := miniredis.RunT(t)
+	first, second := testRegistry(t, m), testRegistry(t, m)
+	ctx, cancel := context.WithCancel(registrytest.Tenant("tenant"))
+	defer cancel()
+	first.listen(ctx)
+	second.listen(ctx)
+
+	events := make(chan api.Event, 10)
+	second.Subscribe(func(event api.Event) {
+		events <- event
+	})
+	next := func() api.Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("event not received")
+		}
+		return api.Event{}
+	}
+
+	// events of one disco instance are delivered to the others
+	resp, err := first.Join(ctx, api.JoinRequest{ServiceId: "SVC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Type != api.EventTypeJoined || e.ServiceId != "SVC" {
+		t.Errorf("unexpected event: %v", e)
+	}
+	if err = first.UpdateMeta(ctx, resp.ClientId, map[string]any{"version": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	updated := next()
+	if updated.Type != api.EventTypeMetaUpdated || updated.Meta["version"] != "2" {
+		t.Errorf("unexpected event: %v", updated)
+	}
+
+	// events are numbered in redis, so watch may be continued with any
+	// instance; instance which has not seen older events reports them compacted
+	for _, rs := range []*redisRegistry{first, second} {
+		resp, err := rs.Watch(ctx, updated.Revision-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Events) != 1 || resp.Events[0].Revision != updated.Revision || resp.Revision != updated.Revision {
+			t.Errorf("unexpected watch response: %+v", resp)
+		}
+	}
+	third := testRegistry(t, m)
+	third.listen(ctx)
+	if err = first.Leave(ctx, resp.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = third.Watch(ctx, updated.Revision-1); !errors.Is(err, api.NewRevisionCompactedError(updated.Revision-1)) {
+		t.Errorf("expected revision compacted error, got %v", err)
+	}
+	watchCtx, cancelWatch := context.WithTimeout(ctx, time.Second)
+	defer cancelWatch()
+	left, err := third.Watch(watchCtx, updated.Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left.Events) == 0 || left.Events[0].Revision != updated.Revision+1 {
+		t.Errorf("expected third instance to continue watch, got %+v", left)
+	}
+}
+func TestConformance(t *testing.T) {
+	registrytest.Run(t, func(t *testing.T, cfg *config.AppConfig, clock common.Clock) registrytest.Subject {
+		m := miniredis.RunT(t)
+		rs, err := newRedisRegistry(cfg, clock, redis.NewClient(&redis.Options{Addr: m.Addr()}), "disco")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		rs.listen(ctx)
+		return registrytest.Subject{Registry: rs, Check: func(now time.Time) {
+			rs.check(context.Background(), now)
+		}}
+	})
+}
@@ -0,0 +1,647 @@
+// Package registrytest provides conformance tests for api.Registry
+// implementations, so every backend has identical registry semantics.
+//
+// Backend runs the suite from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		registrytest.Run(t, func(t *testing.T, cfg *config.AppConfig, clock common.Clock) registrytest.Subject {
+//			rs := newRegistry(cfg, clock)
+//			return registrytest.Subject{Registry: rs, Check: rs.check}
+//		})
+//	}
+package registrytest
+
+import (
+	"context"
+	"errors"
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Subject is a registry under test
+type Subject struct {
+	Registry api.Registry
+	// Check runs single failure detection pass as of given time
+	Check func(now time.Time)
+}
+
+// Factory creates new empty registry for given configuration; registry
+// should take current time (e.g. client's last seen time) from clock
+type Factory func(t *testing.T, cfg *config.AppConfig, clock common.Clock) Subject
+
+// Config returns configuration registries are created with by the suite
+func Config() *config.AppConfig {
+	return &config.AppConfig{
+		PingDuration:     time.Second,
+		FailingThreshold: 2,
+		DownThreshold:    4,
+		RemoveThreshold:  8,
+		MaxClients:       8,
+		RejoinKey:        "registrytest-rejoin-key",
+		TenantQuotas: map[string]config.Quota{
+			"limited":          {MaxClients: 3, MaxInstances: 2, MaxMetaSize: 32},
+			"limited-services": {MaxServices: 2},
+		},
+	}
+}
+
+// Run runs conformance suite against registries created by factory
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s Subject, clock *common.ManualClock)
+	}{
+		{"JoinPingLeave", testJoinPingLeave},
+		{"TenantIsolation", testTenantIsolation},
+		{"DuplicateRegistration", testDuplicateRegistration},
+		{"MaxClientsReached", testMaxClientsReached},
+		{"TenantQuotas", testTenantQuotas},
+		{"DirtySignalling", testDirtySignalling},
+		{"StateTransitions", testStateTransitions},
+		{"ReportedStatus", testReportedStatus},
+		{"Maintenance", testMaintenance},
+		{"MarkAlive", testMarkAlive},
+		{"UpdateMeta", testUpdateMeta},
+		{"Rejoin", testRejoin},
+		{"Watch", testWatch},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := common.NewManualClock(time.Now())
+			tc.test(t, factory(t, Config(), clock), clock)
+		})
+	}
+}
+
+// region - helpers
+
+func Tenant(tenant string) context.Context {
+	return context.WithValue(context.Background(), api.TenantKey, tenant)
+}
+func join(t *testing.T, r api.Registry, tenant, service string, meta map[string]any) *api.JoinResponse {
+	t.Helper()
+	resp, err := r.Join(Tenant(tenant), api.JoinRequest{
+		ServiceId: service,
+		Endpoints: []string{"http://localhost:8080"},
+		Meta:      meta,
+	})
+	if err != nil {
+		t.Fatalf("join %s/%s: %s", tenant, service, err)
+	}
+	return resp
+}
+
+// ping pings client within default tenant, which may access clients of any
+// tenant
+func ping(t *testing.T, r api.Registry, clientId string) api.PongType {
+	t.Helper()
+	pong, err := r.Ping(Tenant(api.TenantDefault), clientId, api.Ping{})
+	if err != nil {
+		t.Fatalf("ping %s: %s", clientId, err)
+	}
+	return pong.Response
+}
+
+// settle pings client until registry has no pending changes for it
+func settle(t *testing.T, r api.Registry, clientId string) {
+	t.Helper()
+	for i := 0; i < 3; i++ {
+		if ping(t, r, clientId) == api.PongTypeOk {
+			return
+		}
+	}
+	t.Fatalf("client %s is still dirty", clientId)
+}
+func find(r api.Registry, tenant, clientId string) api.Client {
+	for _, c := range r.List(Tenant(tenant)) {
+		if c.ClientId() == clientId {
+			return c
+		}
+	}
+	return nil
+}
+func expectState(t *testing.T, r api.Registry, tenant, clientId string, state api.ClientState) {
+	t.Helper()
+	c := find(r, tenant, clientId)
+	if c == nil {
+		t.Fatalf("client %s not found", clientId)
+	}
+	if c.State() != state {
+		t.Errorf("expected client %s to be %s, got %s", clientId, state, c.State())
+	}
+}
+
+// await reads subscribed events until the one of given type for given client
+// arrives; returns all events read
+func await(t *testing.T, events <-chan api.Event, typ api.EventType, clientId string) []api.Event {
+	t.Helper()
+	var result []api.Event
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			result = append(result, e)
+			if e.Type == typ && e.ClientId == clientId {
+				return result
+			}
+		case <-timeout:
+			t.Fatalf("%s event for client %s not received", typ, clientId)
+		}
+	}
+}
+func watch(t *testing.T, r api.Registry, tenant string, revision uint64) *api.WatchResponse {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(Tenant(tenant), 5*time.Second)
+	defer cancel()
+	resp, err := r.Watch(ctx, revision)
+	if err != nil {
+		t.Fatalf("watch %s from %d: %s", tenant, revision, err)
+	}
+	return resp
+}
+func contains(events []api.Event, typ api.EventType, clientId string) bool {
+	for _, e := range events {
+		if e.Type == typ && e.ClientId == clientId {
+			return true
+		}
+	}
+	return false
+}
+func expectOrdered(t *testing.T, events []api.Event, after uint64) {
+	t.Helper()
+	for _, e := range events {
+		if e.Revision <= after {
+			t.Errorf("expected revision greater than %d, got %d (%s)", after, e.Revision, e.Type)
+		}
+		after = e.Revision
+	}
+}
+
+// endregion
+// region - tests
+
+func testJoinPingLeave(t *testing.T, s Subject, _ *common.ManualClock) {
+	r := s.Registry
+	resp := join(t, r, "tenant", "SVC", nil)
+	if resp.ClientId == "" || resp.Token == "" {
+		t.Errorf("expected client id and rejoin token, got %+v", resp)
+	}
+	if resp.PingInterval.Duration != Config().PingDuration {
+		t.Errorf("expected ping interval %s, got %s", Config().PingDuration, resp.PingInterval.Duration)
+	}
+	expectState(t, r, "tenant", resp.ClientId, api.ClientStateStarting)
+	if pong := ping(t, r, resp.ClientId); pong != api.PongTypeChanged {
+		t.Errorf("expected first ping to return %s, got %s", api.PongTypeChanged, pong)
+	}
+	if pong := ping(t, r, resp.ClientId); pong != api.PongTypeOk {
+		t.Errorf("expected second ping to return %s, got %s", api.PongTypeOk, pong)
+	}
+	expectState(t, r, "tenant", resp.ClientId, api.ClientStateUp)
+
+	if err := r.Leave(Tenant("tenant"), resp.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Ping(Tenant("tenant"), resp.ClientId, api.Ping{}); !errors.Is(err, api.NewClientNotFoundError(resp.ClientId)) {
+		t.Errorf("expected client not found on ping after leave, got %v", err)
+	}
+	if err := r.Leave(Tenant("tenant"), resp.ClientId); !errors.Is(err, api.NewClientNotFoundError(resp.ClientId)) {
+		t.Errorf("expected client not found on second leave, got %v", err)
+	}
+	if len(r.List(Tenant("tenant"))) != 0 {
+		t.Errorf("expected empty list after leave")
+	}
+}
+func testTenantIsolation(t *testing.T, s Subject, _ *common.ManualClock) {
+	r := s.Registry
+	a := join(t, r, "tenant-a", "SVC", nil)
+	b := join(t, r, "tenant-b", "SVC", nil)
+
+	for tenant, id := range map[string]string{"tenant-a": a.ClientId, "tenant-b": b.ClientId} {
+		list := r.List(Tenant(tenant))
+		if len(list) != 1 || list[0].ClientId() != id || list[0].Tenant() != tenant {
+			t.Errorf("expected only own client in %s, got %v", tenant, list)
+		}
+	}
+	if list := r.List(Tenant("tenant-c")); len(list) != 0 {
+		t.Errorf("expected empty list for unknown tenant, got %v", list)
+	}
+	if list := r.List(Tenant(api.TenantDefault)); len(list) != 2 {
+		t.Errorf("expected default tenant to see all clients, got %v", list)
+	}
+	if list := r.List(context.Background()); len(list) != 0 {
+		t.Errorf("expected empty list without tenant, got %v", list)
+	}
+	tenants := map[string]int{}
+	for _, tnt := range r.ListAll() {
+		tenants[tnt.Name()] = len(tnt.Clients())
+	}
+	if tenants["tenant-a"] != 1 || tenants["tenant-b"] != 1 {
+		t.Errorf("expected both tenants listed, got %v", tenants)
+	}
+
+	// other tenant's clients can neither be pinged nor removed
+	if _, err := r.Ping(Tenant("tenant-b"), a.ClientId, api.Ping{}); !errors.Is(err, api.NewTenantsClientNotFoundError(a.ClientId)) {
+		t.Errorf("expected tenant's client not found on ping, got %v", err)
+	}
+	if _, err := r.Ping(context.Background(), a.ClientId, api.Ping{}); !errors.Is(err, api.NewTenantsClientNotFoundError(a.ClientId)) {
+		t.Errorf("expected tenant's client not found on ping without tenant, got %v", err)
+	}
+	if err := r.Leave(Tenant("tenant-b"), a.ClientId); !errors.Is(err, api.NewTenantsClientNotFoundError(a.ClientId)) {
+		t.Errorf("expected tenant's client not found on leave, got %v", err)
+	}
+	if list := r.List(Tenant("tenant-a")); len(list) != 1 {
+		t.Errorf("expected client to be kept, got %v", list)
+	}
+	if _, err := r.Ping(Tenant("tenant-a"), a.ClientId, api.Ping{}); err != nil {
+		t.Errorf("expected own client to be pinged, got %v", err)
+	}
+	if err := r.Leave(Tenant(api.TenantDefault), b.ClientId); err != nil {
+		t.Errorf("expected default tenant to remove any client, got %v", err)
+	}
+}
+func testDuplicateRegistration(t *testing.T, s Subject, _ *common.ManualClock) {
+	r := s.Registry
+	join(t, r, "tenant", "SVC", map[string]any{"zone": "eu-1"})
+
+	_, err := r.Join(Tenant("tenant"), api.JoinRequest{
+		ServiceId: "SVC",
+		Endpoints: []string{"http://localhost:8080"},
+		Meta:      map[string]any{"zone": "eu-1"},
+	})
+	if !errors.Is(err, api.NewAlreadyRegisteredError()) {
+		t.Errorf("expected already registered error, got %v", err)
+	}
+	// same registration in other tenant or with other meta is another client
+	join(t, r, "other", "SVC", map[string]any{"zone": "eu-1"})
+	join(t, r, "tenant", "SVC", map[string]any{"zone": "eu-2"})
+}
+func testMaxClientsReached(t *testing.T, s Subject, _ *common.ManualClock) {
+	r := s.Registry
+	max := Config().MaxClients
+	for i := 0; i < max; i++ {
+		join(t, r, "tenant", "SVC", map[string]any{"n": i})
+	}
+	_, err := r.Join(Tenant("other"), api.JoinRequest{ServiceId: "SVC"})
+	if !errors.Is(err, api.NewMaxClientsReachedError(max)) {
+		t.Errorf("expected max clients reached error, got %v", err)
+	}
+}
+func testTenantQuotas(t *testing.T, s Subject, _ *common.ManualClock) {
+	r := s.Registry
+	request := func(service string, n int) api.JoinRequest {
+		return api.JoinRequest{ServiceId: service, Meta: map[string]any{"n": n}}
+	}
+	a := join(t, r, "limited", "A", map[string]any{"n": 1})
+	join(t, r, "limited", "A", map[string]any{"n": 2})
+	if _, err := r.Join(Tenant("limited"), request("A", 3)); !errors.Is(err, &api.ErrInstancesQuotaExceeded{}) {
+		t.Errorf("expected instances quota exceeded, got %v", err)
+	}
+	join(t, r, "limited", "B", map[string]any{"n": 1})
+	if _, err := r.Join(Tenant("limited"), request("B", 2)); !errors.Is(err, &api.ErrClientsQuotaExceeded{}) {
+		t.Errorf("expected clients quota exceeded, got %v", err)
+	}
+	meta := map[string]any{"description": "meta which does not fit tenant's quota"}
+	if _, err := r.Join(Tenant("limited"), api.JoinRequest{ServiceId: "C", Meta: meta}); !errors.Is(err, &api.ErrMetaTooLarge{}) {
+		t.Errorf("expected meta too large, got %v", err)
+	}
+	// leaving client frees quota
+	if err := r.Leave(Tenant("limited"), a.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	join(t, r, "limited", "A", map[string]any{"n": 3})
+
+	join(t, r, "limited-services", "A", nil)
+	join(t, r, "limited-services", "B", nil)
+	join(t, r, "limited-services", "B", map[string]any{"n": 2})
+	if _, err := r.Join(Tenant("limited-services"), request("C", 1)); !errors.Is(err, &api.ErrServicesQuotaExceeded{}) {
+		t.Errorf("expected services quota exceeded, got %v", err)
+	}
+	// other tenants are not limited
+	join(t, r, "tenant", "C", meta)
+}
+func testDirtySignalling(t *testing.T, s Subject, _ *common.ManualClock) {
+	r := s.Registry
+	a := join(t, r, "tenant", "A", nil)
+	settle(t, r, a.ClientId)
+
+	// changes in other tenant are not visible
+	join(t, r, "other", "B", nil)
+	if pong := ping(t, r, a.ClientId); pong != api.PongTypeOk {
+		t.Errorf("expected %s after other tenant's join, got %s", api.PongTypeOk, pong)
+	}
+
+	b := join(t, r, "tenant", "B", nil)
+	if pong := ping(t, r, a.ClientId); pong != api.PongTypeChanged {
+		t.Errorf("expected %s after join, got %s", api.PongTypeChanged, pong)
+	}
+	if pong := ping(t, r, a.ClientId); pong != api.PongTypeOk {
+		t.Errorf("expected change to be reported once, got %s", pong)
+	}
+	settle(t, r, b.ClientId)
+
+	if err := r.Leave(Tenant("tenant"), b.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	if pong := ping(t, r, a.ClientId); pong != api.PongTypeChanged {
+		t.Errorf("expected %s after leave, got %s", api.PongTypeChanged, pong)
+	}
+}
+func testStateTransitions(t *testing.T, s Subject, clock *common.ManualClock) {
+	r := s.Registry
+	cfg := Config()
+	a := join(t, r, "tenant", "A", nil)
+	b := join(t, r, "tenant", "B", nil)
+	settle(t, r, a.ClientId)
+	settle(t, r, b.ClientId)
+
+	s.Check(clock.Now())
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateUp)
+
+	s.Check(clock.Advance(time.Duration(cfg.FailingThreshold)*cfg.PingDuration + cfg.PingDuration/2))
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateFailing)
+	expectState(t, r, "tenant", b.ClientId, api.ClientStateFailing)
+	if pong := ping(t, r, a.ClientId); pong != api.PongTypeChanged {
+		t.Errorf("expected %s after state change, got %s", api.PongTypeChanged, pong)
+	}
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateUp)
+
+	// a was seen again, so it is only failing when b goes down
+	s.Check(clock.Advance(time.Duration(cfg.DownThreshold-cfg.FailingThreshold)*cfg.PingDuration + cfg.PingDuration/2))
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateFailing)
+	expectState(t, r, "tenant", b.ClientId, api.ClientStateDown)
+
+	s.Check(clock.Advance(time.Duration(cfg.RemoveThreshold-cfg.DownThreshold) * cfg.PingDuration))
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateDown)
+	if c := find(r, "tenant", b.ClientId); c != nil {
+		t.Errorf("expected client %s to be removed, got %s", b.ClientId, c.State())
+	}
+	if _, err := r.Ping(Tenant("tenant"), b.ClientId, api.Ping{}); !errors.Is(err, api.NewClientNotFoundError(b.ClientId)) {
+		t.Errorf("expected removed client not to be found, got %v", err)
+	}
+}
+func testReportedStatus(t *testing.T, s Subject, clock *common.ManualClock) {
+	r := s.Registry
+	cfg := Config()
+	a := join(t, r, "tenant", "A", nil)
+	b := join(t, r, "tenant", "B", nil)
+	settle(t, r, a.ClientId)
+	settle(t, r, b.ClientId)
+
+	draining := api.Ping{Status: api.ClientStateDraining, Load: 3, Capacity: 10}
+	if _, err := r.Ping(Tenant("tenant"), a.ClientId, draining); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateDraining)
+	if load, capacity := find(r, "tenant", a.ClientId).Load(); load != 3 || capacity != 10 {
+		t.Errorf("expected load 3/10, got %d/%d", load, capacity)
+	}
+	if pong := ping(t, r, b.ClientId); pong != api.PongTypeChanged {
+		t.Errorf("expected %s after reported status change, got %s", api.PongTypeChanged, pong)
+	}
+
+	// load change alone is not signalled
+	settle(t, r, b.ClientId)
+	draining.Load = 5
+	if _, err := r.Ping(Tenant("tenant"), a.ClientId, draining); err != nil {
+		t.Fatal(err)
+	}
+	if pong := ping(t, r, b.ClientId); pong != api.PongTypeOk {
+		t.Errorf("expected %s after load change, got %s", api.PongTypeOk, pong)
+	}
+	if load, _ := find(r, "tenant", a.ClientId).Load(); load != 5 {
+		t.Errorf("expected load 5, got %d", load)
+	}
+
+	// reported status does not prevent failure detection
+	s.Check(clock.Advance(time.Duration(cfg.FailingThreshold)*cfg.PingDuration + cfg.PingDuration/2))
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateFailing)
+	if _, err := r.Ping(Tenant("tenant"), a.ClientId, draining); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateDraining)
+	ping(t, r, a.ClientId)
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateUp)
+}
+func testMaintenance(t *testing.T, s Subject, clock *common.ManualClock) {
+	r := s.Registry
+	cfg := Config()
+	a := join(t, r, "tenant", "A", nil)
+	settle(t, r, a.ClientId)
+
+	if err := r.SetMaintenance(a.ClientId, true); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateMaintenance)
+	if pong := ping(t, r, a.ClientId); pong != api.PongTypeChanged {
+		t.Errorf("expected %s after maintenance is set, got %s", api.PongTypeChanged, pong)
+	}
+	if _, err := r.Ping(Tenant("tenant"), a.ClientId, api.Ping{Status: api.ClientStateDraining}); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateMaintenance)
+
+	// missed pings are still detected; override is restored on next ping
+	s.Check(clock.Advance(time.Duration(cfg.FailingThreshold)*cfg.PingDuration + cfg.PingDuration/2))
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateFailing)
+	ping(t, r, a.ClientId)
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateMaintenance)
+
+	if err := r.SetMaintenance(a.ClientId, false); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateUp)
+	if _, err := r.Ping(Tenant("tenant"), a.ClientId, api.Ping{Status: api.ClientStateDraining}); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateDraining)
+
+	if err := r.SetMaintenance("unknown", true); !errors.Is(err, api.NewClientNotFoundError("unknown")) {
+		t.Errorf("expected client not found, got %v", err)
+	}
+}
+func testMarkAlive(t *testing.T, s Subject, clock *common.ManualClock) {
+	r := s.Registry
+	cfg := Config()
+	a := join(t, r, "tenant", "A", nil)
+	if err := r.MarkAlive(Tenant("tenant"), a.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateUp)
+	settle(t, r, a.ClientId)
+
+	// reported status, load and pending changes are kept
+	draining := api.Ping{Status: api.ClientStateDraining, Load: 3, Capacity: 10}
+	if _, err := r.Ping(Tenant("tenant"), a.ClientId, draining); err != nil {
+		t.Fatal(err)
+	}
+	join(t, r, "tenant", "B", nil)
+	if err := r.MarkAlive(Tenant(api.TenantDefault), a.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateDraining)
+	if load, capacity := find(r, "tenant", a.ClientId).Load(); load != 3 || capacity != 10 {
+		t.Errorf("expected load 3/10 to be kept, got %d/%d", load, capacity)
+	}
+	if pong, err := r.Ping(Tenant("tenant"), a.ClientId, draining); err != nil || pong.Response != api.PongTypeChanged {
+		t.Errorf("expected %s to be kept for client, got %s (%v)", api.PongTypeChanged, pong.Response, err)
+	}
+
+	// client marked alive is not failing; missed pings are replaced with UP
+	s.Check(clock.Advance(time.Duration(cfg.FailingThreshold)*cfg.PingDuration - cfg.PingDuration/2))
+	if err := r.MarkAlive(Tenant("tenant"), a.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	s.Check(clock.Advance(cfg.PingDuration))
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateDraining)
+	s.Check(clock.Advance(time.Duration(cfg.FailingThreshold) * cfg.PingDuration))
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateFailing)
+	if err := r.MarkAlive(Tenant("tenant"), a.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateUp)
+
+	if err := r.MarkAlive(Tenant("other"), a.ClientId); !errors.Is(err, api.NewTenantsClientNotFoundError(a.ClientId)) {
+		t.Errorf("expected tenant's client not found, got %v", err)
+	}
+	if err := r.MarkAlive(Tenant("tenant"), "unknown"); !errors.Is(err, api.NewClientNotFoundError("unknown")) {
+		t.Errorf("expected client not found, got %v", err)
+	}
+}
+func testUpdateMeta(t *testing.T, s Subject, _ *common.ManualClock) {
+	r := s.Registry
+	a := join(t, r, "tenant", "A", map[string]any{"zone": "eu-1", "version": "1"})
+	b := join(t, r, "tenant", "B", nil)
+	settle(t, r, a.ClientId)
+	settle(t, r, b.ClientId)
+
+	if err := r.UpdateMeta(Tenant("tenant"), a.ClientId, map[string]any{"zone": nil, "version": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if meta := find(r, "tenant", a.ClientId).Meta(); !reflect.DeepEqual(meta, map[string]any{"version": "2"}) {
+		t.Errorf("unexpected meta after update: %v", meta)
+	}
+	if pong := ping(t, r, b.ClientId); pong != api.PongTypeChanged {
+		t.Errorf("expected %s after meta update, got %s", api.PongTypeChanged, pong)
+	}
+	if err := r.UpdateMeta(Tenant("tenant"), a.ClientId, map[string]any{"version": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if pong := ping(t, r, b.ClientId); pong != api.PongTypeOk {
+		t.Errorf("expected unchanged meta not to be signalled, got %s", pong)
+	}
+
+	// meta delta reported with ping
+	if _, err := r.Ping(Tenant("tenant"), a.ClientId, api.Ping{Meta: map[string]any{"zone": "eu-2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if meta := find(r, "tenant", a.ClientId).Meta(); !reflect.DeepEqual(meta, map[string]any{"version": "2", "zone": "eu-2"}) {
+		t.Errorf("unexpected meta after ping: %v", meta)
+	}
+	if pong := ping(t, r, b.ClientId); pong != api.PongTypeChanged {
+		t.Errorf("expected %s after ping meta update, got %s", api.PongTypeChanged, pong)
+	}
+
+	if err := r.UpdateMeta(Tenant("other"), a.ClientId, map[string]any{"zone": "us-1"}); !errors.Is(err, api.NewTenantsClientNotFoundError(a.ClientId)) {
+		t.Errorf("expected tenant's client not found, got %v", err)
+	}
+	if err := r.UpdateMeta(Tenant(api.TenantDefault), a.ClientId, map[string]any{"zone": "us-1"}); err != nil {
+		t.Errorf("expected default tenant to update any client, got %v", err)
+	}
+	if err := r.UpdateMeta(Tenant("tenant"), "unknown", map[string]any{"zone": "us-1"}); !errors.Is(err, api.NewClientNotFoundError("unknown")) {
+		t.Errorf("expected client not found, got %v", err)
+	}
+
+	c := join(t, r, "limited", "C", map[string]any{"v": "1"})
+	if err := r.UpdateMeta(Tenant("limited"), c.ClientId, map[string]any{"big": strings.Repeat("x", 32)}); !errors.Is(err, &api.ErrMetaTooLarge{}) {
+		t.Errorf("expected meta too large, got %v", err)
+	}
+	if _, err := r.Ping(Tenant("limited"), c.ClientId, api.Ping{Meta: map[string]any{"big": strings.Repeat("x", 32)}}); !errors.Is(err, &api.ErrMetaTooLarge{}) {
+		t.Errorf("expected meta too large on ping, got %v", err)
+	}
+	if meta := find(r, "limited", c.ClientId).Meta(); !reflect.DeepEqual(meta, map[string]any{"v": "1"}) {
+		t.Errorf("expected meta to be unchanged, got %v", meta)
+	}
+}
+func testRejoin(t *testing.T, s Subject, clock *common.ManualClock) {
+	r := s.Registry
+	cfg := Config()
+	a := join(t, r, "tenant", "A", nil)
+	settle(t, r, a.ClientId)
+
+	request := api.RejoinRequest{
+		JoinRequest: api.JoinRequest{ServiceId: "A", Endpoints: []string{"http://localhost:8080"}},
+		ClientId:    a.ClientId,
+		Token:       a.Token,
+	}
+	if _, err := r.Rejoin(Tenant("other"), request); !errors.Is(err, api.NewInvalidRejoinTokenError(a.ClientId)) {
+		t.Errorf("expected invalid rejoin token for other tenant, got %v", err)
+	}
+
+	s.Check(clock.Advance(time.Duration(cfg.RemoveThreshold+1) * cfg.PingDuration))
+	if find(r, "tenant", a.ClientId) != nil {
+		t.Fatalf("expected client %s to be removed", a.ClientId)
+	}
+	resp, err := r.Rejoin(Tenant("tenant"), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ClientId != a.ClientId {
+		t.Errorf("expected rejoined client to keep id %s, got %s", a.ClientId, resp.ClientId)
+	}
+	settle(t, r, a.ClientId)
+	expectState(t, r, "tenant", a.ClientId, api.ClientStateUp)
+}
+func testWatch(t *testing.T, s Subject, _ *common.ManualClock) {
+	r := s.Registry
+	events := make(chan api.Event, 64)
+	unsubscribe := r.Subscribe(func(e api.Event) {
+		events <- e
+	})
+	defer unsubscribe()
+
+	a := join(t, r, "tenant", "A", nil)
+	b := join(t, r, "other", "B", nil)
+	received := await(t, events, api.EventTypeJoined, a.ClientId)
+	received = append(received, await(t, events, api.EventTypeJoined, b.ClientId)...)
+	start := watch(t, r, "tenant", 0).Revision
+	if start == 0 {
+		t.Fatal("expected watch to start from current revision")
+	}
+
+	if err := r.UpdateMeta(Tenant("tenant"), a.ClientId, map[string]any{"version": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Leave(Tenant("other"), b.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	received = append(received, await(t, events, api.EventTypeMetaUpdated, a.ClientId)...)
+	received = append(received, await(t, events, api.EventTypeLeft, b.ClientId)...)
+	expectOrdered(t, received, 0)
+
+	resp := watch(t, r, "tenant", start)
+	expectOrdered(t, resp.Events, start)
+	for _, e := range resp.Events {
+		if e.Tenant != "tenant" {
+			t.Errorf("expected only tenant's events, got %s event of %s", e.Type, e.Tenant)
+		}
+	}
+	if !contains(resp.Events, api.EventTypeMetaUpdated, a.ClientId) {
+		t.Errorf("expected meta update of %s to be watched, got %v", a.ClientId, resp.Events)
+	}
+	if n := len(resp.Events); n > 0 && resp.Revision < resp.Events[n-1].Revision {
+		t.Errorf("expected watch revision %d not to be behind its events", resp.Revision)
+	}
+
+	resp = watch(t, r, api.TenantDefault, start)
+	expectOrdered(t, resp.Events, start)
+	if !contains(resp.Events, api.EventTypeMetaUpdated, a.ClientId) || !contains(resp.Events, api.EventTypeLeft, b.ClientId) {
+		t.Errorf("expected default tenant to watch events of all tenants, got %v", resp.Events)
+	}
+}
+
+// endregion
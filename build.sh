@@ -48,7 +48,11 @@ case $1 in
   bin)
     prepare
     templ generate && \
-    go build -ldflags "-s -w" -buildmode plugin -o build/inmem.so backend/inmem/registry.go && \
+    go build -ldflags "-s -w" -buildmode plugin -o build/redis.so backend/redis/registry.go && \
+    go build -ldflags "-s -w" -buildmode plugin -o build/etcd.so backend/etcd/registry.go && \
+    go build -ldflags "-s -w" -buildmode plugin -o build/raft.so ./backend/raft && \
+    go build -ldflags "-s -w" -buildmode plugin -o build/peer.so ./backend/peer && \
+    go build -ldflags "-s -w" -buildmode plugin -o build/bolt.so ./backend/bolt && \
     go build -ldflags="-s -w" -o build/disco ./server
   ;;
   *)
@@ -0,0 +1,381 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/logging"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// region - DiscoClient API
+
+var ErrNotJoined = errors.New("client not joined")
+var ErrNoServiceId = errors.New("service id not set")
+
+type ResponseError struct {
+	Status  int
+	Message string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("disco responded with %d: %s", e.Status, e.Message)
+}
+
+type DiscoClient interface {
+	Join(ctx context.Context) (*api.JoinResponse, error)
+	Rejoin(ctx context.Context) (*api.JoinResponse, error)
+	Leave(ctx context.Context) error
+	Ping(ctx context.Context) (*api.Pong, error)
+	SetStatus(status api.ClientState)
+	SetLoad(load, capacity int)
+	UpdateMeta(ctx context.Context, delta map[string]any) error
+	List(ctx context.Context) ([]Instance, error)
+	Registry() Registry
+	Run(ctx context.Context) error
+}
+
+func NewDiscoClient(cfg *Config) (DiscoClient, error) {
+	if cfg.ServiceId == "" {
+		return nil, ErrNoServiceId
+	}
+	if _, err := url.Parse(cfg.DiscoUrl); err != nil {
+		return nil, err
+	}
+	return &discoClient{
+		cfg:      cfg,
+		baseUrl:  strings.TrimSuffix(cfg.DiscoUrl, "/"),
+		http:     cfg.httpClient(),
+		meta:     cfg.Meta,
+		registry: newRegistry(),
+		logger:   logging.GetLogger("disco-client"),
+	}, nil
+}
+
+// endregion
+// region - implementation
+
+type discoClient struct {
+	sync.RWMutex
+	cfg      *Config
+	baseUrl  string
+	http     *http.Client
+	clientId string
+	token    string
+	secret   string
+	meta     map[string]any
+	report   api.Ping
+	registry *registryImpl
+	logger   logging.Logger
+}
+
+func (c *discoClient) Join(ctx context.Context) (*api.JoinResponse, error) {
+	c.RLock()
+	rq := c.joinRequest()
+	c.RUnlock()
+	var resp api.JoinResponse
+	if err := c.call(ctx, http.MethodPost, "/api/join", nil, rq, &resp); err != nil {
+		return nil, err
+	}
+	c.joined(&resp)
+	c.logger.Info("joined as %s (ping interval %s)", resp.ClientId, resp.PingInterval.Duration)
+	return &resp, nil
+}
+
+// Rejoin restores previous registration (same client id) after disco lost it,
+// e.g. because of disco restart or client removal on missed pings.
+func (c *discoClient) Rejoin(ctx context.Context) (*api.JoinResponse, error) {
+	c.RLock()
+	rq := api.RejoinRequest{
+		ClientId:    c.clientId,
+		Token:       c.token,
+		JoinRequest: c.joinRequest(),
+	}
+	c.RUnlock()
+	if rq.ClientId == "" || rq.Token == "" {
+		return nil, ErrNotJoined
+	}
+	var resp api.JoinResponse
+	if err := c.call(ctx, http.MethodPost, "/api/rejoin", nil, rq, &resp); err != nil {
+		return nil, err
+	}
+	c.joined(&resp)
+	c.logger.Info("rejoined as %s", resp.ClientId)
+	return &resp, nil
+}
+func (c *discoClient) Leave(ctx context.Context) error {
+	clientId := c.id()
+	if clientId == "" {
+		return ErrNotJoined
+	}
+	if err := c.call(ctx, http.MethodPost, "/api/leave", url.Values{"id": {clientId}}, nil, nil); err != nil {
+		return err
+	}
+	c.Lock()
+	c.clientId = ""
+	c.token = ""
+	c.secret = ""
+	c.Unlock()
+	c.logger.Info("client %s left", clientId)
+	return nil
+}
+func (c *discoClient) Ping(ctx context.Context) (*api.Pong, error) {
+	clientId := c.id()
+	if clientId == "" {
+		return nil, ErrNotJoined
+	}
+	c.RLock()
+	report := c.report
+	c.RUnlock()
+	var pong api.Pong
+	if err := c.call(ctx, http.MethodPost, "/api/ping", url.Values{"id": {clientId}}, report, &pong); err != nil {
+		return nil, err
+	}
+	return &pong, nil
+}
+
+// SetStatus sets status reported to disco with subsequent pings: UP (default),
+// STARTING, OUT_OF_SERVICE or DRAINING; e.g. service being shut down reports
+// DRAINING, so other clients stop sending new requests to it.
+func (c *discoClient) SetStatus(status api.ClientState) {
+	c.Lock()
+	defer c.Unlock()
+	c.report.Status = status
+}
+
+// SetLoad sets load and capacity reported to disco with subsequent pings
+func (c *discoClient) SetLoad(load, capacity int) {
+	c.Lock()
+	defer c.Unlock()
+	c.report.Load = load
+	c.report.Capacity = capacity
+}
+
+// UpdateMeta changes client's meta without re-join: keys with nil value are
+// removed, others are set. Updated meta is used for subsequent rejoins too.
+func (c *discoClient) UpdateMeta(ctx context.Context, delta map[string]any) error {
+	clientId := c.id()
+	if clientId == "" {
+		return ErrNotJoined
+	}
+	if err := c.call(ctx, http.MethodPatch, "/api/clients/"+url.PathEscape(clientId)+"/meta", nil, delta, nil); err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	meta := make(map[string]any, len(c.meta)+len(delta))
+	for k, v := range c.meta {
+		meta[k] = v
+	}
+	for k, v := range delta {
+		if v == nil {
+			delete(meta, k)
+		} else {
+			meta[k] = v
+		}
+	}
+	c.meta = meta
+	return nil
+}
+func (c *discoClient) List(ctx context.Context) ([]Instance, error) {
+	var result []Instance
+	if err := c.call(ctx, http.MethodGet, "/api/list", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	c.registry.set(result)
+	return c.registry.List(), nil
+}
+func (c *discoClient) Registry() Registry {
+	return c.registry
+}
+
+// Run joins disco, keeps the registration alive with pings and refreshes
+// the local registry cache whenever disco reports a change. Initial join is
+// retried until it succeeds; pings follow the interval of the latest join or
+// rejoin response. It blocks until ctx is cancelled, then leaves gracefully.
+func (c *discoClient) Run(ctx context.Context) error {
+	resp, err := c.join(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err = c.List(ctx); err != nil {
+		c.logger.Warning("could not fetch registry: %s", err.Error())
+	}
+
+	ticker := time.NewTicker(pingInterval(resp))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return c.leave()
+		case <-ticker.C:
+			if resp = c.ping(ctx); resp != nil {
+				ticker.Reset(pingInterval(resp))
+			}
+		}
+	}
+}
+
+// join joins disco, retrying with exponential backoff until it succeeds or
+// ctx is done, so client may be started before disco is available
+func (c *discoClient) join(ctx context.Context) (*api.JoinResponse, error) {
+	backoff := minJoinBackoff
+	for {
+		resp, err := c.Join(ctx)
+		if err == nil {
+			return resp, nil
+		}
+		c.logger.Warning("could not join: %s; retrying in %s", err.Error(), backoff)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxJoinBackoff {
+			backoff = maxJoinBackoff
+		}
+	}
+}
+
+// ping pings disco and restores registration if disco lost it; response of
+// rejoin (or join) is returned, as it may set another ping interval
+func (c *discoClient) ping(ctx context.Context) *api.JoinResponse {
+	pong, err := c.Ping(ctx)
+	var re *ResponseError
+	if errors.As(err, &re) && re.Status == http.StatusNotFound {
+		return c.restore(ctx)
+	}
+	if err != nil {
+		c.logger.Warning("ping failed: %s", err.Error())
+		return nil
+	}
+	if pong.Response == api.PongTypeChanged {
+		if _, err = c.List(ctx); err != nil {
+			c.logger.Warning("could not refresh registry: %s", err.Error())
+		}
+	}
+	return nil
+}
+func (c *discoClient) restore(ctx context.Context) *api.JoinResponse {
+	c.logger.Warning("client %s not found on disco; trying to rejoin", c.id())
+	resp, err := c.Rejoin(ctx)
+	if err != nil {
+		c.logger.Warning("could not rejoin: %s", err.Error())
+		if resp, err = c.Join(ctx); err != nil {
+			c.logger.Warning("could not join: %s", err.Error())
+			return nil
+		}
+	}
+	if _, err = c.List(ctx); err != nil {
+		c.logger.Warning("could not refresh registry: %s", err.Error())
+	}
+	return resp
+}
+func (c *discoClient) leave() error {
+	// parent context is already cancelled at this point, so use a fresh one
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.timeout())
+	defer cancel()
+	return c.Leave(ctx)
+}
+func (c *discoClient) joinRequest() api.JoinRequest {
+	return api.JoinRequest{
+		ServiceId: c.cfg.ServiceId,
+		Endpoints: c.cfg.Endpoints,
+		Meta:      c.meta,
+	}
+}
+func (c *discoClient) joined(resp *api.JoinResponse) {
+	c.Lock()
+	defer c.Unlock()
+	c.clientId = resp.ClientId
+	c.token = resp.Token
+	c.secret = resp.Secret
+}
+func (c *discoClient) id() string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.clientId
+}
+func pingInterval(resp *api.JoinResponse) time.Duration {
+	if resp.PingInterval.Duration <= 0 {
+		return defaultPingInterval
+	}
+	return resp.PingInterval.Duration
+}
+
+// endregion
+// region - http
+
+func (c *discoClient) call(ctx context.Context, method, path string, query url.Values, body, result any) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	u := c.baseUrl + path
+	if len(query) > 0 {
+		u = u + "?" + query.Encode()
+	}
+	rq, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		rq.Header.Set(api.ContentTypeHeader, api.ContentTypeApplicationJson)
+	}
+	c.authorize(rq)
+
+	resp, err := c.http.Do(rq)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return newResponseError(resp.StatusCode, data)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+func (c *discoClient) authorize(rq *http.Request) {
+	if c.cfg.Token != "" {
+		rq.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	} else if c.cfg.Login != "" {
+		rq.SetBasicAuth(c.cfg.Login, c.cfg.Password)
+	}
+	c.RLock()
+	defer c.RUnlock()
+	if c.secret != "" { // issued by disco, which requires client secrets
+		rq.Header.Set(api.ClientSecretHeader, c.secret)
+	}
+}
+
+func newResponseError(status int, data []byte) error {
+	var msg map[string]string
+	if err := json.Unmarshal(data, &msg); err == nil && msg["error"] != "" {
+		return &ResponseError{Status: status, Message: msg["error"]}
+	}
+	return &ResponseError{Status: status, Message: strings.TrimSpace(string(data))}
+}
+
+// endregion
@@ -0,0 +1,325 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/slink-go/disco/common/api"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeDisco struct {
+	sync.Mutex
+	failJoins int           // join requests to fail before succeeding
+	interval  time.Duration // ping interval set on rejoin; 10ms if not set
+	joined    bool
+	rejoined  bool
+	lost      bool
+	left      bool
+	pings     int
+	lists     int
+	changed   bool
+	report    api.Ping
+	delta     map[string]any
+	secret    string // issued on join
+	received  string // secret received with last ping
+}
+
+func (f *fakeDisco) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/join", func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		defer f.Unlock()
+		if f.failJoins > 0 {
+			f.failJoins--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"error": "unavailable"}`))
+			return
+		}
+		f.joined = true
+		_ = json.NewEncoder(w).Encode(api.JoinResponse{
+			ClientId:     "client-1",
+			PingInterval: api.Duration{Duration: 10 * time.Millisecond},
+			Token:        "token-1",
+			Secret:       f.secret,
+		})
+	})
+	mux.HandleFunc("/api/rejoin", func(w http.ResponseWriter, r *http.Request) {
+		var rq api.RejoinRequest
+		_ = json.NewDecoder(r.Body).Decode(&rq)
+		if rq.ClientId != "client-1" || rq.Token != "token-1" || rq.ServiceId != "test" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"error": "invalid rejoin token"}`))
+			return
+		}
+		f.Lock()
+		f.lost = false
+		f.rejoined = true
+		interval := f.interval
+		f.Unlock()
+		if interval == 0 {
+			interval = 10 * time.Millisecond
+		}
+		_ = json.NewEncoder(w).Encode(api.JoinResponse{
+			ClientId:     rq.ClientId,
+			PingInterval: api.Duration{Duration: interval},
+			Token:        rq.Token,
+		})
+	})
+	mux.HandleFunc("/api/ping", func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		defer f.Unlock()
+		if f.lost || r.URL.Query().Get("id") != "client-1" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error": "client not found"}`))
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&f.report)
+		f.received = r.Header.Get(api.ClientSecretHeader)
+		f.pings++
+		response := api.PongTypeOk
+		if f.changed {
+			f.changed = false
+			response = api.PongTypeChanged
+		}
+		_ = json.NewEncoder(w).Encode(api.Pong{Response: response})
+	})
+	mux.HandleFunc("/api/clients/client-1/meta", func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		defer f.Unlock()
+		if r.Method != http.MethodPatch {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&f.delta)
+		_, _ = w.Write([]byte(`{"updated": "client-1"}`))
+	})
+	mux.HandleFunc("/api/list", func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		f.lists++
+		f.Unlock()
+		_, _ = w.Write([]byte(`[{"client_id":"client-1","service_id":"TEST","endpoints":[{"url":"http://localhost:1234"}],"state":"UP"}]`))
+	})
+	mux.HandleFunc("/api/leave", func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		f.left = true
+		f.Unlock()
+		_, _ = w.Write([]byte(`{"left": "client-1"}`))
+	})
+	return mux
+}
+
+func TestClientLifecycle(t *testing.T) {
+	fake := &fakeDisco{changed: true}
+	srv := httptest.NewServer(fake.handler())
+	defer srv.Close()
+
+	c, err := NewDiscoClient(&Config{
+		DiscoUrl:  srv.URL,
+		ServiceId: "test",
+		Endpoints: []string{"http://localhost:1234"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = c.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Lock()
+	defer fake.Unlock()
+	if !fake.joined || !fake.left {
+		t.Errorf("expected join and leave calls")
+	}
+	if fake.pings == 0 {
+		t.Errorf("expected ping calls")
+	}
+	if fake.lists < 2 {
+		t.Errorf("expected registry refresh on changed pong")
+	}
+	if len(c.Registry().Service("TEST")) != 1 {
+		t.Errorf("unexpected registry contents: %v", c.Registry().List())
+	}
+}
+func TestClientRejoin(t *testing.T) {
+	fake := &fakeDisco{lost: true}
+	srv := httptest.NewServer(fake.handler())
+	defer srv.Close()
+
+	c, err := NewDiscoClient(&Config{DiscoUrl: srv.URL, ServiceId: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = c.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Lock()
+	defer fake.Unlock()
+	if !fake.rejoined {
+		t.Errorf("expected rejoin after client-not-found ping")
+	}
+	if fake.pings == 0 {
+		t.Errorf("expected successful pings after rejoin")
+	}
+}
+func TestClientJoinRetry(t *testing.T) {
+	fake := &fakeDisco{failJoins: 2}
+	srv := httptest.NewServer(fake.handler())
+	defer srv.Close()
+
+	c, err := NewDiscoClient(&Config{DiscoUrl: srv.URL, ServiceId: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = c.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Lock()
+	defer fake.Unlock()
+	if !fake.joined || fake.pings == 0 {
+		t.Errorf("expected client to join and ping after failed joins")
+	}
+}
+func TestClientJoinRetryCancelled(t *testing.T) {
+	fake := &fakeDisco{failJoins: 100}
+	srv := httptest.NewServer(fake.handler())
+	defer srv.Close()
+
+	c, err := NewDiscoClient(&Config{DiscoUrl: srv.URL, ServiceId: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = c.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected join retries to stop when context is done, got %v", err)
+	}
+}
+func TestClientRejoinPingInterval(t *testing.T) {
+	fake := &fakeDisco{lost: true, interval: time.Hour}
+	srv := httptest.NewServer(fake.handler())
+	defer srv.Close()
+
+	c, err := NewDiscoClient(&Config{DiscoUrl: srv.URL, ServiceId: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = c.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Lock()
+	defer fake.Unlock()
+	if !fake.rejoined {
+		t.Fatalf("expected rejoin after client-not-found ping")
+	}
+	if fake.pings != 0 {
+		t.Errorf("expected pings to follow rejoin's ping interval, got %d pings", fake.pings)
+	}
+}
+func TestPingNotJoined(t *testing.T) {
+	c, err := NewDiscoClient(&Config{DiscoUrl: "http://localhost", ServiceId: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Ping(context.Background()); !errors.Is(err, ErrNotJoined) {
+		t.Fatalf("expected ErrNotJoined, got %v", err)
+	}
+}
+func TestPingReportsStatus(t *testing.T) {
+	fake := &fakeDisco{}
+	srv := httptest.NewServer(fake.handler())
+	defer srv.Close()
+
+	c, err := NewDiscoClient(&Config{DiscoUrl: srv.URL, ServiceId: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Join(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.SetStatus(api.ClientStateDraining)
+	c.SetLoad(7, 10)
+	if _, err = c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Lock()
+	defer fake.Unlock()
+	expected := api.Ping{Status: api.ClientStateDraining, Load: 7, Capacity: 10}
+	if !reflect.DeepEqual(fake.report, expected) {
+		t.Errorf("expected %+v reported, got %+v", expected, fake.report)
+	}
+}
+func TestUpdateMeta(t *testing.T) {
+	fake := &fakeDisco{}
+	srv := httptest.NewServer(fake.handler())
+	defer srv.Close()
+
+	c, err := NewDiscoClient(&Config{DiscoUrl: srv.URL, ServiceId: "test", Meta: map[string]any{"zone": "eu-1", "version": "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := map[string]any{"zone": nil, "version": "2"}
+	if err = c.UpdateMeta(context.Background(), delta); !errors.Is(err, ErrNotJoined) {
+		t.Fatalf("expected ErrNotJoined, got %v", err)
+	}
+	if _, err = c.Join(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.UpdateMeta(context.Background(), delta); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Lock()
+	defer fake.Unlock()
+	if !reflect.DeepEqual(fake.delta, delta) {
+		t.Errorf("expected %v sent, got %v", delta, fake.delta)
+	}
+	expected := map[string]any{"version": "2"}
+	if meta := c.(*discoClient).joinRequest().Meta; !reflect.DeepEqual(meta, expected) {
+		t.Errorf("expected %v to be used for rejoin, got %v", expected, meta)
+	}
+}
+func TestClientSecret(t *testing.T) {
+	fake := &fakeDisco{secret: "secret-1"}
+	srv := httptest.NewServer(fake.handler())
+	defer srv.Close()
+
+	c, err := NewDiscoClient(&Config{DiscoUrl: srv.URL, ServiceId: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Join(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Lock()
+	defer fake.Unlock()
+	if fake.received != "secret-1" {
+		t.Errorf("expected issued secret to be sent with ping, got %q", fake.received)
+	}
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"github.com/slink-go/disco/common/config"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout      = 5 * time.Second
+	defaultPingInterval = 15 * time.Second // used if disco does not set one
+	minJoinBackoff      = 100 * time.Millisecond
+	maxJoinBackoff      = 30 * time.Second
+)
+
+type Config struct {
+	DiscoUrl  string
+	Token     string
+	Login     string
+	Password  string
+	ServiceId string
+	Endpoints []string
+	Meta      map[string]any
+	Timeout   time.Duration
+	Http      *http.Client
+}
+
+func LoadConfig() *Config {
+	cfg := Config{
+		DiscoUrl:  config.ReadStringOrDefault("DISCO_URL", "http://localhost:8080"),
+		Token:     config.ReadString("DISCO_TOKEN"),
+		Login:     config.ReadString("DISCO_LOGIN"),
+		Password:  config.ReadString("DISCO_PASSWORD"),
+		ServiceId: config.ReadString("DISCO_SERVICE_ID"),
+		Timeout:   config.ReadDurationOrDefault("DISCO_CLIENT_TIMEOUT", defaultTimeout),
+	}
+	for _, e := range strings.Split(config.ReadString("DISCO_ENDPOINTS"), ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			cfg.Endpoints = append(cfg.Endpoints, e)
+		}
+	}
+	return &cfg
+}
+
+func (cfg *Config) httpClient() *http.Client {
+	if cfg.Http != nil {
+		return cfg.Http
+	}
+	return &http.Client{Timeout: cfg.timeout()}
+}
+func (cfg *Config) timeout() time.Duration {
+	if cfg.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return cfg.Timeout
+}
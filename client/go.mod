@@ -0,0 +1,21 @@
+module github.com/slink-go/disco/client
+
+go 1.22.3
+
+require (
+	github.com/slink-go/disco/common v0.0.0-20230715020414-3395835c0d6c
+	github.com/slink-go/logging v0.0.2
+)
+
+require (
+	github.com/joho/godotenv v1.5.1 // indirect
+	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mattn/go-isatty v0.0.19 // indirect
+	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7 // indirect
+	github.com/rs/zerolog v1.32.0 // indirect
+	github.com/slink-go/logger v0.0.1 // indirect
+	github.com/xhit/go-str2duration/v2 v2.1.0 // indirect
+	golang.org/x/sys v0.12.0 // indirect
+)
+
+replace github.com/slink-go/disco/common => ../common
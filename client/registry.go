@@ -0,0 +1,91 @@
+package client
+
+import (
+	"github.com/slink-go/disco/common/api"
+	"strings"
+	"sync"
+)
+
+// region - instance
+
+type Endpoint struct {
+	UrlStr string `json:"url"`
+}
+
+func (e Endpoint) Url() string {
+	return e.UrlStr
+}
+
+type Instance struct {
+	ClientId  string          `json:"client_id"`
+	ServiceId string          `json:"service_id"`
+	Tenant    string          `json:"tenant,omitempty"`
+	Endpoints []Endpoint      `json:"endpoints,omitempty"`
+	Meta      map[string]any  `json:"meta,omitempty"`
+	State     api.ClientState `json:"state"`
+	Load      int             `json:"load,omitempty"`
+	Capacity  int             `json:"capacity,omitempty"`
+}
+
+// endregion
+// region - registry
+
+type Registry interface {
+	List() []Instance
+	Service(serviceId string) []Instance
+	Services() []string
+}
+
+type registryImpl struct {
+	sync.RWMutex
+	instances []Instance
+}
+
+func newRegistry() *registryImpl {
+	return &registryImpl{
+		instances: make([]Instance, 0),
+	}
+}
+
+func (r *registryImpl) List() []Instance {
+	r.RLock()
+	defer r.RUnlock()
+	result := make([]Instance, len(r.instances))
+	copy(result, r.instances)
+	return result
+}
+func (r *registryImpl) Service(serviceId string) []Instance {
+	r.RLock()
+	defer r.RUnlock()
+	result := make([]Instance, 0)
+	for _, v := range r.instances {
+		if strings.EqualFold(v.ServiceId, serviceId) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+func (r *registryImpl) Services() []string {
+	r.RLock()
+	defer r.RUnlock()
+	seen := make(map[string]struct{})
+	result := make([]string, 0)
+	for _, v := range r.instances {
+		if _, ok := seen[v.ServiceId]; !ok {
+			seen[v.ServiceId] = struct{}{}
+			result = append(result, v.ServiceId)
+		}
+	}
+	return result
+}
+
+func (r *registryImpl) set(instances []Instance) {
+	r.Lock()
+	defer r.Unlock()
+	if instances == nil {
+		instances = make([]Instance, 0)
+	}
+	r.instances = instances
+}
+
+// endregion
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -86,24 +87,33 @@ const (
 	ClientStateFailing
 	ClientStateDown
 	ClientStateRemoved
+	ClientStateOutOfService
+	ClientStateDraining
+	ClientStateMaintenance
 )
 
 var (
 	clientStateNames = map[ClientState]string{
-		ClientStateUnknown:  "UNDEFINED",
-		ClientStateStarting: "STARTING",
-		ClientStateUp:       "UP",
-		ClientStateFailing:  "FAILING",
-		ClientStateDown:     "DOWN",
-		ClientStateRemoved:  "REMOVED",
+		ClientStateUnknown:      "UNDEFINED",
+		ClientStateStarting:     "STARTING",
+		ClientStateUp:           "UP",
+		ClientStateFailing:      "FAILING",
+		ClientStateDown:         "DOWN",
+		ClientStateRemoved:      "REMOVED",
+		ClientStateOutOfService: "OUT_OF_SERVICE",
+		ClientStateDraining:     "DRAINING",
+		ClientStateMaintenance:  "MAINTENANCE",
 	}
 	clientStateValues = map[string]ClientState{
-		"UNDEFINED": ClientStateUnknown,
-		"STARTING":  ClientStateStarting,
-		"UP":        ClientStateUp,
-		"FAILING":   ClientStateFailing,
-		"DOWN":      ClientStateDown,
-		"REMOVED":   ClientStateRemoved,
+		"UNDEFINED":      ClientStateUnknown,
+		"STARTING":       ClientStateStarting,
+		"UP":             ClientStateUp,
+		"FAILING":        ClientStateFailing,
+		"DOWN":           ClientStateDown,
+		"REMOVED":        ClientStateRemoved,
+		"OUT_OF_SERVICE": ClientStateOutOfService,
+		"DRAINING":       ClientStateDraining,
+		"MAINTENANCE":    ClientStateMaintenance,
 	}
 )
 
@@ -141,10 +151,112 @@ func parseClientState(s string) (ClientState, error) {
 	return value, nil
 }
 
+type EventType uint8
+
+const (
+	EventTypeUnknown EventType = iota
+	EventTypeJoined
+	EventTypeLeft
+	EventTypeStateChanged
+	EventTypeMetaUpdated
+)
+
+var (
+	eventTypeNames = map[EventType]string{
+		EventTypeUnknown:      "UNDEFINED",
+		EventTypeJoined:       "JOINED",
+		EventTypeLeft:         "LEFT",
+		EventTypeStateChanged: "STATE_CHANGED",
+		EventTypeMetaUpdated:  "META_UPDATED",
+	}
+	eventTypeValues = map[string]EventType{
+		"UNDEFINED":     EventTypeUnknown,
+		"JOINED":        EventTypeJoined,
+		"LEFT":          EventTypeLeft,
+		"STATE_CHANGED": EventTypeStateChanged,
+		"META_UPDATED":  EventTypeMetaUpdated,
+	}
+)
+
+func (et EventType) String() string {
+	return eventTypeNames[et]
+}
+func (et *EventType) UnmarshalJSON(data []byte) (err error) {
+	var source string
+	if err := json.Unmarshal(data, &source); err != nil {
+		return err
+	}
+	if *et, err = parseEventType(source); err != nil {
+		return err
+	}
+	return err
+}
+func (et EventType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(et.String())
+}
+
+func parseEventType(s string) (EventType, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	value, ok := eventTypeValues[s]
+	if !ok {
+		var values string
+		for k, v := range eventTypeValues {
+			if EventTypeUnknown != v {
+				values += k + ", "
+			}
+		}
+		values = strings.TrimSpace(strings.ToLower(values))
+		values = values[:len(values)-1]
+		return EventTypeUnknown, fmt.Errorf("%q is not a valid EventType; available values are: %s", s, values)
+	}
+	return value, nil
+}
+
 // endregion
 // region - requests
 
+// Ping optionally carries client's own status: UP (default), STARTING,
+// OUT_OF_SERVICE or DRAINING, which becomes client's state in registry, its
+// load/capacity in client-defined units (e.g. in-flight requests) and meta
+// delta (see ValidateMetaDelta)
 type Ping struct {
+	Status   ClientState    `json:"status,omitempty"`
+	Load     int            `json:"load,omitempty"`
+	Capacity int            `json:"capacity,omitempty"`
+	Meta     map[string]any `json:"meta,omitempty"`
+}
+
+// State returns registry state of client which sent the ping
+func (p Ping) State() ClientState {
+	if p.Status == ClientStateUnknown {
+		return ClientStateUp
+	}
+	return p.Status
+}
+func (p Ping) Validate() error {
+	switch p.Status {
+	case ClientStateUnknown, ClientStateStarting, ClientStateUp, ClientStateOutOfService, ClientStateDraining:
+	default:
+		return fmt.Errorf("status %s can not be reported by client", p.Status)
+	}
+	if p.Load < 0 || p.Capacity < 0 {
+		return fmt.Errorf("load and capacity should not be negative")
+	}
+	return ValidateMetaDelta(p.Meta)
+}
+
+var metaKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]{0,62}$`)
+
+// ValidateMetaDelta checks keys of client's meta update: keys are up to 63
+// letters, digits, '.', '_', '/' or '-', starting with letter or digit. In
+// delta keys with null value are removed from client's meta, others are set.
+func ValidateMetaDelta(delta map[string]any) error {
+	for k := range delta {
+		if !metaKeyPattern.MatchString(k) {
+			return NewInvalidMetaKeyError(k)
+		}
+	}
+	return nil
 }
 
 type JoinRequest struct {
@@ -153,6 +265,12 @@ type JoinRequest struct {
 	Meta      map[string]any `json:"meta,omitempty"`
 }
 
+type RejoinRequest struct {
+	ClientId string `json:"id"`
+	Token    string `json:"token"`
+	JoinRequest
+}
+
 // endregion
 // region - responses
 
@@ -171,9 +289,16 @@ func (p *Pong) String() string {
 	return p.Error
 }
 
+type WatchResponse struct {
+	Revision uint64  `json:"revision"`
+	Events   []Event `json:"events"`
+}
+
 type JoinResponse struct {
 	ClientId     string   `json:"id,omitempty"`
 	PingInterval Duration `json:"interval,omitempty"`
+	Token        string   `json:"token,omitempty"`
+	Secret       string   `json:"secret,omitempty"` // client secret (if required by disco)
 }
 
 // endregion
@@ -232,23 +357,72 @@ type Client interface {
 	Tenant() string
 	Endpoints() []Endpoint
 	Meta() map[string]any
-	Ping() bool
+	SetMeta(meta map[string]any)
+	Ping(ping Ping) bool
+	MarkAlive() bool
 	LastSeen() time.Time
 	State() ClientState
 	SetState(state ClientState)
+	Load() (load, capacity int)
+	SetLoad(load, capacity int)
+	Maintenance() bool
+	SetMaintenance(enabled bool)
 	SetDirty(value bool)
 	IsDirty() bool
 }
 
+// endregion
+// region - events
+
+type Event struct {
+	Revision  uint64         `json:"revision"`
+	Type      EventType      `json:"type"`
+	Tenant    string         `json:"tenant,omitempty"`
+	ClientId  string         `json:"client_id"`
+	ServiceId string         `json:"service_id"`
+	Endpoints []string       `json:"endpoints,omitempty"`
+	Meta      map[string]any `json:"meta,omitempty"`
+	PrevState ClientState    `json:"prev_state,omitempty"`
+	State     ClientState    `json:"state"`
+	Time      time.Time      `json:"time"`
+}
+
+type EventHandler func(event Event)
+
 // endregion
 // region - registry
 
 type Registry interface {
 	Join(ctx context.Context, request JoinRequest) (*JoinResponse, error)
+	Rejoin(ctx context.Context, request RejoinRequest) (*JoinResponse, error)
 	Leave(ctx context.Context, clientId string) error
 	List(ctx context.Context) []Client
 	ListAll() []Tenant
-	Ping(clientId string) (Pong, error)
+	Ping(ctx context.Context, clientId string, ping Ping) (Pong, error)
+	MarkAlive(ctx context.Context, clientId string) error
+	SetMaintenance(clientId string, enabled bool) error
+	UpdateMeta(ctx context.Context, clientId string, delta map[string]any) error
+	Watch(ctx context.Context, revision uint64) (*WatchResponse, error)
+	Subscribe(handler EventHandler) (unsubscribe func())
+}
+
+// endregion
+// region - cluster
+
+// Member is a node of multi-node registry cluster
+type Member struct {
+	Id      string `json:"id"`
+	Address string `json:"address"`
+	Voter   bool   `json:"voter"`
+	Leader  bool   `json:"leader"`
+}
+
+// Cluster is implemented by registries replicated across several disco nodes;
+// it allows to inspect and change cluster membership
+type Cluster interface {
+	Members() ([]Member, error)
+	AddMember(member Member) error
+	RemoveMember(id string) error
 }
 
 // endregion
@@ -2,3 +2,4 @@ package api
 
 const ContentTypeHeader = "Content-Type"
 const ContentTypeApplicationJson = "application/json"
+const ClientSecretHeader = "X-Disco-Client-Secret"
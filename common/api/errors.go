@@ -80,7 +80,7 @@ type ErrAlreadyRegistered struct {
 }
 
 func NewAlreadyRegisteredError() error {
-	return &ErrTenantsClientNotFound{
+	return &ErrAlreadyRegistered{
 		message: fmt.Sprintf("client already registered"),
 	}
 }
@@ -111,7 +111,168 @@ func (e *ErrMaxClientsReached) Error() string {
 	return e.message
 }
 func (e *ErrMaxClientsReached) Is(tgt error) bool {
-	_, ok := tgt.(*ErrClientNotFound)
+	_, ok := tgt.(*ErrMaxClientsReached)
+	if !ok {
+		return false
+	}
+	return true
+}
+
+// endregion
+// region - ErrInvalidRejoinToken
+
+type ErrInvalidRejoinToken struct {
+	message string
+}
+
+func NewInvalidRejoinTokenError(clientId string) error {
+	return &ErrInvalidRejoinToken{
+		message: fmt.Sprintf("invalid rejoin token for client %s", clientId),
+	}
+}
+func (e *ErrInvalidRejoinToken) Error() string {
+	return e.message
+}
+func (e *ErrInvalidRejoinToken) Is(tgt error) bool {
+	_, ok := tgt.(*ErrInvalidRejoinToken)
+	if !ok {
+		return false
+	}
+	return true
+}
+
+// endregion
+// region - ErrRevisionCompacted
+
+type ErrRevisionCompacted struct {
+	message string
+}
+
+func NewRevisionCompactedError(revision uint64) error {
+	return &ErrRevisionCompacted{
+		message: fmt.Sprintf("revision %d is compacted", revision),
+	}
+}
+func (e *ErrRevisionCompacted) Error() string {
+	return e.message
+}
+func (e *ErrRevisionCompacted) Is(tgt error) bool {
+	_, ok := tgt.(*ErrRevisionCompacted)
+	if !ok {
+		return false
+	}
+	return true
+}
+
+// endregion
+// region - ErrClientsQuotaExceeded
+
+type ErrClientsQuotaExceeded struct {
+	message string
+}
+
+func NewClientsQuotaExceededError(tenant string, max int) error {
+	return &ErrClientsQuotaExceeded{
+		message: fmt.Sprintf("tenant %s reached maximum clients (%d)", tenant, max),
+	}
+}
+func (e *ErrClientsQuotaExceeded) Error() string {
+	return e.message
+}
+func (e *ErrClientsQuotaExceeded) Is(tgt error) bool {
+	_, ok := tgt.(*ErrClientsQuotaExceeded)
+	if !ok {
+		return false
+	}
+	return true
+}
+
+// endregion
+// region - ErrServicesQuotaExceeded
+
+type ErrServicesQuotaExceeded struct {
+	message string
+}
+
+func NewServicesQuotaExceededError(tenant string, max int) error {
+	return &ErrServicesQuotaExceeded{
+		message: fmt.Sprintf("tenant %s reached maximum services (%d)", tenant, max),
+	}
+}
+func (e *ErrServicesQuotaExceeded) Error() string {
+	return e.message
+}
+func (e *ErrServicesQuotaExceeded) Is(tgt error) bool {
+	_, ok := tgt.(*ErrServicesQuotaExceeded)
+	if !ok {
+		return false
+	}
+	return true
+}
+
+// endregion
+// region - ErrInstancesQuotaExceeded
+
+type ErrInstancesQuotaExceeded struct {
+	message string
+}
+
+func NewInstancesQuotaExceededError(tenant, serviceId string, max int) error {
+	return &ErrInstancesQuotaExceeded{
+		message: fmt.Sprintf("service %s of tenant %s reached maximum instances (%d)", serviceId, tenant, max),
+	}
+}
+func (e *ErrInstancesQuotaExceeded) Error() string {
+	return e.message
+}
+func (e *ErrInstancesQuotaExceeded) Is(tgt error) bool {
+	_, ok := tgt.(*ErrInstancesQuotaExceeded)
+	if !ok {
+		return false
+	}
+	return true
+}
+
+// endregion
+// region - ErrMetaTooLarge
+
+type ErrMetaTooLarge struct {
+	message string
+}
+
+func NewMetaTooLargeError(size, max int) error {
+	return &ErrMetaTooLarge{
+		message: fmt.Sprintf("client meta size %d exceeds maximum (%d)", size, max),
+	}
+}
+func (e *ErrMetaTooLarge) Error() string {
+	return e.message
+}
+func (e *ErrMetaTooLarge) Is(tgt error) bool {
+	_, ok := tgt.(*ErrMetaTooLarge)
+	if !ok {
+		return false
+	}
+	return true
+}
+
+// endregion
+// region - ErrInvalidMetaKey
+
+type ErrInvalidMetaKey struct {
+	message string
+}
+
+func NewInvalidMetaKeyError(key string) error {
+	return &ErrInvalidMetaKey{
+		message: fmt.Sprintf("invalid meta key %q", key),
+	}
+}
+func (e *ErrInvalidMetaKey) Error() string {
+	return e.message
+}
+func (e *ErrInvalidMetaKey) Is(tgt error) bool {
+	_, ok := tgt.(*ErrInvalidMetaKey)
 	if !ok {
 		return false
 	}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorsMatchOwnTypeOnly(t *testing.T) {
+	all := []error{
+		NewClientNotFoundError("id"),
+		NewTenantNotFoundError("tenant"),
+		NewTenantsClientNotFoundError("id"),
+		NewAlreadyRegisteredError(),
+		NewMaxClientsReachedError(1),
+		NewInvalidRejoinTokenError("id"),
+		NewRevisionCompactedError(1),
+		NewClientsQuotaExceededError("tenant", 1),
+		NewServicesQuotaExceededError("tenant", 1),
+		NewInstancesQuotaExceededError("tenant", "svc", 1),
+		NewMetaTooLargeError(2, 1),
+		NewInvalidMetaKeyError("key"),
+	}
+	for i, err := range all {
+		for j, tgt := range all {
+			if errors.Is(err, tgt) != (i == j) {
+				t.Errorf("unexpected errors.Is(%T, %T) = %v", err, tgt, i != j)
+			}
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package config
+
+import (
+	"fmt"
+	"github.com/joho/godotenv"
+	"github.com/slink-go/logging"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Credentials struct {
+	Login    string
+	Password string
+	Scopes   []string // granted scopes; none - register and read (legacy access)
+}
+
+// Quota limits tenant's registrations; zero limit means no limit
+type Quota struct {
+	MaxClients   int // registered clients
+	MaxServices  int // distinct services
+	MaxInstances int // clients per service
+	MaxMetaSize  int // JSON-encoded client meta size, bytes
+}
+type AppConfig struct {
+	Secured          bool
+	SslCertFile      string
+	SslCertKey       string
+	ServicePort      uint16
+	MonitoringPort   uint16
+	PingDuration     time.Duration
+	SecretKey        string
+	JwtPublicKeys    map[string]string // PEM public key files by key id
+	JwtJwks          string            // JWKS URL or file
+	JwtJwksRefresh   time.Duration
+	JwtPrivateKey    string // PEM private key file tokens are signed with
+	JwtKeyId         string
+	OidcIssuer       string // external identity provider tokens are accepted from
+	OidcJwks         string // provider's JWKS; discovered if not set
+	OidcAudience     string
+	OidcTenantClaim  string
+	OidcScopesClaim  string
+	OidcRolesClaim   string
+	TokenStoreFile   string // issued and revoked tokens; in-memory if not set
+	TokenMaxTTL      time.Duration
+	RejoinKey        string // rejoin tokens' and client secrets' signing key is derived from it
+	ClientSecrets    bool   // require per-client secret on ping, leave and meta update
+	BackendType      string
+	PluginDir        string
+	FailingThreshold uint16
+	DownThreshold    uint16
+	RemoveThreshold  uint16
+	MaxClients       int
+	RequestRate      int // api requests per tenant
+	RequestBurst     int
+	PingRate         int // pings per client
+	PingBurst        int
+	RemoteRate       int // all requests per remote address
+	RemoteBurst      int
+	LimiterCapacity  int // rate limiters kept in memory (per budget)
+	HealthChecks     bool
+	HealthInterval   time.Duration
+	HealthTimeout    time.Duration
+	RegisteredUsers  []Credentials
+	DefaultQuota     Quota
+	TenantQuotas     map[string]Quota
+}
+
+func Load() *AppConfig {
+	_ = godotenv.Load(".env") // init env from .env (if found)
+
+	cfg := AppConfig{
+		Secured:          ReadBooleanOrDefault("DISCO_SERVICE_SECURED", false),
+		SslCertFile:      ReadString("DISCO_CERT_FILE"),
+		SslCertKey:       ReadString("DISCO_CERT_KEY"),
+		ServicePort:      uint16(ReadIntOrDefault("DISCO_SERVICE_PORT", 8080)),
+		MonitoringPort:   uint16(ReadIntOrDefault("DISCO_MONITORING_PORT", 0)),
+		PingDuration:     ReadDurationOrDefault("DISCO_PING_INTERVAL", 15*time.Second),
+		SecretKey:        ReadString("DISCO_SECRET_KEY"),
+		JwtJwks:          ReadString("DISCO_JWT_JWKS"),
+		JwtJwksRefresh:   ReadDurationOrDefault("DISCO_JWT_JWKS_REFRESH", time.Hour),
+		JwtPrivateKey:    ReadString("DISCO_JWT_PRIVATE_KEY"),
+		JwtKeyId:         ReadString("DISCO_JWT_KEY_ID"),
+		OidcIssuer:       ReadString("DISCO_OIDC_ISSUER"),
+		OidcJwks:         ReadString("DISCO_OIDC_JWKS"),
+		OidcAudience:     ReadString("DISCO_OIDC_AUDIENCE"),
+		OidcTenantClaim:  ReadStringOrDefault("DISCO_OIDC_TENANT_CLAIM", "tenant"),
+		OidcScopesClaim:  ReadStringOrDefault("DISCO_OIDC_SCOPES_CLAIM", "scope"),
+		OidcRolesClaim:   ReadStringOrDefault("DISCO_OIDC_ROLES_CLAIM", "roles"),
+		TokenStoreFile:   ReadString("DISCO_TOKEN_STORE_FILE"),
+		TokenMaxTTL:      ReadDurationOrDefault("DISCO_TOKEN_MAX_TTL", 365*24*time.Hour),
+		RejoinKey:        ReadString("DISCO_REJOIN_KEY"),
+		ClientSecrets:    ReadBooleanOrDefault("DISCO_CLIENT_SECRETS", false),
+		BackendType:      strings.ToLower(ReadStringOrDefault("DISCO_BACKEND_TYPE", "inmem")),
+		PluginDir:        ReadStringOrDefault("DISCO_PLUGIN_PATH", "."),
+		FailingThreshold: uint16(ReadIntOrDefault("DISCO_CLIENT_FAILING_THRESHOLD", 2)),
+		DownThreshold:    uint16(ReadIntOrDefault("DISCO_CLIENT_DOWN_THRESHOLD", 4)),
+		RemoveThreshold:  uint16(ReadIntOrDefault("DISCO_CLIENT_REMOVE_THRESHOLD", 8)),
+		MaxClients:       ReadIntOrDefault("DISCO_MAX_CLIENTS", 1024),
+		RequestRate:      ReadIntOrDefault("DISCO_LIMIT_RATE", 10),
+		RequestBurst:     ReadIntOrDefault("DISCO_LIMIT_BURST", 20),
+		PingRate:         ReadIntOrDefault("DISCO_LIMIT_PING_RATE", 5),
+		PingBurst:        ReadIntOrDefault("DISCO_LIMIT_PING_BURST", 10),
+		RemoteRate:       ReadIntOrDefault("DISCO_LIMIT_REMOTE_RATE", 100),
+		RemoteBurst:      ReadIntOrDefault("DISCO_LIMIT_REMOTE_BURST", 200),
+		LimiterCapacity:  ReadIntOrDefault("DISCO_LIMIT_KEYS", 10000),
+		HealthChecks:     ReadBooleanOrDefault("DISCO_HEALTH_CHECK_ENABLED", false),
+		HealthTimeout:    ReadDurationOrDefault("DISCO_HEALTH_CHECK_TIMEOUT", 2*time.Second),
+		DefaultQuota: Quota{
+			MaxClients:   ReadIntOrDefault("DISCO_TENANT_MAX_CLIENTS", 0),
+			MaxServices:  ReadIntOrDefault("DISCO_TENANT_MAX_SERVICES", 0),
+			MaxInstances: ReadIntOrDefault("DISCO_TENANT_MAX_INSTANCES", 0),
+			MaxMetaSize:  ReadIntOrDefault("DISCO_TENANT_MAX_META_SIZE", 0),
+		},
+	}
+
+	cfg.RegisteredUsers = parseConfiguredUsers(os.Getenv("DISCO_USERS"))
+	cfg.TenantQuotas = parseTenantQuotas(os.Getenv("DISCO_TENANT_QUOTAS"), cfg.DefaultQuota)
+	cfg.JwtPublicKeys = parsePublicKeys(os.Getenv("DISCO_JWT_PUBLIC_KEYS"))
+	if cfg.RejoinKey == "" {
+		cfg.RejoinKey = cfg.SecretKey
+	}
+	if cfg.TokenMaxTTL <= 0 {
+		logging.GetLogger("config").Warning("invalid token max ttl %s; use default", cfg.TokenMaxTTL)
+		cfg.TokenMaxTTL = 365 * 24 * time.Hour
+	}
+	cfg.HealthInterval = ReadDurationOrDefault("DISCO_HEALTH_CHECK_INTERVAL", cfg.PingDuration)
+	if cfg.HealthInterval <= 0 {
+		logging.GetLogger("config").Warning("invalid health check interval %s; use ping interval", cfg.HealthInterval)
+		cfg.HealthInterval = cfg.PingDuration
+	}
+
+	return &cfg
+}
+func (cfg *AppConfig) Users() string {
+	var result = ""
+	for _, c := range cfg.RegisteredUsers {
+		result = fmt.Sprintf("%s%s,", result, c.Login)
+	}
+	return strings.TrimSuffix(result, ",")
+}
+
+// Quota returns tenant's quota: tenant-specific one if configured, default
+// otherwise
+func (cfg *AppConfig) Quota(tenant string) Quota {
+	if q, ok := cfg.TenantQuotas[tenant]; ok {
+		return q
+	}
+	return cfg.DefaultQuota
+}
+
+// parseConfiguredUsers parses users in form "login:password[:scopes]", e.g.
+// "svc:secret:registrar,dashboard:secret:read"
+func parseConfiguredUsers(users string) []Credentials {
+	if users == "" {
+		return nil
+	}
+	var result []Credentials
+	for _, p := range strings.Split(users, ",") {
+		creds := strings.Split(p, ":")
+		if len(creds) == 2 || len(creds) == 3 {
+			c := Credentials{
+				Login:    strings.TrimSpace(creds[0]),
+				Password: strings.TrimSpace(creds[1]),
+			}
+			if len(creds) == 3 {
+				c.Scopes = parseScopes(creds[2])
+			}
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// parseTenantQuotas parses tenant quotas in form
+// "tenant-a:clients=10,services=2;tenant-b:instances=3,meta=4096";
+// limits not set for tenant are taken from default quota
+func parseTenantQuotas(quotas string, def Quota) map[string]Quota {
+	result := make(map[string]Quota)
+	if quotas == "" {
+		return result
+	}
+	for _, p := range strings.Split(quotas, ";") {
+		tenant, limits, ok := strings.Cut(p, ":")
+		tenant = strings.TrimSpace(tenant)
+		if !ok || tenant == "" {
+			continue
+		}
+		q := def
+		for _, l := range strings.Split(limits, ",") {
+			name, value, ok := strings.Cut(l, "=")
+			if !ok {
+				continue
+			}
+			v, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				continue
+			}
+			switch strings.TrimSpace(name) {
+			case "clients":
+				q.MaxClients = v
+			case "services":
+				q.MaxServices = v
+			case "instances":
+				q.MaxInstances = v
+			case "meta":
+				q.MaxMetaSize = v
+			}
+		}
+		result[tenant] = q
+	}
+	return result
+}
+
+// parsePublicKeys parses comma-separated list of public key files with
+// optional key ids, e.g. "key-1=/etc/disco/key-1.pem,key-2=/etc/disco/key-2.pem";
+// file without key id verifies tokens without "kid" header
+func parsePublicKeys(keys string) map[string]string {
+	result := make(map[string]string)
+	if keys == "" {
+		return result
+	}
+	for _, p := range strings.Split(keys, ",") {
+		kid, file, ok := strings.Cut(p, "=")
+		if !ok {
+			kid, file = "", kid
+		}
+		if file = strings.TrimSpace(file); file != "" {
+			result[strings.TrimSpace(kid)] = file
+		}
+	}
+	return result
+}
+
+func StaticFilePath() string {
+	staticFilePath := os.Getenv("STATIC_FILE_PATH")
+	if staticFilePath == "" {
+		staticFilePath = "/static/"
+	}
+	if !strings.HasSuffix(staticFilePath, "/") {
+		staticFilePath = staticFilePath + "/"
+	}
+	return staticFilePath
+}
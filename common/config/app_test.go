@@ -0,0 +1,67 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTenantQuotas(t *testing.T) {
+	def := Quota{MaxClients: 100, MaxMetaSize: 1024}
+	quotas := parseTenantQuotas("tenant-a: clients=10, services=2; tenant-b:instances=3,meta=4096;broken;tenant-c:clients=x", def)
+
+	if q := quotas["tenant-a"]; q != (Quota{MaxClients: 10, MaxServices: 2, MaxMetaSize: 1024}) {
+		t.Errorf("unexpected tenant-a quota: %+v", q)
+	}
+	if q := quotas["tenant-b"]; q != (Quota{MaxClients: 100, MaxInstances: 3, MaxMetaSize: 4096}) {
+		t.Errorf("unexpected tenant-b quota: %+v", q)
+	}
+	if q := quotas["tenant-c"]; q != def {
+		t.Errorf("expected invalid limit to be ignored, got %+v", q)
+	}
+	if _, ok := quotas["broken"]; ok {
+		t.Errorf("expected malformed entry to be skipped")
+	}
+
+	cfg := AppConfig{DefaultQuota: def, TenantQuotas: quotas}
+	if cfg.Quota("tenant-a").MaxClients != 10 || cfg.Quota("other") != def {
+		t.Errorf("unexpected quota lookup")
+	}
+}
+func TestParseConfiguredUsers(t *testing.T) {
+	users := parseConfiguredUsers("legacy:pass, svc:pass:registrar, dashboard:pass:read, ops:pass:admin+unknown,broken")
+	if len(users) != 4 {
+		t.Fatalf("unexpected users: %+v", users)
+	}
+	expected := map[string][]string{
+		"legacy":    nil,
+		"svc":       {ScopeRead, ScopeRegister},
+		"dashboard": {ScopeRead},
+		"ops":       {ScopeAdmin, ScopeRead, ScopeRegister, "unknown"},
+	}
+	for _, u := range users {
+		if !reflect.DeepEqual(u.Scopes, expected[u.Login]) {
+			t.Errorf("unexpected %s scopes: %v", u.Login, u.Scopes)
+		}
+	}
+}
+func TestParsePublicKeys(t *testing.T) {
+	keys := parsePublicKeys("key-1=/etc/disco/key-1.pem, key-2 = /etc/disco/key-2.pem,/etc/disco/default.pem,key-3=")
+	expected := map[string]string{
+		"key-1": "/etc/disco/key-1.pem",
+		"key-2": "/etc/disco/key-2.pem",
+		"":      "/etc/disco/default.pem",
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("unexpected public keys: %v", keys)
+	}
+}
+func TestLoadHealthInterval(t *testing.T) {
+	t.Setenv("DISCO_PING_INTERVAL", "5s")
+	for value, expected := range map[string]time.Duration{"": 5 * time.Second, "0s": 5 * time.Second, "-1s": 5 * time.Second, "1m": time.Minute} {
+		t.Setenv("DISCO_HEALTH_CHECK_INTERVAL", value)
+		if interval := Load().HealthInterval; interval != expected {
+			t.Errorf("%q: expected health check interval %s, got %s", value, expected, interval)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"sort"
+	"strings"
+)
+
+// Scopes authorize groups of api requests; they are granted either
+// directly or via roles
+const (
+	ScopeRegister = "register" // join, rejoin, ping, leave and meta update
+	ScopeRead     = "read"     // list and watch
+	ScopeAdmin    = "admin"    // cross-tenant access and admin endpoints
+)
+
+var roleScopes = map[string][]string{
+	"registrar": {ScopeRegister, ScopeRead},
+	"reader":    {ScopeRead},
+	"admin":     {ScopeAdmin, ScopeRegister, ScopeRead},
+}
+
+// Scopes returns sorted set of scopes granted by explicit scopes and roles;
+// unknown roles grant nothing
+func Scopes(scopes, roles []string) []string {
+	set := make(map[string]bool)
+	for _, s := range scopes {
+		if s = strings.TrimSpace(s); s != "" {
+			set[s] = true
+		}
+	}
+	for _, r := range roles {
+		for _, s := range roleScopes[strings.TrimSpace(r)] {
+			set[s] = true
+		}
+	}
+	result := make([]string, 0, len(set))
+	for s := range set {
+		result = append(result, s)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// parseScopes parses "+"-separated list of scopes and roles, e.g.
+// "registrar" or "register+read"
+func parseScopes(str string) []string {
+	var scopes, roles []string
+	for _, v := range strings.Split(str, "+") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if _, ok := roleScopes[v]; ok {
+			roles = append(roles, v)
+		} else {
+			scopes = append(scopes, v)
+		}
+	}
+	return Scopes(scopes, roles)
+}
@@ -1,13 +1,17 @@
 module github.com/slink-go/disco/common
 
-go 1.20
+go 1.22.3
 
 require (
+	github.com/joho/godotenv v1.5.1
 	github.com/slink-go/logger v0.0.1
+	github.com/slink-go/logging v0.0.2
 	github.com/xhit/go-str2duration/v2 v2.1.0
 )
 
 require (
-	github.com/joho/godotenv v1.5.1 // indirect
+	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mattn/go-isatty v0.0.19 // indirect
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7 // indirect
+	github.com/rs/zerolog v1.32.0 // indirect
 )
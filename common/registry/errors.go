@@ -0,0 +1,35 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+// region - ErrUnknownBackend
+
+type ErrUnknownBackend struct {
+	message string
+	cause   error
+}
+
+func NewUnknownBackendError(typ string, available []string, cause error) error {
+	return &ErrUnknownBackend{
+		message: fmt.Sprintf("unknown backend %q (available: %s; plugin: %s)", typ, strings.Join(available, ", "), cause),
+		cause:   cause,
+	}
+}
+func (e *ErrUnknownBackend) Error() string {
+	return e.message
+}
+func (e *ErrUnknownBackend) Unwrap() error {
+	return e.cause
+}
+func (e *ErrUnknownBackend) Is(tgt error) bool {
+	_, ok := tgt.(*ErrUnknownBackend)
+	if !ok {
+		return false
+	}
+	return true
+}
+
+// endregion
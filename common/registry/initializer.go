@@ -0,0 +1,78 @@
+package registry
+
+import (
+	"fmt"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"plugin"
+	"sort"
+	"sync"
+)
+
+type Backend interface {
+	Init(cfg *config.AppConfig) api.Registry
+}
+
+var (
+	backendsMutex sync.RWMutex
+	backends      = make(map[string]Backend)
+)
+
+// Register makes a backend available by name; it is intended to be called
+// from init() of statically linked backend packages. Register panics if
+// called twice with the same name or if backend is nil.
+func Register(name string, backend Backend) {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	if backend == nil {
+		panic("registry: Register backend is nil")
+	}
+	if _, dup := backends[name]; dup {
+		panic("registry: Register called twice for backend " + name)
+	}
+	backends[name] = backend
+}
+
+// Backends returns sorted names of statically linked backends
+func Backends() []string {
+	backendsMutex.RLock()
+	defer backendsMutex.RUnlock()
+	result := make([]string, 0, len(backends))
+	for name := range backends {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// LoadBackend returns statically linked backend registered with given type;
+// unknown types are loaded from <path>/<type>.so go plugin
+func LoadBackend(path, typ string) (Backend, error) {
+	backendsMutex.RLock()
+	back, ok := backends[typ]
+	backendsMutex.RUnlock()
+	if ok {
+		return back, nil
+	}
+	back, err := loadPlugin(path, typ)
+	if err != nil {
+		return nil, NewUnknownBackendError(typ, Backends(), err)
+	}
+	return back, nil
+}
+func loadPlugin(path, typ string) (Backend, error) {
+	module := fmt.Sprintf("%s/%s.so", path, typ)
+	p, err := plugin.Open(module)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup("Backend")
+	if err != nil {
+		return nil, err
+	}
+	back, ok := sym.(Backend)
+	if !ok {
+		return nil, fmt.Errorf("that's not a Backend")
+	}
+	return back, nil
+}
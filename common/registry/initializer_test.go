@@ -0,0 +1,53 @@
+package registry
+
+import (
+	"errors"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"strings"
+	"testing"
+)
+
+type testBackend struct{}
+
+func (b *testBackend) Init(cfg *config.AppConfig) api.Registry {
+	return nil
+}
+
+func TestRegisterAndLoad(t *testing.T) {
+	b := &testBackend{}
+	Register("test-static", b)
+	loaded, err := LoadBackend(t.TempDir(), "test-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != b {
+		t.Errorf("expected registered backend")
+	}
+	found := false
+	for _, name := range Backends() {
+		found = found || name == "test-static"
+	}
+	if !found {
+		t.Errorf("expected test-static in %v", Backends())
+	}
+}
+func TestRegisterDuplicate(t *testing.T) {
+	Register("test-duplicate", &testBackend{})
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic on duplicate registration")
+		}
+	}()
+	Register("test-duplicate", &testBackend{})
+}
+func TestUnknownBackend(t *testing.T) {
+	Register("test-available", &testBackend{})
+	_, err := LoadBackend(t.TempDir(), "missing")
+	if !errors.Is(err, &ErrUnknownBackend{}) {
+		t.Fatalf("expected unknown backend error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "test-available") {
+		t.Errorf("expected available backends in error: %s", err.Error())
+	}
+}
@@ -0,0 +1,67 @@
+package audit
+
+import (
+	"github.com/slink-go/logging"
+	"sync"
+	"time"
+)
+
+// region - Log API
+
+// Entry records administrative action: who (Actor) did what (Action) to
+// which client or service (Target)
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Tenant string    `json:"tenant,omitempty"`
+	Target string    `json:"target"`
+}
+
+// Log keeps recent audit entries in memory; every entry is logged as well,
+// so full audit trail is available from disco logs
+type Log interface {
+	Record(entry Entry)
+	List() []Entry
+}
+
+func NewLog(capacity int) Log {
+	return &auditLog{
+		capacity: capacity,
+		logger:   logging.GetLogger("audit"),
+	}
+}
+
+// endregion
+// region - log
+
+type auditLog struct {
+	sync.RWMutex
+	entries  []Entry
+	capacity int
+	logger   logging.Logger
+}
+
+func (l *auditLog) Record(entry Entry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	l.logger.Info("[audit] %s: %s %s/%s", entry.Actor, entry.Action, entry.Tenant, entry.Target)
+	l.Lock()
+	defer l.Unlock()
+	l.entries = append(l.entries, entry)
+	if len(l.entries) > l.capacity {
+		l.entries = l.entries[len(l.entries)-l.capacity:]
+	}
+}
+
+// List returns entries in order they were recorded
+func (l *auditLog) List() []Entry {
+	l.RLock()
+	defer l.RUnlock()
+	result := make([]Entry, len(l.entries))
+	copy(result, l.entries)
+	return result
+}
+
+// endregion
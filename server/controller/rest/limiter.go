@@ -0,0 +1,90 @@
+package rest
+
+import (
+	"container/list"
+	"golang.org/x/time/rate"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultLimiterCapacity = 10000
+
+// keyedLimiter keeps separate rate limiter per key (tenant, client id or
+// remote address); when capacity is reached, least recently used limiter
+// is evicted, so idle keys do not accumulate
+type keyedLimiter struct {
+	sync.Mutex
+	limit    rate.Limit
+	burst    int
+	capacity int
+	limiters map[string]*list.Element
+	lru      *list.List
+}
+type limiterEntry struct {
+	key     string
+	limiter *rate.Limiter
+}
+
+func newKeyedLimiter(limit rate.Limit, burst, capacity int) *keyedLimiter {
+	if capacity <= 0 {
+		capacity = defaultLimiterCapacity
+	}
+	return &keyedLimiter{
+		limit:    limit,
+		burst:    burst,
+		capacity: capacity,
+		limiters: make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// allow reports whether request for key is allowed at given time; if not,
+// it also returns delay after which request may be retried
+func (l *keyedLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	r := l.get(key).ReserveN(now, 1)
+	if !r.OK() {
+		return false, time.Second
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+func (l *keyedLimiter) get(key string) *rate.Limiter {
+	l.Lock()
+	defer l.Unlock()
+	if e, ok := l.limiters[key]; ok {
+		l.lru.MoveToFront(e)
+		return e.Value.(*limiterEntry).limiter
+	}
+	if l.lru.Len() >= l.capacity {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.limiters, oldest.Value.(*limiterEntry).key)
+	}
+	entry := &limiterEntry{key: key, limiter: rate.NewLimiter(l.limit, l.burst)}
+	l.limiters[key] = l.lru.PushFront(entry)
+	return entry.limiter
+}
+func (l *keyedLimiter) size() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.lru.Len()
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+func remoteAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
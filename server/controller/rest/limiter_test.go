@@ -0,0 +1,127 @@
+package rest
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestKeyedLimiter(t *testing.T) {
+	l := newKeyedLimiter(1, 2, 10)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("expected request %d to be allowed within burst", i)
+		}
+	}
+	ok, retryAfter := l.allow("a", now)
+	if ok || retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("expected request to be limited with retry after <= 1s, got %v, %s", ok, retryAfter)
+	}
+	if ok, _ = l.allow("b", now); !ok {
+		t.Errorf("expected other key to have own budget")
+	}
+	if ok, _ = l.allow("a", now.Add(time.Second)); !ok {
+		t.Errorf("expected budget to be refilled")
+	}
+}
+func TestKeyedLimiterEviction(t *testing.T) {
+	l := newKeyedLimiter(1, 1, 2)
+	now := time.Now()
+	l.allow("a", now)
+	l.allow("b", now)
+	l.allow("a", now) // a is recently used
+	l.allow("c", now) // evicts b
+	if l.size() != 2 {
+		t.Fatalf("expected 2 limiters, got %d", l.size())
+	}
+	if _, ok := l.limiters["b"]; ok {
+		t.Errorf("expected least recently used limiter to be evicted")
+	}
+	if _, ok := l.limiters["a"]; !ok {
+		t.Errorf("expected recently used limiter to be kept")
+	}
+}
+func TestTenantRequestBudgets(t *testing.T) {
+	s := &restServiceImpl{
+		cfg:           &config.AppConfig{},
+		apiLimiter:    newKeyedLimiter(1, 1, 10),
+		pingLimiter:   newKeyedLimiter(1, 1, 10),
+		remoteLimiter: newKeyedLimiter(1, 1, 10),
+	}
+	request := func(path, tenant string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		if s.allowTenantRequest(w, r, tenant) {
+			return http.StatusOK
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Errorf("expected Retry-After header")
+		}
+		return w.Code
+	}
+	if request("/api/ping?id=c1", "tenant") != http.StatusOK || request("/api/ping?id=c1", "tenant") != http.StatusTooManyRequests {
+		t.Errorf("expected client ping budget to be exhausted")
+	}
+	if request("/api/ping?id=c2", "tenant") != http.StatusOK {
+		t.Errorf("expected other client's pings not to be limited")
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/ping?id=c1", nil)
+	r.RemoteAddr = "10.0.0.9:1000"
+	if !s.allowTenantRequest(w, r, "tenant") {
+		t.Errorf("expected pings with client's id from other address not to use client's budget")
+	}
+	if request("/api/join", "tenant") != http.StatusOK || request("/api/list", "tenant") != http.StatusTooManyRequests {
+		t.Errorf("expected tenant api budget to be separate from pings and exhausted")
+	}
+	if request("/api/join", api.TenantDefault) != http.StatusOK {
+		t.Errorf("expected other tenant not to be limited")
+	}
+}
+func TestRemoteRateLimit(t *testing.T) {
+	s := &restServiceImpl{remoteLimiter: newKeyedLimiter(1, 1, 10)}
+	handler := s.rateLimiterMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	codes := make([]int, 0)
+	for _, addr := range []string{"10.0.0.1:1000", "10.0.0.1:1001", "10.0.0.2:1000"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/list", nil)
+		r.RemoteAddr = addr
+		handler.ServeHTTP(w, r)
+		codes = append(codes, w.Code)
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Errorf("expected Retry-After 1, got %q", w.Header().Get("Retry-After"))
+		}
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests || codes[2] != http.StatusOK {
+		t.Errorf("unexpected status codes: %v", codes)
+	}
+}
+func TestRemoteRateLimitBeforeAuth(t *testing.T) {
+	s := &restServiceImpl{
+		cfg:              &config.AppConfig{},
+		apiLimiter:       newKeyedLimiter(100, 100, 10),
+		pingLimiter:      newKeyedLimiter(100, 100, 10),
+		remoteLimiter:    newKeyedLimiter(1, 1, 10),
+		httpDurationHist: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_http_duration_seconds"}, []string{"path"}),
+	}
+	router := s.configureServiceRouter()
+	codes := make([]int, 0)
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/ping?id=c1", nil)
+		r.RemoteAddr = "10.0.0.1:1000"
+		r.SetBasicAuth("tenant", "wrong")
+		router.ServeHTTP(w, r)
+		codes = append(codes, w.Code)
+	}
+	if codes[0] != http.StatusUnauthorized || codes[1] != http.StatusTooManyRequests {
+		t.Errorf("expected unauthenticated requests to be limited per remote address, got %v", codes)
+	}
+}
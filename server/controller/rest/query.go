@@ -0,0 +1,305 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/slink-go/disco/common/api"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// region - filter
+
+// clientFilter selects clients by request query parameters:
+//   - service: service id, case-insensitive
+//   - state / exclude: comma-separated client states to include / exclude
+//   - endpoint: comma-separated endpoint types (http, https, grpc); client
+//     matches if it has at least one endpoint of any of given types
+//   - meta.<key>=<value>: client's meta value equals given one
+//   - selector: comma-separated meta label selectors: "key=value", "key!=value",
+//     "key in (v1,v2)", "key notin (v1,v2)", "key" (exists) and "!key"
+type clientFilter struct {
+	service   string
+	include   map[api.ClientState]bool
+	exclude   map[api.ClientState]bool
+	endpoints map[api.EndpointType]bool
+	selectors []selector
+}
+
+func newClientFilter(r *http.Request) (*clientFilter, error) {
+	var err error
+	f := clientFilter{
+		service: r.URL.Query().Get("service"),
+	}
+	if f.include, err = queryStates(r, "state"); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = queryStates(r, "exclude"); err != nil {
+		return nil, err
+	}
+	if f.endpoints, err = queryEndpointTypes(r, "endpoint"); err != nil {
+		return nil, err
+	}
+	for key, values := range r.URL.Query() {
+		name, ok := strings.CutPrefix(key, "meta.")
+		if !ok {
+			continue
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty meta key in %q", key)
+		}
+		for _, v := range values {
+			f.selectors = append(f.selectors, selector{key: name, op: selectorIn, values: []string{v}})
+		}
+	}
+	if f.selectors, err = parseSelectors(f.selectors, r.URL.Query().Get("selector")); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+func (f *clientFilter) matches(c api.Client) bool {
+	if f.service != "" && !strings.EqualFold(c.ServiceId(), f.service) {
+		return false
+	}
+	if len(f.include) > 0 && !f.include[c.State()] || f.exclude[c.State()] {
+		return false
+	}
+	if len(f.endpoints) > 0 && !f.hasEndpoint(c) {
+		return false
+	}
+	for _, s := range f.selectors {
+		if !s.matches(c.Meta()) {
+			return false
+		}
+	}
+	return true
+}
+func (f *clientFilter) hasEndpoint(c api.Client) bool {
+	for _, e := range c.Endpoints() {
+		if f.endpoints[e.Type()] {
+			return true
+		}
+	}
+	return false
+}
+func (f *clientFilter) apply(clients []api.Client) []api.Client {
+	result := []api.Client{}
+	for _, c := range clients {
+		if f.matches(c) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// endregion
+// region - selector
+
+type selectorOp uint8
+
+const (
+	selectorIn selectorOp = iota
+	selectorNotIn
+	selectorExists
+	selectorNotExists
+)
+
+// selector is a single meta label selector; meta values are compared by
+// their string representation, so "version in (1,2)" matches both numeric
+// and string versions
+type selector struct {
+	key    string
+	op     selectorOp
+	values []string
+}
+
+func (s selector) matches(meta map[string]any) bool {
+	value, ok := meta[s.key]
+	switch s.op {
+	case selectorExists:
+		return ok
+	case selectorNotExists:
+		return !ok
+	case selectorIn:
+		return ok && s.contains(fmt.Sprint(value))
+	case selectorNotIn:
+		return !ok || !s.contains(fmt.Sprint(value))
+	}
+	return false
+}
+func (s selector) contains(value string) bool {
+	for _, v := range s.values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSelectors appends selectors parsed from comma-separated expression
+// list (commas within parentheses do not separate expressions)
+func parseSelectors(selectors []selector, str string) ([]selector, error) {
+	for _, expr := range splitSelectors(str) {
+		s, err := parseSelector(expr)
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, s)
+	}
+	return selectors, nil
+}
+func splitSelectors(str string) []string {
+	var result []string
+	depth, start := 0, 0
+	for i, ch := range str {
+		switch ch {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				result = append(result, str[start:i])
+				start = i + 1
+			}
+		}
+	}
+	result = append(result, str[start:])
+	var exprs []string
+	for _, v := range result {
+		if v = strings.TrimSpace(v); v != "" {
+			exprs = append(exprs, v)
+		}
+	}
+	return exprs
+}
+
+// parseSelector parses single selector expression; set operators are
+// detected first and equality ones are split at the first operator, so
+// values may contain "=" and "!="
+func parseSelector(expr string) (selector, error) {
+	if key, ok := strings.CutPrefix(expr, "!"); ok {
+		return newSelector(expr, key, selectorNotExists, nil)
+	}
+	fields := strings.Fields(expr)
+	if len(fields) > 1 && (fields[1] == "in" || fields[1] == "notin") {
+		return parseSetSelector(expr, fields[0], fields[1])
+	}
+	i := strings.IndexAny(expr, "!=")
+	if i < 0 {
+		if len(fields) == 1 {
+			return newSelector(expr, fields[0], selectorExists, nil)
+		}
+		return selector{}, fmt.Errorf("invalid selector %q", expr)
+	}
+	key, rest := expr[:i], expr[i:]
+	if value, ok := strings.CutPrefix(rest, "!="); ok {
+		return newSelector(expr, key, selectorNotIn, []string{strings.TrimSpace(value)})
+	}
+	if value, ok := strings.CutPrefix(rest, "=="); ok {
+		return newSelector(expr, key, selectorIn, []string{strings.TrimSpace(value)})
+	}
+	if value, ok := strings.CutPrefix(rest, "="); ok {
+		return newSelector(expr, key, selectorIn, []string{strings.TrimSpace(value)})
+	}
+	return selector{}, fmt.Errorf("invalid selector %q", expr)
+}
+func parseSetSelector(expr, key, operator string) (selector, error) {
+	op := selectorIn
+	if operator == "notin" {
+		op = selectorNotIn
+	}
+	list := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(expr, key)), operator))
+	if !strings.HasPrefix(list, "(") || !strings.HasSuffix(list, ")") {
+		return selector{}, fmt.Errorf("invalid selector %q: value list should be enclosed in parentheses", expr)
+	}
+	var values []string
+	for _, v := range strings.Split(list[1:len(list)-1], ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return newSelector(expr, key, op, values)
+}
+func newSelector(expr, key string, op selectorOp, values []string) (selector, error) {
+	key = strings.TrimSpace(key)
+	if key == "" || strings.ContainsAny(key, " ()!=") {
+		return selector{}, fmt.Errorf("invalid selector %q", expr)
+	}
+	if (op == selectorIn || op == selectorNotIn) && len(values) == 0 {
+		return selector{}, fmt.Errorf("invalid selector %q: no values", expr)
+	}
+	return selector{key: key, op: op, values: values}, nil
+}
+
+// endregion
+// region - query parameters
+
+var endpointTypes = map[string]api.EndpointType{
+	"http":  api.HttpEndpoint,
+	"https": api.HttpsEndpoint,
+	"grpc":  api.GrpcEndpoint,
+}
+
+// queryStates parses comma-separated client states from query parameter,
+// e.g. state=UP,STARTING (case-insensitive)
+func queryStates(r *http.Request, key string) (map[api.ClientState]bool, error) {
+	result := make(map[api.ClientState]bool)
+	for _, v := range strings.Split(r.URL.Query().Get(key), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		var state api.ClientState
+		if err := state.UnmarshalJSON([]byte(strconv.Quote(strings.ToUpper(v)))); err != nil {
+			return nil, err
+		}
+		result[state] = true
+	}
+	return result, nil
+}
+func queryEndpointTypes(r *http.Request, key string) (map[api.EndpointType]bool, error) {
+	result := make(map[api.EndpointType]bool)
+	for _, v := range strings.Split(r.URL.Query().Get(key), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		t, ok := endpointTypes[strings.ToLower(v)]
+		if !ok {
+			return nil, fmt.Errorf("%q is not a valid endpoint type; available values are: http, https, grpc", v)
+		}
+		result[t] = true
+	}
+	return result, nil
+}
+
+// endregion
+// region - services
+
+// serviceInstances is a group of service's instances listed by /api/services
+type serviceInstances struct {
+	ServiceId string       `json:"service_id"`
+	Instances []api.Client `json:"instances"`
+}
+
+// groupByService groups clients by service id; groups are sorted by service
+// id, instances keep their order
+func groupByService(clients []api.Client) []serviceInstances {
+	index := make(map[string]int)
+	result := []serviceInstances{}
+	for _, c := range clients {
+		i, ok := index[c.ServiceId()]
+		if !ok {
+			i = len(result)
+			index[c.ServiceId()] = i
+			result = append(result, serviceInstances{ServiceId: c.ServiceId()})
+		}
+		result[i].Instances = append(result[i].Instances, c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ServiceId < result[j].ServiceId
+	})
+	return result
+}
+
+// endregion
@@ -0,0 +1,54 @@
+package rest
+
+import (
+	"testing"
+)
+
+func TestSelectors(t *testing.T) {
+	meta := map[string]any{"zone": "eu-1", "version": 2, "canary": true, "query": "a=b"}
+	tests := []struct {
+		selector string
+		matches  bool
+	}{
+		{"zone=eu-1", true},
+		{"zone==eu-1", true},
+		{"zone=eu-2", false},
+		{"zone!=eu-2", true},
+		{"version in (1,2)", true},
+		{"version in (1, 3)", false},
+		{"version notin (3,4)", true},
+		{"region notin (3,4)", true},
+		{"zone in (eu-1, eu-2),version=2", true},
+		{"zone in (eu-1, eu-2),version=3", false},
+		{"canary", true},
+		{"!canary", false},
+		{"!region", true},
+		{"region", false},
+		{"query=a=b", true},
+		{"query==a=b", true},
+		{"query!=a=b", false},
+		{"query in (a=b, c=d)", true},
+		{"query notin (a=b)", false},
+		{"zone in (eu-1),query=a=b", true},
+		{"zone=a!=b", false},
+	}
+	for _, tc := range tests {
+		selectors, err := parseSelectors(nil, tc.selector)
+		if err != nil {
+			t.Errorf("%q: %s", tc.selector, err)
+			continue
+		}
+		matches := true
+		for _, s := range selectors {
+			matches = matches && s.matches(meta)
+		}
+		if matches != tc.matches {
+			t.Errorf("%q: expected match %v, got %v", tc.selector, tc.matches, matches)
+		}
+	}
+	for _, invalid := range []string{"=eu-1", "zone in eu-1", "zone in ()", "zone near (eu-1)", "a b in (1)", "zone!eu-1", "a b=1"} {
+		if _, err := parseSelectors(nil, invalid); err == nil {
+			t.Errorf("%q: expected to be invalid", invalid)
+		}
+	}
+}
@@ -8,12 +8,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/slink-go/disco/backend/common"
 	"github.com/slink-go/disco/common/api"
-	"github.com/slink-go/disco/server/config"
+	"github.com/slink-go/disco/common/config"
+	"github.com/slink-go/disco/server/audit"
 	"github.com/slink-go/disco/server/jwt"
 	"github.com/slink-go/disco/server/templates"
 	"github.com/slink-go/logging"
@@ -22,34 +25,80 @@ import (
 	"golang.org/x/time/rate"
 	"log"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Service interface {
 	Run()
 }
 
+const (
+	contentTypeEventStream = "text/event-stream"
+	watchDefaultTimeout    = 30 * time.Second
+	watchMaxTimeout        = 5 * time.Minute
+	auditCapacity          = 1024
+	identityKey            = "identity"
+)
+
 var (
 	ErrUnauthorized          = errors.New("unauthorized")
 	ErrBasicAuthNotSupported = errors.New("basic authorization is not enabled")
 	ErrNonTokenAuth          = errors.New("non-token auth attempted")
+	ErrForbidden             = errors.New("forbidden")
+	ErrNotClustered          = errors.New("registry backend is not clustered")
+	ErrNoClients             = errors.New("no clients found")
+	ErrInvalidClientSecret   = errors.New("invalid client secret")
+	ErrTokensNotSupported    = errors.New("token management is not configured")
+	ErrNoClientSecretKey     = errors.New("client secrets require DISCO_REJOIN_KEY or DISCO_SECRET_KEY to be set")
 )
 
-func NewDiscoService(jwt jwt.Jwt, registry api.Registry, cfg *config.AppConfig) (Service, error) {
+func NewDiscoService(jwt jwt.Jwt, tokens jwt.TokenStore, registry api.Registry, cfg *config.AppConfig) (Service, error) {
+	secretKey, err := clientSecretKey(cfg)
+	if err != nil {
+		return nil, err
+	}
 	var httpDuration *prometheus.HistogramVec
 	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "disco_http_duration_seconds",
 		Help: "Duration of HTTP requests.",
 	}, []string{"path"})
+	registryEvents := promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "disco_registry_events_total",
+		Help: "Number of registry events by type.",
+	}, []string{"type"})
+	registry.Subscribe(func(event api.Event) {
+		registryEvents.WithLabelValues(event.Type.String()).Inc()
+	})
 	return &restServiceImpl{
 		jwt:              jwt,
+		tokens:           tokens,
 		registry:         registry,
 		httpDurationHist: httpDuration,
 		cfg:              cfg,
-		limiter:          rate.NewLimiter(rate.Limit(cfg.RequestRate), cfg.RequestBurst),
+		apiLimiter:       newKeyedLimiter(rate.Limit(cfg.RequestRate), cfg.RequestBurst, cfg.LimiterCapacity),
+		pingLimiter:      newKeyedLimiter(rate.Limit(cfg.PingRate), cfg.PingBurst, cfg.LimiterCapacity),
+		remoteLimiter:    newKeyedLimiter(rate.Limit(cfg.RemoteRate), cfg.RemoteBurst, cfg.LimiterCapacity),
+		audit:            audit.NewLog(auditCapacity),
+		secretKey:        secretKey,
 		logger:           logging.GetLogger("service"),
 	}, nil
 }
+
+// clientSecretKey returns key client secrets are signed with; nil if client
+// secrets are not required. Key should be configured: generated one would
+// differ between disco instances and restarts, invalidating issued secrets
+func clientSecretKey(cfg *config.AppConfig) ([]byte, error) {
+	if !cfg.ClientSecrets {
+		return nil, nil
+	}
+	if cfg.RejoinKey == "" {
+		return nil, ErrNoClientSecretKey
+	}
+	return common.NewRejoinKey(cfg.RejoinKey), nil
+}
 func (s *restServiceImpl) Run() {
 
 	if s.cfg.MonitoringPort > 0 {
@@ -65,10 +114,15 @@ func (s *restServiceImpl) Run() {
 
 type restServiceImpl struct {
 	jwt              jwt.Jwt
+	tokens           jwt.TokenStore
 	registry         api.Registry
 	httpDurationHist *prometheus.HistogramVec
 	cfg              *config.AppConfig
-	limiter          *rate.Limiter
+	apiLimiter       *keyedLimiter // join, list, etc. per tenant
+	pingLimiter      *keyedLimiter // pings per client
+	remoteLimiter    *keyedLimiter // all requests per remote address
+	audit            audit.Log
+	secretKey        []byte // client secret signing key (nil - secrets are not required)
 	logger           logging.Logger
 }
 
@@ -98,12 +152,25 @@ func (s *restServiceImpl) configureServiceRouter() *mux.Router {
 	router.Use(s.prometheusMiddleware)
 	router.Path("/metrics").Handler(promhttp.Handler())
 
-	//router.HandleFunc("/api/token/{tenant}", s.handleGetToken).Methods("GET")
-
-	router.HandleFunc("/api/join", s.authMiddleware(s.handleJoin)).Methods("POST")
-	router.HandleFunc("/api/leave", s.authMiddleware(s.handleLeave)).Methods("POST")
-	router.HandleFunc("/api/ping", s.authMiddleware(s.handlePing)).Methods("POST")
-	router.HandleFunc("/api/list", s.authMiddleware(s.handleList)).Methods("GET")
+	router.HandleFunc("/api/join", s.authMiddleware(config.ScopeRegister, s.handleJoin)).Methods("POST")
+	router.HandleFunc("/api/rejoin", s.authMiddleware(config.ScopeRegister, s.handleRejoin)).Methods("POST")
+	router.HandleFunc("/api/leave", s.authMiddleware(config.ScopeRegister, s.handleLeave)).Methods("POST")
+	router.HandleFunc("/api/ping", s.authMiddleware(config.ScopeRegister, s.handlePing)).Methods("POST")
+	router.HandleFunc("/api/clients/{id}/meta", s.authMiddleware(config.ScopeRegister, s.handleUpdateMeta)).Methods("PATCH")
+	router.HandleFunc("/api/list", s.authMiddleware(config.ScopeRead, s.handleList)).Methods("GET")
+	router.HandleFunc("/api/services", s.authMiddleware(config.ScopeRead, s.handleServices)).Methods("GET")
+	router.HandleFunc("/api/services/{name}/instances", s.authMiddleware(config.ScopeRead, s.handleServiceInstances)).Methods("GET")
+	router.HandleFunc("/api/watch", s.authMiddleware(config.ScopeRead, s.handleWatch)).Methods("GET")
+
+	router.HandleFunc("/api/admin/cluster", s.authMiddleware(config.ScopeAdmin, s.adminMiddleware(s.handleClusterMembers))).Methods("GET")
+	router.HandleFunc("/api/admin/cluster", s.authMiddleware(config.ScopeAdmin, s.adminMiddleware(s.handleClusterAdd))).Methods("POST")
+	router.HandleFunc("/api/admin/cluster/{id}", s.authMiddleware(config.ScopeAdmin, s.adminMiddleware(s.handleClusterRemove))).Methods("DELETE")
+	router.HandleFunc("/api/admin/clients/{id}/maintenance", s.authMiddleware(config.ScopeAdmin, s.adminMiddleware(s.handleClientMaintenance))).Methods("PUT", "DELETE")
+	router.HandleFunc("/api/admin/tenants/{tenant}/services/{service}/maintenance", s.authMiddleware(config.ScopeAdmin, s.adminMiddleware(s.handleServiceMaintenance))).Methods("PUT", "DELETE")
+	router.HandleFunc("/api/admin/audit", s.authMiddleware(config.ScopeAdmin, s.adminMiddleware(s.handleAudit))).Methods("GET")
+	router.HandleFunc("/api/token/{tenant}", s.authMiddleware(config.ScopeAdmin, s.adminMiddleware(s.tokensMiddleware(s.handleGetToken)))).Methods("POST")
+	router.HandleFunc("/api/admin/tokens", s.authMiddleware(config.ScopeAdmin, s.adminMiddleware(s.tokensMiddleware(s.handleTokens)))).Methods("GET")
+	router.HandleFunc("/api/admin/tokens/{id}", s.authMiddleware(config.ScopeAdmin, s.adminMiddleware(s.tokensMiddleware(s.handleRevokeToken)))).Methods("DELETE")
 
 	return router
 }
@@ -119,9 +186,10 @@ func (s *restServiceImpl) handleJoin(w http.ResponseWriter, r *http.Request) {
 	rq.ServiceId = strings.ToUpper(rq.ServiceId)
 	resp, err := s.registry.Join(r.Context(), rq)
 	if err != nil {
-		writeResponseMessage(w, http.StatusBadRequest, "error", fmt.Sprintf("could not join: %s", err.Error()))
+		writeResponseMessage(w, joinErrorStatus(err), "error", fmt.Sprintf("could not join: %s", err.Error()))
 		return
 	}
+	s.issueSecret(resp)
 	result, err := json.Marshal(resp)
 	if err != nil {
 		writeResponseMessage(w, http.StatusInternalServerError, "error", fmt.Sprintf("could not marshall json: %s", err.Error()))
@@ -130,24 +198,80 @@ func (s *restServiceImpl) handleJoin(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(api.ContentTypeHeader, api.ContentTypeApplicationJson)
 	writeResponseStr(w, http.StatusOK, string(result))
 }
+func (s *restServiceImpl) handleRejoin(w http.ResponseWriter, r *http.Request) {
+	var rq api.RejoinRequest
+	err := decodeJSONBody(w, r, &rq)
+	if err != nil {
+		writeResponseStr(w, http.StatusBadRequest, fmt.Sprintf("error reading request: %s", err.Error()))
+		return
+	}
+	rq.ServiceId = strings.ToUpper(rq.ServiceId)
+	resp, err := s.registry.Rejoin(r.Context(), rq)
+	if err != nil {
+		if errors.Is(err, api.NewInvalidRejoinTokenError(rq.ClientId)) {
+			writeResponseMessage(w, http.StatusForbidden, "error", fmt.Sprintf("could not rejoin: %s", err.Error()))
+		} else {
+			writeResponseMessage(w, joinErrorStatus(err), "error", fmt.Sprintf("could not rejoin: %s", err.Error()))
+		}
+		return
+	}
+	s.issueSecret(resp)
+	result, err := json.Marshal(resp)
+	if err != nil {
+		writeResponseMessage(w, http.StatusInternalServerError, "error", fmt.Sprintf("could not marshall json: %s", err.Error()))
+		return
+	}
+	w.Header().Set(api.ContentTypeHeader, api.ContentTypeApplicationJson)
+	writeResponseStr(w, http.StatusOK, string(result))
+}
+
+// joinErrorStatus maps registration error to response status: exhausted
+// capacity or quota is reported as 429, registration which is not allowed
+// for tenant at all as 403
+func joinErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, &api.ErrMaxClientsReached{}),
+		errors.Is(err, &api.ErrClientsQuotaExceeded{}),
+		errors.Is(err, &api.ErrServicesQuotaExceeded{}),
+		errors.Is(err, &api.ErrInstancesQuotaExceeded{}):
+		return http.StatusTooManyRequests
+	case errors.Is(err, &api.ErrMetaTooLarge{}):
+		return http.StatusForbidden
+	default:
+		return http.StatusBadRequest
+	}
+}
 func (s *restServiceImpl) handleLeave(w http.ResponseWriter, r *http.Request) {
 	clientId := r.URL.Query().Get("id")
+	if !s.checkSecret(w, r, clientId) {
+		return
+	}
 	err := s.registry.Leave(r.Context(), clientId)
 	if err != nil {
-		writeResponseError(w, http.StatusInternalServerError, err)
+		writeResponseError(w, clientErrorStatus(err), err)
 		return
 	}
 	writeResponseMessage(w, http.StatusOK, "left", clientId)
 }
 func (s *restServiceImpl) handlePing(w http.ResponseWriter, r *http.Request) {
 	clientId := r.URL.Query().Get("id")
-	pong, err := s.registry.Ping(clientId)
-	if err != nil {
-		if errors.Is(err, api.NewClientNotFoundError(clientId)) {
-			writeResponseError(w, http.StatusNotFound, err)
-		} else {
-			writeResponseError(w, http.StatusInternalServerError, err)
+	if !s.checkSecret(w, r, clientId) {
+		return
+	}
+	var rq api.Ping
+	if r.ContentLength != 0 { // status report is optional
+		if err := decodeJSONBody(w, r, &rq); err != nil {
+			writeResponseStr(w, http.StatusBadRequest, fmt.Sprintf("error reading request: %s", err.Error()))
+			return
 		}
+	}
+	if err := rq.Validate(); err != nil {
+		writeResponseError(w, http.StatusBadRequest, err)
+		return
+	}
+	pong, err := s.registry.Ping(r.Context(), clientId, rq)
+	if err != nil {
+		writeResponseError(w, clientErrorStatus(err), err)
 		return
 	}
 	result, err := json.Marshal(pong)
@@ -157,16 +281,56 @@ func (s *restServiceImpl) handlePing(w http.ResponseWriter, r *http.Request) {
 	}
 	writeResponseBytes(w, http.StatusOK, result)
 }
+
+// handleUpdateMeta merges delta into client's meta: keys with null value are
+// removed, others are set
+func (s *restServiceImpl) handleUpdateMeta(w http.ResponseWriter, r *http.Request) {
+	clientId := mux.Vars(r)["id"]
+	if !s.checkSecret(w, r, clientId) {
+		return
+	}
+	var delta map[string]any
+	if err := decodeJSONBody(w, r, &delta); err != nil {
+		writeResponseStr(w, http.StatusBadRequest, fmt.Sprintf("error reading request: %s", err.Error()))
+		return
+	}
+	if err := api.ValidateMetaDelta(delta); err != nil {
+		writeResponseError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.registry.UpdateMeta(r.Context(), clientId, delta); err != nil {
+		writeResponseError(w, clientErrorStatus(err), err)
+		return
+	}
+	writeResponseMessage(w, http.StatusOK, "updated", clientId)
+}
+
+// clientErrorStatus maps error of operation on registered client (ping,
+// leave, meta update) to response status; other tenant's clients are not
+// found
+func clientErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, &api.ErrClientNotFound{}),
+		errors.Is(err, &api.ErrTenantsClientNotFound{}):
+		return http.StatusNotFound
+	case errors.Is(err, &api.ErrMetaTooLarge{}):
+		return http.StatusForbidden
+	case errors.Is(err, &api.ErrInvalidMetaKey{}):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
 func (s *restServiceImpl) handleList(w http.ResponseWriter, r *http.Request) {
-	service := r.URL.Query().Get("service")
+	filter, err := newClientFilter(r)
+	if err != nil {
+		writeResponseError(w, http.StatusBadRequest, err)
+		return
+	}
 	var list []api.Client
-	if service == "" {
-		list = s.registry.List(r.Context())
-	} else {
-		for _, v := range s.registry.List(r.Context()) {
-			if v.ServiceId() == service {
-				list = append(list, v)
-			}
+	for _, v := range s.registry.List(r.Context()) {
+		if filter.matches(v) {
+			list = append(list, v)
 		}
 	}
 	b, err := json.Marshal(list)
@@ -177,24 +341,328 @@ func (s *restServiceImpl) handleList(w http.ResponseWriter, r *http.Request) {
 	writeResponseBytes(w, http.StatusOK, b)
 }
 
+// handleServices lists tenant's clients matching query filters grouped by
+// service
+func (s *restServiceImpl) handleServices(w http.ResponseWriter, r *http.Request) {
+	filter, err := newClientFilter(r)
+	if err != nil {
+		writeResponseError(w, http.StatusBadRequest, err)
+		return
+	}
+	b, err := json.Marshal(groupByService(filter.apply(s.registry.List(r.Context()))))
+	if err != nil {
+		writeResponseError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeResponseBytes(w, http.StatusOK, b)
+}
+
+// handleServiceInstances lists instances of service (case-insensitive)
+// matching query filters
+func (s *restServiceImpl) handleServiceInstances(w http.ResponseWriter, r *http.Request) {
+	filter, err := newClientFilter(r)
+	if err != nil {
+		writeResponseError(w, http.StatusBadRequest, err)
+		return
+	}
+	filter.service = mux.Vars(r)["name"]
+	b, err := json.Marshal(filter.apply(s.registry.List(r.Context())))
+	if err != nil {
+		writeResponseError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeResponseBytes(w, http.StatusOK, b)
+}
+
+func (s *restServiceImpl) handleWatch(w http.ResponseWriter, r *http.Request) {
+	revision, err := watchRevision(r)
+	if err != nil {
+		writeResponseError(w, http.StatusBadRequest, err)
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), contentTypeEventStream) {
+		s.streamEvents(w, r, revision)
+		return
+	}
+	timeout := watchDefaultTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		timeout, err = str2duration.ParseDuration(v)
+		if err != nil {
+			writeResponseError(w, http.StatusBadRequest, err)
+			return
+		}
+		timeout = min(timeout, watchMaxTimeout)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	resp, err := s.registry.Watch(ctx, revision)
+	if err != nil {
+		if errors.Is(err, api.NewRevisionCompactedError(revision)) {
+			writeResponseError(w, http.StatusGone, err)
+		} else {
+			writeResponseError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	result, err := json.Marshal(resp)
+	if err != nil {
+		writeResponseMessage(w, http.StatusInternalServerError, "error", fmt.Sprintf("could not marshall json: %s", err.Error()))
+		return
+	}
+	w.Header().Set(api.ContentTypeHeader, api.ContentTypeApplicationJson)
+	writeResponseBytes(w, http.StatusOK, result)
+}
+func (s *restServiceImpl) streamEvents(w http.ResponseWriter, r *http.Request, revision uint64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeResponseMessage(w, http.StatusInternalServerError, "error", "streaming not supported")
+		return
+	}
+	w.Header().Set(api.ContentTypeHeader, contentTypeEventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		resp, err := s.registry.Watch(r.Context(), revision)
+		if err != nil {
+			_, _ = fmt.Fprintf(w, "event: error\ndata: {\"error\": %q}\n\n", err.Error())
+			flusher.Flush()
+			return
+		}
+		if r.Context().Err() != nil {
+			return
+		}
+		for _, e := range resp.Events {
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			_, _ = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Revision, e.Type, data)
+		}
+		flusher.Flush()
+		revision = resp.Revision
+	}
+}
+
+func (s *restServiceImpl) handleClusterMembers(w http.ResponseWriter, r *http.Request) {
+	cluster, ok := s.registry.(api.Cluster)
+	if !ok {
+		writeResponseError(w, http.StatusNotImplemented, ErrNotClustered)
+		return
+	}
+	members, err := cluster.Members()
+	if err != nil {
+		writeResponseError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	result, err := json.Marshal(members)
+	if err != nil {
+		writeResponseMessage(w, http.StatusInternalServerError, "error", fmt.Sprintf("could not marshall json: %s", err.Error()))
+		return
+	}
+	w.Header().Set(api.ContentTypeHeader, api.ContentTypeApplicationJson)
+	writeResponseBytes(w, http.StatusOK, result)
+}
+func (s *restServiceImpl) handleClusterAdd(w http.ResponseWriter, r *http.Request) {
+	cluster, ok := s.registry.(api.Cluster)
+	if !ok {
+		writeResponseError(w, http.StatusNotImplemented, ErrNotClustered)
+		return
+	}
+	var member api.Member
+	if err := decodeJSONBody(w, r, &member); err != nil {
+		writeResponseStr(w, http.StatusBadRequest, fmt.Sprintf("error reading request: %s", err.Error()))
+		return
+	}
+	if err := cluster.AddMember(member); err != nil {
+		writeResponseError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeResponseMessage(w, http.StatusOK, "added", member.Id)
+}
+func (s *restServiceImpl) handleClusterRemove(w http.ResponseWriter, r *http.Request) {
+	cluster, ok := s.registry.(api.Cluster)
+	if !ok {
+		writeResponseError(w, http.StatusNotImplemented, ErrNotClustered)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if err := cluster.RemoveMember(id); err != nil {
+		writeResponseError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeResponseMessage(w, http.StatusOK, "removed", id)
+}
+
+// handleClientMaintenance sets (PUT) or clears (DELETE) client's maintenance
+// override: client stays MAINTENANCE regardless of its pings
+func (s *restServiceImpl) handleClientMaintenance(w http.ResponseWriter, r *http.Request) {
+	clientId := mux.Vars(r)["id"]
+	enabled := r.Method == http.MethodPut
+	if err := s.registry.SetMaintenance(clientId, enabled); err != nil {
+		if errors.Is(err, api.NewClientNotFoundError(clientId)) {
+			writeResponseError(w, http.StatusNotFound, err)
+		} else {
+			writeResponseError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	s.audit.Record(audit.Entry{
+		Actor:  identity(r),
+		Action: maintenanceAction(enabled),
+		Target: clientId,
+	})
+	writeResponseMessage(w, http.StatusOK, "maintenance", clientId)
+}
+
+// handleServiceMaintenance sets or clears maintenance override for all
+// currently registered instances of tenant's service
+func (s *restServiceImpl) handleServiceMaintenance(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	service := mux.Vars(r)["service"]
+	enabled := r.Method == http.MethodPut
+	clients := make([]string, 0)
+	for _, c := range s.registry.List(context.WithValue(r.Context(), api.TenantKey, tenant)) {
+		if c.Tenant() != tenant || !strings.EqualFold(c.ServiceId(), service) {
+			continue
+		}
+		if err := s.registry.SetMaintenance(c.ClientId(), enabled); err != nil {
+			if errors.Is(err, api.NewClientNotFoundError(c.ClientId())) {
+				continue // left meanwhile
+			}
+			writeResponseError(w, http.StatusInternalServerError, err)
+			return
+		}
+		clients = append(clients, c.ClientId())
+	}
+	if len(clients) == 0 {
+		writeResponseError(w, http.StatusNotFound, ErrNoClients)
+		return
+	}
+	s.audit.Record(audit.Entry{
+		Actor:  identity(r),
+		Action: maintenanceAction(enabled),
+		Tenant: tenant,
+		Target: strings.ToUpper(service),
+	})
+	result, err := json.Marshal(map[string][]string{"maintenance": clients})
+	if err != nil {
+		writeResponseMessage(w, http.StatusInternalServerError, "error", fmt.Sprintf("could not marshall json: %s", err.Error()))
+		return
+	}
+	w.Header().Set(api.ContentTypeHeader, api.ContentTypeApplicationJson)
+	writeResponseBytes(w, http.StatusOK, result)
+}
+func (s *restServiceImpl) handleAudit(w http.ResponseWriter, r *http.Request) {
+	result, err := json.Marshal(s.audit.List())
+	if err != nil {
+		writeResponseMessage(w, http.StatusInternalServerError, "error", fmt.Sprintf("could not marshall json: %s", err.Error()))
+		return
+	}
+	w.Header().Set(api.ContentTypeHeader, api.ContentTypeApplicationJson)
+	writeResponseBytes(w, http.StatusOK, result)
+}
+
+// issuedToken is a response to token issue request
+type issuedToken struct {
+	Id        string    `json:"id"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// handleGetToken issues token for tenant; token's ttl (30m by default, at most
+// configured maximum) and comma-separated scopes are taken from query parameters
 func (s *restServiceImpl) handleGetToken(w http.ResponseWriter, r *http.Request) {
-	//time.Sleep(time.Duration(rand.Intn(5)) * time.Second) // random delay
 	tenant := mux.Vars(r)["tenant"]
 	durationStr := r.URL.Query().Get("ttl")
 	if durationStr == "" {
 		durationStr = "30m"
 	}
 	dur, err := str2duration.ParseDuration(durationStr)
+	if err != nil || dur <= 0 {
+		writeResponseMessage(w, http.StatusBadRequest, "error", fmt.Sprintf("invalid ttl %q", durationStr))
+		return
+	}
+	var scopes []string
+	for _, v := range strings.Split(r.URL.Query().Get("scopes"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			scopes = append(scopes, v)
+		}
+	}
+	token, err := s.jwt.Generate("disco", tenant, dur, scopes...)
+	if errors.Is(err, jwt.ErrSigningNotSupported) {
+		writeResponseError(w, http.StatusNotImplemented, err)
+		return
+	}
+	if errors.Is(err, jwt.ErrTokenTTL) {
+		writeResponseMessage(w, http.StatusBadRequest, "error", fmt.Sprintf("ttl %q exceeds maximum %s", durationStr, s.cfg.TokenMaxTTL))
+		return
+	}
 	if err != nil {
 		writeResponseError(w, http.StatusInternalServerError, err)
 		return
 	}
-	token, err := s.jwt.Generate(r.RemoteAddr, tenant, dur)
+	claims, err := s.jwt.Validate(token)
 	if err != nil {
 		writeResponseError(w, http.StatusInternalServerError, err)
 		return
 	}
-	writeResponseStr(w, http.StatusOK, token)
+	s.audit.Record(audit.Entry{
+		Actor:  identity(r),
+		Action: "token issued",
+		Tenant: tenant,
+		Target: claims.GetId().String(),
+	})
+	result, err := json.Marshal(issuedToken{
+		Id:        claims.GetId().String(),
+		Token:     token,
+		ExpiresAt: claims.GetExpiresAt(),
+	})
+	if err != nil {
+		writeResponseMessage(w, http.StatusInternalServerError, "error", fmt.Sprintf("could not marshall json: %s", err.Error()))
+		return
+	}
+	w.Header().Set(api.ContentTypeHeader, api.ContentTypeApplicationJson)
+	writeResponseBytes(w, http.StatusOK, result)
+}
+
+// handleTokens lists tokens issued by disco and revoked tokens, optionally
+// filtered by tenant
+func (s *restServiceImpl) handleTokens(w http.ResponseWriter, r *http.Request) {
+	tokens := []jwt.TokenInfo{}
+	for _, t := range s.tokens.List() {
+		if !r.URL.Query().Has("tenant") || t.Tenant == r.URL.Query().Get("tenant") {
+			tokens = append(tokens, t)
+		}
+	}
+	result, err := json.Marshal(tokens)
+	if err != nil {
+		writeResponseMessage(w, http.StatusInternalServerError, "error", fmt.Sprintf("could not marshall json: %s", err.Error()))
+		return
+	}
+	w.Header().Set(api.ContentTypeHeader, api.ContentTypeApplicationJson)
+	writeResponseBytes(w, http.StatusOK, result)
+}
+
+// handleRevokeToken revokes token by id; token does not need to be known to
+// token store (e.g. issued with `disco -token` or before restart)
+func (s *restServiceImpl) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		writeResponseMessage(w, http.StatusBadRequest, "error", fmt.Sprintf("invalid token id: %s", err.Error()))
+		return
+	}
+	if err = s.tokens.Revoke(id); err != nil {
+		writeResponseError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.audit.Record(audit.Entry{
+		Actor:  identity(r),
+		Action: "token revoked",
+		Target: id.String(),
+	})
+	writeResponseMessage(w, http.StatusOK, "revoked", id.String())
 }
 
 // endregion
@@ -295,18 +763,41 @@ func (s *restServiceImpl) prometheusMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// rateLimiterMiddleware limits requests per remote address before they are
+// authenticated; tenant and client budgets are checked by authMiddleware
 func (s *restServiceImpl) rateLimiterMiddleware(next http.Handler) http.Handler {
 	// https://www.alexedwards.net/blog/how-to-rate-limit-http-requests
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if s.limiter.Allow() == false {
-			http.Error(w, http.StatusText(429), http.StatusTooManyRequests)
+		if ok, retryAfter := s.remoteLimiter.allow(remoteAddress(r), time.Now()); !ok {
+			writeTooManyRequests(w, retryAfter)
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (s *restServiceImpl) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// allowTenantRequest checks authenticated request against its budget: pings
+// are limited per client and remote address, so client pinging in a loop
+// does not affect other clients, and pings sent with someone else's client
+// id do not exhaust that client's budget; other requests are limited per tenant
+func (s *restServiceImpl) allowTenantRequest(w http.ResponseWriter, r *http.Request, tenant string) bool {
+	var ok bool
+	var retryAfter time.Duration
+	if r.URL.Path == "/api/ping" {
+		ok, retryAfter = s.pingLimiter.allow(tenant+"/"+remoteAddress(r)+"/"+r.URL.Query().Get("id"), time.Now())
+	} else {
+		ok, retryAfter = s.apiLimiter.allow(tenant, time.Now())
+	}
+	if !ok {
+		writeTooManyRequests(w, retryAfter)
+	}
+	return ok
+}
+
+// authMiddleware authenticates request and requires given scope to be granted
+// to the caller; access within default tenant (i.e. cross-tenant) requires
+// admin scope as well
+func (s *restServiceImpl) authMiddleware(scope string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		tokenString := r.Header.Get("Authorization")
 		if len(tokenString) == 0 {
@@ -315,7 +806,7 @@ func (s *restServiceImpl) authMiddleware(next http.HandlerFunc) http.HandlerFunc
 		}
 
 		// try token auth
-		tenant, err := s.tokenAuth(r)
+		tenant, identity, scopes, err := s.tokenAuth(r)
 		if err != nil && !errors.Is(err, ErrNonTokenAuth) {
 			writeResponseError(w, http.StatusUnauthorized, err)
 			return
@@ -323,26 +814,62 @@ func (s *restServiceImpl) authMiddleware(next http.HandlerFunc) http.HandlerFunc
 
 		if errors.Is(err, ErrNonTokenAuth) {
 			// try basic auth
-			tenant, err = s.basicAuth(r)
+			tenant, scopes, err = s.basicAuth(r)
 			if err != nil {
 				writeResponseError(w, http.StatusUnauthorized, err)
 				return
 			}
+			identity = tenant
+			scopes = grantedScopes(tenant, scopes)
+		}
+
+		if !slices.Contains(scopes, scope) || tenant == api.TenantDefault && !slices.Contains(scopes, config.ScopeAdmin) {
+			writeResponseError(w, http.StatusForbidden, ErrForbidden)
+			return
+		}
+		if !s.allowTenantRequest(w, r, tenant) {
+			return
+		}
+		ctx := context.WithValue(r.Context(), api.TenantKey, tenant)
+		r = r.WithContext(context.WithValue(ctx, identityKey, identity))
+		next.ServeHTTP(w, r)
+	}
+}
+
+// tokensMiddleware answers 501 if tokens are not managed by disco (i.e. no
+// token verifier is configured, only basic auth is used)
+func (s *restServiceImpl) tokensMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.jwt == nil || s.tokens == nil {
+			writeResponseError(w, http.StatusNotImplemented, ErrTokensNotSupported)
+			return
 		}
+		next.ServeHTTP(w, r)
+	}
+}
 
-		r = r.WithContext(context.WithValue(r.Context(), api.TenantKey, tenant))
+// adminMiddleware allows request for default tenant only (i.e. token
+// without tenant); must be used after authMiddleware
+func (s *restServiceImpl) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(api.TenantKey) != api.TenantDefault {
+			writeResponseError(w, http.StatusForbidden, ErrForbidden)
+			return
+		}
 		next.ServeHTTP(w, r)
 	}
 }
-func (s *restServiceImpl) basicAuth(r *http.Request) (string, error) {
+
+// basicAuth returns user's tenant (user name) and scopes granted to user
+func (s *restServiceImpl) basicAuth(r *http.Request) (string, []string, error) {
 	//https://www.alexedwards.net/blog/basic-authentication-in-go
 	username, password, ok := r.BasicAuth()
 	if !ok {
-		return "", ErrUnauthorized
+		return "", nil, ErrUnauthorized
 	}
 
 	if s.cfg.RegisteredUsers == nil || len(s.cfg.RegisteredUsers) == 0 {
-		return "", ErrBasicAuthNotSupported
+		return "", nil, ErrBasicAuthNotSupported
 	}
 
 	usernameHash := sha256.Sum256([]byte(username))
@@ -355,28 +882,76 @@ func (s *restServiceImpl) basicAuth(r *http.Request) (string, error) {
 		userMatch = s.checkHash(usernameHash, cr.Login)
 		passMatch = s.checkHash(passwordHash, cr.Password)
 		if userMatch && passMatch {
-			return username, nil
+			return username, cr.Scopes, nil
 		}
 	}
 
-	return "", ErrUnauthorized
+	return "", nil, ErrUnauthorized
 }
-func (s *restServiceImpl) tokenAuth(r *http.Request) (string, error) {
+
+// tokenAuth returns token's tenant, identity (issuer and token id) used for
+// audit and scopes granted by token (directly or via roles)
+func (s *restServiceImpl) tokenAuth(r *http.Request) (string, string, []string, error) {
 	authStr := r.Header.Get("Authorization")
 	if !strings.Contains(authStr, "Bearer ") {
-		return "", ErrNonTokenAuth
+		return "", "", nil, ErrNonTokenAuth
+	}
+	if s.jwt == nil {
+		return "", "", nil, ErrUnauthorized
 	}
 	authStr = strings.Replace(authStr, "Bearer ", "", 1)
 	payload, err := s.jwt.Validate(authStr)
 	if err != nil {
-		return "", err
+		return "", "", nil, err
 	}
-	if payload.GetTenant() != "" {
-		return payload.GetTenant(), nil
-	} else {
-		return api.TenantDefault, nil
+	identity := fmt.Sprintf("%s (token %s)", payload.GetIssuer(), payload.GetId())
+	tenant := payload.GetTenant()
+	if tenant == "" {
+		tenant = api.TenantDefault
+	}
+	scopes := config.Scopes(payload.GetScopes(), payload.GetRoles())
+	if payload.External() {
+		// identity provider's users get no access implicitly
+		return tenant, identity, scopes, nil
+	}
+	return tenant, identity, grantedScopes(tenant, scopes), nil
+}
+
+// grantedScopes returns scopes of disco's own token or basic auth user;
+// credentials without scopes (issued before scopes were introduced) grant
+// register and read within tenant and everything within default tenant
+func grantedScopes(tenant string, scopes []string) []string {
+	if len(scopes) > 0 {
+		return scopes
+	}
+	if tenant == api.TenantDefault {
+		return []string{config.ScopeAdmin, config.ScopeRead, config.ScopeRegister}
+	}
+	return []string{config.ScopeRead, config.ScopeRegister}
+}
+
+// issueSecret adds client secret to join response if secrets are required
+func (s *restServiceImpl) issueSecret(resp *api.JoinResponse) {
+	if s.secretKey != nil {
+		resp.Secret = common.NewClientSecret(s.secretKey, resp.ClientId)
 	}
 }
+
+// checkSecret verifies client secret accompanying client's own request;
+// requests of default tenant (admin) do not need one
+func (s *restServiceImpl) checkSecret(w http.ResponseWriter, r *http.Request, clientId string) bool {
+	if s.secretKey == nil {
+		return true
+	}
+	if tenant, _ := r.Context().Value(api.TenantKey).(string); tenant == api.TenantDefault {
+		return true
+	}
+	if !common.ValidClientSecret(s.secretKey, clientId, r.Header.Get(api.ClientSecretHeader)) {
+		writeResponseError(w, http.StatusForbidden, ErrInvalidClientSecret)
+		return false
+	}
+	return true
+}
 func (s *restServiceImpl) checkHash(hash [sha256.Size]byte, str string) bool {
 	check := sha256.Sum256([]byte(str))
 	return subtle.ConstantTimeCompare(hash[:], check[:]) == 1
@@ -385,6 +960,35 @@ func (s *restServiceImpl) checkHash(hash [sha256.Size]byte, str string) bool {
 // endregion
 // region -> helpers
 
+func watchRevision(r *http.Request) (uint64, error) {
+	v := r.URL.Query().Get("revision")
+	if v == "" {
+		v = r.Header.Get("Last-Event-ID")
+	}
+	if v == "" {
+		return 0, nil
+	}
+	revision, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid revision: %s", v)
+	}
+	return revision, nil
+}
+
+// identity returns authenticated caller for audit
+func identity(r *http.Request) string {
+	if v, ok := r.Context().Value(identityKey).(string); ok {
+		return v
+	}
+	return r.RemoteAddr
+}
+func maintenanceAction(enabled bool) string {
+	if enabled {
+		return "maintenance on"
+	}
+	return "maintenance off"
+}
+
 func writeResponseStr(w http.ResponseWriter, code int, str string) {
 	writeResponseBytes(w, code, []byte(fmt.Sprintf("%s\n", str)))
 }
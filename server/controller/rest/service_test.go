@@ -0,0 +1,553 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	gojwt "github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slink-go/disco/backend/common"
+	"github.com/slink-go/disco/backend/inmem"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"github.com/slink-go/disco/server/audit"
+	"github.com/slink-go/disco/server/jwt"
+	"github.com/slink-go/logging"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// region - helpers
+
+type testService struct {
+	*restServiceImpl
+	handler http.Handler
+}
+
+func newTestService(t *testing.T) *testService {
+	t.Helper()
+	cfg := &config.AppConfig{
+		PingDuration:     time.Minute,
+		FailingThreshold: 2,
+		DownThreshold:    4,
+		RemoveThreshold:  8,
+		MaxClients:       16,
+		TokenMaxTTL:      24 * time.Hour,
+	}
+	j, err := jwt.Init("quite-a-long-secret-key-used-by-rest-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := jwt.NewMemoryTokenStore(cfg.TokenMaxTTL)
+	s := &restServiceImpl{
+		jwt:      jwt.WithTokenStore(j, tokens),
+		tokens:   tokens,
+		registry: inmem.Backend.Init(cfg),
+		httpDurationHist: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "disco_test_http_duration_seconds",
+		}, []string{"path"}),
+		cfg:           cfg,
+		apiLimiter:    newKeyedLimiter(1000, 1000, 10),
+		pingLimiter:   newKeyedLimiter(1000, 1000, 10),
+		remoteLimiter: newKeyedLimiter(1000, 1000, 10),
+		audit:         audit.NewLog(10),
+		logger:        logging.GetLogger("test"),
+	}
+	return &testService{restServiceImpl: s, handler: s.configureServiceRouter()}
+}
+func (ts *testService) token(t *testing.T, tenant string) string {
+	t.Helper()
+	token, err := ts.jwt.Generate("test", tenant, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+func (ts *testService) scopedToken(t *testing.T, tenant string, scopes ...string) string {
+	t.Helper()
+	token, err := ts.jwt.Generate("test", tenant, time.Hour, scopes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+func (ts *testService) request(t *testing.T, method, path, token string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	return ts.requestWithSecret(t, method, path, token, "", body)
+}
+func (ts *testService) requestWithSecret(t *testing.T, method, path, token, secret string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := httptest.NewRequest(method, path, bytes.NewReader(data))
+	r.Header.Set("Authorization", "Bearer "+token)
+	if secret != "" {
+		r.Header.Set(api.ClientSecretHeader, secret)
+	}
+	w := httptest.NewRecorder()
+	ts.handler.ServeHTTP(w, r)
+	return w
+}
+func (ts *testService) join(t *testing.T, tenant, service string) string {
+	t.Helper()
+	resp, err := ts.registry.Join(context.WithValue(context.Background(), api.TenantKey, tenant), api.JoinRequest{
+		ServiceId: service,
+		Endpoints: []string{"http://localhost:8080"},
+		Meta:      map[string]any{"n": time.Now().UnixNano()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.ClientId
+}
+func (ts *testService) state(t *testing.T, clientId string) api.ClientState {
+	t.Helper()
+	for _, c := range ts.registry.List(context.WithValue(context.Background(), api.TenantKey, api.TenantDefault)) {
+		if c.ClientId() == clientId {
+			return c.State()
+		}
+	}
+	t.Fatalf("client %s not found", clientId)
+	return api.ClientStateUnknown
+}
+
+// endregion
+
+func TestPingStatusAndListFilter(t *testing.T) {
+	ts := newTestService(t)
+	token := ts.token(t, "tenant")
+	a := ts.join(t, "tenant", "API")
+	b := ts.join(t, "tenant", "API")
+
+	if w := ts.request(t, http.MethodPost, "/api/ping?id="+a, token, api.Ping{Status: api.ClientStateDraining}); w.Code != http.StatusOK {
+		t.Fatalf("expected ping to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := ts.request(t, http.MethodPost, "/api/ping?id="+b, token, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected ping without body to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := ts.request(t, http.MethodPost, "/api/ping?id="+b, token, api.Ping{Status: api.ClientStateDown}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected DOWN status to be rejected, got %d", w.Code)
+	}
+
+	var list []struct {
+		ClientId string          `json:"client_id"`
+		State    api.ClientState `json:"state"`
+	}
+	w := ts.request(t, http.MethodGet, "/api/list?service=API&exclude=DRAINING,OUT_OF_SERVICE", token, nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ClientId != b || list[0].State != api.ClientStateUp {
+		t.Errorf("expected only UP client %s, got %+v", b, list)
+	}
+	if w = ts.request(t, http.MethodGet, "/api/list?state=SLEEPING", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid state filter to be rejected, got %d", w.Code)
+	}
+}
+func TestMaintenance(t *testing.T) {
+	ts := newTestService(t)
+	admin := ts.token(t, "")
+	a := ts.join(t, "tenant", "API")
+	b := ts.join(t, "tenant", "API")
+	c := ts.join(t, "other", "API")
+
+	if w := ts.request(t, http.MethodPut, "/api/admin/clients/"+a+"/maintenance", ts.token(t, "tenant"), nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected tenant token to be forbidden, got %d", w.Code)
+	}
+	if w := ts.request(t, http.MethodPut, "/api/admin/clients/"+a+"/maintenance", admin, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected maintenance to be set, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := ts.registry.Ping(context.WithValue(context.Background(), api.TenantKey, "tenant"), a, api.Ping{}); err != nil {
+		t.Fatal(err)
+	}
+	if s := ts.state(t, a); s != api.ClientStateMaintenance {
+		t.Errorf("expected maintenance to persist across pings, got %s", s)
+	}
+	if w := ts.request(t, http.MethodDelete, "/api/admin/clients/"+a+"/maintenance", admin, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected maintenance to be cleared, got %d: %s", w.Code, w.Body.String())
+	}
+	if s := ts.state(t, a); s != api.ClientStateUp {
+		t.Errorf("expected UP after maintenance, got %s", s)
+	}
+	if w := ts.request(t, http.MethodPut, "/api/admin/clients/unknown/maintenance", admin, nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected unknown client not to be found, got %d", w.Code)
+	}
+
+	if w := ts.request(t, http.MethodPut, "/api/admin/tenants/tenant/services/api/maintenance", admin, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected service maintenance to be set, got %d: %s", w.Code, w.Body.String())
+	}
+	if ts.state(t, a) != api.ClientStateMaintenance || ts.state(t, b) != api.ClientStateMaintenance {
+		t.Errorf("expected all tenant's instances in maintenance")
+	}
+	if s := ts.state(t, c); s == api.ClientStateMaintenance {
+		t.Errorf("expected other tenant's instance not to be affected")
+	}
+
+	var entries []audit.Entry
+	w := ts.request(t, http.MethodGet, "/api/admin/audit", admin, nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 audit entries, got %+v", entries)
+	}
+	if entries[0].Action != "maintenance on" || entries[0].Target != a || entries[0].Actor == "" {
+		t.Errorf("unexpected audit entry: %+v", entries[0])
+	}
+	if entries[2].Tenant != "tenant" || entries[2].Target != "API" {
+		t.Errorf("unexpected service audit entry: %+v", entries[2])
+	}
+}
+func TestUpdateMeta(t *testing.T) {
+	ts := newTestService(t)
+	token := ts.token(t, "tenant")
+	a := ts.join(t, "tenant", "API")
+
+	if w := ts.request(t, http.MethodPatch, "/api/clients/"+a+"/meta", token, map[string]any{"zone": "eu-1", "n": nil}); w.Code != http.StatusOK {
+		t.Fatalf("expected meta to be updated, got %d: %s", w.Code, w.Body.String())
+	}
+	var list []struct {
+		ClientId string         `json:"client_id"`
+		Meta     map[string]any `json:"meta"`
+	}
+	w := ts.request(t, http.MethodGet, "/api/list", token, nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || len(list[0].Meta) != 1 || list[0].Meta["zone"] != "eu-1" {
+		t.Errorf("expected updated meta to be listed, got %+v", list)
+	}
+
+	if w = ts.request(t, http.MethodPatch, "/api/clients/"+a+"/meta", token, map[string]any{"bad key": 1}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid key to be rejected, got %d", w.Code)
+	}
+	if w = ts.request(t, http.MethodPatch, "/api/clients/"+a+"/meta", ts.token(t, "other"), map[string]any{"zone": "us-1"}); w.Code != http.StatusNotFound {
+		t.Errorf("expected other tenant's client not to be found, got %d", w.Code)
+	}
+	if w = ts.request(t, http.MethodPost, "/api/ping?id="+a, token, api.Ping{Meta: map[string]any{"zone": "eu-2"}}); w.Code != http.StatusOK {
+		t.Fatalf("expected ping with meta delta to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w = ts.request(t, http.MethodPost, "/api/ping?id="+a, token, api.Ping{Meta: map[string]any{"-": 1}}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected ping with invalid meta key to be rejected, got %d", w.Code)
+	}
+}
+func TestServices(t *testing.T) {
+	ts := newTestService(t)
+	token := ts.token(t, "tenant")
+	ctx := context.WithValue(context.Background(), api.TenantKey, "tenant")
+	for _, rq := range []api.JoinRequest{
+		{ServiceId: "API", Endpoints: []string{"http://localhost:8080"}, Meta: map[string]any{"zone": "eu-1", "version": "1"}},
+		{ServiceId: "API", Endpoints: []string{"grpc://localhost:9090"}, Meta: map[string]any{"zone": "eu-2", "version": "2"}},
+		{ServiceId: "WEB", Endpoints: []string{"https://localhost:8443"}, Meta: map[string]any{"zone": "eu-1"}},
+	} {
+		if _, err := ts.registry.Join(ctx, rq); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var services []struct {
+		ServiceId string `json:"service_id"`
+		Instances []struct {
+			ClientId string `json:"client_id"`
+		} `json:"instances"`
+	}
+	w := ts.request(t, http.MethodGet, "/api/services?meta.zone=eu-1", token, nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &services); err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 || services[0].ServiceId != "API" || len(services[0].Instances) != 1 || services[1].ServiceId != "WEB" {
+		t.Errorf("unexpected services: %+v", services)
+	}
+
+	var instances []struct {
+		ServiceId string         `json:"service_id"`
+		Meta      map[string]any `json:"meta"`
+	}
+	for query, expected := range map[string]int{
+		"":                           2,
+		"?endpoint=grpc":             1,
+		"?endpoint=http,https":       1,
+		"?selector=version+in+(1,2)": 2,
+		"?selector=version+notin+(1)&meta.zone=eu-2":     1,
+		"?selector=zone,!canary&state=starting,draining": 2,
+		"?state=UP": 0,
+	} {
+		w = ts.request(t, http.MethodGet, "/api/services/api/instances"+query, token, nil)
+		if err := json.Unmarshal(w.Body.Bytes(), &instances); err != nil {
+			t.Fatal(err)
+		}
+		if len(instances) != expected {
+			t.Errorf("%q: expected %d instances, got %+v", query, expected, instances)
+		}
+	}
+	if w = ts.request(t, http.MethodGet, "/api/services?endpoint=ftp", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid endpoint type to be rejected, got %d", w.Code)
+	}
+	if w = ts.request(t, http.MethodGet, "/api/services?selector="+url.QueryEscape("version in 1"), token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid selector to be rejected, got %d", w.Code)
+	}
+	if w = ts.request(t, http.MethodGet, "/api/list?service=api", token, nil); !strings.Contains(w.Body.String(), "API") {
+		t.Errorf("expected case-insensitive service match in list, got %s", w.Body.String())
+	}
+}
+func TestClientSecretKey(t *testing.T) {
+	if _, err := clientSecretKey(&config.AppConfig{ClientSecrets: true}); !errors.Is(err, ErrNoClientSecretKey) {
+		t.Errorf("expected client secrets without key to be refused, got %v", err)
+	}
+	key, err := clientSecretKey(&config.AppConfig{ClientSecrets: true, RejoinKey: "rejoin-key"})
+	if err != nil || string(key) != string(common.NewRejoinKey("rejoin-key")) {
+		t.Errorf("expected key to be derived from configured one: %v", err)
+	}
+	if string(key) == "rejoin-key" {
+		t.Errorf("expected configured secret not to be used as a key as is")
+	}
+	if key, _ = clientSecretKey(&config.AppConfig{RejoinKey: "rejoin-key"}); key != nil {
+		t.Errorf("expected no key if client secrets are disabled")
+	}
+}
+func TestClientSecrets(t *testing.T) {
+	ts := newTestService(t)
+	ts.secretKey = common.NewRejoinKey("client-secret-test-key")
+	token := ts.token(t, "tenant")
+
+	var resp api.JoinResponse
+	w := ts.request(t, http.MethodPost, "/api/join", token, api.JoinRequest{ServiceId: "api", Endpoints: []string{"http://localhost:8080"}})
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Secret == "" {
+		t.Fatalf("expected client secret to be issued: %s", w.Body.String())
+	}
+	ping := "/api/ping?id=" + resp.ClientId
+	if w = ts.request(t, http.MethodPost, ping, token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected ping without secret to be forbidden, got %d", w.Code)
+	}
+	if w = ts.requestWithSecret(t, http.MethodPost, ping, token, "wrong", nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected ping with wrong secret to be forbidden, got %d", w.Code)
+	}
+	if w = ts.requestWithSecret(t, http.MethodPost, ping, token, resp.Secret, nil); w.Code != http.StatusOK {
+		t.Errorf("expected ping with secret to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w = ts.request(t, http.MethodPost, ping, ts.token(t, ""), nil); w.Code != http.StatusOK {
+		t.Errorf("expected admin ping not to require secret, got %d: %s", w.Code, w.Body.String())
+	}
+	leave := "/api/leave?id=" + resp.ClientId
+	if w = ts.requestWithSecret(t, http.MethodPost, leave, ts.token(t, "other"), resp.Secret, nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected other tenant's leave not to find client, got %d", w.Code)
+	}
+	if w = ts.request(t, http.MethodPost, leave, token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected leave without secret to be forbidden, got %d", w.Code)
+	}
+	if w = ts.requestWithSecret(t, http.MethodPost, leave, token, resp.Secret, nil); w.Code != http.StatusOK {
+		t.Errorf("expected leave with secret to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestScopes(t *testing.T) {
+	ts := newTestService(t)
+	ts.cfg.RegisteredUsers = []config.Credentials{
+		{Login: "tenant", Password: "secret", Scopes: []string{config.ScopeRead}},
+	}
+	join := api.JoinRequest{ServiceId: "api", Endpoints: []string{"http://localhost:8080"}}
+
+	reader := ts.scopedToken(t, "tenant", config.ScopeRead)
+	if w := ts.request(t, http.MethodPost, "/api/join", reader, join); w.Code != http.StatusForbidden {
+		t.Errorf("expected reader's join to be forbidden, got %d", w.Code)
+	}
+	if w := ts.request(t, http.MethodGet, "/api/list", reader, nil); w.Code != http.StatusOK {
+		t.Errorf("expected reader's list to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	registrar := ts.scopedToken(t, "tenant", config.ScopeRegister)
+	if w := ts.request(t, http.MethodPost, "/api/join", registrar, join); w.Code != http.StatusOK {
+		t.Errorf("expected registrar's join to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := ts.request(t, http.MethodGet, "/api/list", registrar, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected list without read scope to be forbidden, got %d", w.Code)
+	}
+	if w := ts.request(t, http.MethodGet, "/api/admin/audit", ts.scopedToken(t, "tenant", config.ScopeAdmin), nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected tenant's admin request to be forbidden, got %d", w.Code)
+	}
+	if w := ts.request(t, http.MethodGet, "/api/list", ts.scopedToken(t, "", config.ScopeRead), nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected cross-tenant list without admin scope to be forbidden, got %d", w.Code)
+	}
+	if w := ts.request(t, http.MethodGet, "/api/admin/audit", ts.scopedToken(t, "", config.ScopeAdmin), nil); w.Code != http.StatusOK {
+		t.Errorf("expected admin request to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := ts.request(t, http.MethodGet, "/api/admin/audit", ts.token(t, ""), nil); w.Code != http.StatusOK {
+		t.Errorf("expected legacy admin token to keep admin access, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := ts.request(t, http.MethodPost, "/api/join", ts.token(t, "tenant"), api.JoinRequest{ServiceId: "api", Endpoints: []string{"http://localhost:8081"}}); w.Code != http.StatusOK {
+		t.Errorf("expected legacy tenant token to keep register access, got %d: %s", w.Code, w.Body.String())
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/join", strings.NewReader(`{"service_id":"api","endpoints":["http://localhost:8080"]}`))
+	r.SetBasicAuth("tenant", "secret")
+	w := httptest.NewRecorder()
+	ts.handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected basic auth reader's join to be forbidden, got %d", w.Code)
+	}
+}
+
+func TestExternalTokenScopes(t *testing.T) {
+	ts := newTestService(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := jwt.NewPemKeySet(map[string][]byte{"idp": pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	external, err := jwt.InitExternal(keys, jwt.ClaimMapping{Tenant: "org", Scopes: "scp", Roles: "roles"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.jwt = jwt.NewChain(ts.jwt, external)
+	token := func(claims gojwt.MapClaims) string {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		token, err := gojwt.NewWithClaims(gojwt.SigningMethodRS256, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	join := func(port int) api.JoinRequest {
+		return api.JoinRequest{ServiceId: "api", Endpoints: []string{fmt.Sprintf("http://localhost:%d", port)}}
+	}
+
+	// unlike disco's own tokens, external ones get no scopes implicitly
+	if w := ts.request(t, http.MethodPost, "/api/join", token(gojwt.MapClaims{"org": "tenant", "roles": "unknown"}), join(8080)); w.Code != http.StatusForbidden {
+		t.Errorf("expected join with unmapped roles to be forbidden, got %d", w.Code)
+	}
+	if w := ts.request(t, http.MethodPost, "/api/join", token(gojwt.MapClaims{"org": "tenant"}), join(8081)); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected token without scopes to be rejected, got %d", w.Code)
+	}
+	if w := ts.request(t, http.MethodPost, "/api/join", token(gojwt.MapClaims{"org": "tenant", "scp": config.ScopeRead}), join(8082)); w.Code != http.StatusForbidden {
+		t.Errorf("expected reader's join to be forbidden, got %d", w.Code)
+	}
+	if w := ts.request(t, http.MethodPost, "/api/join", token(gojwt.MapClaims{"org": "tenant", "scp": config.ScopeRegister}), join(8083)); w.Code != http.StatusOK {
+		t.Errorf("expected registrar's join to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+}
+func TestTokens(t *testing.T) {
+	ts := newTestService(t)
+	admin := ts.token(t, "")
+
+	if w := ts.request(t, http.MethodPost, "/api/token/tenant-a", ts.token(t, "tenant-a"), nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected tenant's token issue to be forbidden, got %d", w.Code)
+	}
+	w := ts.request(t, http.MethodPost, "/api/token/tenant-a?ttl=1h&scopes=read", admin, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected token to be issued, got %d: %s", w.Code, w.Body.String())
+	}
+	var issued issuedToken
+	if err := json.Unmarshal(w.Body.Bytes(), &issued); err != nil {
+		t.Fatal(err)
+	}
+	if w = ts.request(t, http.MethodGet, "/api/list", issued.Token, nil); w.Code != http.StatusOK {
+		t.Errorf("expected issued token to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+	if w = ts.request(t, http.MethodPost, "/api/join", issued.Token, api.JoinRequest{ServiceId: "api"}); w.Code != http.StatusForbidden {
+		t.Errorf("expected issued token to be limited to its scopes, got %d", w.Code)
+	}
+	ts.token(t, "tenant-b")
+
+	var tokens []jwt.TokenInfo
+	w = ts.request(t, http.MethodGet, "/api/admin/tokens?tenant=tenant-a", admin, nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[1].Id.String() != issued.Id || tokens[1].Revoked {
+		t.Errorf("unexpected tenant-a tokens: %+v", tokens)
+	}
+
+	if w = ts.request(t, http.MethodDelete, "/api/admin/tokens/"+issued.Id, admin, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected token to be revoked, got %d: %s", w.Code, w.Body.String())
+	}
+	if w = ts.request(t, http.MethodGet, "/api/list", issued.Token, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected revoked token to be rejected, got %d", w.Code)
+	}
+	if w = ts.request(t, http.MethodDelete, "/api/admin/tokens/not-a-uuid", admin, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid token id to be rejected, got %d", w.Code)
+	}
+	if w = ts.request(t, http.MethodPost, "/api/token/tenant-a?ttl=2d", admin, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected ttl over maximum to be rejected, got %d", w.Code)
+	}
+
+	// token unknown to store (e.g. issued before restart) is revoked as well
+	unknown := ts.scopedToken(t, "tenant-a", config.ScopeRead)
+	claims, err := ts.jwt.Validate(unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.tokens = jwt.NewMemoryTokenStore(ts.cfg.TokenMaxTTL)
+	ts.jwt = jwt.WithTokenStore(ts.jwt, ts.tokens)
+	if w = ts.request(t, http.MethodDelete, "/api/admin/tokens/"+claims.GetId().String(), admin, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected unknown token to be revoked, got %d: %s", w.Code, w.Body.String())
+	}
+	if w = ts.request(t, http.MethodGet, "/api/list", unknown, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected revoked unknown token to be rejected, got %d", w.Code)
+	}
+	var entries []audit.Entry
+	w = ts.request(t, http.MethodGet, "/api/admin/audit", admin, nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Action != "token issued" || entries[1].Action != "token revoked" || entries[2].Action != "token revoked" {
+		t.Errorf("unexpected audit entries: %+v", entries)
+	}
+}
+func TestTokensNotConfigured(t *testing.T) {
+	ts := newTestService(t)
+	ts.jwt, ts.tokens = nil, nil
+	ts.cfg.RegisteredUsers = []config.Credentials{{Login: api.TenantDefault, Password: "secret"}}
+	for _, rq := range []struct{ method, path string }{
+		{http.MethodPost, "/api/token/tenant-a"},
+		{http.MethodGet, "/api/admin/tokens"},
+		{http.MethodDelete, "/api/admin/tokens/" + uuid.NewString()},
+	} {
+		r := httptest.NewRequest(rq.method, rq.path, nil)
+		r.SetBasicAuth(api.TenantDefault, "secret")
+		w := httptest.NewRecorder()
+		ts.handler.ServeHTTP(w, r)
+		if w.Code != http.StatusNotImplemented {
+			t.Errorf("expected %s %s to be not implemented, got %d", rq.method, rq.path, w.Code)
+		}
+	}
+
+	ts = newTestService(t)
+	keys, err := jwt.NewPemKeySet(map[string][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := jwt.InitWithKeys(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := ts.token(t, "")
+	ts.jwt = jwt.NewChain(verifier, ts.jwt)
+	if w := ts.request(t, http.MethodPost, "/api/token/tenant-a", admin, nil); w.Code != http.StatusNotImplemented {
+		t.Errorf("expected token issue without signer to be not implemented, got %d", w.Code)
+	}
+}
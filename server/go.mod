@@ -6,21 +6,23 @@ require (
 	github.com/a-h/templ v0.2.697
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/golang/gddo v0.0.0-20210115222349-20d68f94ee1f
-	github.com/google/uuid v1.3.0
+	github.com/google/uuid v1.3.1
 	github.com/gorilla/mux v1.8.0
-	github.com/joho/godotenv v1.5.1
 	github.com/prometheus/client_golang v1.16.0
-	github.com/slink-go/disco/common v0.0.0-20230619091337-ec0ab3fcf597
+	github.com/slink-go/disco/backend v0.0.0-20230715020414-3395835c0d6c
+	github.com/slink-go/disco/common v0.0.0-20230715020414-3395835c0d6c
 	github.com/slink-go/logging v0.0.2
 	github.com/xhit/go-str2duration/v2 v2.1.0
 	golang.org/x/crypto v0.22.0
+	golang.org/x/net v0.24.0
 	golang.org/x/time v0.3.0
 )
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
-	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/golang/protobuf v1.5.4 // indirect
+	github.com/joho/godotenv v1.5.1 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
@@ -30,8 +32,12 @@ require (
 	github.com/prometheus/procfs v0.10.1 // indirect
 	github.com/rs/zerolog v1.32.0 // indirect
 	github.com/slink-go/logger v0.0.1 // indirect
-	golang.org/x/net v0.24.0 // indirect
 	golang.org/x/sys v0.19.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
-	google.golang.org/protobuf v1.30.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+)
+
+replace (
+	github.com/slink-go/disco/backend => ../backend
+	github.com/slink-go/disco/common => ../common
 )
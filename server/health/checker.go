@@ -0,0 +1,212 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/logging"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clients opt in for server-side health checks with meta keys
+const (
+	MetaCheck   = "health-check"   // http, tcp or grpc
+	MetaPath    = "health-path"    // path for http check, /health by default
+	MetaService = "health-service" // service name for grpc check, server's overall health by default
+)
+
+const (
+	CheckHttp = "http"
+	CheckTcp  = "tcp"
+	CheckGrpc = "grpc"
+)
+
+const defaultHealthPath = "/health"
+
+// region - Checker API
+
+// Checker actively probes endpoints of clients which can not run ping loop.
+// Successful probe marks client alive (see api.Registry.MarkAlive), so such
+// clients go through the same STARTING/UP/FAILING/DOWN state machine as
+// clients sending heartbeats; status, load and changes reported by client
+// with pings are kept.
+//
+// Note, that probes are sent by disco to hosts and ports clients registered
+// with, so enabled checks let any client make disco connect to addresses it
+// chooses; enable them only where clients are trusted or disco's network
+// access is restricted. Probes go directly to registered endpoints only
+// (proxies and redirects are not followed).
+type Checker interface {
+	Run(ctx context.Context)
+}
+
+func NewChecker(registry api.Registry, interval, timeout time.Duration) Checker {
+	return newChecker(registry, interval, timeout)
+}
+
+// endregion
+// region - checker
+
+type checker struct {
+	registry api.Registry
+	interval time.Duration
+	timeout  time.Duration
+	http     *http.Client
+	grpc     *http.Client
+	logger   logging.Logger
+}
+
+func newChecker(registry api.Registry, interval, timeout time.Duration) *checker {
+	return &checker{
+		registry: registry,
+		interval: interval,
+		timeout:  timeout,
+		http: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{Proxy: nil, DisableKeepAlives: true},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		grpc:   newGrpcClient(timeout),
+		logger: logging.GetLogger("health"),
+	}
+}
+
+func (c *checker) Run(ctx context.Context) {
+	c.logger.Info("health checks started (interval %s)", c.interval)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.checkAll(ctx)
+		}
+	}
+}
+
+// checkAll probes all opted-in clients concurrently and waits for results
+func (c *checker) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	admin := context.WithValue(ctx, api.TenantKey, api.TenantDefault)
+	for _, client := range c.registry.List(admin) {
+		kind := checkKind(client.Meta())
+		if kind == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(client api.Client) {
+			defer wg.Done()
+			err := c.check(ctx, kind, client)
+			if err != nil {
+				c.logger.Debug("[health][%s] client %s unhealthy: %s", kind, client.ClientId(), err.Error())
+				return
+			}
+			if err = c.registry.MarkAlive(admin, client.ClientId()); err != nil {
+				c.logger.Debug("[health][%s] client %s: %s", kind, client.ClientId(), err.Error())
+			}
+		}(client)
+	}
+	wg.Wait()
+}
+
+// check reports client healthy if any of its endpoints passes the check
+func (c *checker) check(ctx context.Context, kind string, client api.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	err := fmt.Errorf("no endpoints to check")
+	for _, e := range client.Endpoints() {
+		u, perr := url.Parse(e.Url())
+		if perr != nil {
+			err = perr
+			continue
+		}
+		switch {
+		case kind == CheckHttp && (e.Type() == api.HttpEndpoint || e.Type() == api.HttpsEndpoint):
+			err = c.checkHttp(ctx, u, metaString(client.Meta(), MetaPath, defaultHealthPath))
+		case kind == CheckTcp:
+			err = c.checkTcp(ctx, u)
+		case kind == CheckGrpc && e.Type() == api.GrpcEndpoint:
+			err = c.checkGrpc(ctx, u, metaString(client.Meta(), MetaService, ""))
+		default:
+			continue
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// checkHttp probes health path on endpoint's host; path can not redirect
+// probe to other host
+func (c *checker) checkHttp(ctx context.Context, u *url.URL, path string) error {
+	p, err := url.Parse(path)
+	if err != nil || p.Scheme != "" || p.Host != "" || p.User != nil {
+		return fmt.Errorf("invalid health path %q", path)
+	}
+	target := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/" + strings.TrimPrefix(p.Path, "/"), RawQuery: p.RawQuery}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("%s returned %s", target.String(), resp.Status)
+	}
+	return nil
+}
+func (c *checker) checkTcp(ctx context.Context, u *url.URL) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", hostPort(u))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// endregion
+// region - helpers
+
+func checkKind(meta map[string]any) string {
+	kind := strings.ToLower(metaString(meta, MetaCheck, ""))
+	switch kind {
+	case CheckHttp, CheckTcp, CheckGrpc:
+		return kind
+	case "":
+		if metaString(meta, MetaPath, "") != "" {
+			return CheckHttp
+		}
+	}
+	return ""
+}
+func metaString(meta map[string]any, key, def string) string {
+	if v, ok := meta[key].(string); ok && v != "" {
+		return v
+	}
+	return def
+}
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	default:
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+}
+
+// endregion
@@ -0,0 +1,121 @@
+package health
+
+import (
+	"context"
+	"github.com/slink-go/disco/backend/inmem"
+	"github.com/slink-go/disco/common/api"
+	"github.com/slink-go/disco/common/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRegistry() api.Registry {
+	return inmem.Backend.Init(&config.AppConfig{
+		PingDuration:     time.Minute,
+		FailingThreshold: 2,
+		DownThreshold:    4,
+		RemoveThreshold:  8,
+		MaxClients:       16,
+	})
+}
+func join(t *testing.T, r api.Registry, service, endpoint string, meta map[string]any) string {
+	t.Helper()
+	resp, err := r.Join(context.WithValue(context.Background(), api.TenantKey, "tenant"), api.JoinRequest{
+		ServiceId: service,
+		Endpoints: []string{endpoint},
+		Meta:      meta,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.ClientId
+}
+func states(r api.Registry) map[string]api.ClientState {
+	result := make(map[string]api.ClientState)
+	for _, c := range r.List(context.WithValue(context.Background(), api.TenantKey, "tenant")) {
+		result[c.ClientId()] = c.State()
+	}
+	return result
+}
+
+// grpcHealthServer serves grpc.health.v1.Health/Check over h2c, reporting
+// given serving status
+func grpcHealthServer(t *testing.T, status byte) string {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		if r.URL.Path != grpcHealthCheckPath || r.Header.Get("Content-Type") != "application/grpc" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = w.Write(grpcFrame([]byte{0x08, status}))
+		w.Header().Set("Grpc-Status", "0")
+	})
+	server := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	t.Cleanup(server.Close)
+	return "grpc://" + strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestActiveHealthChecks(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ready" {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer httpServer.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	_ = closed.Close()
+
+	r := testRegistry()
+	expected := map[string]api.ClientState{
+		join(t, r, "HTTP", httpServer.URL, map[string]any{MetaPath: "/ready"}):                        api.ClientStateUp,
+		join(t, r, "HTTP", httpServer.URL, map[string]any{MetaCheck: CheckHttp}):                      api.ClientStateStarting,
+		join(t, r, "HTTP", "http://"+closedAddr, map[string]any{MetaPath: httpServer.URL + "/ready"}): api.ClientStateStarting,
+		join(t, r, "TCP", "http://"+listener.Addr().String(), map[string]any{MetaCheck: CheckTcp}):    api.ClientStateUp,
+		join(t, r, "TCP", "http://"+closedAddr, map[string]any{MetaCheck: CheckTcp}):                  api.ClientStateStarting,
+		join(t, r, "GRPC", grpcHealthServer(t, grpcServing), map[string]any{MetaCheck: CheckGrpc}):    api.ClientStateUp,
+		join(t, r, "GRPC", grpcHealthServer(t, 2), map[string]any{MetaCheck: CheckGrpc, "n": 2}):      api.ClientStateStarting,
+		join(t, r, "PING", httpServer.URL, map[string]any{"health": "not requested"}):                 api.ClientStateStarting,
+	}
+
+	newChecker(r, time.Second, time.Second).checkAll(context.Background())
+
+	actual := states(r)
+	for id, state := range expected {
+		if actual[id] != state {
+			t.Errorf("expected client %s to be %s, got %s", id, state, actual[id])
+		}
+	}
+}
+func TestHealthCheckStatus(t *testing.T) {
+	// unknown fields are skipped, omitted status is UNKNOWN
+	status, err := healthCheckStatus([]byte{0x12, 0x01, 'x', 0x08, 0x01})
+	if err != nil || status != grpcServing {
+		t.Errorf("expected SERVING, got %d, %v", status, err)
+	}
+	if status, err = healthCheckStatus(nil); err != nil || status != 0 {
+		t.Errorf("expected UNKNOWN, got %d, %v", status, err)
+	}
+	if _, err = healthCheckStatus([]byte{0x12, 0x05, 'x'}); err == nil {
+		t.Errorf("expected truncated message error")
+	}
+}
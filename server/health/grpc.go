@@ -0,0 +1,128 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/http2"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// gRPC health checking protocol (grpc.health.v1.Health/Check) implemented
+// over plain HTTP/2, which is enough for single unary call
+
+const (
+	grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+	grpcStatusOk        = "0"
+	grpcServing         = 1 // HealthCheckResponse.SERVING
+)
+
+func newGrpcClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http2.Transport{
+			AllowHTTP: true, // grpc:// endpoints are plaintext (h2c)
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+func (c *checker) checkGrpc(ctx context.Context, u *url.URL, service string) error {
+	target := url.URL{Scheme: "http", Host: u.Host, Path: grpcHealthCheckPath}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), bytes.NewReader(grpcFrame(healthCheckRequest(service))))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := c.grpc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	// trailers-only response carries status in headers
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != grpcStatusOk {
+		return fmt.Errorf("health check failed: grpc status %s %s", status, resp.Trailer.Get("Grpc-Message"))
+	}
+	if len(data) < 5 {
+		return fmt.Errorf("invalid health check response")
+	}
+	serving, err := healthCheckStatus(data[5:])
+	if err != nil {
+		return err
+	}
+	if serving != grpcServing {
+		return fmt.Errorf("service is not serving (status %d)", serving)
+	}
+	return nil
+}
+
+// grpcFrame prefixes message with uncompressed flag and its length
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// healthCheckRequest encodes HealthCheckRequest{service = 1}
+func healthCheckRequest(service string) []byte {
+	if service == "" {
+		return nil
+	}
+	message := []byte{0x0a}
+	message = binary.AppendUvarint(message, uint64(len(service)))
+	return append(message, service...)
+}
+
+// healthCheckStatus decodes status (field 1) of HealthCheckResponse
+func healthCheckStatus(message []byte) (uint64, error) {
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return 0, fmt.Errorf("invalid health check response")
+		}
+		message = message[n:]
+		switch key & 0x7 {
+		case 0: // varint
+			value, n := binary.Uvarint(message)
+			if n <= 0 {
+				return 0, fmt.Errorf("invalid health check response")
+			}
+			if key>>3 == 1 {
+				return value, nil
+			}
+			message = message[n:]
+		case 2: // length-delimited
+			size, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < size {
+				return 0, fmt.Errorf("invalid health check response")
+			}
+			message = message[n+int(size):]
+		default:
+			return 0, fmt.Errorf("invalid health check response")
+		}
+	}
+	return 0, nil // status is omitted when UNKNOWN
+}
@@ -1,6 +1,10 @@
 package jwt
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt"
@@ -14,6 +18,7 @@ import (
 
 var ErrExpiredToken = errors.New("auth token expired")
 var ErrInvalidToken = errors.New("auth token invalid")
+var ErrSigningNotSupported = errors.New("token signing is not configured")
 
 const minKeySize = 32
 
@@ -21,11 +26,15 @@ type Claims interface {
 	GetId() uuid.UUID
 	GetIssuer() string
 	GetTenant() string
+	GetScopes() []string
+	GetRoles() []string
+	GetExpiresAt() time.Time
 	Expired() bool
+	External() bool // issued by external identity provider
 }
 
 type Jwt interface {
-	Generate(issuer, tenant string, duration time.Duration) (string, error)
+	Generate(issuer, tenant string, duration time.Duration, scopes ...string) (string, error)
 	Validate(token string) (Claims, error)
 }
 
@@ -34,7 +43,42 @@ func Init(secret string) (Jwt, error) {
 		return nil, fmt.Errorf("invalid key size: must be at least %d characters", minKeySize)
 	}
 	return &jwtImpl{
-		secret: []byte(secret),
+		method:  jwt.SigningMethodHS256,
+		signKey: []byte(secret),
+		keyFunc: hmacKey([]byte(secret)),
+	}, nil
+}
+
+// InitWithKeys creates verifier of RS*, PS*, ES* and EdDSA signed tokens;
+// tokens can not be generated with it
+func InitWithKeys(keys KeySet) (Jwt, error) {
+	if keys == nil {
+		return nil, errors.New("no verification keys")
+	}
+	return &jwtImpl{
+		keyFunc: publicKey(keys),
+	}, nil
+}
+
+// InitWithSigningKey creates Jwt generating tokens signed with PEM-encoded
+// RSA (RS256), ECDSA (ES256, ES384 or ES512 depending on curve) or Ed25519
+// (EdDSA) private key; tokens are verified with its public key or keys from
+// optional key set
+func InitWithSigningKey(kid string, privateKey []byte, keys KeySet) (Jwt, error) {
+	key, method, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	own := staticKeys{kid: key.Public()}
+	var verify KeySet = own
+	if keys != nil {
+		verify = multiKeys{own, keys}
+	}
+	return &jwtImpl{
+		method:  method,
+		signKey: key,
+		kid:     kid,
+		keyFunc: publicKey(verify),
 	}, nil
 }
 
@@ -45,6 +89,8 @@ type tokenPayload struct {
 	ID        uuid.UUID `json:"id"`
 	Issuer    string    `json:"issuer"`
 	Tenant    string    `json:"tenant"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	Roles     []string  `json:"roles,omitempty"`
 	IssuedAt  time.Time `json:"issued_at"`
 	ExpiredAt time.Time `json:"expired_at"`
 }
@@ -64,34 +110,48 @@ func (p *tokenPayload) GetIssuer() string {
 func (p *tokenPayload) GetTenant() string {
 	return p.Tenant
 }
+func (p *tokenPayload) GetScopes() []string {
+	return p.Scopes
+}
+func (p *tokenPayload) GetRoles() []string {
+	return p.Roles
+}
+func (p *tokenPayload) GetExpiresAt() time.Time {
+	return p.ExpiredAt
+}
 func (p *tokenPayload) Expired() bool {
 	return p.ExpiredAt.Before(time.Now())
 }
+func (p *tokenPayload) External() bool {
+	return false
+}
 
 // endregion
 // region - token
 
 type jwtImpl struct {
-	secret []byte
+	method  jwt.SigningMethod // nil - verification only
+	signKey interface{}
+	kid     string
+	keyFunc jwt.Keyfunc
 }
 
-func (j *jwtImpl) Generate(issuer, tenant string, duration time.Duration) (string, error) {
-	payload, err := j.newPayload(issuer, tenant, duration)
+func (j *jwtImpl) Generate(issuer, tenant string, duration time.Duration, scopes ...string) (string, error) {
+	if j.method == nil {
+		return "", ErrSigningNotSupported
+	}
+	payload, err := j.newPayload(issuer, tenant, duration, scopes)
 	if err != nil {
 		return "", err
 	}
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, payload)
-	return jwtToken.SignedString(j.secret)
+	jwtToken := jwt.NewWithClaims(j.method, payload)
+	if j.kid != "" {
+		jwtToken.Header["kid"] = j.kid
+	}
+	return jwtToken.SignedString(j.signKey)
 }
 func (j *jwtImpl) Validate(token string) (Claims, error) {
-	keyFunc := func(token *jwt.Token) (interface{}, error) {
-		_, ok := token.Method.(*jwt.SigningMethodHMAC)
-		if !ok {
-			return nil, ErrInvalidToken
-		}
-		return j.secret, nil
-	}
-	jwtToken, err := jwt.ParseWithClaims(token, &tokenPayload{}, keyFunc)
+	jwtToken, err := jwt.ParseWithClaims(token, &tokenPayload{}, j.keyFunc)
 	if err != nil {
 		verr, ok := err.(*jwt.ValidationError)
 		if ok && errors.Is(verr.Inner, ErrExpiredToken) {
@@ -106,7 +166,7 @@ func (j *jwtImpl) Validate(token string) (Claims, error) {
 	return payload, nil
 }
 
-func (j *jwtImpl) newPayload(issuer, tenant string, duration time.Duration) (*tokenPayload, error) {
+func (j *jwtImpl) newPayload(issuer, tenant string, duration time.Duration, scopes []string) (*tokenPayload, error) {
 	tokenID, err := uuid.NewRandom()
 	if err != nil {
 		return nil, err
@@ -115,6 +175,7 @@ func (j *jwtImpl) newPayload(issuer, tenant string, duration time.Duration) (*to
 		ID:        tokenID,
 		Issuer:    issuer,
 		Tenant:    tenant,
+		Scopes:    scopes,
 		IssuedAt:  time.Now(),
 		ExpiredAt: time.Now().Add(duration),
 	}
@@ -122,3 +183,63 @@ func (j *jwtImpl) newPayload(issuer, tenant string, duration time.Duration) (*to
 }
 
 // endregion
+// region - keys
+
+// hmacKey accepts HS* signed tokens only
+func hmacKey(secret []byte) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, ErrInvalidToken
+		}
+		return secret, nil
+	}
+}
+
+// publicKey accepts asymmetrically signed tokens only (HS* token "signed"
+// with public key is rejected) and requires key type to match the algorithm
+func publicKey(keys KeySet) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := keys.Key(kid)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			_, ok = key.(*rsa.PublicKey)
+		case *jwt.SigningMethodECDSA:
+			_, ok = key.(*ecdsa.PublicKey)
+		case *jwt.SigningMethodEd25519:
+			_, ok = key.(ed25519.PublicKey)
+		}
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+		return key, nil
+	}
+}
+func parsePrivateKey(data []byte) (crypto.Signer, jwt.SigningMethod, error) {
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return key, jwt.SigningMethodRS256, nil
+	}
+	if key, err := jwt.ParseECPrivateKeyFromPEM(data); err == nil {
+		switch key.Curve.Params().BitSize {
+		case 256:
+			return key, jwt.SigningMethodES256, nil
+		case 384:
+			return key, jwt.SigningMethodES384, nil
+		case 521:
+			return key, jwt.SigningMethodES512, nil
+		}
+		return nil, nil, fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+	}
+	if key, err := jwt.ParseEdPrivateKeyFromPEM(data); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, jwt.SigningMethodEdDSA, nil
+		}
+	}
+	return nil, nil, errors.New("not a PEM-encoded RSA, ECDSA or Ed25519 private key")
+}
+
+// endregion
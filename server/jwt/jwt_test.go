@@ -67,3 +67,20 @@ func TestTokenPayload(t *testing.T) {
 		t.Errorf("unexpected issuer found")
 	}
 }
+func TestTokenScopes(t *testing.T) {
+	jwt, err := Init(jwtSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Generate("issuer", "tenant", time.Second, "read", "register")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := jwt.Validate(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scopes := claims.GetScopes(); len(scopes) != 2 || scopes[0] != "read" || scopes[1] != "register" {
+		t.Errorf("unexpected scopes: %v", scopes)
+	}
+}
@@ -0,0 +1,317 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"github.com/slink-go/logging"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// region - KeySet API
+
+var ErrUnknownKey = errors.New("unknown token signing key")
+
+// KeySet provides public keys asymmetrically signed tokens are verified with;
+// keys are looked up by token's key id ("kid" header), token without key id
+// may be verified only if set contains single key
+type KeySet interface {
+	Key(kid string) (crypto.PublicKey, error)
+}
+
+// NewPemKeySet creates key set from PEM-encoded RSA, ECDSA or Ed25519 public
+// keys indexed by key id
+func NewPemKeySet(pems map[string][]byte) (KeySet, error) {
+	keys := make(map[string]crypto.PublicKey, len(pems))
+	for kid, data := range pems {
+		key, err := ParsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse key %q: %w", kid, err)
+		}
+		keys[kid] = key
+	}
+	return staticKeys(keys), nil
+}
+
+// NewJwksKeySet creates key set loaded from JWKS document; source is either
+// http(s) URL or file path. Keys are reloaded every refresh interval and on
+// unknown key id (at most once per minRefreshInterval), so signing keys may
+// be rotated without disco restart
+func NewJwksKeySet(source string, refresh time.Duration) (KeySet, error) {
+	s := &jwksKeys{
+		source:  source,
+		refresh: refresh,
+		client:  &http.Client{Timeout: jwksRequestTimeout},
+		logger:  logging.GetLogger("jwt"),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewMultiKeySet creates key set looking keys up in given sets in order
+func NewMultiKeySet(sets ...KeySet) KeySet {
+	if len(sets) == 1 {
+		return sets[0]
+	}
+	return multiKeys(sets)
+}
+
+// ParsePublicKey parses PEM-encoded RSA, ECDSA or Ed25519 public key
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("not a PEM-encoded RSA, ECDSA or Ed25519 public key")
+}
+
+// endregion
+// region - static keys
+
+type staticKeys map[string]crypto.PublicKey
+
+func (s staticKeys) Key(kid string) (crypto.PublicKey, error) {
+	return lookupKey(s, kid)
+}
+
+// lookupKey finds key by id; empty id matches the only key of the set
+func lookupKey(keys map[string]crypto.PublicKey, kid string) (crypto.PublicKey, error) {
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// multiKeys looks key up in several key sets in order
+type multiKeys []KeySet
+
+func (m multiKeys) Key(kid string) (crypto.PublicKey, error) {
+	for _, s := range m {
+		if key, err := s.Key(kid); err == nil {
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// endregion
+// region - jwks
+
+const (
+	jwksRequestTimeout = 10 * time.Second
+	minRefreshInterval = 10 * time.Second
+)
+
+// jwksKeys serves keys from the last loaded snapshot; JWKS is fetched without
+// blocking lookups of known keys, concurrent reloads share a single fetch
+type jwksKeys struct {
+	sync.Mutex // guards fetch
+	source     string
+	refresh    time.Duration
+	client     *http.Client
+	snapshot   atomic.Pointer[jwksSnapshot]
+	fetch      chan struct{} // closed when reload in progress is done; nil if none
+	logger     logging.Logger
+}
+type jwksSnapshot struct {
+	keys   map[string]crypto.PublicKey
+	loaded time.Time
+}
+
+func (s *jwksKeys) Key(kid string) (crypto.PublicKey, error) {
+	current := s.snapshot.Load()
+	if s.refresh > 0 && time.Since(current.loaded) > s.refresh {
+		s.reload() // current keys are served meanwhile
+	}
+	key, err := lookupKey(current.keys, kid)
+	if errors.Is(err, ErrUnknownKey) && time.Since(current.loaded) > minRefreshInterval {
+		// key may have been rotated
+		<-s.reload()
+		key, err = lookupKey(s.snapshot.Load().keys, kid)
+	}
+	return key, err
+}
+
+// reload starts loading keys in background unless it is already in progress;
+// returned channel is closed when keys are loaded. Previously loaded keys are
+// kept on failure, so temporary JWKS unavailability does not reject valid
+// tokens
+func (s *jwksKeys) reload() <-chan struct{} {
+	s.Lock()
+	defer s.Unlock()
+	if s.fetch != nil {
+		return s.fetch
+	}
+	done := make(chan struct{})
+	s.fetch = done
+	go func() {
+		if err := s.load(); err != nil {
+			s.logger.Warning("[jwks][reload] %s", err)
+			s.snapshot.Store(&jwksSnapshot{keys: s.snapshot.Load().keys, loaded: time.Now()})
+		}
+		s.Lock()
+		s.fetch = nil
+		s.Unlock()
+		close(done)
+	}()
+	return done
+}
+func (s *jwksKeys) load() error {
+	data, err := s.read()
+	if err != nil {
+		return fmt.Errorf("could not read jwks from %s: %w", s.source, err)
+	}
+	keys, err := parseJwks(data)
+	if err != nil {
+		return fmt.Errorf("could not parse jwks from %s: %w", s.source, err)
+	}
+	s.snapshot.Store(&jwksSnapshot{keys: keys, loaded: time.Now()})
+	return nil
+}
+func (s *jwksKeys) read() ([]byte, error) {
+	if !strings.HasPrefix(s.source, "http://") && !strings.HasPrefix(s.source, "https://") {
+		return os.ReadFile(s.source)
+	}
+	resp, err := s.client.Get(s.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// jwk is a single JSON Web Key (RFC 7517); only signature verification keys
+// of RSA, EC and OKP (Ed25519) types are used
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func parseJwks(data []byte) (map[string]crypto.PublicKey, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	// keys of unsupported types are skipped, so that provider's other keys
+	// (e.g. encryption ones) do not prevent token verification
+	var err error
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, kerr := k.publicKey()
+		if kerr != nil {
+			err = fmt.Errorf("key %q: %w", k.Kid, kerr)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New("no signing keys found")
+	}
+	return keys, nil
+}
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+func decodeBigInt(str string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("missing key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// endregion
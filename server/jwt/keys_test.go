@@ -0,0 +1,333 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/golang-jwt/jwt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// region - helpers
+
+func generateKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"RS256": rsaKey, "ES256": ecKey, "EdDSA": edKey}
+}
+func privatePem(t *testing.T, key crypto.Signer) []byte {
+	t.Helper()
+	var block *pem.Block
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case *ecdsa.PrivateKey:
+		data, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: data}
+	default:
+		data, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: data}
+	}
+	return pem.EncodeToMemory(block)
+}
+func publicPem(t *testing.T, key crypto.PublicKey) []byte {
+	t.Helper()
+	data, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: data})
+}
+func encodeJwk(kid string, key crypto.PublicKey) map[string]string {
+	enc := base64.RawURLEncoding.EncodeToString
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kid": kid, "kty": "RSA", "use": "sig", "n": enc(k.N.Bytes()), "e": enc(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kid": kid, "kty": "EC", "crv": "P-256", "x": enc(k.X.Bytes()), "y": enc(k.Y.Bytes())}
+	case ed25519.PublicKey:
+		return map[string]string{"kid": kid, "kty": "OKP", "crv": "Ed25519", "x": enc(k)}
+	}
+	return nil
+}
+func encodeJwks(t *testing.T, keys map[string]crypto.PublicKey) []byte {
+	t.Helper()
+	var doc struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for kid, key := range keys {
+		doc.Keys = append(doc.Keys, encodeJwk(kid, key))
+	}
+	doc.Keys = append(doc.Keys, map[string]string{"kid": "enc", "kty": "RSA", "use": "enc"})
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// endregion
+
+func TestSigningKeys(t *testing.T) {
+	for alg, key := range generateKeys(t) {
+		t.Run(alg, func(t *testing.T) {
+			j, err := InitWithSigningKey("key-1", privatePem(t, key), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := j.Generate("issuer", "tenant", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, _, err := new(jwt.Parser).ParseUnverified(token, &tokenPayload{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Method.Alg() != alg || parsed.Header["kid"] != "key-1" {
+				t.Errorf("unexpected token header: %v", parsed.Header)
+			}
+			claims, err := j.Validate(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.GetTenant() != "tenant" {
+				t.Errorf("unexpected tenant %q", claims.GetTenant())
+			}
+
+			// verification with public key only
+			keys, err := NewPemKeySet(map[string][]byte{"key-1": publicPem(t, key.Public())})
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := InitWithKeys(keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = v.Validate(token); err != nil {
+				t.Errorf("expected token to be verified with public key: %s", err)
+			}
+			if _, err = v.Generate("issuer", "tenant", time.Minute); !errors.Is(err, ErrSigningNotSupported) {
+				t.Errorf("expected verification-only jwt not to sign tokens, got %v", err)
+			}
+		})
+	}
+}
+func TestPublicKeyAsHmacSecret(t *testing.T) {
+	key := generateKeys(t)["RS256"]
+	public := publicPem(t, key.Public())
+	keys, err := NewPemKeySet(map[string][]byte{"": public})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := InitWithKeys(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// token "signed" with public key as HS256 secret must be rejected
+	payload, _ := (&jwtImpl{}).newPayload("issuer", "", time.Minute, nil)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, payload).SignedString(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = v.Validate(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected HS256 token to be rejected, got %v", err)
+	}
+}
+func TestUnknownKey(t *testing.T) {
+	signers := generateKeys(t)
+	j, err := InitWithSigningKey("key-1", privatePem(t, signers["ES256"]), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := j.Generate("issuer", "tenant", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewPemKeySet(map[string][]byte{
+		"key-1": publicPem(t, signers["EdDSA"].Public()),
+		"key-2": publicPem(t, signers["ES256"].Public()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := InitWithKeys(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// key-1 is Ed25519 key, so ES256 token can not be verified with it
+	if _, err = v.Validate(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected token signed with other key to be rejected, got %v", err)
+	}
+}
+func TestJwksKeySet(t *testing.T) {
+	signers := generateKeys(t)
+	var mu sync.Mutex
+	var requests int
+	published := map[string]crypto.PublicKey{"rsa-1": signers["RS256"].Public()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		_, _ = w.Write(encodeJwks(t, published))
+	}))
+	defer srv.Close()
+
+	keys, err := NewJwksKeySet(srv.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := InitWithKeys(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := InitWithSigningKey("rsa-1", privatePem(t, signers["RS256"]), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := rs.Generate("issuer", "tenant", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = v.Validate(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	if requests != 1 {
+		t.Errorf("expected jwks to be cached, got %d requests", requests)
+	}
+	// rotation: new key is published and picked up on unknown key id
+	published["ed-2"] = signers["EdDSA"].Public()
+	mu.Unlock()
+
+	ed, err := InitWithSigningKey("ed-2", privatePem(t, signers["EdDSA"]), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = ed.Generate("issuer", "tenant", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := keys.(*jwksKeys)
+	jwks.snapshot.Store(&jwksSnapshot{keys: jwks.snapshot.Load().keys, loaded: time.Now().Add(-minRefreshInterval - time.Second)})
+	if _, err = v.Validate(token); err != nil {
+		t.Errorf("expected rotated key to be loaded: %s", err)
+	}
+	mu.Lock()
+	if requests != 2 {
+		t.Errorf("expected jwks to be reloaded once, got %d requests", requests)
+	}
+	mu.Unlock()
+}
+func TestJwksReloadDoesNotBlock(t *testing.T) {
+	signers := generateKeys(t)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		if n > 1 {
+			<-release
+		}
+		_, _ = w.Write(encodeJwks(t, map[string]crypto.PublicKey{"rsa-1": signers["RS256"].Public()}))
+	}))
+	defer srv.Close()
+
+	keys, err := NewJwksKeySet(srv.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := keys.(*jwksKeys)
+	jwks.snapshot.Store(&jwksSnapshot{keys: jwks.snapshot.Load().keys, loaded: time.Now().Add(-2 * time.Hour)})
+
+	// refresh is due, but known key is served while jwks is being fetched
+	done := make(chan error)
+	go func() {
+		_, err := keys.Key("rsa-1")
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		close(release)
+		t.Fatal("key lookup is blocked by jwks reload")
+	}
+
+	// unknown key ids wait for the same fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = keys.Key("rsa-2")
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 2 {
+		t.Errorf("expected single jwks reload, got %d requests", requests-1)
+	}
+}
+func TestJwksFile(t *testing.T) {
+	signers := generateKeys(t)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, encodeJwks(t, map[string]crypto.PublicKey{"ec-1": signers["ES256"].Public()}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewJwksKeySet(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := keys.Key("ec-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signers["ES256"].Public().(*ecdsa.PublicKey).Equal(key) {
+		t.Errorf("unexpected key loaded")
+	}
+	if _, err = keys.Key("ec-2"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected unknown key error, got %v", err)
+	}
+}
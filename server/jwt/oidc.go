@@ -0,0 +1,246 @@
+package jwt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// region - external tokens API
+
+// ClaimMapping configures how external (e.g. OIDC provider's) tokens are
+// validated and which of their claims carry disco's tenant, scopes and roles;
+// claim names may be dotted paths into nested objects, e.g. "realm_access.roles"
+type ClaimMapping struct {
+	Issuer   string // required "iss"; not checked if empty
+	Audience string // "aud" should contain it; not checked if empty
+	Tenant   string // claim carrying tenant; token without it belongs to default tenant
+	Scopes   string // space-separated string or array of scopes
+	Roles    string // space-separated string or array of roles
+}
+
+// InitExternal creates verifier of tokens issued by external identity provider
+// and signed with one of given keys; token should carry standard "exp" claim,
+// "nbf" and "iat" are checked if present. Tokens can not be generated with it
+func InitExternal(keys KeySet, mapping ClaimMapping) (Jwt, error) {
+	if keys == nil {
+		return nil, errors.New("no verification keys")
+	}
+	return &externalJwt{
+		keyFunc: publicKey(keys),
+		mapping: mapping,
+	}, nil
+}
+
+// DiscoverJwks returns JWKS URL published in OIDC provider's discovery
+// document (<issuer>/.well-known/openid-configuration)
+func DiscoverJwks(issuer string) (string, error) {
+	url := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	resp, err := (&http.Client{Timeout: jwksRequestTimeout}).Get(url)
+	if err != nil {
+		return "", fmt.Errorf("could not read oidc configuration: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not read oidc configuration: unexpected response status %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not read oidc configuration: %w", err)
+	}
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JwksUri string `json:"jwks_uri"`
+	}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return "", fmt.Errorf("could not parse oidc configuration: %w", err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return "", fmt.Errorf("oidc configuration issuer %q does not match %q", doc.Issuer, issuer)
+	}
+	if doc.JwksUri == "" {
+		return "", errors.New("oidc configuration does not contain jwks_uri")
+	}
+	return doc.JwksUri, nil
+}
+
+// NewChain creates Jwt accepting tokens valid for any of given ones (tried in
+// order); tokens are generated with the first one
+func NewChain(jwts ...Jwt) Jwt {
+	if len(jwts) == 1 {
+		return jwts[0]
+	}
+	return chainJwt(jwts)
+}
+
+// endregion
+// region - external claims
+
+// clockSkew is tolerated difference between provider's and disco's clocks
+const clockSkew = time.Minute
+
+type externalClaims struct {
+	claims  jwt.MapClaims
+	mapping ClaimMapping
+}
+
+func (c *externalClaims) GetId() uuid.UUID {
+	jti, _ := c.claims["jti"].(string)
+	if id, err := uuid.Parse(jti); err == nil {
+		return id
+	}
+	// non-uuid token ids are mapped to stable name-based uuids
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(c.GetIssuer()+"#"+jti))
+}
+func (c *externalClaims) GetIssuer() string {
+	iss, _ := c.claims["iss"].(string)
+	return iss
+}
+func (c *externalClaims) GetTenant() string {
+	if c.mapping.Tenant == "" {
+		return ""
+	}
+	v, _ := c.claim(c.mapping.Tenant).(string)
+	return v
+}
+func (c *externalClaims) GetScopes() []string {
+	return c.list(c.mapping.Scopes)
+}
+func (c *externalClaims) GetRoles() []string {
+	return c.list(c.mapping.Roles)
+}
+func (c *externalClaims) GetExpiresAt() time.Time {
+	exp, _ := c.time("exp")
+	return exp
+}
+func (c *externalClaims) Expired() bool {
+	exp, ok := c.time("exp")
+	return !ok || time.Now().After(exp.Add(clockSkew))
+}
+func (c *externalClaims) External() bool {
+	return true
+}
+func (c *externalClaims) valid() error {
+	if c.Expired() {
+		return ErrExpiredToken
+	}
+	now := time.Now()
+	if nbf, ok := c.time("nbf"); ok && now.Add(clockSkew).Before(nbf) {
+		return ErrInvalidToken
+	}
+	if iat, ok := c.time("iat"); ok && now.Add(clockSkew).Before(iat) {
+		return ErrInvalidToken
+	}
+	if c.mapping.Issuer != "" && c.GetIssuer() != c.mapping.Issuer {
+		return ErrInvalidToken
+	}
+	if c.mapping.Audience != "" && !c.claims.VerifyAudience(c.mapping.Audience, true) {
+		return ErrInvalidToken
+	}
+	// unlike disco's own tokens, external ones get no access without explicit
+	// scopes or roles
+	if len(c.GetScopes()) == 0 && len(c.GetRoles()) == 0 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// claim returns value of (possibly nested) claim
+func (c *externalClaims) claim(path string) any {
+	var v any = map[string]any(c.claims)
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[name]
+	}
+	return v
+}
+func (c *externalClaims) list(path string) []string {
+	if path == "" {
+		return nil
+	}
+	switch v := c.claim(path).(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		var result []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+func (c *externalClaims) time(name string) (time.Time, bool) {
+	switch v := c.claims[name].(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return time.Unix(n, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// endregion
+// region - external token
+
+type externalJwt struct {
+	keyFunc jwt.Keyfunc
+	mapping ClaimMapping
+}
+
+func (j *externalJwt) Generate(string, string, time.Duration, ...string) (string, error) {
+	return "", ErrSigningNotSupported
+}
+func (j *externalJwt) Validate(token string) (Claims, error) {
+	// standard claims are checked with clock skew below
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	claims := jwt.MapClaims{}
+	if _, err := parser.ParseWithClaims(token, claims, j.keyFunc); err != nil {
+		return nil, ErrInvalidToken
+	}
+	result := &externalClaims{claims: claims, mapping: j.mapping}
+	if err := result.valid(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// endregion
+// region - chain
+
+type chainJwt []Jwt
+
+func (c chainJwt) Generate(issuer, tenant string, duration time.Duration, scopes ...string) (string, error) {
+	return c[0].Generate(issuer, tenant, duration, scopes...)
+}
+
+// Validate returns first successful validation result; token expired
+// according to any of validators is reported as expired
+func (c chainJwt) Validate(token string) (Claims, error) {
+	err := ErrInvalidToken
+	for _, j := range c {
+		claims, verr := j.Validate(token)
+		if verr == nil {
+			return claims, nil
+		}
+		if errors.Is(verr, ErrExpiredToken) {
+			err = verr
+		}
+	}
+	return nil, err
+}
+
+// endregion
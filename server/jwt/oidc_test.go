@@ -0,0 +1,184 @@
+package jwt
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// region - mock issuer
+
+type mockIssuer struct {
+	*httptest.Server
+	key crypto.Signer
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	m := &mockIssuer{key: generateKeys(t)["RS256"]}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   m.URL,
+			"jwks_uri": m.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(encodeJwks(t, map[string]crypto.PublicKey{"idp-1": m.key.Public()}))
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+func (m *mockIssuer) token(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "idp-1"
+	result, err := token.SignedString(m.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+func (m *mockIssuer) claims(overrides jwt.MapClaims) jwt.MapClaims {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": m.URL,
+		"aud": []string{"disco", "other"},
+		"sub": "service-account",
+		"jti": "token-1",
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+		"org": "tenant-a",
+		"scp": "read register",
+		"realm_access": map[string]any{
+			"roles": []string{"reader"},
+		},
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+func (m *mockIssuer) jwt(t *testing.T) Jwt {
+	t.Helper()
+	jwks, err := DiscoverJwks(m.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewJwksKeySet(jwks, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := InitExternal(keys, ClaimMapping{
+		Issuer:   m.URL,
+		Audience: "disco",
+		Tenant:   "org",
+		Scopes:   "scp",
+		Roles:    "realm_access.roles",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+// endregion
+
+func TestExternalClaims(t *testing.T) {
+	m := newMockIssuer(t)
+	j := m.jwt(t)
+
+	claims, err := j.Validate(m.token(t, m.claims(nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.GetTenant() != "tenant-a" || claims.GetIssuer() != m.URL || claims.Expired() {
+		t.Errorf("unexpected claims: tenant %q, issuer %q", claims.GetTenant(), claims.GetIssuer())
+	}
+	if !reflect.DeepEqual(claims.GetScopes(), []string{"read", "register"}) {
+		t.Errorf("unexpected scopes: %v", claims.GetScopes())
+	}
+	if !reflect.DeepEqual(claims.GetRoles(), []string{"reader"}) {
+		t.Errorf("unexpected roles: %v", claims.GetRoles())
+	}
+	id := uuid.New()
+	if claims, err = j.Validate(m.token(t, m.claims(jwt.MapClaims{"jti": id.String()}))); err != nil || claims.GetId() != id {
+		t.Errorf("expected uuid token id to be kept: %v", err)
+	}
+	if _, err = j.Generate("issuer", "tenant", time.Minute); !errors.Is(err, ErrSigningNotSupported) {
+		t.Errorf("expected external jwt not to sign tokens, got %v", err)
+	}
+}
+func TestExternalValidation(t *testing.T) {
+	m := newMockIssuer(t)
+	j := m.jwt(t)
+	now := time.Now()
+
+	cases := map[string]struct {
+		claims   jwt.MapClaims
+		expected error
+	}{
+		"expired":              {jwt.MapClaims{"exp": now.Add(-time.Hour).Unix()}, ErrExpiredToken},
+		"no exp":               {jwt.MapClaims{"exp": nil}, ErrExpiredToken},
+		"not yet valid":        {jwt.MapClaims{"nbf": now.Add(time.Hour).Unix()}, ErrInvalidToken},
+		"issued in future":     {jwt.MapClaims{"iat": now.Add(time.Hour).Unix()}, ErrInvalidToken},
+		"wrong issuer":         {jwt.MapClaims{"iss": "https://other.example.com"}, ErrInvalidToken},
+		"wrong audience":       {jwt.MapClaims{"aud": "other"}, ErrInvalidToken},
+		"no tenant nor scopes": {jwt.MapClaims{"org": nil, "scp": nil, "realm_access": nil}, ErrInvalidToken},
+		"no scopes":            {jwt.MapClaims{"scp": nil, "realm_access": nil}, ErrInvalidToken},
+		"clock skew":           {jwt.MapClaims{"exp": now.Add(-clockSkew / 2).Unix()}, nil},
+		"admin":                {jwt.MapClaims{"org": nil, "scp": "admin"}, nil},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := j.Validate(m.token(t, m.claims(c.claims))); !errors.Is(err, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, err)
+			}
+		})
+	}
+}
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	m := newMockIssuer(t)
+	if _, err := DiscoverJwks(m.URL + "/realms/other"); err == nil {
+		t.Errorf("expected discovery of other issuer to fail")
+	}
+}
+func TestChain(t *testing.T) {
+	m := newMockIssuer(t)
+	own, err := Init(jwtSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChain(own, m.jwt(t))
+
+	token, err := chain.Generate("issuer", "tenant-b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := chain.Validate(token); err != nil || claims.GetTenant() != "tenant-b" {
+		t.Errorf("expected own token to be accepted: %v", err)
+	}
+	if claims, err := chain.Validate(m.token(t, m.claims(nil))); err != nil || claims.GetTenant() != "tenant-a" {
+		t.Errorf("expected external token to be accepted: %v", err)
+	}
+	expired := m.token(t, m.claims(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}))
+	if _, err = chain.Validate(expired); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("expected expired external token to be reported as expired, got %v", err)
+	}
+	if _, err = chain.Validate("garbage"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected invalid token error, got %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+package jwt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/slink-go/logging"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// region - TokenStore API
+
+var ErrRevokedToken = errors.New("auth token revoked")
+var ErrTokenTTL = errors.New("token ttl exceeds maximum")
+
+// refreshInterval is how often file store checks whether its file was
+// changed by another process on token validation
+const refreshInterval = time.Second
+
+// TokenInfo describes token issued by disco (token itself is not kept)
+type TokenInfo struct {
+	Id        uuid.UUID `json:"id"`
+	Issuer    string    `json:"issuer,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Revoked   bool      `json:"revoked"`
+}
+
+// TokenStore keeps tokens issued by disco until they expire; tokens may not
+// live longer than store's maximum ttl (ErrTokenTTL). Any token may be
+// revoked, including ones not known to the store (e.g. issued before restart):
+// revoked unknown token is kept as long as maximum ttl, i.e. until any token
+// with its id has expired
+type TokenStore interface {
+	Add(info TokenInfo) error
+	List() []TokenInfo
+	Revoke(id uuid.UUID) error
+	Revoked(id uuid.UUID) bool
+}
+
+func NewMemoryTokenStore(maxTTL time.Duration) TokenStore {
+	return &memoryTokens{
+		tokens: make(map[uuid.UUID]TokenInfo),
+		maxTTL: maxTTL,
+	}
+}
+
+// NewFileTokenStore creates token store saved to JSON file on every change,
+// so revocations survive disco restarts; file is re-read when it is changed
+// by another process (e.g. `disco -token` or other disco instance), token
+// validation checks for changes at most once per refreshInterval
+func NewFileTokenStore(file string, maxTTL time.Duration) (TokenStore, error) {
+	s := &fileTokens{
+		memoryTokens: memoryTokens{tokens: make(map[uuid.UUID]TokenInfo), maxTTL: maxTTL},
+		file:         file,
+		logger:       logging.GetLogger("jwt"),
+	}
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// WithTokenStore makes Jwt record generated tokens in store and reject
+// revoked ones
+func WithTokenStore(j Jwt, store TokenStore) Jwt {
+	return &storedJwt{Jwt: j, store: store}
+}
+
+// endregion
+// region - stored jwt
+
+type storedJwt struct {
+	Jwt
+	store TokenStore
+}
+
+func (j *storedJwt) Generate(issuer, tenant string, duration time.Duration, scopes ...string) (string, error) {
+	token, err := j.Jwt.Generate(issuer, tenant, duration, scopes...)
+	if err != nil {
+		return "", err
+	}
+	claims, err := j.Jwt.Validate(token)
+	if err != nil {
+		return "", err
+	}
+	err = j.store.Add(TokenInfo{
+		Id:        claims.GetId(),
+		Issuer:    issuer,
+		Tenant:    tenant,
+		Scopes:    scopes,
+		IssuedAt:  time.Now(),
+		ExpiresAt: claims.GetExpiresAt(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+func (j *storedJwt) Validate(token string) (Claims, error) {
+	claims, err := j.Jwt.Validate(token)
+	if err != nil {
+		return nil, err
+	}
+	if j.store.Revoked(claims.GetId()) {
+		return nil, ErrRevokedToken
+	}
+	return claims, nil
+}
+
+// endregion
+// region - memory store
+
+type memoryTokens struct {
+	sync.RWMutex
+	tokens map[uuid.UUID]TokenInfo
+	maxTTL time.Duration
+}
+
+func (s *memoryTokens) Add(info TokenInfo) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.add(info)
+}
+func (s *memoryTokens) List() []TokenInfo {
+	s.RLock()
+	defer s.RUnlock()
+	return s.list()
+}
+func (s *memoryTokens) Revoke(id uuid.UUID) error {
+	s.Lock()
+	defer s.Unlock()
+	s.revoke(id)
+	return nil
+}
+func (s *memoryTokens) Revoked(id uuid.UUID) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.tokens[id].Revoked
+}
+func (s *memoryTokens) add(info TokenInfo) error {
+	if info.ExpiresAt.After(time.Now().Add(s.maxTTL)) {
+		return ErrTokenTTL
+	}
+	s.purge()
+	s.tokens[info.Id] = info
+	return nil
+}
+func (s *memoryTokens) revoke(id uuid.UUID) {
+	s.purge()
+	info, ok := s.tokens[id]
+	if !ok {
+		now := time.Now()
+		info = TokenInfo{Id: id, IssuedAt: now, ExpiresAt: now.Add(s.maxTTL)}
+	}
+	info.Revoked = true
+	s.tokens[id] = info
+}
+
+// list returns tokens ordered by issue time
+func (s *memoryTokens) list() []TokenInfo {
+	result := make([]TokenInfo, 0, len(s.tokens))
+	for _, info := range s.tokens {
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].IssuedAt.Equal(result[j].IssuedAt) {
+			return result[i].Id.String() < result[j].Id.String()
+		}
+		return result[i].IssuedAt.Before(result[j].IssuedAt)
+	})
+	return result
+}
+func (s *memoryTokens) purge() {
+	now := time.Now()
+	for id, info := range s.tokens {
+		if info.ExpiresAt.Before(now) {
+			delete(s.tokens, id)
+		}
+	}
+}
+
+// endregion
+// region - file store
+
+type fileTokens struct {
+	memoryTokens
+	file    string
+	modTime time.Time    // of file state loaded or saved last
+	size    int64        // of file state loaded or saved last
+	checked atomic.Int64 // unix nanos file was checked for changes last
+	logger  logging.Logger
+}
+
+func (s *fileTokens) Add(info TokenInfo) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	if err := s.add(info); err != nil {
+		return err
+	}
+	return s.save()
+}
+func (s *fileTokens) List() []TokenInfo {
+	s.Lock()
+	defer s.Unlock()
+	s.tryRefresh()
+	return s.list()
+}
+func (s *fileTokens) Revoke(id uuid.UUID) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	s.revoke(id)
+	return s.save()
+}
+func (s *fileTokens) Revoked(id uuid.UUID) bool {
+	if s.refreshDue() {
+		s.Lock()
+		if s.refreshDue() { // unless refreshed while waiting for lock
+			s.tryRefresh()
+		}
+		s.Unlock()
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return s.tokens[id].Revoked
+}
+func (s *fileTokens) refreshDue() bool {
+	return time.Since(time.Unix(0, s.checked.Load())) > refreshInterval
+}
+
+// tryRefresh refreshes store keeping its current state on failure
+func (s *fileTokens) tryRefresh() {
+	if err := s.refresh(); err != nil {
+		s.logger.Warning("[tokens][refresh] %s", err)
+	}
+}
+
+// refresh loads file if it was changed since last load or save
+func (s *fileTokens) refresh() error {
+	s.checked.Store(time.Now().UnixNano())
+	fi, err := os.Stat(s.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return nil
+	}
+	if err = s.load(); err != nil {
+		return err
+	}
+	s.modTime, s.size = fi.ModTime(), fi.Size()
+	return nil
+}
+
+// load merges tokens saved to file into store; token revoked either in file
+// or in store stays revoked
+func (s *fileTokens) load() error {
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	var tokens []TokenInfo
+	if err = json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("could not parse token store %s: %w", s.file, err)
+	}
+	for _, info := range tokens {
+		info.Revoked = info.Revoked || s.tokens[info.Id].Revoked
+		s.tokens[info.Id] = info
+	}
+	s.purge()
+	return nil
+}
+
+// save writes store to temporary file and renames it, so store file is
+// never left partially written
+func (s *fileTokens) save() error {
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.file), filepath.Base(s.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), s.file); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(s.file); err == nil {
+		s.modTime, s.size = fi.ModTime(), fi.Size()
+	}
+	return nil
+}
+
+// endregion
@@ -0,0 +1,125 @@
+package jwt
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRevokedToken(t *testing.T) {
+	j, err := Init(jwtSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryTokenStore(time.Hour)
+	j = WithTokenStore(j, store)
+	token, err := j.Generate("issuer", "tenant", time.Minute, "read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := j.Validate(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := store.List()
+	if len(tokens) != 1 || tokens[0].Id != claims.GetId() || tokens[0].Tenant != "tenant" || tokens[0].ExpiresAt.IsZero() {
+		t.Fatalf("unexpected stored tokens: %+v", tokens)
+	}
+	if err = store.Revoke(claims.GetId()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = j.Validate(token); !errors.Is(err, ErrRevokedToken) {
+		t.Errorf("expected revoked token to be rejected, got %v", err)
+	}
+}
+func TestTokenStorePurge(t *testing.T) {
+	store := NewMemoryTokenStore(time.Hour)
+	expired, valid := uuid.New(), uuid.New()
+	_ = store.Add(TokenInfo{Id: expired, ExpiresAt: time.Now().Add(-time.Second)})
+	_ = store.Add(TokenInfo{Id: valid, ExpiresAt: time.Now().Add(time.Hour)})
+	tokens := store.List()
+	if len(tokens) != 1 || tokens[0].Id != valid {
+		t.Errorf("expected expired token to be purged: %+v", tokens)
+	}
+}
+func TestTokenStoreMaxTTL(t *testing.T) {
+	j, err := Init(jwtSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryTokenStore(time.Hour)
+	j = WithTokenStore(j, store)
+	if _, err = j.Generate("issuer", "tenant", 2*time.Hour); !errors.Is(err, ErrTokenTTL) {
+		t.Errorf("expected token living longer than maximum ttl to be refused, got %v", err)
+	}
+
+	// unknown token (e.g. issued before restart) is revoked until any token
+	// with its id has expired
+	token, err := Init(jwtSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := token.Generate("issuer", "tenant", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := j.Validate(unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Revoke(claims.GetId()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = j.Validate(unknown); !errors.Is(err, ErrRevokedToken) {
+		t.Errorf("expected revoked unknown token to be rejected, got %v", err)
+	}
+	tokens := store.List()
+	if len(tokens) != 1 || !tokens[0].Revoked || tokens[0].ExpiresAt.Before(claims.GetExpiresAt()) {
+		t.Errorf("expected revoked unknown token to be kept as long as maximum ttl: %+v", tokens)
+	}
+}
+func TestFileTokenStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.json")
+	first, err := NewFileTokenStore(file, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := uuid.New(), uuid.New()
+	if err = first.Add(TokenInfo{Id: a, Tenant: "tenant", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// token added by another process (e.g. disco -token) is kept on change
+	second, err := NewFileTokenStore(file, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = second.Add(TokenInfo{Id: b, Tenant: "tenant", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err = first.Revoke(b); err != nil {
+		t.Fatal(err)
+	}
+	// revocation by another process is seen without changes of own once
+	// refresh interval has passed
+	if second.Revoked(b) {
+		t.Errorf("expected file not to be checked for changes on every validation")
+	}
+	second.(*fileTokens).checked.Store(time.Now().Add(-refreshInterval).UnixNano())
+	if !second.Revoked(b) {
+		t.Errorf("expected revocation made by other store to be seen")
+	}
+	if err = second.Revoke(a); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewFileTokenStore(file, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.Revoked(a) || !restored.Revoked(b) || len(restored.List()) != 2 {
+		t.Errorf("unexpected restored tokens: %+v", restored.List())
+	}
+}
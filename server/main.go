@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"flag"
 	"fmt"
-	"github.com/slink-go/disco/server/config"
+	_ "github.com/slink-go/disco/backend/inmem"
+	"github.com/slink-go/disco/common/config"
+	"github.com/slink-go/disco/common/registry"
 	"github.com/slink-go/disco/server/controller/rest"
+	"github.com/slink-go/disco/server/health"
 	"github.com/slink-go/disco/server/jwt"
-	"github.com/slink-go/disco/server/registry"
 	"github.com/slink-go/logging"
 	"github.com/xhit/go-str2duration/v2"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -23,7 +31,7 @@ func main() {
 		return
 	}
 
-	cfg, j := prepare()
+	cfg, j, tokens := prepare()
 	logger = logging.GetLogger("main")
 
 	// Print Version
@@ -41,10 +49,27 @@ func main() {
 	logger.Info("[cfg] down threshold: %v", cfg.DownThreshold)
 	logger.Info("[cfg] remove threshold: %v", cfg.RemoveThreshold)
 	logger.Info("[cfg] max clients: %v", cfg.MaxClients)
+	logger.Info("[cfg] default tenant quota: %+v", cfg.DefaultQuota)
+	logger.Info("[cfg] tenant quotas: %+v", cfg.TenantQuotas)
 	logger.Info("[cfg] rate limit: %v", cfg.RequestRate)
 	logger.Info("[cfg] burst limit: %v", cfg.RequestBurst)
+	logger.Info("[cfg] ping rate limit: %v", cfg.PingRate)
+	logger.Info("[cfg] ping burst limit: %v", cfg.PingBurst)
+	logger.Info("[cfg] remote rate limit: %v", cfg.RemoteRate)
+	logger.Info("[cfg] remote burst limit: %v", cfg.RemoteBurst)
+	logger.Info("[cfg] health checks: %v", cfg.HealthChecks)
+	if cfg.HealthChecks {
+		logger.Info("[cfg] health check interval: %v", str2duration.String(cfg.HealthInterval))
+		logger.Info("[cfg] health check timeout: %v", str2duration.String(cfg.HealthTimeout))
+	}
 	logger.Info("[cfg] registered users: %v", cfg.Users())
 	//logger.Info("[cfg] secret key: %v", cfg.SecretKey)
+	if cfg.JwtJwks != "" {
+		logger.Info("[cfg] jwks: %v (refresh %v)", cfg.JwtJwks, str2duration.String(cfg.JwtJwksRefresh))
+	}
+	if cfg.OidcIssuer != "" {
+		logger.Info("[cfg] oidc issuer: %v (audience %v, tenant claim %v)", cfg.OidcIssuer, cfg.OidcAudience, cfg.OidcTenantClaim)
+	}
 	logger.Info("[cfg] backend type: %v", cfg.BackendType)
 	logger.Info("[cfg] plugin dir: %v", cfg.PluginDir)
 	logger.Info("[cfg] static file path: %v", config.StaticFilePath())
@@ -54,18 +79,38 @@ func main() {
 		panic(err)
 	}
 	r := b.Init(cfg)
+	if c, ok := r.(io.Closer); ok {
+		go closeOnSignal(c)
+	}
+	if cfg.HealthChecks {
+		go health.NewChecker(r, cfg.HealthInterval, cfg.HealthTimeout).Run(context.Background())
+	}
 
-	restSvc, err := rest.NewDiscoService(j, r, cfg)
+	restSvc, err := rest.NewDiscoService(j, tokens, r, cfg)
 	if err != nil {
 		panic(err)
 	}
 	restSvc.Run()
 
 }
+
+// closeOnSignal closes registry (e.g. to save its final snapshot) and exits
+// once disco is interrupted or terminated
+func closeOnSignal(c io.Closer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	logger.Info("[main] %s received, closing registry", sig)
+	if err := c.Close(); err != nil {
+		logger.Warning("[main] could not close registry: %s", err.Error())
+	}
+	os.Exit(0)
+}
 func generateToken() bool {
 	tokenPtr := flag.Bool("token", false, "generate token")
 	tenantPtr := flag.String("tenant", "", "use provided tenant name for token generation")
 	durPtr := flag.String("duration", "", "use provided duration for token generation")
+	scopesPtr := flag.String("scopes", "", "comma-separated scopes (register, read, admin) granted by token")
 	flag.Parse()
 	if tokenPtr != nil && *tokenPtr {
 		durationStr := "1d"
@@ -82,9 +127,13 @@ func generateToken() bool {
 		if err != nil {
 			logger.Warning("could not parse duration: %s", err.Error())
 		} else {
-			_, j := prepare()
+			_, j, _ := prepare()
 			var token string
-			token, err = j.Generate("disco", tenant, duration)
+			var scopes []string
+			if scopesPtr != nil && *scopesPtr != "" {
+				scopes = strings.Split(*scopesPtr, ",")
+			}
+			token, err = j.Generate("disco", tenant, duration, scopes...)
 			if err != nil {
 				logger.Warning("could not generate token: %s", err.Error())
 			} else {
@@ -95,14 +144,107 @@ func generateToken() bool {
 	}
 	return false
 }
-func prepare() (*config.AppConfig, jwt.Jwt) {
+func prepare() (*config.AppConfig, jwt.Jwt, jwt.TokenStore) {
 	cfg := config.Load()
-	if cfg.SecretKey != "" {
-		j, err := jwt.Init(cfg.SecretKey)
+	j, err := initJwt(cfg)
+	if err != nil {
+		panic(err)
+	}
+	if j == nil {
+		return cfg, nil, nil
+	}
+	tokens, err := initTokenStore(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return cfg, jwt.WithTokenStore(j, tokens), tokens
+}
+func initTokenStore(cfg *config.AppConfig) (jwt.TokenStore, error) {
+	if cfg.TokenStoreFile != "" {
+		return jwt.NewFileTokenStore(cfg.TokenStoreFile, cfg.TokenMaxTTL)
+	}
+	return jwt.NewMemoryTokenStore(cfg.TokenMaxTTL), nil
+}
+
+// initJwt creates token verifier of disco's own tokens, which also accepts
+// external identity provider's tokens if OIDC issuer is configured
+func initJwt(cfg *config.AppConfig) (jwt.Jwt, error) {
+	j, err := initDiscoJwt(cfg)
+	if err != nil || cfg.OidcIssuer == "" {
+		return j, err
+	}
+	ext, err := initOidcJwt(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if j == nil {
+		return ext, nil
+	}
+	return jwt.NewChain(j, ext), nil
+}
+
+// initDiscoJwt creates token verifier: asymmetric one if private key, public
+// keys or JWKS are configured, HS256 with secret key otherwise
+func initDiscoJwt(cfg *config.AppConfig) (jwt.Jwt, error) {
+	var keys []jwt.KeySet
+	if len(cfg.JwtPublicKeys) > 0 {
+		pems := make(map[string][]byte)
+		for kid, file := range cfg.JwtPublicKeys {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			pems[kid] = data
+		}
+		ks, err := jwt.NewPemKeySet(pems)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, ks)
+	}
+	if cfg.JwtJwks != "" {
+		ks, err := jwt.NewJwksKeySet(cfg.JwtJwks, cfg.JwtJwksRefresh)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		return cfg, j
+		keys = append(keys, ks)
+	}
+	var ks jwt.KeySet
+	if len(keys) > 0 {
+		ks = jwt.NewMultiKeySet(keys...)
+	}
+	if cfg.JwtPrivateKey != "" {
+		data, err := os.ReadFile(cfg.JwtPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		return jwt.InitWithSigningKey(cfg.JwtKeyId, data, ks)
+	}
+	if ks != nil {
+		return jwt.InitWithKeys(ks)
+	}
+	if cfg.SecretKey != "" {
+		return jwt.Init(cfg.SecretKey)
+	}
+	return nil, nil
+}
+func initOidcJwt(cfg *config.AppConfig) (jwt.Jwt, error) {
+	jwks := cfg.OidcJwks
+	if jwks == "" {
+		var err error
+		if jwks, err = jwt.DiscoverJwks(cfg.OidcIssuer); err != nil {
+			return nil, err
+		}
+	}
+	keys, err := jwt.NewJwksKeySet(jwks, cfg.JwtJwksRefresh)
+	if err != nil {
+		return nil, err
 	}
-	return cfg, nil
+	return jwt.InitExternal(keys, jwt.ClaimMapping{
+		Issuer:   cfg.OidcIssuer,
+		Audience: cfg.OidcAudience,
+		Tenant:   cfg.OidcTenantClaim,
+		Scopes:   cfg.OidcScopesClaim,
+		Roles:    cfg.OidcRolesClaim,
+	})
 }